@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+// errNotAdmin is returned when an impersonation token is used by someone who is no longer an admin
+var errNotAdmin = errors.New("Impersonator is not an admin")
+
+type impersonateRequest struct {
+	Reason *string `json:"reason,omitempty"`
+}
+
+type impersonationResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int64  `json:"expires_in"`
+	UserId    string `json:"user_id"`
+}
+
+// auditImpersonation records a request an admin makes as another user. Admins who have since lost the role can't
+// use their impersonation tokens any more, for which errNotAdmin is returned.
+func auditImpersonation(r *http.Request, principal *Principal) error {
+	actor, err := db.GetUserById(*principal.ImpersonatorId)
+	if err == pgx.ErrNoRows || (err == nil && !actor.IsAdmin) {
+		return errNotAdmin
+	} else if err != nil {
+		return err
+	}
+	return db.RecordAudit(&db.AuditEntry{
+		ActorId:   principal.ImpersonatorId,
+		SubjectId: principal.UserId,
+		Action:    db.AuditImpersonationRequest,
+		Details:   r.Method + " " + r.URL.RequestURI(),
+		IpAddress: clientIP(r),
+	})
+}
+
+func writeImpersonationDenied(w http.ResponseWriter) {
+	write403WithErrors(w, &[]errorStruct{
+		{
+			Error:  "This can't be done while impersonating a user.",
+			Fields: []string{"header: authorization"},
+		},
+	})
+}
+
+// RequireAdmin wraps a handler which only platform admins may call, logged in as themselves
+func RequireAdmin(next http.Handler) http.Handler {
+	return RequireLogin(DenyImpersonation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := CurrentUser(r); user == nil || !user.IsAdmin {
+			write403(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})))
+}
+
+// impersonateUser is an http.HandlerFunc which lets an admin act as a user to see what they see. The access token
+// it returns names the user as its subject and the admin as its actor (the act claim). It can't be refreshed, and it
+// can't be used on endpoints which destroy data or change credentials. Starting the impersonation and every
+// request made with the token are recorded in the audit log.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains an access token acting as the user
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The caller isn't an admin, or the user is an admin too
+// 404 Not Found: The user doesn't exist
+// 422 Unprocessable Entity: Admins can't impersonate themselves
+// 500 Server Error:
+func impersonateUser(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req impersonateRequest
+	var err error
+
+	admin := CurrentUser(r)
+
+	// The reason is optional, so an empty body is fine
+	if err = decoder.Decode(&req); err != nil && err != io.EOF {
+		write400(w)
+		return
+	}
+
+	userId := mux.Vars(r)["userId"]
+	if _, err = uuid.FromString(userId); err != nil {
+		write400(w)
+		return
+	}
+	if userId == admin.Id {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Admins can't impersonate themselves",
+				Fields: []string{"userId"},
+			},
+		})
+		return
+	}
+
+	user, err := db.GetUserById(userId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user to impersonate")
+		write500(w)
+		return
+	}
+	// Admins acting as each other would blur who did what
+	if user.IsAdmin {
+		write403WithErrors(w, &[]errorStruct{
+			{
+				Error:  "Admins can't be impersonated",
+				Fields: []string{"userId"},
+			},
+		})
+		return
+	}
+
+	var reason string
+	if req.Reason != nil {
+		reason = *req.Reason
+	}
+	err = db.RecordAudit(&db.AuditEntry{
+		ActorId:   &admin.Id,
+		SubjectId: &user.Id,
+		Action:    db.AuditImpersonationStart,
+		Details:   reason,
+		IpAddress: clientIP(r),
+	})
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to audit impersonation")
+		write500(w)
+		return
+	}
+
+	userAgent := r.Header.Get("User-Agent")
+	// The admin's own second factor carries over to organizations which require one
+	session, err := db.CreateImpersonationSession(user.Id, admin.Id, uuid.NewV4().String(), userAgent,
+		deviceFromUserAgent(userAgent), clientIP(r), CurrentPrincipal(r).MFA)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to start impersonation session")
+		write500(w)
+		return
+	}
+
+	now := time.Now()
+	ttl := conf.Config.GetDuration("kubrik.impersonation_ttl")
+	tokenString, err := signToken(&jwtClaims{
+		UserId: &user.Id,
+		Actor:  &actorClaim{Subject: admin.Id},
+		StandardClaims: jwt.StandardClaims{
+			Audience:  conf.Config.GetString("kubrik.audience"),
+			ExpiresAt: now.Add(ttl).Unix(),
+			Id:        session.Jti,
+			IssuedAt:  now.Unix(),
+			Issuer:    conf.Config.GetString("kubrik.issuer"),
+		},
+	})
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	log.Security("impersonation_started").WithFields(logrus.Fields{
+		"actor":  admin.Id,
+		"user":   user.Id,
+		"reason": reason,
+	}).Warn("Admin is impersonating a user")
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&impersonationResponse{
+		Token:     tokenString,
+		TokenType: "bearer",
+		ExpiresIn: int64(ttl / time.Second),
+		UserId:    user.Id,
+	})
+}
+
+func RouteAdmin(router *mux.Router) {
+	sub := router.PathPrefix("/admin").Subrouter()
+
+	sub.Handle("/impersonate/{userId}", RequireAdmin(http.HandlerFunc(impersonateUser))).Methods("POST")
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"net/http"
 	"encoding/json"
+	"strconv"
+	"time"
 )
 
 type errorStruct struct {
@@ -48,6 +50,10 @@ func write401(w http.ResponseWriter, errs *[]errorStruct) {
 }
 
 func write403(w http.ResponseWriter) {
+	write403WithErrors(w, &[]errorStruct{})
+}
+
+func write403WithErrors(w http.ResponseWriter, errs *[]errorStruct) {
 	encoder := json.NewEncoder(w)
 	addContentTypeJSONHeader(w)
 	addWWWAuthenticateHeader(w)
@@ -55,7 +61,7 @@ func write403(w http.ResponseWriter) {
 	encoder.Encode(&errorResponse{
 		HttpStatus: http.StatusForbidden,
 		Message:    "Forbidden",
-		Errors:     &[]errorStruct{},
+		Errors:     errs,
 	})
 }
 
@@ -114,3 +120,16 @@ func write500(w http.ResponseWriter) {
 	})
 
 }
+
+func write429(w http.ResponseWriter, retryAfter time.Duration, errs *[]errorStruct) {
+	encoder := json.NewEncoder(w)
+	addContentTypeJSONHeader(w)
+	// Retry-After is in whole seconds, so round up rather than invite a retry that is still too early
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	encoder.Encode(errorResponse{
+		HttpStatus: http.StatusTooManyRequests,
+		Message:    "Too many requests",
+		Errors:     errs,
+	})
+}
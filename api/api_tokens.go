@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+type apiTokenRequest struct {
+	Name      *string   `json:"name,omitempty"`
+	Scopes    *[]string `json:"scopes,omitempty"`
+	ExpiresIn *int64    `json:"expires_in,omitempty"`
+}
+
+type apiTokenResponse struct {
+	Id             string     `json:"id"`
+	Name           string     `json:"name"`
+	Prefix         string     `json:"prefix"`
+	Scopes         []string   `json:"scopes"`
+	UserId         *string    `json:"user_id,omitempty"`
+	OrganizationId *string    `json:"organization_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Token          string     `json:"token,omitempty"`
+}
+
+func newAPITokenResponse(t *db.APITokenModel) apiTokenResponse {
+	return apiTokenResponse{
+		Id:             t.Id,
+		Name:           t.Name,
+		Prefix:         t.Prefix,
+		Scopes:         t.Scopes,
+		UserId:         t.UserId,
+		OrganizationId: t.OrganizationId,
+		CreatedAt:      t.CreatedAt,
+		LastUsedAt:     t.LastUsedAt,
+		ExpiresAt:      t.ExpiresAt,
+	}
+}
+
+// apiTokenOwner resolves whose tokens a request manages: the user in the path, who must be the logged in user,
+// or the organization in the path, which the logged in user must own. Tokens are only ever managed by logging in,
+// never with another API token. If the owner can't be resolved, an error response is written and ok is false.
+func apiTokenOwner(w http.ResponseWriter, r *http.Request) (callerId string, userId, organizationId *string, ok bool) {
+	principal := CurrentPrincipal(r)
+
+	vars := mux.Vars(r)
+	if id, isUser := vars["id"]; isUser {
+		if id != *principal.UserId {
+			write403(w)
+			return "", nil, nil, false
+		}
+		return *principal.UserId, principal.UserId, nil, true
+	}
+
+	orgId := vars["orgId"]
+	if _, err := uuid.FromString(orgId); err != nil {
+		write400(w)
+		return "", nil, nil, false
+	}
+	org, err := db.GetOrganizationById(orgId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return "", nil, nil, false
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get organization for API tokens")
+		write500(w)
+		return "", nil, nil, false
+	}
+	if org.OwnerId != *principal.UserId {
+		write403(w)
+		return "", nil, nil, false
+	}
+	return *principal.UserId, nil, &org.Id, true
+}
+
+// createAPIToken is an http.HandlerFunc which creates an API token for a user or an organization.
+// The token is only ever shown in this response.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the token
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user isn't the user in the path, or doesn't own the organization
+// 404 Not Found: No organization has the id
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req apiTokenRequest
+	var err error
+
+	callerId, userId, organizationId, ok := apiTokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateAPITokenRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		write500(w)
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	var expiresAt *time.Time
+	if req.ExpiresIn != nil {
+		t := time.Now().Add(time.Duration(*req.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	created, err := db.CreateAPIToken(*req.Name, token[:len(apiTokenPrefix)+8], hashOpaqueToken(token), *req.Scopes,
+		userId, organizationId, callerId, expiresAt)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to create API token")
+		write500(w)
+		return
+	}
+	log.Security("api_token_created").WithFields(logrus.Fields{
+		"token":        created.Id,
+		"user":         callerId,
+		"organization": organizationId,
+		"scopes":       created.Scopes,
+	}).Info("API token created")
+
+	resp := newAPITokenResponse(created)
+	resp.Token = token
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// listAPITokens is an http.HandlerFunc which lists the unrevoked API tokens of a user or an organization
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the tokens, without their secrets
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user isn't the user in the path, or doesn't own the organization
+// 404 Not Found: No organization has the id
+// 500 Server Error:
+func listAPITokens(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	_, userId, organizationId, ok := apiTokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := db.ListAPITokens(userId, organizationId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list API tokens")
+		write500(w)
+		return
+	}
+
+	resp := []apiTokenResponse{}
+	for i := range *tokens {
+		resp = append(resp, newAPITokenResponse(&(*tokens)[i]))
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// revokeAPIToken is an http.HandlerFunc which revokes an API token of a user or an organization
+// It can return the following HTTP statuses:
+// 204 No Content: The token was revoked
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user isn't the user in the path, or doesn't own the organization
+// 404 Not Found: The owner has no such token
+// 500 Server Error:
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	callerId, userId, organizationId, ok := apiTokenOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tokenId := mux.Vars(r)["tokenId"]
+	if _, err := uuid.FromString(tokenId); err != nil {
+		write404(w)
+		return
+	}
+
+	err := db.RevokeAPIToken(tokenId, userId, organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to revoke API token")
+		write500(w)
+		return
+	}
+	log.Security("api_token_revoked").WithFields(logrus.Fields{
+		"token": tokenId,
+		"user":  callerId,
+	}).Info("API token revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
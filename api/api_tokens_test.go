@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mg4tv/kubrik/db"
+	"github.com/satori/go.uuid"
+)
+
+func TestCreateAPITokenRejections(T *testing.T) {
+	const template = "/users/{id}/tokens"
+	userId := "00000000-0000-4000-8000-000000000001"
+	otherId := "00000000-0000-4000-8000-000000000002"
+	caller := &Principal{UserId: &userId, SessionId: "session"}
+
+	for _, c := range []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantField  string
+	}{
+		{"another user's tokens", "/users/" + otherId + "/tokens", `{"name": "CI", "scopes": ["videos:read"]}`, http.StatusForbidden, ""},
+		{"malformed JSON", "/users/" + userId + "/tokens", `{"name": `, http.StatusBadRequest, ""},
+		{"no name", "/users/" + userId + "/tokens", `{"scopes": ["videos:read"]}`, http.StatusUnprocessableEntity, "name"},
+		{"no scopes", "/users/" + userId + "/tokens", `{"name": "CI", "scopes": []}`, http.StatusUnprocessableEntity, "scopes"},
+		{"unknown scope", "/users/" + userId + "/tokens", `{"name": "CI", "scopes": ["videos:delete"]}`, http.StatusUnprocessableEntity, "scopes"},
+		{"past expiry", "/users/" + userId + "/tokens", `{"name": "CI", "scopes": ["videos:read"], "expires_in": -1}`, http.StatusUnprocessableEntity, "expires_in"},
+	} {
+		w := serveAs(caller, createAPIToken, "POST", template, c.path, c.body)
+		if w.Code != c.wantStatus {
+			T.Errorf("%s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+			continue
+		}
+		if c.wantField == "" {
+			continue
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Errors == nil || len(*resp.Errors) != 1 {
+			T.Errorf("%s: expected one error, got %s", c.name, w.Body.String())
+			continue
+		}
+		if fields := (*resp.Errors)[0].Fields; len(fields) != 1 || fields[0] != c.wantField {
+			T.Errorf("%s: expected an error for %s, got %v", c.name, c.wantField, fields)
+		}
+	}
+
+	w := serveAs(caller, createAPIToken, "POST", "/organizations/{orgId}/tokens", "/organizations/acme/tokens",
+		`{"name": "CI", "scopes": ["videos:read"]}`)
+	if w.Code != http.StatusBadRequest {
+		T.Errorf("malformed organization id: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAPITokenLifecycle(T *testing.T) {
+	requireDatabase(T)
+
+	username := "token-test-" + uuid.NewV4().String()[:8]
+	user, err := db.CreateUser(&username, username+"@example.com", []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(user.Id)
+	caller := &Principal{UserId: &user.Id, SessionId: "session"}
+
+	w := serveAs(caller, createAPIToken, "POST", "/users/{id}/tokens", "/users/"+user.Id+"/tokens",
+		`{"name": "CI", "scopes": ["videos:read"], "expires_in": 3600}`)
+	if w.Code != http.StatusOK {
+		T.Fatalf("expected status %d creating a token, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var created apiTokenResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		T.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, apiTokenPrefix) || !strings.HasPrefix(created.Token, created.Prefix) {
+		T.Errorf("expected a token starting with %s and its prefix %s, got %s", apiTokenPrefix, created.Prefix, created.Token)
+	}
+	if created.UserId == nil || *created.UserId != user.Id || created.ExpiresAt == nil {
+		T.Errorf("expected an expiring token of the user, got %+v", created)
+	}
+
+	// The token authenticates as the user, limited to its scopes
+	principal, err := principalFromHeader("Bearer " + created.Token)
+	if err != nil {
+		T.Fatalf("expected the token to authenticate, got %v", err)
+	}
+	if principal.UserId == nil || *principal.UserId != user.Id || !principal.IsAPIToken() ||
+		principal.HasScope(scopeVideosWrite) || !principal.HasScope(scopeVideosRead) {
+		T.Errorf("expected a videos:read token of the user, got %+v", principal)
+	}
+
+	w = serveAs(caller, listAPITokens, "GET", "/users/{id}/tokens", "/users/"+user.Id+"/tokens", "")
+	var listed []apiTokenResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &listed); err != nil || w.Code != http.StatusOK {
+		T.Fatalf("expected status %d listing tokens, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(listed) != 1 || listed[0].Id != created.Id || listed[0].Token != "" {
+		T.Errorf("expected the token to be listed without its secret, got %+v", listed)
+	}
+
+	w = serveAs(caller, revokeAPIToken, "DELETE", "/users/{id}/tokens/{tokenId}",
+		"/users/"+user.Id+"/tokens/"+created.Id, "")
+	if w.Code != http.StatusNoContent {
+		T.Fatalf("expected status %d revoking the token, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, err = principalFromHeader("Bearer " + created.Token); err == nil {
+		T.Error("expected a revoked token not to authenticate")
+	}
+}
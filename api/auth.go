@@ -7,32 +7,15 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mg4tv/kubrik/db"
 	"errors"
-	"github.com/Sirupsen/logrus"
 	"github.com/mg4tv/kubrik/log"
 	"github.com/mg4tv/kubrik/conf"
 	"github.com/satori/go.uuid"
 	"strings"
-	"io/ioutil"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"time"
 )
 
-type serverFacebookTokenResponse struct {
-	AccessToken *string `json:"access_token,omitempty"`
-	TokenType   *string `json:"token_type,omitempty"`
-	ExpiresIn   *int    `json:"expires_in,omitempty"`
-}
-
-type serverFacebookUserAttributes struct {
-	Id    *string `json:"id,omitempty"`
-	Email *string `json:"email,omitempty"`
-}
-
-type clientFacebookTokenRequest struct {
-	Code        *string `json:"code,omitempty"`
-	ClientId    *string `json:"client_id,omitempty"`
-	RedirectURI *string `json:"redirect_uri,omitemoty"`
-}
-
 type tokenRequest struct {
 	Username *string `json:"username,omitempty"`
 	Email    *string `json:"email,omitempty"`
@@ -40,25 +23,38 @@ type tokenRequest struct {
 }
 
 type tokenResponse struct {
-	Token     string `json:"token"`
-	TokenType string `json:"token_type"`
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken *string `json:"refresh_token,omitempty"`
 }
 
 type jwtClaims struct {
 	UserId *string `json:"uid,omitempty"`
+	// Actor is the admin really making requests with a token issued to impersonate the user, as in RFC 8693
+	Actor *actorClaim `json:"act,omitempty"`
 	jwt.StandardClaims
 }
 
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
+
 // login is an httprouter.HandlerFunc which handles username/email & password login
 // It can return the following HTTP statuses:
-// 200 OK: The request was accepted and the body contains a signed JWT
+// 200 OK: The request was accepted and the body contains a signed JWT and a refresh token, or an mfa_pending token
+// if the user has a second factor
 // 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
 // 401 Unauthenticated: The credentials provided don't match a known user credential
 // 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 429 Too Many Requests: Too many attempts failed for the account or from the client, see Retry-After
 // 500 Server Error:
 func login(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	encoder := json.NewEncoder(w)
 
 	var req tokenRequest
 	var err error
@@ -76,6 +72,17 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	accountKey := loginAccountKey(&req)
+	if !throttle(w, r, "login", accountKey) {
+		return
+	}
+
+	if err = LoadPasswordPolicy(); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to load password policy")
+		write500(w)
+		return
+	}
+
 	var user *db.UserModel
 	if req.Username != nil {
 		user, err = db.GetUserByUsername(*req.Username)
@@ -87,10 +94,10 @@ func login(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// If the user is not found, we don't want to communicate that via a 404 error or timing on the 401 response.
 		// Providing either of those would allow attackers to reduce their attack surface and only focus on existing users.
-		// To prevent this, we manually set the user.EncryptedPassword so that the bcrypt hash comparison below will
-		// Still happen and take time as if the user exists, but will always fail because []byte("FAKEPASSWORD") cannot
-		// be the resulting bytes from our bcrypt hash as it is much too short.
-		bcrypt.CompareHashAndPassword([]byte("FAKEPASSWORD"), []byte(*req.Password))
+		// To prevent this, we compare the password against a dummy hash made at the configured cost, so that the
+		// comparison takes as long as it would for a user who exists, but always fails.
+		passwordPolicy.CompareDummy(*req.Password)
+		recordFailure(r, "login", accountKey)
 		write401(w, &[]errorStruct{
 			{
 				Error:  "Invalid Login/Password combination",
@@ -102,6 +109,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 
 
 	if err := bcrypt.CompareHashAndPassword(user.EncryptedPassword, []byte(*req.Password)); err != nil {
+		recordFailure(r, "login", accountKey)
 		write401(w, &[]errorStruct{
 			{
 				Error:  "Invalid Login/Password combination",
@@ -110,182 +118,160 @@ func login(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	recordSuccess(accountKey)
 
-	// TODO: check to make sure this config value exists... somehow
-	testSigningKey := []byte(conf.Config.GetString("kubrik.secret"))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"uid": user.Id,
-	})
-	tokenString, _ := token.SignedString(testSigningKey)
+	// The password is only ever known here, so this is where hashes made at an older, lower cost are replaced
+	if passwordPolicy.NeedsUpgrade(user.EncryptedPassword) {
+		upgradePasswordHash(user, *req.Password)
+	}
 
-	addContentTypeJSONHeader(w)
-	w.WriteHeader(http.StatusOK)
-	encoder.Encode(&tokenResponse{
-		Token:     string(tokenString),
-		TokenType: "bearer",
-	})
+	completeLogin(w, r, user.Id)
 }
 
-func convertFacebookCodeToToken(request clientFacebookTokenRequest) (*serverFacebookTokenResponse, error) {
-	req, err := http.NewRequest("GET", "https://graph.facebook.com/v2.8/oauth/access_token", nil)
+// upgradePasswordHash rehashes a user's password at the configured cost. The login goes on if it fails, as the old
+// hash still works.
+func upgradePasswordHash(user *db.UserModel, pw string) {
+	hash, err := passwordPolicy.Hash(pw)
 	if err != nil {
-		return nil, err
-	}
-	q := req.URL.Query()
-	// TODO: check that the client id is the one we have configured
-	q.Add("client_id", *request.ClientId)
-	q.Add("redirect_uri", *request.RedirectURI)
-	q.Add("client_secret", conf.Config.GetString("facebook.client_secret"))
-	q.Add("code", *request.Code)
-	req.URL.RawQuery = q.Encode()
-
-	log.Logger.WithField("URL", req.URL.RequestURI()).Info("our request")
-
-	var fbResp serverFacebookTokenResponse
-	resp, err := http.DefaultClient.Do(req)
-	log.Logger.WithFields(logrus.Fields{
-		"resp": resp,
-	}).Debug("Convert code response")
-	if resp.StatusCode != http.StatusOK {
-		// FIXME: handle error within error inception
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Logger.
-			WithField("URL", req.URL.RequestURI()).
-			WithField("Body", body).
-			Error("Facebook didn't like our request")
-		return nil, errors.New("Bad Loginorino")
-	}
-
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&fbResp); err != nil {
-		return nil, err
+		log.Logger.WithField("error", err).Error("Failing to hash password for cost upgrade")
+		return
 	}
-
-	if !validateFacebookTokenResponse(&fbResp) {
-		return nil, errors.New("Bad login")
+	if err = db.UpgradePasswordHash(user.Id, user.EncryptedPassword, hash); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to upgrade password hash")
+		return
 	}
-	return &fbResp, nil
+	log.Logger.WithField("user", user.Id).Info("Upgraded password hash cost")
 }
 
-func loginOrSignUpWithFacebook(w http.ResponseWriter, r *http.Request) {
+// refreshAccessToken is an http.HandlerFunc which exchanges a refresh token for a new access token.
+// The refresh token is rotated on every use. Presenting a refresh token which was already rotated revokes
+// every token descended from the same login.
+// It can return the following HTTP statuses:
+// 200 OK: The request was accepted and the body contains a signed JWT and a new refresh token
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The refresh token is unknown, expired, revoked or was already used
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func refreshAccessToken(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	encoder := json.NewEncoder(w)
 
-	var req clientFacebookTokenRequest
+	var req refreshTokenRequest
 	var err error
 
 	if err = decoder.Decode(&req); err != nil {
-		log.Logger.Error("Failing to decode client Facebook Token Request in Login Or Sign Up With Facebook")
 		write400(w)
 		return
 	}
 
-	// Convert code into token
-	// TODO: check validation
-	validateFacebookTokenRequest(&req)
-	accessToken, err := convertFacebookCodeToToken(req)
-	if err != nil {
-		log.Logger.Error("Failing to convert Facebook Code to token in Login or signup with facebook")
-		write400(w)
+	if valid, eStructs := validateRefreshTokenRequest(&req); !valid {
+		write422(w, eStructs)
 		return
 	}
-	// TODO: check error and handle
-	// Inspect token
-	userAttrs, err := getFacebookUserAttributes(*accessToken.AccessToken)
-	// TODO: validate fb token has fields we need and request didn't error
-	log.Logger.WithFields(logrus.Fields{
-		"email": *userAttrs.Email,
-		"id":    *userAttrs.Id,
-		"err":   err,
-	}).Debug("Facebook user attribute response")
 
-	var user *db.UserModel
-	user, err = db.GetUserByFacebook(*userAttrs.Id)
+	newRefreshToken, err := newOpaqueToken()
 	if err != nil {
-		log.Logger.WithField("error", err).Debug("Get user by facebook error")
-		user, err = db.CreateUserByFacebook(*userAttrs.Id, *userAttrs.Email)
-		log.Logger.WithField("user", user).Debug("Create user response")
-		if err != nil {
-			log.Logger.WithField("error", err).Error("Failing to make new user")
-			write400(w)
-			return
-		}
-	}
-
-	testSigningKey := []byte(conf.Config.GetString("kubrik.secret"))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"uid": user.Id,
-	})
-	tokenString, _ := token.SignedString(testSigningKey)
-
-	addContentTypeJSONHeader(w)
-	w.WriteHeader(http.StatusOK)
-	encoder.Encode(&tokenResponse{
-		Token:     string(tokenString),
-		TokenType: "bearer",
-	})
-
-}
-
-func getFacebookUserAttributes(accessToken string) (*serverFacebookUserAttributes, error) {
-	req, err := http.NewRequest("GET", "https://graph.facebook.com/v2.8/me", nil)
-	if err != nil {
-		return nil, err
-	}
-	q := req.URL.Query()
-	q.Add("fields", "id,email")
-	q.Add("access_token", accessToken)
-	req.URL.RawQuery = q.Encode()
-
-	var fbResp serverFacebookUserAttributes
-	resp, err := http.DefaultClient.Do(req)
-	if resp.StatusCode != http.StatusOK {
-		// TODO: better error message
-		return nil, errors.New("Bad Loginorino")
+		write500(w)
+		return
 	}
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&fbResp); err != nil {
-		return nil, err
+	jti := uuid.NewV4().String()
+	expiresAt := time.Now().Add(conf.Config.GetDuration("kubrik.refresh_token_ttl"))
+
+	refreshToken, revokedJti, err := db.RotateRefreshToken(
+		hashOpaqueToken(*req.RefreshToken), hashOpaqueToken(newRefreshToken), jti, expiresAt)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows, db.ErrRefreshTokenExpired, db.ErrRefreshTokenRevoked:
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Invalid refresh token",
+				Fields: []string{"refresh_token"},
+			},
+		})
+		return
+	case db.ErrRefreshTokenReused:
+		// The access token of the revoked session must stop working now, not once the cache forgets it
+		activeSessions.invalidate(revokedJti)
+		log.Logger.WithField("error", err).Warn("Refresh token reuse detected, revoked session")
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Invalid refresh token",
+				Fields: []string{"refresh_token"},
+			},
+		})
+		return
+	default:
+		log.Logger.WithField("error", err).Error("Failing to rotate refresh token")
+		write500(w)
+		return
 	}
-	return &fbResp, nil
-}
-
-func deauthFacebook(_ http.ResponseWriter, _ *http.Request) {
-}
-
-func convertGoogleToken(_ http.ResponseWriter, _ *http.Request) {
-}
 
-func jwtKeyFunc(_ *jwt.Token) (interface{}, error) {
-	return []byte(conf.Config.GetString("kubrik.secret")), nil
+	writeTokenResponse(w, refreshToken.UserId, jti, newRefreshToken)
 }
 
-func GetUserIdFromToken(header string) (*string, error) {
-	//FIXME: sanity check that the user actually exists
+// parseAccessToken validates the access token in a bearer authorization header and returns its claims, and whether
+// its session was started with a second factor. Tokens whose session has been revoked are rejected.
+func parseAccessToken(header string) (*jwtClaims, bool, error) {
 	var jwtT *jwt.Token
 	var err error
 	headerParts := strings.Split(header, " ")
 	if len(headerParts) != 2 || strings.ToLower(headerParts[0]) != "bearer" {
-		return nil, errors.New("Inmroper token form. Must begin with 'bearer '.")
+		return nil, false, errors.New("Inmroper token form. Must begin with 'bearer '.")
 	}
 	if jwtT, err = jwt.ParseWithClaims(headerParts[1], &jwtClaims{}, jwtKeyFunc); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if claims, ok := jwtT.Claims.(*jwtClaims); ok && jwtT.Valid {
-		if claims.UserId != nil {
-			if _, err := uuid.FromString(*claims.UserId); err != nil {
-				return nil, errors.New("Claimed user id is not a UUID")
+		// Tokens minted before expiry was introduced carry none of these claims and must not be accepted
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+			return nil, false, errors.New("Token is expired or has no expiry")
+		}
+		if !claims.VerifyIssuer(conf.Config.GetString("kubrik.issuer"), true) {
+			return nil, false, errors.New("Token has an unexpected issuer")
+		}
+		if !claims.VerifyAudience(conf.Config.GetString("kubrik.audience"), true) {
+			return nil, false, errors.New("Token has an unexpected audience")
+		}
+		if claims.UserId == nil {
+			return nil, false, errors.New("Unspecified user id in claims")
+		}
+		if _, err := uuid.FromString(*claims.UserId); err != nil {
+			return nil, false, errors.New("Claimed user id is not a UUID")
+		}
+		if claims.Actor != nil {
+			if _, err := uuid.FromString(claims.Actor.Subject); err != nil {
+				return nil, false, errors.New("Claimed actor id is not a UUID")
 			}
-			return claims.UserId, nil
 		}
-		return nil, errors.New("Unspecified user id in claims")
+		active, mfa, err := activeSessions.isActive(claims.Id, *claims.UserId)
+		if err != nil {
+			return nil, false, err
+		} else if !active {
+			return nil, false, errors.New("Session has been revoked")
+		}
+		return claims, mfa, nil
 	}
-	return nil, errors.New("Invalid JWT")
+	return nil, false, errors.New("Invalid JWT")
 }
 
 func RouteAuth(router *mux.Router) {
 	router.HandleFunc("/auth/login", login).Methods("POST")
-	router.HandleFunc("/auth/facebook", loginOrSignUpWithFacebook).Methods("POST")
-	router.HandleFunc("/auth/google", convertGoogleToken).Methods("POST")
+	router.HandleFunc("/auth/refresh", refreshAccessToken).Methods("POST")
+	router.Handle("/auth/logout", RequireLogin(http.HandlerFunc(logout))).Methods("POST")
+	router.HandleFunc("/auth/mfa", completeMFALogin).Methods("POST")
+	router.HandleFunc("/auth/device/code", requestDeviceCode).Methods("POST")
+	router.HandleFunc("/auth/device/token", pollDeviceToken).Methods("POST")
+	router.Handle("/auth/device/verify", RequireLogin(DenyImpersonation(http.HandlerFunc(verifyDevice)))).Methods("POST")
+	router.HandleFunc("/auth/magic-link", requestMagicLink).Methods("POST")
+	router.HandleFunc("/auth/magic-link/token", loginWithMagicLink).Methods("POST")
+	router.Handle("/auth/saml/token", OptionalAuth(DenyImpersonation(http.HandlerFunc(loginWithSAMLCode)))).Methods("POST")
+	router.HandleFunc("/auth/password/forgot", forgotPassword).Methods("POST")
+	router.HandleFunc("/auth/password/reset", resetPassword).Methods("POST")
+	router.HandleFunc("/auth/email/verify", verifyEmail).Methods("POST")
 	router.HandleFunc("/deauth/facebook", deauthFacebook).Methods("POST")
+	router.HandleFunc("/deauth/facebook/deletion", deleteFacebookData).Methods("POST")
+	router.HandleFunc("/deauth/facebook/deletion/{code}", showFacebookDeletion).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", showJWKS).Methods("GET")
+
+	// External identity providers are matched last so that they can't shadow the routes above
+	router.HandleFunc("/auth/{provider}", loginOrSignUpWithProvider).Methods("POST")
 }
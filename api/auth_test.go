@@ -1,6 +1,63 @@
 package api
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mg4tv/kubrik/db"
+	"github.com/satori/go.uuid"
+)
 
 func TestLogin(T *testing.T) {
-}
\ No newline at end of file
+}
+
+func TestRefreshTokenReuseEndsSession(T *testing.T) {
+	requireDatabase(T)
+
+	username := "refresh-test-" + uuid.NewV4().String()[:8]
+	user, err := db.CreateUser(&username, username+"@example.com", []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(user.Id)
+
+	// refresh exchanges a refresh token as a client would
+	refresh := func(refreshToken string) (int, tokenResponse) {
+		w := httptest.NewRecorder()
+		refreshAccessToken(w, httptest.NewRequest("POST", "/auth/refresh",
+			strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`)))
+		var resp tokenResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	w := httptest.NewRecorder()
+	writeTokens(w, httptest.NewRequest("POST", "/auth/token", nil), user.Id, false)
+	var login tokenResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.RefreshToken == "" {
+		T.Fatalf("expected tokens, got %s", w.Body.String())
+	}
+	status, _ := refresh(login.RefreshToken)
+	if status != http.StatusOK {
+		T.Fatalf("expected status %d refreshing, got %d", http.StatusOK, status)
+	}
+
+	// The refreshed access token is cached as active until the first refresh token comes back
+	sessions, err := db.ListSessionsByUser(user.Id)
+	if err != nil || len(*sessions) != 1 {
+		T.Fatalf("expected one session, got %v", err)
+	}
+	jti := (*sessions)[0].Jti
+	if active, _, err := activeSessions.isActive(jti, user.Id); err != nil || !active {
+		T.Fatalf("expected the session to be active, got %v, %v", active, err)
+	}
+	if status, _ = refresh(login.RefreshToken); status != http.StatusUnauthorized {
+		T.Errorf("expected status %d reusing a refresh token, got %d", http.StatusUnauthorized, status)
+	}
+	if active, _, err := activeSessions.isActive(jti, user.Id); err != nil || active {
+		T.Errorf("expected the session to end with the reuse, got %v, %v", active, err)
+	}
+}
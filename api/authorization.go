@@ -0,0 +1,246 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// Reasons a caller may not do something in an organization
+var (
+	ErrOrganizationNotFound = errors.New("Organization does not exist")
+	ErrNotMember            = errors.New("Not a member of the organization")
+	ErrPermissionDenied     = errors.New("Missing the permission in the organization")
+	ErrMFARequired          = errors.New("The organization requires two-factor authentication")
+)
+
+type permissionCacheEntry struct {
+	permissions *db.UserPermissionsModel
+	expiresAt   time.Time
+}
+
+// permissionCache remembers what users may do in organizations, so that authorizing doesn't need a database round
+// trip on every request. Changes to memberships and groups made by this process invalidate it immediately, changes
+// made by other instances are picked up once the cached entry expires (kubrik.permission_cache_ttl).
+type permissionCache struct {
+	sync.Mutex
+	// entries are keyed by user id, then organization id
+	entries map[string]map[string]permissionCacheEntry
+	size    int
+}
+
+var userPermissions = &permissionCache{entries: map[string]map[string]permissionCacheEntry{}}
+
+// get returns what a user may do in an organization. pgx.ErrNoRows is returned if the organization doesn't exist.
+func (c *permissionCache) get(userId, organizationId string) (*db.UserPermissionsModel, error) {
+	now := time.Now()
+
+	c.Lock()
+	entry, ok := c.entries[userId][organizationId]
+	c.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.permissions, nil
+	}
+
+	permissions, err := db.GetUserPermissions(userId, organizationId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	// Drop stale entries every so often so that the cache doesn't grow without bound
+	if c.size > 10000 {
+		c.size = 0
+		for user, organizations := range c.entries {
+			for organization, e := range organizations {
+				if now.After(e.expiresAt) {
+					delete(organizations, organization)
+				}
+			}
+			if len(organizations) == 0 {
+				delete(c.entries, user)
+			}
+			c.size += len(organizations)
+		}
+	}
+	if c.entries[userId] == nil {
+		c.entries[userId] = map[string]permissionCacheEntry{}
+	}
+	if _, exists := c.entries[userId][organizationId]; !exists {
+		c.size++
+	}
+	c.entries[userId][organizationId] = permissionCacheEntry{
+		permissions: permissions,
+		expiresAt:   now.Add(conf.Config.GetDuration("kubrik.permission_cache_ttl")),
+	}
+	c.Unlock()
+
+	return permissions, nil
+}
+
+// invalidateUser forgets what the users may do, for when they join or leave groups
+func (c *permissionCache) invalidateUser(userIds ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, userId := range userIds {
+		c.size -= len(c.entries[userId])
+		delete(c.entries, userId)
+	}
+}
+
+// invalidateOrganization forgets what anyone may do in an organization, for when its groups or settings change
+func (c *permissionCache) invalidateOrganization(organizationId string) {
+	c.Lock()
+	defer c.Unlock()
+	for userId, organizations := range c.entries {
+		if _, ok := organizations[organizationId]; ok {
+			delete(organizations, organizationId)
+			c.size--
+		}
+		if len(organizations) == 0 {
+			delete(c.entries, userId)
+		}
+	}
+}
+
+// requestPermissions holds the permissions read while serving one request, so that every check made for the
+// request sees the same permissions and reads them at most once. withCaller puts one in each request's context.
+type requestPermissions struct {
+	sync.Mutex
+	entries map[[2]string]*db.UserPermissionsModel
+}
+
+func newRequestPermissions() *requestPermissions {
+	return &requestPermissions{entries: map[[2]string]*db.UserPermissionsModel{}}
+}
+
+// permissionsFor returns what a user may do in an organization, from the request's permissions if it has them.
+// r may be nil outside of a request.
+func permissionsFor(r *http.Request, userId, organizationId string) (*db.UserPermissionsModel, error) {
+	var cache *requestPermissions
+	if r != nil {
+		cache, _ = r.Context().Value(permissionsContextKey).(*requestPermissions)
+	}
+	if cache == nil {
+		return userPermissions.get(userId, organizationId)
+	}
+
+	key := [2]string{userId, organizationId}
+	cache.Lock()
+	defer cache.Unlock()
+	if permissions, ok := cache.entries[key]; ok {
+		return permissions, nil
+	}
+	permissions, err := userPermissions.get(userId, organizationId)
+	if err != nil {
+		return nil, err
+	}
+	cache.entries[key] = permissions
+	return permissions, nil
+}
+
+// checkPermission decides whether a user's permissions in an organization include a permission. Owners may do
+// anything, everyone else needs a group granting it.
+func checkPermission(permissions *db.UserPermissionsModel, permission string) error {
+	if permissions.IsOwner {
+		return nil
+	}
+	if !permissions.IsMember {
+		return ErrNotMember
+	}
+	for _, name := range permissions.Permissions {
+		if name == permission {
+			return nil
+		}
+	}
+	return ErrPermissionDenied
+}
+
+// authorizeMember checks that a user owns or is a member of an organization, and returns what they may do in it
+func authorizeMember(r *http.Request, userId, organizationId string) (*db.UserPermissionsModel, error) {
+	permissions, err := permissionsFor(r, userId, organizationId)
+	if err == pgx.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !permissions.IsOwner && !permissions.IsMember {
+		return nil, ErrNotMember
+	}
+	if err = checkOrganizationMFA(r, userId, permissions); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// authorizeJoin decides whether a user may join an organization's public group themselves. They needn't be in the
+// organization yet, but must meet its MFA requirement as its members do.
+func authorizeJoin(r *http.Request, userId, organizationId string) error {
+	permissions, err := permissionsFor(r, userId, organizationId)
+	if err == pgx.ErrNoRows {
+		return ErrOrganizationNotFound
+	} else if err != nil {
+		return err
+	}
+	return checkOrganizationMFA(r, userId, permissions)
+}
+
+// checkOrganizationMFA enforces an organization's MFA requirement. Organizations can require everyone acting in
+// them, owners included, to have logged in with a second factor.
+func checkOrganizationMFA(r *http.Request, userId string, permissions *db.UserPermissionsModel) error {
+	if !permissions.RequireMFA {
+		return nil
+	}
+	verified, err := verifiedMFA(r, userId)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrMFARequired
+	}
+	return nil
+}
+
+// verifiedMFA reports whether the user acting in a request proved their second factor. Logged in users must have
+// done so to start their session. API tokens and callers outside a request have no session to go by, so the user
+// having a second factor is all that can be asked of them.
+func verifiedMFA(r *http.Request, userId string) (bool, error) {
+	if r != nil {
+		if principal := CurrentPrincipal(r); principal != nil && !principal.IsAPIToken() &&
+			principal.UserId != nil && *principal.UserId == userId {
+			return principal.MFA, nil
+		}
+	}
+	return db.UserHasMFA(userId)
+}
+
+// authorizeUser is IsAuthorized within a request, whose permissions are reused by later checks
+func authorizeUser(r *http.Request, userId, organizationId, permission string) error {
+	permissions, err := authorizeMember(r, userId, organizationId)
+	if err != nil {
+		return err
+	}
+	return checkPermission(permissions, permission)
+}
+
+// writeAuthorizationError writes a 403 explaining why the caller was refused, or a 500 if authorizing failed
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrOrganizationNotFound, ErrNotMember, ErrPermissionDenied, ErrMFARequired:
+		write403WithErrors(w, &[]errorStruct{
+			{
+				Error:  err.Error(),
+				Fields: []string{"organization_id"},
+			},
+		})
+	default:
+		log.Logger.WithField("error", err).Error("Failing to authorize")
+		write500(w)
+	}
+}
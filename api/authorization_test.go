@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mg4tv/kubrik/db"
+)
+
+func TestCheckPermission(T *testing.T) {
+	owner := &db.UserPermissionsModel{IsOwner: true}
+	if err := checkPermission(owner, "MANAGE_GROUPS"); err != nil {
+		T.Errorf("expected the owner to have every permission, got %v", err)
+	}
+
+	member := &db.UserPermissionsModel{IsMember: true, Permissions: []string{"CREATE_VIDEO", "EDIT_VIDEO"}}
+	if err := checkPermission(member, "EDIT_VIDEO"); err != nil {
+		T.Errorf("expected a member to have a permission granted by a group, got %v", err)
+	}
+	if err := checkPermission(member, "DELETE_VIDEO"); err != ErrPermissionDenied {
+		T.Errorf("expected ErrPermissionDenied for a permission no group grants, got %v", err)
+	}
+
+	outsider := &db.UserPermissionsModel{Permissions: []string{"CREATE_VIDEO"}}
+	if err := checkPermission(outsider, "CREATE_VIDEO"); err != ErrNotMember {
+		T.Errorf("expected ErrNotMember for a user in none of the groups, got %v", err)
+	}
+}
+
+func TestPermissionCacheInvalidation(T *testing.T) {
+	cache := &permissionCache{entries: map[string]map[string]permissionCacheEntry{
+		"user-a": {"org-1": {}, "org-2": {}},
+		"user-b": {"org-1": {}},
+	}, size: 3}
+
+	cache.invalidateOrganization("org-1")
+	if _, ok := cache.entries["user-a"]["org-1"]; ok {
+		T.Error("expected the organization's entries to be forgotten")
+	}
+	if _, ok := cache.entries["user-b"]; ok {
+		T.Error("expected users without entries left to be dropped")
+	}
+	if _, ok := cache.entries["user-a"]["org-2"]; !ok {
+		T.Error("expected other organizations' entries to be kept")
+	}
+
+	cache.invalidateUser("user-a")
+	if len(cache.entries) != 0 || cache.size != 0 {
+		T.Errorf("expected an empty cache, got %d users and size %d", len(cache.entries), cache.size)
+	}
+}
+
+func TestAuthorizeMemberRequiresMFASession(T *testing.T) {
+	userId := "00000000-0000-4000-8000-000000000001"
+	organizationId := "00000000-0000-4000-8000-000000000002"
+
+	for _, mfa := range []bool{false, true} {
+		permissions := newRequestPermissions()
+		permissions.entries[[2]string{userId, organizationId}] = &db.UserPermissionsModel{IsOwner: true, RequireMFA: true}
+		principal := &Principal{UserId: &userId, SessionId: "session", MFA: mfa}
+		r := httptest.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(r.Context(), principalContextKey, principal)
+		r = r.WithContext(context.WithValue(ctx, permissionsContextKey, permissions))
+
+		_, err := authorizeMember(r, userId, organizationId)
+		if mfa && err != nil {
+			T.Errorf("expected a session started with a second factor to be let in, got %v", err)
+		} else if !mfa && err != ErrMFARequired {
+			T.Errorf("expected ErrMFARequired for a session started without a second factor, got %v", err)
+		}
+	}
+}
+
+func TestAuthorizeJoinRequiresMFASession(T *testing.T) {
+	userId := "00000000-0000-4000-8000-000000000001"
+	organizationId := "00000000-0000-4000-8000-000000000002"
+
+	for _, mfa := range []bool{false, true} {
+		// Someone joining isn't in the organization yet, but still has to meet its requirement
+		permissions := newRequestPermissions()
+		permissions.entries[[2]string{userId, organizationId}] = &db.UserPermissionsModel{RequireMFA: true}
+		principal := &Principal{UserId: &userId, SessionId: "session", MFA: mfa}
+		r := httptest.NewRequest("POST", "/", nil)
+		ctx := context.WithValue(r.Context(), principalContextKey, principal)
+		r = r.WithContext(context.WithValue(ctx, permissionsContextKey, permissions))
+
+		err := authorizeJoin(r, userId, organizationId)
+		if mfa && err != nil {
+			T.Errorf("expected a session started with a second factor to join, got %v", err)
+		} else if !mfa && err != ErrMFARequired {
+			T.Errorf("expected ErrMFARequired for a session started without a second factor, got %v", err)
+		}
+	}
+}
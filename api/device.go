@@ -0,0 +1,270 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// deviceGrantType is the grant_type devices poll /auth/device/token with
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// userCodeAlphabet leaves out vowels, so codes don't spell words, and characters easily confused with each other
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength gives 20^8 possible codes, about 34 bits, as RFC 8628 recommends
+const userCodeLength = 8
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type deviceVerifyRequest struct {
+	UserCode *string `json:"user_code,omitempty"`
+	Deny     *bool   `json:"deny,omitempty"`
+}
+
+type deviceVerifyResponse struct {
+	ClientId string `json:"client_id"`
+	Status   string `json:"status"`
+}
+
+// writeOAuthError writes an error the way RFC 6749 section 5.2 has token endpoints report them, which device
+// clients expect rather than our own error format
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	encoder := json.NewEncoder(w)
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	encoder.Encode(&oauthErrorResponse{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+// newUserCode generates a code for the user to type in, without the dash it is displayed with
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode undoes what users do to codes when typing them: lower case, dashes and spaces
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// deviceClientAllowed reports whether a client may use the device flow. When device.client_ids is empty, any
+// client id is accepted.
+func deviceClientAllowed(clientId string) bool {
+	allowed := conf.Config.GetStringSlice("device.client_ids")
+	if len(allowed) == 0 {
+		return clientId != ""
+	}
+	for _, id := range allowed {
+		if id == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// requestDeviceCode is an http.HandlerFunc for the RFC 8628 device authorization endpoint. A device with no
+// keyboard calls it with its client_id, shows the user_code, and polls /auth/device/token until the user approves.
+// The request is form encoded, as the RFC requires.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the device code, the user code and where the user should enter it
+// 400 Bad Request: The client_id is missing or not allowed to use the device flow
+// 500 Server Error:
+func requestDeviceCode(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	clientId := r.PostFormValue("client_id")
+	if !deviceClientAllowed(clientId) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client", "Unknown client_id")
+		return
+	}
+
+	deviceCode, err := newOpaqueToken()
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	ttl := conf.Config.GetDuration("device.code_ttl")
+	interval := conf.Config.GetDuration("device.poll_interval")
+	var userCode string
+	// User codes are short enough to collide once in a while, so try a few
+	for attempt := 0; ; attempt++ {
+		if userCode, err = newUserCode(); err != nil {
+			write500(w)
+			return
+		}
+		err = db.CreateDeviceCode(hashOpaqueToken(deviceCode), userCode, clientId, interval, time.Now().Add(ttl))
+		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ && attempt < 3 {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to create device code")
+		write500(w)
+		return
+	}
+
+	displayCode := userCode[:4] + "-" + userCode[4:]
+	verificationURI := conf.Config.GetString("kubrik.app_url") + "/device"
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&deviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                displayCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: appURL("/device", url.Values{"user_code": {displayCode}}),
+		ExpiresIn:               int64(ttl / time.Second),
+		Interval:                int64(interval / time.Second),
+	})
+}
+
+// pollDeviceToken is an http.HandlerFunc for the RFC 8628 device access token request. Once the user has approved
+// the device, it gets an access token and refresh token like any other login. Until then it gets an OAuth error
+// telling it whether to keep polling.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains a signed JWT and a refresh token
+// 400 Bad Request: The body contains an OAuth error: authorization_pending, slow_down, access_denied,
+// expired_token, invalid_grant, invalid_client or unsupported_grant_type
+// 500 Server Error:
+func pollDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("grant_type") != deviceGrantType {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	clientId := r.PostFormValue("client_id")
+	if !deviceClientAllowed(clientId) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client", "Unknown client_id")
+		return
+	}
+
+	userId, err := db.PollDeviceCode(hashOpaqueToken(r.PostFormValue("device_code")), clientId)
+	switch err {
+	case nil:
+	case db.ErrDeviceAuthorizationPending, db.ErrDeviceSlowDown, db.ErrDeviceAccessDenied, db.ErrDeviceCodeExpired:
+		writeOAuthError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	case pgx.ErrNoRows:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Unknown or already used device_code")
+		return
+	default:
+		log.Logger.WithField("error", err).Error("Failing to poll device code")
+		write500(w)
+		return
+	}
+
+	log.Logger.WithFields(logrus.Fields{
+		"user":      userId,
+		"client_id": clientId,
+	}).Info("Device authorized")
+	// The device never proves a second factor itself, so its session doesn't count as one started with it
+	writeTokens(w, r, userId, false)
+}
+
+// verifyDevice is an http.HandlerFunc which the logged in user calls with the code shown on their device, to let
+// the device log in as them or to turn it away
+// It can return the following HTTP statuses:
+// 200 OK: The device was approved or denied and the body names the client that asked
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request has no valid access token
+// 404 Not Found: No pending device has the code, or it has expired
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 429 Too Many Requests: Too many codes were wrong, see Retry-After
+// 500 Server Error:
+func verifyDevice(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req deviceVerifyRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+
+	if err = decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if req.UserCode == nil || len(normalizeUserCode(*req.UserCode)) != userCodeLength {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Enter the code shown on your device",
+				Fields: []string{"user_code"},
+			},
+		})
+		return
+	}
+
+	// Codes are short, so guessing them counts against the user like a password would
+	accountKey := "device:" + *principal.UserId
+	if !throttle(w, r, "device_verify", accountKey) {
+		return
+	}
+
+	approve := req.Deny == nil || !*req.Deny
+	clientId, err := db.DecideDeviceCode(normalizeUserCode(*req.UserCode), *principal.UserId, approve)
+	if err == pgx.ErrNoRows {
+		recordFailure(r, "device_verify", accountKey)
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to decide device code")
+		write500(w)
+		return
+	}
+	recordSuccess(accountKey)
+
+	status := db.DeviceCodeApproved
+	if !approve {
+		status = db.DeviceCodeDenied
+	}
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&deviceVerifyResponse{
+		ClientId: clientId,
+		Status:   status,
+	})
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mg4tv/kubrik/db"
+	"github.com/satori/go.uuid"
+)
+
+func TestUserCodes(T *testing.T) {
+	code, err := newUserCode()
+	if err != nil {
+		T.Fatal(err)
+	}
+	if len(code) != userCodeLength || normalizeUserCode(code) != code {
+		T.Errorf("unexpected user code %q", code)
+	}
+
+	if got := normalizeUserCode(" bcdf-ghjk "); got != "BCDFGHJK" {
+		T.Errorf("expected typed codes to be normalized, got %q", got)
+	}
+	if got := normalizeUserCode("BCDF-GHJA"); got != "BCDFGHJ" {
+		T.Errorf("expected characters outside the alphabet to be dropped, got %q", got)
+	}
+}
+
+// pollDevice makes a device access token request the way a device would, form encoded
+func pollDevice(form url.Values) (int, oauthErrorResponse) {
+	r := httptest.NewRequest("POST", "/auth/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	pollDeviceToken(w, r)
+
+	var resp oauthErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestPollDeviceTokenRejections(T *testing.T) {
+	status, resp := pollDevice(url.Values{"grant_type": {"password"}, "client_id": {"mg4-tv"}, "device_code": {"code"}})
+	if status != http.StatusBadRequest || resp.Error != "unsupported_grant_type" {
+		T.Errorf("expected unsupported_grant_type for another grant type, got %d %s", status, resp.Error)
+	}
+
+	status, resp = pollDevice(url.Values{"grant_type": {deviceGrantType}, "device_code": {"code"}})
+	if status != http.StatusBadRequest || resp.Error != "invalid_client" {
+		T.Errorf("expected invalid_client without a client_id, got %d %s", status, resp.Error)
+	}
+}
+
+func TestPollDeviceToken(T *testing.T) {
+	requireDatabase(T)
+
+	username := "device-test-" + uuid.NewV4().String()[:8]
+	user, err := db.CreateUser(&username, username+"@example.com", []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(user.Id)
+
+	// newDeviceCode stores a device authorization as requestDeviceCode would, and returns the device and user codes
+	newDeviceCode := func(interval time.Duration, expiresAt time.Time) (string, string) {
+		deviceCode, err := newOpaqueToken()
+		if err != nil {
+			T.Fatal(err)
+		}
+		userCode, err := newUserCode()
+		if err != nil {
+			T.Fatal(err)
+		}
+		if err = db.CreateDeviceCode(hashOpaqueToken(deviceCode), userCode, "mg4-tv", interval, expiresAt); err != nil {
+			T.Fatal(err)
+		}
+		return deviceCode, userCode
+	}
+	poll := func(deviceCode string) (int, oauthErrorResponse) {
+		return pollDevice(url.Values{"grant_type": {deviceGrantType}, "client_id": {"mg4-tv"}, "device_code": {deviceCode}})
+	}
+
+	// Polling faster than the interval asks the device to slow down
+	deviceCode, _ := newDeviceCode(time.Minute, time.Now().Add(10*time.Minute))
+	if status, resp := poll(deviceCode); status != http.StatusBadRequest || resp.Error != "authorization_pending" {
+		T.Errorf("expected authorization_pending before the user decides, got %d %s", status, resp.Error)
+	}
+	if status, resp := poll(deviceCode); status != http.StatusBadRequest || resp.Error != "slow_down" {
+		T.Errorf("expected slow_down polling again right away, got %d %s", status, resp.Error)
+	}
+
+	deviceCode, _ = newDeviceCode(0, time.Now().Add(-time.Minute))
+	if status, resp := poll(deviceCode); status != http.StatusBadRequest || resp.Error != "expired_token" {
+		T.Errorf("expected expired_token for an expired code, got %d %s", status, resp.Error)
+	}
+
+	deviceCode, userCode := newDeviceCode(0, time.Now().Add(10*time.Minute))
+	if _, err = db.DecideDeviceCode(userCode, user.Id, false); err != nil {
+		T.Fatal(err)
+	}
+	if status, resp := poll(deviceCode); status != http.StatusBadRequest || resp.Error != "access_denied" {
+		T.Errorf("expected access_denied for a denied code, got %d %s", status, resp.Error)
+	}
+
+	// An approved code logs the device in once, and is spent after that
+	deviceCode, userCode = newDeviceCode(0, time.Now().Add(10*time.Minute))
+	if _, err = db.DecideDeviceCode(userCode, user.Id, true); err != nil {
+		T.Fatal(err)
+	}
+	if status, resp := poll(deviceCode); status != http.StatusOK {
+		T.Fatalf("expected tokens for an approved code, got %d %s", status, resp.Error)
+	}
+	if status, resp := poll(deviceCode); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		T.Errorf("expected invalid_grant for a spent code, got %d %s", status, resp.Error)
+	}
+
+	if status, resp := poll("unknown"); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		T.Errorf("expected invalid_grant for an unknown code, got %d %s", status, resp.Error)
+	}
+}
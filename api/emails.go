@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/mg4tv/kubrik/mail"
+)
+
+type verifyEmailRequest struct {
+	Token *string `json:"token,omitempty"`
+}
+
+type changeEmailRequest struct {
+	Email *string `json:"email,omitempty"`
+}
+
+// sendEmailVerification emails a verification link for an address to a user. When the address isn't the user's
+// current email, following the link changes it.
+func sendEmailVerification(userId, email string, change bool) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to generate email verification token")
+		return
+	}
+	ttl := conf.Config.GetDuration("kubrik.email_verification_ttl")
+	if err = db.CreateEmailVerificationToken(userId, email, hashOpaqueToken(token), time.Now().Add(ttl)); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store email verification token")
+		return
+	}
+
+	msg := &mail.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: "Confirm this is your email address by following this link:\n\n" +
+			appURL("/verify-email", url.Values{"token": {token}}) + "\n\n" +
+			"The link expires in " + ttl.String() + ".\n",
+	}
+	if change {
+		msg.Subject = "Confirm your new email"
+		msg.Body = "Someone asked to change the email of your account to this address. If it was you, confirm it here:\n\n" +
+			appURL("/verify-email", url.Values{"token": {token}}) + "\n\n" +
+			"The link expires in " + ttl.String() + ". Until then your account keeps its current email.\n"
+	}
+	if err = mail.Send(msg); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to send email verification")
+	}
+}
+
+// requireVerifiedEmail checks a user may take actions that need a verified email, which is only enforced when
+// kubrik.require_verified_email is set. If not, a 403 is written and false is returned.
+func requireVerifiedEmail(w http.ResponseWriter, userId string) bool {
+	if !conf.Config.GetBool("kubrik.require_verified_email") {
+		return true
+	}
+
+	user, err := db.GetUserById(userId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user to check email verification")
+		write500(w)
+		return false
+	}
+	if user.EmailVerifiedAt == nil {
+		write403WithErrors(w, &[]errorStruct{
+			{
+				Error:  "Verify your email before doing this",
+				Fields: []string{"email"},
+			},
+		})
+		return false
+	}
+	return true
+}
+
+// verifyEmail is an http.HandlerFunc which marks the email a verification token was sent to as verified.
+// If the token was for a new address, the user's email is changed to it.
+// It can return the following HTTP statuses:
+// 200 OK: The email was verified and the body contains the user
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The token doesn't exist, has expired or was already used
+// 409 Conflict: Another user has taken the new address since it was requested
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req verifyEmailRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode verify email request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateVerifyEmailRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	user, err := db.VerifyEmail(hashOpaqueToken(*req.Token))
+	if err == db.ErrEmailVerificationTokenInvalid {
+		write401(w, &[]errorStruct{
+			{
+				Error:  "This verification link is invalid or has expired",
+				Fields: []string{"token"},
+			},
+		})
+		return
+	} else if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "Email must be unique",
+				Fields: []string{"email"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to verify email")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&userResponse{
+		Id:       user.Id,
+		Username: user.Username,
+		Email:    user.Email,
+	})
+}
+
+// resendEmailVerification is an http.HandlerFunc which sends the logged in user a new link to verify their email
+// It can return the following HTTP statuses:
+// 202 Accepted: A verification link will be sent
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 409 Conflict: The email is already verified
+// 500 Server Error:
+func resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user.EmailVerifiedAt != nil {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "Email is already verified",
+				Fields: []string{"email"},
+			},
+		})
+		return
+	}
+
+	go sendEmailVerification(user.Id, user.Email, false)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// changeEmail is an http.HandlerFunc which starts changing the logged in user's email. A confirmation link is sent
+// to the new address and the email only changes once it is followed. The current address is told of the request.
+// It can return the following HTTP statuses:
+// 202 Accepted: A confirmation link will be sent to the new address
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 409 Conflict: Another user has the address
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req changeEmailRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode change email request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateChangeEmailRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	user := CurrentUser(r)
+
+	if other, err := db.GetUserByEmail(*req.Email); err == nil && other.Id != user.Id {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "Email must be unique",
+				Fields: []string{"email"},
+			},
+		})
+		return
+	} else if err != nil && err != pgx.ErrNoRows {
+		log.Logger.WithField("error", err).Error("Failing to get user by email")
+		write500(w)
+		return
+	}
+
+	log.Logger.WithFields(logrus.Fields{
+		"user": user.Id,
+	}).Info("Email change requested")
+	go func(current, requested string) {
+		sendEmailVerification(user.Id, requested, requested != current)
+		if requested == current {
+			return
+		}
+		err := mail.Send(&mail.Message{
+			To:      current,
+			Subject: "Your email is being changed",
+			Body: "Someone asked to change the email of your account to " + requested + ". " +
+				"It changes once the new address is confirmed. If this wasn't you, reset your password.\n",
+		})
+		if err != nil {
+			log.Logger.WithField("error", err).Error("Failing to send email change notice")
+		}
+	}(user.Email, *req.Email)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/auth"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// facebookProvider is the name Facebook identities are linked under
+const facebookProvider = "facebook"
+
+type facebookDeletionResponse struct {
+	URL              string `json:"url"`
+	ConfirmationCode string `json:"confirmation_code"`
+}
+
+type facebookDeletionStatusResponse struct {
+	ConfirmationCode string     `json:"confirmation_code"`
+	Status           string     `json:"status"`
+	RequestedAt      time.Time  `json:"requested_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+}
+
+// parseFacebookSignedRequest reads and verifies the signed_request form field Facebook posts to its callbacks.
+// If it is missing or not signed with our app secret, a 400 is written and ok is false.
+func parseFacebookSignedRequest(w http.ResponseWriter, r *http.Request) (req *auth.FacebookSignedRequest, ok bool) {
+	req, err := auth.ParseFacebookSignedRequest(r.PostFormValue("signed_request"), conf.Config.GetString("facebook.client_secret"))
+	if err != nil {
+		log.Logger.WithField("error", err).Warn("Rejected Facebook signed request")
+		write400(w)
+		return nil, false
+	}
+	return req, true
+}
+
+// publicURL returns the base URL clients reach this API at, from kubrik.public_url or else the request itself
+func publicURL(r *http.Request) string {
+	if base := conf.Config.GetString("kubrik.public_url"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func newConfirmationCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// deauthFacebook is an http.HandlerFunc for Facebook's deauthorize callback, called when a user removes our app.
+// The user's Facebook identity is unlinked and all of their sessions are revoked.
+// It can return the following HTTP statuses:
+// 200 OK: The callback was handled, whether or not the Facebook user was linked to anyone
+// 400 Bad Request: The signed_request was missing or its signature didn't match
+// 500 Server Error:
+func deauthFacebook(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseFacebookSignedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userId, err := db.UnlinkExternalIdentity(facebookProvider, req.UserId)
+	if err == pgx.ErrNoRows {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to unlink Facebook identity")
+		write500(w)
+		return
+	}
+
+	if err = revokeUserSessions(userId); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to revoke sessions of deauthorized Facebook user")
+		write500(w)
+		return
+	}
+	log.Logger.WithField("user", userId).Info("Facebook identity deauthorized")
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteFacebookData is an http.HandlerFunc for Facebook's data deletion callback.
+// The user's Facebook identity is removed along with the account itself if it has no other way to log in.
+// It can return the following HTTP statuses:
+// 200 OK: The data was deleted and the body contains a confirmation code and the URL its status can be checked at
+// 400 Bad Request: The signed_request was missing or its signature didn't match
+// 500 Server Error:
+func deleteFacebookData(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	req, ok := parseFacebookSignedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	code, err := newConfirmationCode()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to generate confirmation code")
+		write500(w)
+		return
+	}
+	if err = db.CreateFacebookDeletionRequest(code, req.UserId); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to record Facebook deletion request")
+		write500(w)
+		return
+	}
+
+	user, err := db.GetUserByExternalIdentity(facebookProvider, req.UserId)
+	if err == nil {
+		if err = revokeUserSessions(user.Id); err != nil {
+			log.Logger.WithField("error", err).Error("Failing to revoke sessions of Facebook user requesting deletion")
+			write500(w)
+			return
+		}
+		var deleted bool
+		if deleted, err = db.ForgetExternalIdentity(facebookProvider, req.UserId); err != nil && err != pgx.ErrNoRows {
+			log.Logger.WithField("error", err).Error("Failing to delete Facebook user data")
+			write500(w)
+			return
+		}
+		log.Logger.WithFields(logrus.Fields{
+			"user":    user.Id,
+			"deleted": deleted,
+		}).Info("Facebook user data deleted")
+	} else if err != pgx.ErrNoRows {
+		log.Logger.WithField("error", err).Error("Failing to get user by Facebook identity")
+		write500(w)
+		return
+	}
+
+	// Nothing is left to delete once the identity is gone, so the request is complete even if it was never linked
+	if err = db.CompleteFacebookDeletionRequest(code); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to complete Facebook deletion request")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&facebookDeletionResponse{
+		URL:              publicURL(r) + "/deauth/facebook/deletion/" + code,
+		ConfirmationCode: code,
+	})
+}
+
+// showFacebookDeletion is an http.HandlerFunc that reports the status of a Facebook data deletion request
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the status of the request
+// 404 Not Found: No deletion request has the confirmation code
+// 500 Server Error:
+func showFacebookDeletion(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	req, err := db.GetFacebookDeletionRequest(mux.Vars(r)["code"])
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get Facebook deletion request")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&facebookDeletionStatusResponse{
+		ConfirmationCode: req.ConfirmationCode,
+		Status:           req.Status,
+		RequestedAt:      req.RequestedAt,
+		CompletedAt:      req.CompletedAt,
+	})
+}
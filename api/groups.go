@@ -0,0 +1,587 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+func newGroupResponse(g *db.GroupModel) groupResponse {
+	resp := groupResponse{
+		Id:          g.Id,
+		Name:        g.Name,
+		IsPublic:    g.IsPublic,
+		Permissions: []permissionResponse{},
+	}
+	for _, permission := range g.Permissions {
+		resp.Permissions = append(resp.Permissions, permissionResponse{
+			Id:     permission.Id,
+			TypeId: permission.PermissionTypeId,
+			Name:   permission.PermissionTypeName,
+		})
+	}
+	return resp
+}
+
+// groupOrganization reads the organization id from the path and checks that the caller may manage its groups.
+// It writes the response and returns false if they may not.
+func groupOrganization(w http.ResponseWriter, r *http.Request) (organizationId string, ok bool) {
+	organizationId = mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return "", false
+	}
+
+	err := authorizePrincipal(r, CurrentPrincipal(r), organizationId, permissionManageGroups)
+	if err == ErrOrganizationNotFound {
+		write404(w)
+		return "", false
+	} else if err != nil {
+		writeAuthorizationError(w, err)
+		return "", false
+	}
+	return organizationId, true
+}
+
+// publicManagementGroupError refuses a public group granting management permissions, which anyone could join
+var publicManagementGroupError = errorStruct{
+	Error:  "Public groups can't grant MANAGE_GROUPS or MANAGE_ORG",
+	Fields: []string{"is_public", "permissions"},
+}
+
+// writeGroupError writes the response for the errors creating or updating a group can fail with
+func writeGroupError(w http.ResponseWriter, err error) {
+	if err == pgx.ErrNoRows {
+		write404(w)
+	} else if err == db.ErrUnknownPermission {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Permissions must be existing permission types",
+				Fields: []string{"permissions"},
+			},
+		})
+	} else if err == db.ErrPublicGroupPermission {
+		write422(w, &[]errorStruct{publicManagementGroupError})
+	} else if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "The organization already has a group with this name",
+				Fields: []string{"name"},
+			},
+		})
+	} else {
+		log.Logger.WithField("error", err).Error("Failing to save group")
+		write500(w)
+	}
+}
+
+// listOrganizationGroups is an http.HandlerFunc which lists an organization's groups and their permissions.
+// Anyone can see them, as they can on the organization.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the groups
+// 400 Bad Request: The organization id is malformed
+// 404 Not Found: No organization has the id
+// 500 Server Error:
+func listOrganizationGroups(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	organizationId := mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return
+	}
+
+	groups, err := db.ListGroups(organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list groups")
+		write500(w)
+		return
+	}
+
+	resp := []groupResponse{}
+	for i := range groups {
+		resp = append(resp, newGroupResponse(&groups[i]))
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// showOrganizationGroup is an http.HandlerFunc which shows one of an organization's groups and its permissions
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the group
+// 400 Bad Request: The organization id is malformed
+// 404 Not Found: The organization has no such group
+// 500 Server Error:
+func showOrganizationGroup(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	vars := mux.Vars(r)
+
+	if _, err := uuid.FromString(vars["orgId"]); err != nil {
+		write400(w)
+		return
+	}
+	if _, err := uuid.FromString(vars["groupId"]); err != nil {
+		write404(w)
+		return
+	}
+
+	group, err := db.GetGroup(vars["orgId"], vars["groupId"])
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get group")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(newGroupResponse(group))
+}
+
+// createOrganizationGroup is an http.HandlerFunc which creates a group in an organization, granting its members
+// the permission types named in the request
+// It can return the following HTTP statuses:
+// 201 Created: The group was created and the body contains it
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: No organization has the id
+// 409 Conflict: The organization already has a group with the name
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards, or a permission type doesn't exist
+// 500 Server Error:
+func createOrganizationGroup(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req groupRequest
+
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	if err := decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateGroupRequest(&req, false); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	isPublic := req.IsPublic != nil && *req.IsPublic
+	var permissions []string
+	if req.Permissions != nil {
+		permissions = *req.Permissions
+	}
+	group, err := db.CreateGroup(organizationId, *req.Name, isPublic, permissions)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        group.Id,
+	}).Info("Created group")
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Location", publicURL(r)+"/organizations/"+organizationId+"/groups/"+group.Id)
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(newGroupResponse(group))
+}
+
+// updateGroup changes a group from a PUT or PATCH. PUT replaces the group, so fields missing from it are reset.
+func updateGroup(w http.ResponseWriter, r *http.Request, partial bool) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req groupRequest
+
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+	groupId := mux.Vars(r)["groupId"]
+	if _, err := uuid.FromString(groupId); err != nil {
+		write404(w)
+		return
+	}
+
+	if err := decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateGroupRequest(&req, partial); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	update := db.GroupUpdate{
+		Name:               req.Name,
+		IsPublic:           req.IsPublic,
+		Permissions:        req.Permissions,
+		PrivatePermissions: managementPermissions,
+	}
+	if !partial {
+		if update.IsPublic == nil {
+			isPublic := false
+			update.IsPublic = &isPublic
+		}
+		if update.Permissions == nil {
+			update.Permissions = &[]string{}
+		}
+	}
+	group, err := db.UpdateGroup(organizationId, groupId, &update)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	userPermissions.invalidateOrganization(organizationId)
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(newGroupResponse(group))
+}
+
+// partiallyUpdateOrganizationGroup is an http.HandlerFunc which changes the fields of a group present in the
+// request. Permissions, when present, replace the group's permissions.
+// It can return the following HTTP statuses:
+// 200 OK: The group was updated and the body contains it
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: The organization has no such group
+// 409 Conflict: The organization already has another group with the name
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards, or a permission type doesn't exist
+// 500 Server Error:
+func partiallyUpdateOrganizationGroup(w http.ResponseWriter, r *http.Request) {
+	updateGroup(w, r, true)
+}
+
+// updateOrganizationGroup is an http.HandlerFunc which replaces a group. A group left out of is_public is private
+// and one left out of permissions has none.
+// It can return the following HTTP statuses:
+// 200 OK: The group was updated and the body contains it
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: The organization has no such group
+// 409 Conflict: The organization already has another group with the name
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards, or a permission type doesn't exist
+// 500 Server Error:
+func updateOrganizationGroup(w http.ResponseWriter, r *http.Request) {
+	updateGroup(w, r, false)
+}
+
+// deleteOrganizationGroup is an http.HandlerFunc which deletes one of an organization's groups. Its members lose
+// the permissions it granted them.
+// It can return the following HTTP statuses:
+// 204 No Content: The group was deleted
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: The organization has no such group
+// 500 Server Error:
+func deleteOrganizationGroup(w http.ResponseWriter, r *http.Request) {
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+	groupId := mux.Vars(r)["groupId"]
+	if _, err := uuid.FromString(groupId); err != nil {
+		write404(w)
+		return
+	}
+
+	err := db.DeleteGroup(organizationId, groupId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to delete group")
+		write500(w)
+		return
+	}
+	userPermissions.invalidateOrganization(organizationId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        groupId,
+	}).Info("Deleted group")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type groupMemberResponse struct {
+	Id       string  `json:"id"`
+	Username *string `json:"username"`
+}
+
+type userOrganizationResponse struct {
+	Id          string          `json:"id"`
+	Name        string          `json:"name"`
+	OwnerId     string          `json:"owner_id"`
+	IsOwner     bool            `json:"is_owner"`
+	RequireMFA  bool            `json:"require_mfa"`
+	Groups      []groupResponse `json:"groups"`
+	Permissions []string        `json:"permissions"`
+}
+
+// groupMembership reads the organization, group and user ids from the path of a membership and returns the group.
+// It writes the response and returns false if any of them is malformed or doesn't exist.
+func groupMembership(w http.ResponseWriter, r *http.Request) (organizationId string, group *db.GroupModel, userId string, ok bool) {
+	vars := mux.Vars(r)
+	organizationId, userId = vars["orgId"], vars["userId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return "", nil, "", false
+	}
+	if _, err := uuid.FromString(vars["groupId"]); err != nil {
+		write404(w)
+		return "", nil, "", false
+	}
+	if _, err := uuid.FromString(userId); err != nil {
+		write404(w)
+		return "", nil, "", false
+	}
+
+	group, err := db.GetGroup(organizationId, vars["groupId"])
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return "", nil, "", false
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get group")
+		write500(w)
+		return "", nil, "", false
+	}
+	return organizationId, group, userId, true
+}
+
+// listGroupMembers is an http.HandlerFunc which lists the members of one of an organization's groups.
+// Only the organization's owner and members can see them.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the members
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller isn't in the organization
+// 404 Not Found: The organization has no such group
+// 500 Server Error:
+func listGroupMembers(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+	vars := mux.Vars(r)
+
+	organizationId := vars["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return
+	}
+	if _, err := uuid.FromString(vars["groupId"]); err != nil {
+		write404(w)
+		return
+	}
+
+	err := authorizePrincipalMember(r, CurrentPrincipal(r), organizationId)
+	if err == ErrOrganizationNotFound {
+		write404(w)
+		return
+	} else if err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	members, err := db.ListGroupMembers(organizationId, vars["groupId"])
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list group members")
+		write500(w)
+		return
+	}
+
+	resp := []groupMemberResponse{}
+	for _, member := range members {
+		resp = append(resp, groupMemberResponse{
+			Id:       member.Id,
+			Username: member.Username,
+		})
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// addGroupMember is an http.HandlerFunc which puts a user in one of an organization's groups. Anyone may join a
+// public group themselves, as long as it doesn't grant management permissions and they meet the organization's MFA
+// requirement. Otherwise the caller needs to be able to manage the organization's groups.
+// It can return the following HTTP statuses:
+// 204 No Content: The user is in the group
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not add the user to the group, or is being impersonated
+// 404 Not Found: The organization has no such group, or there is no such user
+// 500 Server Error:
+func addGroupMember(w http.ResponseWriter, r *http.Request) {
+	principal := CurrentPrincipal(r)
+
+	organizationId, group, userId, ok := groupMembership(w, r)
+	if !ok {
+		return
+	}
+
+	var permissions []string
+	for _, permission := range group.Permissions {
+		permissions = append(permissions, permission.PermissionTypeName)
+	}
+	selfJoin := principal.UserId != nil && *principal.UserId == userId && group.IsPublic && !grantsManagement(permissions)
+	if selfJoin {
+		if !requireScope(w, principal, scopeOrgsWrite) {
+			return
+		}
+		if err := authorizeJoin(r, userId, organizationId); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	} else if err := authorizePrincipal(r, principal, organizationId, permissionManageGroups); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	if _, err := db.GetUserById(userId); err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user to add to group")
+		write500(w)
+		return
+	}
+
+	if err := db.AddGroupMember(group.Id, userId); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to add group member")
+		write500(w)
+		return
+	}
+	userPermissions.invalidateUser(userId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        group.Id,
+		"user":         userId,
+		"self_join":    selfJoin,
+	}).Info("Added group member")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeGroupMember is an http.HandlerFunc which takes a user out of one of an organization's groups. Anyone may
+// leave a group themselves, otherwise the caller needs to be able to manage the organization's groups.
+// It can return the following HTTP statuses:
+// 204 No Content: The user was taken out of the group
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not remove the user from the group, or is being impersonated
+// 404 Not Found: The organization has no such group, or the user isn't in it
+// 500 Server Error:
+func removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	principal := CurrentPrincipal(r)
+
+	organizationId, group, userId, ok := groupMembership(w, r)
+	if !ok {
+		return
+	}
+
+	if principal.UserId != nil && *principal.UserId == userId {
+		if !requireScope(w, principal, scopeOrgsWrite) {
+			return
+		}
+	} else if err := authorizePrincipal(r, principal, organizationId, permissionManageGroups); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	err := db.RemoveGroupMember(group.Id, userId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to remove group member")
+		write500(w)
+		return
+	}
+	userPermissions.invalidateUser(userId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        group.Id,
+		"user":         userId,
+	}).Info("Removed group member")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listUserOrganizations is an http.HandlerFunc which lists the organizations the user in the path owns or is in a
+// group of, with their groups there and the permissions those give them
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the organizations
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The user in the path isn't the caller, or the token lacks orgs:read
+// 500 Server Error:
+func listUserOrganizations(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+	if principal.UserId == nil || mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+	if !requireScope(w, principal, scopeOrgsRead) {
+		return
+	}
+
+	organizations, err := db.ListUserOrganizations(*principal.UserId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list user organizations")
+		write500(w)
+		return
+	}
+
+	resp := []userOrganizationResponse{}
+	for _, org := range organizations {
+		orgResp := userOrganizationResponse{
+			Id:          org.Organization.Id,
+			Name:        org.Organization.Name,
+			OwnerId:     org.Organization.OwnerId,
+			IsOwner:     org.IsOwner,
+			RequireMFA:  org.Organization.RequireMFA,
+			Groups:      []groupResponse{},
+			Permissions: []string{},
+		}
+		// Grants of permissions dropped from the registry are kept, but don't let anyone do anything
+		for _, permission := range org.Permissions {
+			if validPermissions[permission] {
+				orgResp.Permissions = append(orgResp.Permissions, permission)
+			}
+		}
+		for i := range org.Groups {
+			orgResp.Groups = append(orgResp.Groups, newGroupResponse(&org.Groups[i]))
+		}
+		resp = append(resp, orgResp)
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
@@ -0,0 +1,41 @@
+package api
+
+import "testing"
+
+func TestValidateGroupRequest(T *testing.T) {
+	name := "Editors"
+	long := "A group name far longer than allowed"
+	empty := ""
+	isPublic := true
+
+	if valid, _ := validateGroupRequest(&groupRequest{Name: &name}, false); !valid {
+		T.Error("expected a group with a name to be valid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{IsPublic: &isPublic}, false); valid {
+		T.Error("expected a group without a name to be invalid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{Name: &long}, false); valid {
+		T.Error("expected a name over 31 characters to be invalid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{Name: &name, Permissions: &[]string{"CREATE_VIDEO", ""}}, false); valid {
+		T.Error("expected an empty permission name to be invalid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{Name: &name, Permissions: &[]string{"LAUNCH_ROCKETS"}}, false); valid {
+		T.Error("expected a permission missing from the registry to be invalid")
+	}
+	for _, permission := range []string{"MANAGE_GROUPS", "MANAGE_ORG"} {
+		if valid, _ := validateGroupRequest(&groupRequest{Name: &name, IsPublic: &isPublic, Permissions: &[]string{permission}}, false); valid {
+			T.Errorf("expected a public group granting %s to be invalid", permission)
+		}
+	}
+
+	if valid, _ := validateGroupRequest(&groupRequest{IsPublic: &isPublic}, true); !valid {
+		T.Error("expected a change without a name to be valid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{}, true); valid {
+		T.Error("expected a change without any field to be invalid")
+	}
+	if valid, _ := validateGroupRequest(&groupRequest{Name: &empty}, true); valid {
+		T.Error("expected a change to an empty name to be invalid")
+	}
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/auth"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+type clientProviderTokenRequest struct {
+	Code        *string `json:"code,omitempty"`
+	RedirectURI *string `json:"redirect_uri,omitempty"`
+	IdToken     *string `json:"id_token,omitempty"`
+}
+
+type identityResponse struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     *string   `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// providerIdentity resolves the credentials in a request to the identity they belong to at the provider.
+// If the provider rejects them, an error response is written and ok is false.
+func providerIdentity(w http.ResponseWriter, provider auth.IdentityProvider, req *clientProviderTokenRequest) (identity *auth.Identity, ok bool) {
+	var token *auth.Token
+	var err error
+
+	if req.Code != nil {
+		if token, err = provider.Exchange(*req.Code, *req.RedirectURI); err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				"provider": provider.Name(),
+				"error":    err,
+			}).Error("Failing to convert code to token")
+			write400(w)
+			return nil, false
+		}
+	} else {
+		token = &auth.Token{IdToken: *req.IdToken}
+	}
+
+	identity, err = provider.Profile(token)
+	if err == auth.ErrUnsupportedCredentials {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "This provider does not accept an id_token",
+				Fields: []string{"id_token"},
+			},
+		})
+		return nil, false
+	} else if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			"provider": provider.Name(),
+			"error":    err,
+		}).Debug("Provider rejected credentials")
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Invalid provider credentials",
+				Fields: []string{"id_token", "code"},
+			},
+		})
+		return nil, false
+	}
+	return identity, true
+}
+
+// loginOrSignUpWithProvider is an http.HandlerFunc which logs in, or signs up, a user with an external identity
+// provider configured in auth.providers. The body holds either an authorization code and the redirect_uri it was
+// issued for, or, for OpenID Connect providers, an ID token obtained by the client directly.
+// It can return the following HTTP statuses:
+// 200 OK: The request was accepted and the body contains a signed JWT and a refresh token, or an mfa_pending token
+// if the user has a second factor
+// 400 Bad Request: The request was malformed, or the provider rejected the code
+// 401 Unauthenticated: The provider's credentials could not be verified
+// 404 Not Found: No provider is configured with the name
+// 409 Conflict: An account already has the email, and it can't be safely linked to the identity
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func loginOrSignUpWithProvider(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req clientProviderTokenRequest
+	var err error
+
+	provider, ok := auth.GetProvider(mux.Vars(r)["provider"])
+	if !ok {
+		write404(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode client provider token request in login or sign up with provider")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateProviderTokenRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	identity, ok := providerIdentity(w, provider, &req)
+	if !ok {
+		return
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"provider": provider.Name(),
+		"email":    identity.Email,
+		"id":       identity.Subject,
+	}).Debug("Provider identity response")
+
+	var user *db.UserModel
+	user, err = db.GetUserByExternalIdentity(provider.Name(), identity.Subject)
+	if err == pgx.ErrNoRows {
+		if identity.Email == "" {
+			// Without an email there is nothing to sign the user up with
+			write400(w)
+			return
+		}
+		if user, ok = signUpOrMergeWithProvider(w, provider, identity); !ok {
+			return
+		}
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user by external identity")
+		write500(w)
+		return
+	}
+
+	completeLogin(w, r, user.Id)
+}
+
+// signUpOrMergeWithProvider creates a user for an identity that isn't linked to anyone yet. If an account already
+// has the identity's email, the identity is linked to it instead, but only when both the provider and we have
+// verified the email. Otherwise whoever controls the provider account could take over the existing one.
+// If neither can be done, an error response is written and ok is false.
+func signUpOrMergeWithProvider(w http.ResponseWriter, provider auth.IdentityProvider, identity *auth.Identity) (user *db.UserModel, ok bool) {
+	existing, err := db.GetUserByEmail(identity.Email)
+	if err == pgx.ErrNoRows {
+		user, err = db.CreateUserByExternalIdentity(provider.Name(), identity.Subject, identity.Email, identity.EmailVerified)
+		log.Logger.WithField("user", user).Debug("Create user response")
+		if err != nil {
+			log.Logger.WithField("error", err).Error("Failing to make new user")
+			write400(w)
+			return nil, false
+		}
+		if !identity.EmailVerified {
+			go sendEmailVerification(user.Id, user.Email, false)
+		}
+		return user, true
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user by email")
+		write500(w)
+		return nil, false
+	}
+
+	if !identity.EmailVerified || existing.EmailVerifiedAt == nil {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "An account with this email already exists. Log in to it and link " + provider.Name() + " from there",
+				Fields: []string{"email"},
+			},
+		})
+		return nil, false
+	}
+
+	err = db.LinkExternalIdentity(provider.Name(), identity.Subject, existing.Id, identity.Email, true)
+	if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		// The account is already linked to another identity with this provider
+		write409(w, &[]errorStruct{
+			{
+				Error:  "The account with this email is linked to another " + provider.Name() + " identity",
+				Fields: []string{"email"},
+			},
+		})
+		return nil, false
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to link identity to existing user")
+		write500(w)
+		return nil, false
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"provider": provider.Name(),
+		"user":     existing.Id,
+	}).Info("Merged provider identity into existing user by verified email")
+	return existing, true
+}
+
+// listUserIdentities is an http.HandlerFunc which lists the external identities linked to the logged in user
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the linked identities
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 500 Server Error:
+func listUserIdentities(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	identities, err := db.ListExternalIdentitiesByUser(*principal.UserId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list external identities")
+		write500(w)
+		return
+	}
+
+	resp := []identityResponse{}
+	for _, identity := range *identities {
+		resp = append(resp, identityResponse{
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// linkUserIdentity is an http.HandlerFunc which links an identity at a provider to the logged in user.
+// The body holds the same credentials as logging in with the provider does.
+// It can return the following HTTP statuses:
+// 204 No Content: The identity was linked
+// 400 Bad Request: The request was malformed, or the provider rejected the code
+// 401 Unauthenticated: The request has no valid access token, or the provider's credentials could not be verified
+// 403 Forbidden: The user in the path isn't the logged in user
+// 404 Not Found: No provider is configured with the name
+// 409 Conflict: The identity is linked to someone, or the user already has an identity with the provider
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func linkUserIdentity(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req clientProviderTokenRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	provider, ok := auth.GetProvider(mux.Vars(r)["provider"])
+	if !ok {
+		write404(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode client provider token request in link user identity")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateProviderTokenRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	identity, ok := providerIdentity(w, provider, &req)
+	if !ok {
+		return
+	}
+
+	err = db.LinkExternalIdentity(provider.Name(), identity.Subject, *principal.UserId, identity.Email, identity.EmailVerified)
+	if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "This identity is linked to an account already, or the account has another " + provider.Name() + " identity",
+				Fields: []string{"provider"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to link external identity")
+		write500(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unlinkUserIdentity is an http.HandlerFunc which unlinks the logged in user's identity at a provider.
+// The last way a user can log in, be it a password or an identity, can't be removed.
+// It can return the following HTTP statuses:
+// 204 No Content: The identity was unlinked
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 404 Not Found: The user has no identity with the provider
+// 409 Conflict: The identity is the user's only login method
+// 500 Server Error:
+func unlinkUserIdentity(w http.ResponseWriter, r *http.Request) {
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	err := db.UnlinkUserIdentity(*principal.UserId, mux.Vars(r)["provider"])
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err == db.ErrLastLoginMethod {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "Set a password or link another provider before removing your only way to log in",
+				Fields: []string{"provider"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to unlink external identity")
+		write500(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,419 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/mg4tv/kubrik/mail"
+	"github.com/satori/go.uuid"
+)
+
+type invitationRequest struct {
+	Email    *string `json:"email,omitempty"`
+	Username *string `json:"username,omitempty"`
+	GroupId  *string `json:"group_id,omitempty"`
+}
+
+// invitationAnswerRequest picks the invitation to accept or decline: by the token from its email, or by its id
+// among the logged in user's invitations
+type invitationAnswerRequest struct {
+	Token *string `json:"token,omitempty"`
+	Id    *string `json:"id,omitempty"`
+}
+
+type invitationResponse struct {
+	Id               string               `json:"id"`
+	OrganizationId   string               `json:"organization_id"`
+	OrganizationName string               `json:"organization_name"`
+	GroupId          string               `json:"group_id"`
+	GroupName        string               `json:"group_name"`
+	Email            *string              `json:"email,omitempty"`
+	Invitee          *groupMemberResponse `json:"invitee,omitempty"`
+	InviterId        *string              `json:"inviter_id"`
+	CreatedAt        time.Time            `json:"created_at"`
+	ExpiresAt        time.Time            `json:"expires_at"`
+}
+
+func newInvitationResponse(inv *db.InvitationModel) invitationResponse {
+	resp := invitationResponse{
+		Id:               inv.Id,
+		OrganizationId:   inv.OrganizationId,
+		OrganizationName: inv.OrganizationName,
+		GroupId:          inv.GroupId,
+		GroupName:        inv.GroupName,
+		Email:            inv.Email,
+		InviterId:        inv.InviterId,
+		CreatedAt:        inv.CreatedAt,
+		ExpiresAt:        inv.ExpiresAt,
+	}
+	// Who an email belongs to is never revealed, so only invitations by username show the invitee
+	if inv.Email == nil && inv.InviteeId != nil {
+		resp.Invitee = &groupMemberResponse{
+			Id:       *inv.InviteeId,
+			Username: inv.InviteeUsername,
+		}
+	}
+	return resp
+}
+
+// sendInvitation emails the link to accept an invitation
+func sendInvitation(inv *db.InvitationModel, to, token, inviter string) {
+	ttl := conf.Config.GetDuration("kubrik.invitation_ttl")
+	err := mail.Send(&mail.Message{
+		To:      to,
+		Subject: "You're invited to join " + inv.OrganizationName,
+		Body: inviter + " invited you to join the " + inv.GroupName + " group of " + inv.OrganizationName + ". " +
+			"To accept, or to decline, follow this link:\n\n" +
+			appURL("/invitations", url.Values{"token": {token}}) + "\n\n" +
+			"If you don't have an account yet, you can create one from there. The invitation expires in " +
+			ttl.String() + ".\n",
+	})
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to send invitation email")
+	}
+}
+
+// createInvitation is an http.HandlerFunc which invites someone to one of an organization's groups, by email or
+// by the username of an existing user. The invitation is emailed to them with a link to accept it. Organizations
+// can only send so many invitations an hour (kubrik.invitation_max_per_hour).
+// It can return the following HTTP statuses:
+// 201 Created: The invitation was sent and the body contains it
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: No organization has the id
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards, no user has the username, or the
+// group isn't the organization's
+// 429 Too Many Requests: The organization sent too many invitations in the last hour, see Retry-After
+// 500 Server Error:
+func createInvitation(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req invitationRequest
+
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+	principal := CurrentPrincipal(r)
+
+	if err := decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateInvitationRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	inv := db.InvitationModel{
+		OrganizationId: organizationId,
+		GroupId:        *req.GroupId,
+		Email:          req.Email,
+		InviterId:      principal.UserId,
+		ExpiresAt:      time.Now().Add(conf.Config.GetDuration("kubrik.invitation_ttl")),
+	}
+	var to string
+	if req.Username != nil {
+		invitee, err := db.GetUserByUsername(*req.Username)
+		if err == pgx.ErrNoRows {
+			write422(w, &[]errorStruct{
+				{
+					Error:  "No user has this username",
+					Fields: []string{"username"},
+				},
+			})
+			return
+		} else if err != nil {
+			log.Logger.WithField("error", err).Error("Failing to get user to invite")
+			write500(w)
+			return
+		}
+		inv.InviteeId = &invitee.Id
+		to = invitee.Email
+	} else {
+		to = *req.Email
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to generate invitation token")
+		write500(w)
+		return
+	}
+	err = db.CreateInvitation(&inv, hashOpaqueToken(token), conf.Config.GetInt("kubrik.invitation_max_per_hour"))
+	if err == db.ErrTooManyInvitations {
+		log.Security("invitations_limited").WithField("organization", organizationId).Warn("Not sending more invitations")
+		write429(w, time.Hour, &[]errorStruct{
+			{
+				Error:  "The organization sent too many invitations recently. Try again later",
+				Fields: []string{},
+			},
+		})
+		return
+	} else if err == db.ErrUnknownGroup {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Group must be one of the organization's",
+				Fields: []string{"group_id"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to create invitation")
+		write500(w)
+		return
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        inv.GroupId,
+		"invitation":   inv.Id,
+	}).Info("Created invitation")
+
+	inviter := inv.OrganizationName
+	if user := CurrentUser(r); user != nil && user.Username != nil {
+		inviter = *user.Username
+	}
+	go sendInvitation(&inv, to, token, inviter)
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(newInvitationResponse(&inv))
+}
+
+// listOrganizationInvitations is an http.HandlerFunc which lists the invitations to an organization which can
+// still be accepted
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the invitations
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups
+// 404 Not Found: No organization has the id
+// 500 Server Error:
+func listOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	invitations, err := db.ListOrganizationInvitations(organizationId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list organization invitations")
+		write500(w)
+		return
+	}
+
+	resp := []invitationResponse{}
+	for i := range invitations {
+		resp = append(resp, newInvitationResponse(&invitations[i]))
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// revokeInvitation is an http.HandlerFunc which withdraws an invitation to an organization, so that it can't be
+// accepted anymore
+// It can return the following HTTP statuses:
+// 204 No Content: The invitation was revoked
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token or API token
+// 403 Forbidden: The caller may not manage the organization's groups, or is being impersonated
+// 404 Not Found: The organization has no such invitation which can still be accepted
+// 500 Server Error:
+func revokeInvitation(w http.ResponseWriter, r *http.Request) {
+	organizationId, ok := groupOrganization(w, r)
+	if !ok {
+		return
+	}
+	invitationId := mux.Vars(r)["invitationId"]
+	if _, err := uuid.FromString(invitationId); err != nil {
+		write404(w)
+		return
+	}
+
+	err := db.RevokeInvitation(organizationId, invitationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to revoke invitation")
+		write500(w)
+		return
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"invitation":   invitationId,
+	}).Info("Revoked invitation")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listUserInvitations is an http.HandlerFunc which lists the invitations the logged in user can accept by id.
+// Invitations to their email show up once they have verified it.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the invitations
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 500 Server Error:
+func listUserInvitations(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	invitations, err := db.ListUserInvitations(*principal.UserId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list user invitations")
+		write500(w)
+		return
+	}
+
+	resp := []invitationResponse{}
+	for i := range invitations {
+		resp = append(resp, newInvitationResponse(&invitations[i]))
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// answerInvitation decodes the invitation an accept or decline request is for. The token is hashed, and is nil
+// when the invitation is picked by id. It writes the response and returns false if the request is invalid.
+func answerInvitation(w http.ResponseWriter, r *http.Request) (tokenHash []byte, invitationId string, ok bool) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req invitationAnswerRequest
+	if err := decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode invitation answer")
+		write400(w)
+		return nil, "", false
+	}
+
+	if valid, eStructs := validateInvitationAnswerRequest(&req); !valid {
+		write422(w, eStructs)
+		return nil, "", false
+	}
+
+	if req.Token != nil && *req.Token != "" {
+		return hashOpaqueToken(*req.Token), "", true
+	}
+	return nil, *req.Id, true
+}
+
+// writeInvitationInvalid writes the 404 for an invitation which can't be answered
+func writeInvitationInvalid(w http.ResponseWriter) {
+	encoder := json.NewEncoder(w)
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusNotFound)
+	encoder.Encode(errorResponse{
+		HttpStatus: http.StatusNotFound,
+		Message:    "Resource not found",
+		Errors: &[]errorStruct{
+			{
+				Error:  "This invitation is invalid, has expired or was already answered",
+				Fields: []string{"token", "id"},
+			},
+		},
+	})
+}
+
+// acceptInvitation is an http.HandlerFunc which puts the logged in user in the group they were invited to
+// It can return the following HTTP statuses:
+// 200 OK: The user joined the group and the body contains the invitation
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user is being impersonated
+// 404 Not Found: There is no such invitation the user can accept
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+
+	tokenHash, invitationId, ok := answerInvitation(w, r)
+	if !ok {
+		return
+	}
+
+	inv, err := db.AcceptInvitation(tokenHash, invitationId, *principal.UserId)
+	if err == db.ErrInvitationInvalid {
+		writeInvitationInvalid(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to accept invitation")
+		write500(w)
+		return
+	}
+	userPermissions.invalidateUser(*principal.UserId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": inv.OrganizationId,
+		"group":        inv.GroupId,
+		"invitation":   inv.Id,
+		"user":         *principal.UserId,
+	}).Info("Accepted invitation")
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(newInvitationResponse(inv))
+}
+
+// declineInvitation is an http.HandlerFunc which turns down an invitation. Anyone with the token from the email can
+// decline it, account or not. Declining by id needs the invited user to be logged in.
+// It can return the following HTTP statuses:
+// 204 No Content: The invitation was declined
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The invitation was picked by id without an access token, or the access token is invalid
+// 403 Forbidden: The logged in user is being impersonated
+// 404 Not Found: There is no such invitation which can still be answered
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func declineInvitation(w http.ResponseWriter, r *http.Request) {
+	tokenHash, invitationId, ok := answerInvitation(w, r)
+	if !ok {
+		return
+	}
+
+	var userId string
+	if principal := CurrentPrincipal(r); principal != nil && principal.UserId != nil && !principal.IsAPIToken() {
+		userId = *principal.UserId
+	} else if tokenHash == nil {
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Log in to decline an invitation by id, or use the token from its email",
+				Fields: []string{"header: authorization"},
+			},
+		})
+		return
+	}
+
+	err := db.DeclineInvitation(tokenHash, invitationId, userId)
+	if err == db.ErrInvitationInvalid {
+		writeInvitationInvalid(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to decline invitation")
+		write500(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/mail"
+	"github.com/satori/go.uuid"
+)
+
+func TestNewInvitationResponseHidesEmailInvitees(T *testing.T) {
+	email := "someone@example.com"
+	inviteeId := "00000000-0000-4000-8000-000000000001"
+	username := "someone"
+
+	resp := newInvitationResponse(&db.InvitationModel{Email: &email, InviteeId: &inviteeId, InviteeUsername: &username})
+	if resp.Invitee != nil {
+		T.Errorf("expected the invitee of an email invitation to be hidden, got %+v", resp.Invitee)
+	}
+
+	resp = newInvitationResponse(&db.InvitationModel{InviteeId: &inviteeId, InviteeUsername: &username})
+	if resp.Invitee == nil || resp.Invitee.Id != inviteeId {
+		T.Errorf("expected the invitee of an invitation by username, got %+v", resp.Invitee)
+	}
+}
+
+func TestCreateInvitationRejections(T *testing.T) {
+	const template = "/organizations/{orgId}/invitations"
+	orgId := "00000000-0000-4000-8000-000000000001"
+	otherId := "00000000-0000-4000-8000-000000000002"
+	tokenId := "00000000-0000-4000-8000-000000000003"
+	groupId := "00000000-0000-4000-8000-000000000004"
+	caller := &Principal{OrganizationId: &orgId, TokenId: &tokenId, Scopes: []string{scopeOrgsWrite}}
+	readOnly := &Principal{OrganizationId: &orgId, TokenId: &tokenId, Scopes: []string{scopeOrgsRead}}
+
+	for _, c := range []struct {
+		name       string
+		principal  *Principal
+		path       string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{"another organization", caller, "/organizations/" + otherId + "/invitations",
+			`{"email": "a@example.com", "group_id": "` + groupId + `"}`, http.StatusForbidden, nil},
+		{"no orgs:write", readOnly, "/organizations/" + orgId + "/invitations",
+			`{"email": "a@example.com", "group_id": "` + groupId + `"}`, http.StatusForbidden, nil},
+		{"malformed organization id", caller, "/organizations/acme/invitations",
+			`{"email": "a@example.com", "group_id": "` + groupId + `"}`, http.StatusBadRequest, nil},
+		{"malformed JSON", caller, "/organizations/" + orgId + "/invitations", `{"email": `, http.StatusBadRequest, nil},
+		{"email and username", caller, "/organizations/" + orgId + "/invitations",
+			`{"email": "a@example.com", "username": "a", "group_id": "` + groupId + `"}`,
+			http.StatusUnprocessableEntity, []string{"email", "username"}},
+		{"invalid email", caller, "/organizations/" + orgId + "/invitations",
+			`{"email": "A <a@example.com>", "group_id": "` + groupId + `"}`, http.StatusUnprocessableEntity, []string{"email"}},
+		{"no group", caller, "/organizations/" + orgId + "/invitations",
+			`{"email": "a@example.com"}`, http.StatusUnprocessableEntity, []string{"group_id"}},
+	} {
+		w := serveAs(c.principal, createInvitation, "POST", template, c.path, c.body)
+		if w.Code != c.wantStatus {
+			T.Errorf("%s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+			continue
+		}
+		if c.wantFields == nil {
+			continue
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Errors == nil || len(*resp.Errors) != 1 {
+			T.Errorf("%s: expected one error, got %s", c.name, w.Body.String())
+			continue
+		}
+		if fields := (*resp.Errors)[0].Fields; strings.Join(fields, ",") != strings.Join(c.wantFields, ",") {
+			T.Errorf("%s: expected an error for %v, got %v", c.name, c.wantFields, fields)
+		}
+	}
+}
+
+// waitForMail returns the messages sent to an address once there are any, as invitations are sent apart from the
+// request
+func waitForMail(outbox *mail.Outbox, to string) []mail.Message {
+	for i := 0; i < 50; i++ {
+		if msgs := outbox.To(to); len(msgs) > 0 {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestInvitationByEmailAcceptedAtSignup(T *testing.T) {
+	requireDatabase(T)
+
+	outbox := mail.NewOutbox()
+	mail.SetMailer(outbox)
+	defer mail.Load(conf.Config)
+
+	suffix := uuid.NewV4().String()[:8]
+	ownerName := "invitation-owner-" + suffix
+	owner, err := db.CreateUser(&ownerName, ownerName+"@example.com", []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(owner.Id)
+	org, err := db.CreateOrganization("invitation-test-"+suffix, owner.Id, false,
+		[]db.GroupTemplateModel{{Name: "Members"}})
+	if err != nil {
+		T.Fatal(err)
+	}
+	org, err = db.GetOrganizationById(org.Id)
+	if err != nil || len(org.Groups) != 1 {
+		T.Fatalf("expected the organization's group, got %v", err)
+	}
+	tokenId := uuid.NewV4().String()
+	caller := &Principal{OrganizationId: &org.Id, TokenId: &tokenId, Scopes: []string{scopeOrgsWrite}}
+
+	// Someone already has the email, which the response mustn't give away
+	inviteeName := "invitee-" + suffix
+	email := inviteeName + "@example.com"
+	existing, err := db.CreateUser(&inviteeName, email, []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(existing.Id)
+
+	w := serveAs(caller, createInvitation, "POST", "/organizations/{orgId}/invitations",
+		"/organizations/"+org.Id+"/invitations", `{"email": "`+email+`", "group_id": "`+org.Groups[0].Id+`"}`)
+	if w.Code != http.StatusCreated {
+		T.Fatalf("expected status %d inviting by email, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), existing.Id) || strings.Contains(w.Body.String(), inviteeName+`"`) {
+		T.Errorf("expected the invitation not to reveal who has the email, got %s", w.Body.String())
+	}
+	var created invitationResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		T.Fatal(err)
+	}
+	if created.Invitee != nil || created.Email == nil || *created.Email != email {
+		T.Errorf("expected an invitation to %s without an invitee, got %+v", email, created)
+	}
+
+	msgs := waitForMail(outbox, email)
+	if len(msgs) != 1 {
+		T.Fatalf("expected one invitation email, got %d", len(msgs))
+	}
+	start := strings.Index(msgs[0].Body, "http")
+	link, err := url.Parse(strings.Fields(msgs[0].Body[start:])[0])
+	if err != nil || link.Query().Get("token") == "" {
+		T.Fatalf("expected a link with a token in the invitation, got %s", msgs[0].Body)
+	}
+	token := link.Query().Get("token")
+
+	// The invitation can be accepted by signing up with it, which verifies the email it was sent to
+	db.DeleteUser(existing.Id)
+	password := "correct horse battery staple " + suffix
+	body := `{"username": "` + inviteeName + `", "email": "` + email + `", "password": "` + password +
+		`", "password_confirmation": "` + password + `", "invitation_token": "` + token + `"}`
+	w = serveAs(nil, createUser, "POST", "/users", "/users", body)
+	if w.Code != http.StatusOK {
+		T.Fatalf("expected status %d signing up, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var signedUp userResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &signedUp); err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(signedUp.Id)
+
+	permissions, err := db.GetUserPermissions(signedUp.Id, org.Id)
+	if err != nil || !permissions.IsMember {
+		T.Errorf("expected the new user to be in the group they were invited to, got %+v, %v", permissions, err)
+	}
+	user, err := db.GetUserById(signedUp.Id)
+	if err != nil || user.EmailVerifiedAt == nil {
+		T.Errorf("expected accepting the invitation to verify the email, got %+v, %v", user, err)
+	}
+
+	// It can't be used again
+	w = serveAs(nil, createUser, "POST", "/users", "/users", strings.Replace(body, inviteeName, inviteeName+"-2", -1))
+	if w.Code != http.StatusUnprocessableEntity {
+		T.Errorf("expected status %d signing up with a used invitation, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
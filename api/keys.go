@@ -0,0 +1,305 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mg4tv/kubrik/conf"
+)
+
+// keyConfig is a single entry of kubrik.keys.
+// Either the private key (to sign and verify) or only the public key (to verify) may be given, inline or as a file.
+type keyConfig struct {
+	Kid            string `mapstructure:"kid"`
+	Alg            string `mapstructure:"alg"`
+	PrivateKey     string `mapstructure:"private_key"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	PublicKey      string `mapstructure:"public_key"`
+	PublicKeyFile  string `mapstructure:"public_key_file"`
+	RetiredAt      string `mapstructure:"retired_at"`
+}
+
+type signingKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+	retiredAt  *time.Time
+}
+
+// keySet holds every key tokens may be signed or verified with.
+// When kubrik.keys is empty, tokens are signed with HS512 using kubrik.secret and no JWKS is published.
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+var signingKeys *keySet
+var signingKeysErr error
+var signingKeysOnce sync.Once
+
+// LoadSigningKeys reads kubrik.keys and returns any error in the configuration.
+// The keys are loaded once, so this should be called at startup to fail early on a bad key.
+func LoadSigningKeys() error {
+	signingKeysOnce.Do(func() {
+		signingKeys, signingKeysErr = loadKeySet()
+	})
+	return signingKeysErr
+}
+
+func loadKeySet() (*keySet, error) {
+	var configs []keyConfig
+	if err := conf.Config.UnmarshalKey("kubrik.keys", &configs); err != nil {
+		return nil, err
+	}
+
+	set := keySet{keys: map[string]*signingKey{}}
+	if len(configs) == 0 {
+		// TODO: check to make sure this config value exists... somehow
+		set.active = &signingKey{
+			method:     jwt.SigningMethodHS512,
+			privateKey: []byte(conf.Config.GetString("kubrik.secret")),
+			publicKey:  []byte(conf.Config.GetString("kubrik.secret")),
+		}
+		return &set, nil
+	}
+
+	for _, c := range configs {
+		key, err := parseKeyConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := set.keys[key.kid]; exists {
+			return nil, fmt.Errorf("Duplicate signing key id %q", key.kid)
+		}
+		set.keys[key.kid] = key
+	}
+
+	activeKid := conf.Config.GetString("kubrik.signing_key")
+	for _, c := range configs {
+		key := set.keys[c.Kid]
+		if (activeKid == "" || activeKid == key.kid) && key.retiredAt == nil && key.privateKey != nil {
+			set.active = key
+			break
+		}
+	}
+	if set.active == nil {
+		return nil, errors.New("No usable signing key in kubrik.keys. The active key must have a private key and not be retired")
+	}
+	return &set, nil
+}
+
+func parseKeyConfig(c keyConfig) (*signingKey, error) {
+	if c.Kid == "" {
+		return nil, errors.New("Every key in kubrik.keys must have a kid")
+	}
+
+	key := signingKey{kid: c.Kid}
+	switch c.Alg {
+	case "RS256", "RS384", "RS512", "ES256", "ES384", "ES512":
+		key.method = jwt.GetSigningMethod(c.Alg)
+	default:
+		return nil, fmt.Errorf("Key %q has unsupported alg %q", c.Kid, c.Alg)
+	}
+	isRSA := c.Alg[:2] == "RS"
+
+	if c.RetiredAt != "" {
+		retiredAt, err := time.Parse(time.RFC3339, c.RetiredAt)
+		if err != nil {
+			return nil, fmt.Errorf("Key %q has an invalid retired_at: %s", c.Kid, err)
+		}
+		key.retiredAt = &retiredAt
+	}
+
+	privatePEM, err := readKeyMaterial(c.PrivateKey, c.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Key %q: %s", c.Kid, err)
+	}
+	publicPEM, err := readKeyMaterial(c.PublicKey, c.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Key %q: %s", c.Kid, err)
+	}
+
+	switch {
+	case privatePEM != nil && isRSA:
+		var private *rsa.PrivateKey
+		if private, err = jwt.ParseRSAPrivateKeyFromPEM(privatePEM); err == nil {
+			key.privateKey, key.publicKey = private, &private.PublicKey
+		}
+	case privatePEM != nil:
+		var private *ecdsa.PrivateKey
+		if private, err = jwt.ParseECPrivateKeyFromPEM(privatePEM); err == nil {
+			key.privateKey, key.publicKey = private, &private.PublicKey
+		}
+	case publicPEM != nil && isRSA:
+		key.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	case publicPEM != nil:
+		key.publicKey, err = jwt.ParseECPublicKeyFromPEM(publicPEM)
+	default:
+		err = errors.New("no private_key or public_key given")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Key %q: %s", c.Kid, err)
+	}
+
+	if ecKey, ok := key.publicKey.(*ecdsa.PublicKey); ok {
+		if ecKey.Curve.Params().BitSize != key.method.(*jwt.SigningMethodECDSA).CurveBits {
+			return nil, fmt.Errorf("Key %q: curve does not match alg %s", c.Kid, c.Alg)
+		}
+	}
+	return &key, nil
+}
+
+func readKeyMaterial(inline, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// acceptsTokens reports whether tokens signed with the key may still be verified
+func (k *signingKey) acceptsTokens(now time.Time) bool {
+	if k.retiredAt == nil {
+		return true
+	}
+	return now.Before(k.retiredAt.Add(conf.Config.GetDuration("kubrik.key_grace_period")))
+}
+
+// signToken signs claims with the active key, setting the kid header when the key set is asymmetric
+func signToken(claims jwt.Claims) (string, error) {
+	if err := LoadSigningKeys(); err != nil {
+		return "", err
+	}
+	key := signingKeys.active
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.kid != "" {
+		token.Header["kid"] = key.kid
+	}
+	return token.SignedString(key.privateKey)
+}
+
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if err := LoadSigningKeys(); err != nil {
+		return nil, err
+	}
+
+	// Without kubrik.keys, only the shared secret is accepted
+	if len(signingKeys.keys) == 0 {
+		if token.Method != jwt.SigningMethodHS512 {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return signingKeys.active.publicKey, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := signingKeys.keys[kid]
+	if !ok {
+		return nil, errors.New("Unknown signing key")
+	}
+	// The algorithm must come from our configuration rather than the token, or a public key could be used as an
+	// HMAC secret
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("Unexpected signing method")
+	}
+	if !key.acceptsTokens(time.Now()) {
+		return nil, errors.New("Signing key has been retired")
+	}
+	return key.publicKey, nil
+}
+
+// jsonWebKeys returns the public half of every key which may still verify tokens
+func (s *keySet) jsonWebKeys(now time.Time) []jsonWebKey {
+	kids := []string{}
+	for kid := range s.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := []jsonWebKey{}
+	for _, kid := range kids {
+		key := s.keys[kid]
+		if !key.acceptsTokens(now) {
+			continue
+		}
+		jwk := jsonWebKey{
+			Kid: key.kid,
+			Use: "sig",
+			Alg: key.method.Alg(),
+		}
+		switch public := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(public.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(public.Y.Bytes(), size))
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// padBytes left pads b with zeros to size bytes, as JWK coordinates must be of fixed length
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// showJWKS is an http.HandlerFunc which publishes the public keys tokens are signed with, so that other services
+// can verify tokens without holding any secret.
+// It can return the following HTTP statuses:
+// 200 OK: The body is a JWK Set. It is empty when tokens are signed with a shared secret
+// 500 Server Error:
+func showJWKS(w http.ResponseWriter, _ *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	if err := LoadSigningKeys(); err != nil {
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&jsonWebKeySet{
+		Keys: signingKeys.jsonWebKeys(time.Now()),
+	})
+}
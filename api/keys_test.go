@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mg4tv/kubrik/conf"
+)
+
+func rsaPEM(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func ecPEM(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+}
+
+// useConfiguredKeys replaces the loaded key set with one read from the current configuration.
+// It returns a function restoring the previous key set.
+func useConfiguredKeys(t *testing.T) func() {
+	LoadSigningKeys()
+	previous := signingKeys
+	keys, err := loadKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKeys = keys
+	return func() { signingKeys = previous }
+}
+
+func TestKeyRotation(T *testing.T) {
+	retiredAt := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	conf.Config.Set("kubrik.keys", []interface{}{
+		map[string]interface{}{"kid": "current", "alg": "ES256", "private_key": ecPEM(T)},
+		map[string]interface{}{"kid": "previous", "alg": "RS256", "private_key": rsaPEM(T), "retired_at": retiredAt},
+	})
+	defer conf.Config.Set("kubrik.keys", nil)
+
+	defer useConfiguredKeys(T)()
+
+	if signingKeys.active.kid != "current" {
+		T.Fatalf("expected the unretired key to sign, got %q", signingKeys.active.kid)
+	}
+
+	tokenString, err := signToken(&jwt.StandardClaims{Subject: "x"})
+	if err != nil {
+		T.Fatal(err)
+	}
+	token, err := jwt.Parse(tokenString, jwtKeyFunc)
+	if err != nil || !token.Valid || token.Header["kid"] != "current" {
+		T.Fatalf("expected token signed by current key to verify: %v", err)
+	}
+
+	// Tokens signed by the retired key are accepted within the grace period only
+	previous := jwt.NewWithClaims(jwt.SigningMethodRS256, &jwt.StandardClaims{Subject: "x"})
+	previous.Header["kid"] = "previous"
+	previousString, _ := previous.SignedString(signingKeys.keys["previous"].privateKey)
+
+	conf.Config.Set("kubrik.key_grace_period", "2h")
+	if _, err = jwt.Parse(previousString, jwtKeyFunc); err != nil {
+		T.Fatalf("expected retired key to verify within grace period: %v", err)
+	}
+	if len(signingKeys.jsonWebKeys(time.Now())) != 2 {
+		T.Fatal("expected both keys to be published within grace period")
+	}
+
+	conf.Config.Set("kubrik.key_grace_period", "30m")
+	defer conf.Config.Set("kubrik.key_grace_period", "24h")
+	if _, err = jwt.Parse(previousString, jwtKeyFunc); err == nil {
+		T.Fatal("expected retired key to be rejected after grace period")
+	}
+	jwks := signingKeys.jsonWebKeys(time.Now())
+	if len(jwks) != 1 || jwks[0].Kty != "EC" || jwks[0].Crv != "P-256" || len(jwks[0].X) != 43 {
+		T.Fatalf("unexpected JWKS %+v", jwks)
+	}
+}
+
+func TestKeyAlgorithmConfusion(T *testing.T) {
+	conf.Config.Set("kubrik.keys", []interface{}{
+		map[string]interface{}{"kid": "rsa", "alg": "RS256", "private_key": rsaPEM(T)},
+	})
+	defer conf.Config.Set("kubrik.keys", nil)
+
+	defer useConfiguredKeys(T)()
+
+	// An attacker who knows the public key must not be able to use it as an HMAC secret
+	public, _ := x509.MarshalPKIXPublicKey(signingKeys.keys["rsa"].publicKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "x"})
+	forged.Header["kid"] = "rsa"
+	forgedString, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+	if _, err := jwt.Parse(forgedString, jwtKeyFunc); err == nil {
+		T.Fatal("expected HMAC token to be rejected for an RSA key")
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/mg4tv/kubrik/mail"
+)
+
+type magicLinkRequest struct {
+	Email *string `json:"email,omitempty"`
+}
+
+type magicLinkTokenRequest struct {
+	Token *string `json:"token,omitempty"`
+}
+
+// sendMagicLink emails a login link to the user with the email, if there is one.
+// It runs apart from the request so that whether an account exists can't be told from the response time.
+func sendMagicLink(email string) {
+	user, err := db.GetUserByEmail(email)
+	if err == pgx.ErrNoRows {
+		log.Logger.WithField("email", email).Debug("Magic link requested for unknown email")
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user by email for magic link")
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to generate magic link token")
+		return
+	}
+	ttl := conf.Config.GetDuration("kubrik.magic_link_ttl")
+	err = db.CreateMagicLinkToken(user.Id, hashOpaqueToken(token), time.Now().Add(ttl),
+		conf.Config.GetInt("kubrik.magic_link_max_active"))
+	if err == db.ErrTooManyMagicLinks {
+		// Whoever keeps asking can't flood the user's inbox, and the user still has a working link
+		log.Security("magic_link_limited").WithField("user", user.Id).Warn("Not sending more magic links")
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store magic link token")
+		return
+	}
+
+	err = mail.Send(&mail.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: "Someone asked to log in to your account without a password. If it was you, log in here:\n\n" +
+			appURL("/magic-link", url.Values{"token": {token}}) + "\n\n" +
+			"The link works once and expires in " + ttl.String() + ". " +
+			"If you didn't ask for this, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to send magic link email")
+	}
+}
+
+// requestMagicLink is an http.HandlerFunc which emails a single use login link to the user with an email.
+// Like login, it doesn't tell whether anyone has the email: the response is the same either way.
+// It can return the following HTTP statuses:
+// 202 Accepted: A login link will be sent if a user has the email
+// 400 Bad Request: The request was malformed
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+func requestMagicLink(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req magicLinkRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode magic link request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateMagicLinkRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	go sendMagicLink(*req.Email)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// loginWithMagicLink is an http.HandlerFunc which exchanges the token from a magic link email for an access token.
+// Users with a second factor still have to provide it, exactly as after a password login.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains a signed JWT and a refresh token, or an mfa_pending token if the user has a second factor
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The token doesn't exist, has expired or was already used
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func loginWithMagicLink(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req magicLinkTokenRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode magic link login request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateMagicLinkTokenRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	userId, err := db.UseMagicLinkToken(hashOpaqueToken(*req.Token))
+	if err == db.ErrMagicLinkTokenInvalid {
+		write401(w, &[]errorStruct{
+			{
+				Error:  "This login link is invalid or has expired",
+				Fields: []string{"token"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to use magic link token")
+		write500(w)
+		return
+	}
+
+	completeLogin(w, r, userId)
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/auth"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets when they enable a second factor
+const recoveryCodeCount = 10
+
+// errSecondFactorInvalid is returned when a TOTP or recovery code doesn't match, or was already used
+var errSecondFactorInvalid = errors.New("Second factor is invalid")
+
+type mfaPendingResponse struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type mfaRequest struct {
+	MfaToken     *string `json:"mfa_token,omitempty"`
+	Code         *string `json:"code,omitempty"`
+	RecoveryCode *string `json:"recovery_code,omitempty"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// mfaPendingAudience is the audience of tokens proving a user got past their first factor. It differs from the
+// access token audience so that one can never be used as the other.
+func mfaPendingAudience() string {
+	return conf.Config.GetString("kubrik.audience") + ":mfa_pending"
+}
+
+// completeLogin is called once a user has proven their first factor, by whatever means. Users with a second factor
+// get a short lived mfa_pending token to exchange at /auth/mfa, everyone else gets their tokens right away.
+func completeLogin(w http.ResponseWriter, r *http.Request, userId string) {
+	enabled, err := db.UserHasMFA(userId)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to check if user has MFA")
+		write500(w)
+		return
+	}
+	if !enabled {
+		writeTokens(w, r, userId, false)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	now := time.Now()
+	ttl := conf.Config.GetDuration("kubrik.mfa_pending_ttl")
+	tokenString, err := signToken(&jwtClaims{
+		UserId: &userId,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  mfaPendingAudience(),
+			ExpiresAt: now.Add(ttl).Unix(),
+			Id:        uuid.NewV4().String(),
+			IssuedAt:  now.Unix(),
+			Issuer:    conf.Config.GetString("kubrik.issuer"),
+		},
+	})
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&mfaPendingResponse{
+		MfaRequired: true,
+		MfaToken:    tokenString,
+		TokenType:   "mfa_pending",
+		ExpiresIn:   int64(ttl / time.Second),
+	})
+}
+
+// parseMFAPendingToken validates a token issued by completeLogin and returns its claims
+func parseMFAPendingToken(token string) (*jwtClaims, error) {
+	jwtT, err := jwt.ParseWithClaims(token, &jwtClaims{}, jwtKeyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := jwtT.Claims.(*jwtClaims)
+	if !ok || !jwtT.Valid {
+		return nil, errors.New("Invalid JWT")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("Token is expired or has no expiry")
+	}
+	if !claims.VerifyIssuer(conf.Config.GetString("kubrik.issuer"), true) {
+		return nil, errors.New("Token has an unexpected issuer")
+	}
+	if !claims.VerifyAudience(mfaPendingAudience(), true) {
+		return nil, errors.New("Token has an unexpected audience")
+	}
+	if claims.UserId == nil {
+		return nil, errors.New("Unspecified user id in claims")
+	}
+	return claims, nil
+}
+
+// newRecoveryCodes generates a set of recovery codes and their hashes. The codes are shown to the user once and
+// only the hashes are stored.
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring the case and dashes users may or may not type
+func hashRecoveryCode(code string) []byte {
+	return hashOpaqueToken(strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1)))
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code for a user, spending whichever is used
+func verifySecondFactor(userId string, code, recoveryCode *string) error {
+	if code != nil {
+		totp, err := db.GetTOTP(userId)
+		if err == pgx.ErrNoRows {
+			return errSecondFactorInvalid
+		} else if err != nil {
+			return err
+		}
+		step, ok := auth.ValidateTOTP(totp.Secret, *code, time.Now())
+		if !ok || totp.ConfirmedAt == nil {
+			return errSecondFactorInvalid
+		}
+		if err = db.UseTOTPStep(userId, step); err == db.ErrTOTPCodeReused {
+			return errSecondFactorInvalid
+		}
+		return err
+	}
+
+	err := db.UseRecoveryCode(userId, hashRecoveryCode(*recoveryCode))
+	if err == pgx.ErrNoRows {
+		return errSecondFactorInvalid
+	}
+	return err
+}
+
+// completeMFALogin is an http.HandlerFunc which exchanges an mfa_pending token and a second factor for tokens
+// It can return the following HTTP statuses:
+// 200 OK: The request was accepted and the body contains a signed JWT and a refresh token
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The mfa_pending token is invalid or expired, or the code doesn't match
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 429 Too Many Requests: Too many codes failed for the account or from the client, see Retry-After
+// 500 Server Error:
+func completeMFALogin(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req mfaRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode MFA request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateMFARequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	claims, err := parseMFAPendingToken(*req.MfaToken)
+	if err != nil {
+		log.Logger.WithField("error", err).Debug("Rejected mfa_pending token")
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Log in again, this login has expired",
+				Fields: []string{"mfa_token"},
+			},
+		})
+		return
+	}
+
+	// Codes are short enough to guess, so attempts count against the account like passwords do
+	accountKey := "mfa:" + *claims.UserId
+	if !throttle(w, r, "mfa", accountKey) {
+		return
+	}
+
+	if err = verifySecondFactor(*claims.UserId, req.Code, req.RecoveryCode); err == errSecondFactorInvalid {
+		recordFailure(r, "mfa", accountKey)
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Invalid code",
+				Fields: []string{"code", "recovery_code"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to verify second factor")
+		write500(w)
+		return
+	}
+	recordSuccess(accountKey)
+
+	writeTokens(w, r, *claims.UserId, true)
+}
+
+// enrollTOTP is an http.HandlerFunc which starts setting up an authenticator app for the logged in user.
+// The authenticator isn't used until a code from it is confirmed.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the secret and an otpauth URI to show as a QR code
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 409 Conflict: The user already has an authenticator
+// 500 Server Error:
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	user := CurrentUser(r)
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		write500(w)
+		return
+	}
+	if err = db.CreatePendingTOTP(user.Id, secret); err == db.ErrTOTPAlreadyEnabled {
+		write409(w, &[]errorStruct{
+			{
+				Error:  "Two-factor authentication is already enabled",
+				Fields: []string{"totp"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store pending TOTP")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&totpEnrollResponse{
+		Secret: auth.EncodeTOTPSecret(secret),
+		URI:    auth.TOTPURI(conf.Config.GetString("kubrik.issuer"), user.Email, secret),
+	})
+}
+
+// confirmTOTP is an http.HandlerFunc which enables the logged in user's pending authenticator once it produces a
+// valid code, and issues their recovery codes
+// It can return the following HTTP statuses:
+// 200 OK: The authenticator is enabled and the body contains the recovery codes, which are never shown again
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The user in the path isn't the logged in user
+// 404 Not Found: The user has no pending authenticator
+// 422 Unprocessable Entity: The code is missing or doesn't match
+// 500 Server Error:
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req mfaRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode TOTP confirmation request")
+		write400(w)
+		return
+	}
+
+	totp, err := db.GetTOTP(*principal.UserId)
+	if err == pgx.ErrNoRows || (err == nil && totp.ConfirmedAt != nil) {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get pending TOTP")
+		write500(w)
+		return
+	}
+
+	var step int64
+	var ok bool
+	if req.Code != nil {
+		step, ok = auth.ValidateTOTP(totp.Secret, *req.Code, time.Now())
+	}
+	if req.Code == nil || !ok {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Enter a current code from your authenticator app",
+				Fields: []string{"code"},
+			},
+		})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		write500(w)
+		return
+	}
+	if err = db.ConfirmTOTP(*principal.UserId, step, hashes); err == pgx.ErrNoRows {
+		// Confirmed concurrently, or with this very code
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to confirm TOTP")
+		write500(w)
+		return
+	}
+	log.Logger.WithField("user", *principal.UserId).Info("Two-factor authentication enabled")
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// disableTOTP is an http.HandlerFunc which turns off the logged in user's second factor. A current code or a
+// recovery code is required, so that a stolen access token can't remove it without also guessing one. Failed codes
+// count against the same limits as MFA logins, which keeps guessing slow.
+// It can return the following HTTP statuses:
+// 204 No Content: The second factor was removed
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request has no valid access token, or the code doesn't match
+// 403 Forbidden: The user in the path isn't the logged in user
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 429 Too Many Requests: Too many codes failed for the account or from the client, see Retry-After
+// 500 Server Error:
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req mfaRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode TOTP disable request")
+		write400(w)
+		return
+	}
+
+	if req.Code == nil && req.RecoveryCode == nil {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Request must have a code or a recovery code",
+				Fields: []string{"code", "recovery_code"},
+			},
+		})
+		return
+	}
+
+	accountKey := "mfa:" + *principal.UserId
+	if !throttle(w, r, "mfa", accountKey) {
+		return
+	}
+
+	if err = verifySecondFactor(*principal.UserId, req.Code, req.RecoveryCode); err == errSecondFactorInvalid {
+		recordFailure(r, "mfa", accountKey)
+		write401(w, &[]errorStruct{
+			{
+				Error:  "Invalid code",
+				Fields: []string{"code", "recovery_code"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to verify second factor")
+		write500(w)
+		return
+	}
+	recordSuccess(accountKey)
+
+	if err = db.DeleteTOTP(*principal.UserId); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to disable TOTP")
+		write500(w)
+		return
+	}
+	log.Logger.WithField("user", *principal.UserId).Info("Two-factor authentication disabled")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mg4tv/kubrik/auth"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/satori/go.uuid"
+)
+
+// postMFA exchanges an mfa_pending token and a second factor the way a client finishing a login would
+func postMFA(mfaToken string, code, recoveryCode *string) int {
+	body, _ := json.Marshal(&mfaRequest{MfaToken: &mfaToken, Code: code, RecoveryCode: recoveryCode})
+	w := httptest.NewRecorder()
+	completeMFALogin(w, httptest.NewRequest("POST", "/auth/mfa", strings.NewReader(string(body))))
+	return w.Code
+}
+
+func TestCompleteMFALoginRejectsTokens(T *testing.T) {
+	userId := "00000000-0000-4000-8000-000000000001"
+	code := "123456"
+	now := time.Now()
+	token := func(audience string, expiresAt time.Time) string {
+		tokenString, err := signToken(&jwtClaims{
+			UserId: &userId,
+			StandardClaims: jwt.StandardClaims{
+				Audience:  audience,
+				ExpiresAt: expiresAt.Unix(),
+				Id:        uuid.NewV4().String(),
+				IssuedAt:  now.Unix(),
+				Issuer:    conf.Config.GetString("kubrik.issuer"),
+			},
+		})
+		if err != nil {
+			T.Fatal(err)
+		}
+		return tokenString
+	}
+
+	for _, c := range []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "not a token"},
+		{"expired", token(mfaPendingAudience(), now.Add(-time.Minute))},
+		{"access token", token(conf.Config.GetString("kubrik.audience"), now.Add(time.Minute))},
+	} {
+		if status := postMFA(c.token, &code, nil); status != http.StatusUnauthorized {
+			T.Errorf("%s: expected status %d, got %d", c.name, http.StatusUnauthorized, status)
+		}
+	}
+}
+
+func TestSecondFactorHandlers(T *testing.T) {
+	requireDatabase(T)
+
+	username := "mfa-test-" + uuid.NewV4().String()[:8]
+	user, err := db.CreateUser(&username, username+"@example.com", []byte("not a hash"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer db.DeleteUser(user.Id)
+	principal := &Principal{UserId: &user.Id, SessionId: "session"}
+	path := "/users/" + user.Id + "/mfa/totp"
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		T.Fatal(err)
+	}
+	if err = db.CreatePendingTOTP(user.Id, secret); err != nil {
+		T.Fatal(err)
+	}
+	code := auth.TOTPCode(secret, time.Now())
+
+	w := serveAs(principal, confirmTOTP, "POST", "/users/{id}/mfa/totp/confirm", path+"/confirm", `{"code": "`+code+`"}`)
+	if w.Code != http.StatusOK {
+		T.Fatalf("expected status %d confirming the authenticator, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var recovery recoveryCodesResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &recovery); err != nil || len(recovery.RecoveryCodes) != recoveryCodeCount {
+		T.Fatalf("expected %d recovery codes, got %s", recoveryCodeCount, w.Body.String())
+	}
+
+	// mfaToken logs the user in with their password, as far as the second factor
+	mfaToken := func() string {
+		w := httptest.NewRecorder()
+		completeLogin(w, httptest.NewRequest("POST", "/auth/token", nil), user.Id)
+		var pending mfaPendingResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil || !pending.MfaRequired {
+			T.Fatalf("expected an mfa_pending token, got %s", w.Body.String())
+		}
+		return pending.MfaToken
+	}
+
+	// The code that confirmed the authenticator has been used up
+	if status := postMFA(mfaToken(), &code, nil); status != http.StatusUnauthorized {
+		T.Errorf("expected status %d replaying a spent code, got %d", http.StatusUnauthorized, status)
+	}
+
+	// A recovery code logs in once
+	if status := postMFA(mfaToken(), nil, &recovery.RecoveryCodes[0]); status != http.StatusOK {
+		T.Errorf("expected status %d with a recovery code, got %d", http.StatusOK, status)
+	}
+	if status := postMFA(mfaToken(), nil, &recovery.RecoveryCodes[0]); status != http.StatusUnauthorized {
+		T.Errorf("expected status %d reusing a recovery code, got %d", http.StatusUnauthorized, status)
+	}
+
+	w = serveAs(principal, disableTOTP, "DELETE", "/users/{id}/mfa/totp", path, `{"recovery_code": "`+recovery.RecoveryCodes[0]+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		T.Errorf("expected status %d disabling with a spent recovery code, got %d", http.StatusUnauthorized, w.Code)
+	}
+	w = serveAs(principal, disableTOTP, "DELETE", "/users/{id}/mfa/totp", path, `{"recovery_code": "`+recovery.RecoveryCodes[1]+`"}`)
+	if w.Code != http.StatusNoContent {
+		T.Fatalf("expected status %d disabling with a recovery code, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if enabled, err := db.UserHasMFA(user.Id); err != nil || enabled {
+		T.Errorf("expected the second factor to be gone, got %v, %v", enabled, err)
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+type contextKey int
+
+const (
+	principalContextKey contextKey = iota
+	userContextKey
+	permissionsContextKey
+)
+
+// withCaller authenticates a request and passes it on to next with the caller in its context.
+// Requests without credentials are passed on as they are unless required is set.
+// Credentials which are present but invalid are always rejected with a 401, rather than treated as anonymous.
+// So are credentials of a user who has since been deleted.
+func withCaller(next http.Handler, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") == "" && !required {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := principalFromHeader(r.Header.Get("authorization"))
+		var user *db.UserModel
+		if err == nil && principal.UserId != nil {
+			user, err = db.GetUserById(*principal.UserId)
+			if err != nil && err != pgx.ErrNoRows {
+				log.Logger.WithField("error", err).Error("Failing to get user of credentials")
+				write500(w)
+				return
+			}
+		}
+		if err == nil && principal.IsImpersonated() {
+			if err = auditImpersonation(r, principal); err == errNotAdmin {
+				log.Security("impersonation_rejected").WithField("actor", *principal.ImpersonatorId).
+					Warn("Impersonation token used by someone who is no longer an admin")
+			} else if err != nil {
+				log.Logger.WithField("error", err).Error("Failing to audit impersonated request")
+				write500(w)
+				return
+			}
+		}
+		if err != nil {
+			log.Logger.WithField("error", err).Debug("Rejected credentials")
+			write401(w, &[]errorStruct{
+				{
+					Error:  "This endpoint requires a logged in user or an API token.",
+					Fields: []string{"header: authorization"},
+				},
+			})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, principal)
+		ctx = context.WithValue(ctx, userContextKey, user)
+		ctx = context.WithValue(ctx, permissionsContextKey, newRequestPermissions())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireAuth wraps a handler so that it is only called for requests with a valid access token or API token.
+// Other requests get a 401. The handler finds the caller with CurrentPrincipal and CurrentUser.
+func RequireAuth(next http.Handler) http.Handler {
+	return withCaller(next, true)
+}
+
+// OptionalAuth wraps a handler which serves anonymous requests too. When a request has credentials they must be
+// valid, and the handler finds the caller with CurrentPrincipal and CurrentUser. Otherwise both return nil.
+func OptionalAuth(next http.Handler) http.Handler {
+	return withCaller(next, false)
+}
+
+// RequireLogin wraps a handler which only a logged in user may call, such as one managing the user's credentials.
+// Requests without a valid access token get a 401, and API tokens get a 403.
+func RequireLogin(next http.Handler) http.Handler {
+	return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CurrentPrincipal(r).IsAPIToken() {
+			write403WithErrors(w, &[]errorStruct{
+				{
+					Error:  "This endpoint requires a logged in user, API tokens can't use it.",
+					Fields: []string{"header: authorization"},
+				},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// DenyImpersonation wraps a handler which admins must not call while acting as a user, because it destroys data or
+// changes how the user logs in. It must be wrapped by RequireAuth or RequireLogin itself.
+func DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal := CurrentPrincipal(r); principal != nil && principal.IsImpersonated() {
+			writeImpersonationDenied(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CurrentPrincipal returns who the request acts for, or nil for an anonymous request.
+// It only works in handlers wrapped by RequireAuth, OptionalAuth or RequireLogin.
+func CurrentPrincipal(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalContextKey).(*Principal)
+	return principal
+}
+
+// CurrentUser returns the user the request acts as. It is nil for anonymous requests and organization API tokens.
+// It only works in handlers wrapped by RequireAuth, OptionalAuth or RequireLogin.
+func CurrentUser(r *http.Request) *db.UserModel {
+	user, _ := r.Context().Value(userContextKey).(*db.UserModel)
+	return user
+}
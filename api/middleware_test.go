@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddleware(T *testing.T) {
+	var called bool
+	var principal *Principal
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		principal = CurrentPrincipal(r)
+		if CurrentUser(r) != nil {
+			T.Error("expected no user for an anonymous request")
+		}
+	})
+
+	for _, c := range []struct {
+		name       string
+		wrap       func(http.Handler) http.Handler
+		header     string
+		wantStatus int
+		wantCalled bool
+	}{
+		{"required without credentials", RequireAuth, "", http.StatusUnauthorized, false},
+		{"required with a malformed header", RequireAuth, "Basic dXNlcjpwYXNz", http.StatusUnauthorized, false},
+		{"required with a bad token", RequireAuth, "Bearer not.a.jwt", http.StatusUnauthorized, false},
+		{"login without credentials", RequireLogin, "", http.StatusUnauthorized, false},
+		{"optional without credentials", OptionalAuth, "", http.StatusOK, true},
+		{"optional with a bad token", OptionalAuth, "Bearer not.a.jwt", http.StatusUnauthorized, false},
+	} {
+		called, principal = false, nil
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		c.wrap(handler).ServeHTTP(w, r)
+
+		if w.Code != c.wantStatus {
+			T.Errorf("%s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+		}
+		if called != c.wantCalled {
+			T.Errorf("%s: expected the handler to be called: %v", c.name, c.wantCalled)
+		}
+		if principal != nil {
+			T.Errorf("%s: expected no principal, got %+v", c.name, principal)
+		}
+	}
+}
+
+func TestDenyImpersonation(T *testing.T) {
+	userId, adminId := "00000000-0000-4000-8000-000000000001", "00000000-0000-4000-8000-000000000002"
+	handler := DenyImpersonation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, c := range []struct {
+		principal  *Principal
+		wantStatus int
+	}{
+		{&Principal{UserId: &userId}, http.StatusNoContent},
+		{&Principal{UserId: &userId, ImpersonatorId: &adminId}, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey, c.principal))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.wantStatus {
+			T.Errorf("impersonated %v: expected status %d, got %d", c.principal.IsImpersonated(), c.wantStatus, w.Code)
+		}
+	}
+}
@@ -12,8 +12,9 @@ import (
 )
 
 type groupResponse struct {
-	Id          string   `json:"id"`
-	Name        string   `json:"name"`
+	Id          string               `json:"id"`
+	Name        string               `json:"name"`
+	IsPublic    bool                 `json:"is_public"`
 	Permissions []permissionResponse `json:"permissions"`
 }
 
@@ -24,10 +25,11 @@ type permissionResponse struct {
 }
 
 type organizationResponse struct {
-	Id      string          `json:"id"`
-	Name    string          `json:"name"`
-	OwnerId string          `json:"owner_id"`
-	Groups  []groupResponse `json:"groups"`
+	Id         string          `json:"id"`
+	Name       string          `json:"name"`
+	OwnerId    string          `json:"owner_id"`
+	RequireMFA bool            `json:"require_mfa"`
+	Groups     []groupResponse `json:"groups"`
 }
 
 type groupRequest struct {
@@ -37,9 +39,10 @@ type groupRequest struct {
 }
 
 type organizationRequest struct {
-	Name    *string       `json:"name,omitempty"`
-	OwnerId *string       `json:"name,omitempty"`
-	Groups  *groupRequest `json:"groups,omitempty"`
+	Name       *string       `json:"name,omitempty"`
+	OwnerId    *string       `json:"owner_id,omitempty"`
+	RequireMFA *bool         `json:"require_mfa,omitempty"`
+	Groups     *groupRequest `json:"groups,omitempty"`
 }
 
 func createOrganization(w http.ResponseWriter, r *http.Request) {
@@ -50,17 +53,17 @@ func createOrganization(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var userId *string
 
-	if userId, err = GetUserIdFromToken(r.Header.Get("authorization")); err != nil {
-		if r.Header.Get("authorization") != "" {
-			write403(w)
-		} else {
-			write401(w, &[]errorStruct{
-				{
-					Error:  "This endpoint requires a logged in user.",
-					Fields: []string{"header: authorization"},
-				},
-			})
-		}
+	principal := CurrentPrincipal(r)
+	// Organization tokens act within their organization and can't create others
+	if principal.UserId == nil {
+		write403(w)
+		return
+	}
+	if !requireScope(w, principal, scopeOrgsWrite) {
+		return
+	}
+	userId = principal.UserId
+	if !requireVerifiedEmail(w, *userId) {
 		return
 	}
 
@@ -69,12 +72,11 @@ func createOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//FIXME: validate org
-	/*if valid, vErrs := validateOrganization(req, "create"); !valid {
-		write422(w, vErrs)
+	if valid, eStructs := validateOrganizationRequest(&req); !valid {
+		write422(w, eStructs)
 		return
-	}*/
-	newOrg, err := db.CreateOrganization(*req.Name, *userId, false)
+	}
+	newOrg, err := db.CreateOrganization(*req.Name, *userId, false, roleTemplates)
 	if err != nil {
 		log.Logger.WithFields(logrus.Fields{
 			"err": err,
@@ -83,13 +85,19 @@ func createOrganization(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addContentTypeJSONHeader(w)
-	w.WriteHeader(http.StatusOK)
-	encoder.Encode(&organizationResponse{
+	resp := organizationResponse{
 		Id:      newOrg.Id,
 		Name:    newOrg.Name,
 		OwnerId: newOrg.OwnerId,
-	})
+		Groups:  []groupResponse{},
+	}
+	for i := range newOrg.Groups {
+		resp.Groups = append(resp.Groups, newGroupResponse(&newOrg.Groups[i]))
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
 }
 
 func showOrganization(w http.ResponseWriter, r *http.Request) {
@@ -117,26 +125,15 @@ func showOrganization(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := organizationResponse{
-		Id:      org.Id,
-		Name:    org.Name,
-		OwnerId: org.OwnerId,
-		Groups:  []groupResponse{},
+		Id:         org.Id,
+		Name:       org.Name,
+		OwnerId:    org.OwnerId,
+		RequireMFA: org.RequireMFA,
+		Groups:     []groupResponse{},
 	}
 
-	for _, group := range org.Groups {
-		gResp := groupResponse{
-			Id:          group.Id,
-			Name:        group.Name,
-			Permissions: []permissionResponse{},
-		}
-		for _, permission := range group.Permissions {
-			gResp.Permissions = append(gResp.Permissions, permissionResponse{
-				Id:     permission.Id,
-				TypeId: permission.PermissionTypeId,
-				Name:   permission.PermissionTypeName,
-			})
-		}
-		resp.Groups = append(resp.Groups, gResp)
+	for i := range org.Groups {
+		resp.Groups = append(resp.Groups, newGroupResponse(&org.Groups[i]))
 	}
 
 	addContentTypeJSONHeader(w)
@@ -173,34 +170,151 @@ func showOrganizationByName(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func IsAuthorized(userId, organizationId, permission string) (bool, error) {
-	return true, nil
+// partiallyUpdateOrganization is an http.HandlerFunc which lets an organization's owner change its settings.
+// Only require_mfa can be changed so far. Owners must have a second factor themselves before requiring one.
+// It can return the following HTTP statuses:
+// 200 OK: The organization was updated and the body contains it
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user doesn't own the organization
+// 404 Not Found: No organization has the id
+// 409 Conflict: The owner didn't log in with a second factor, so requiring one would lock them out
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func partiallyUpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req organizationRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+
+	rawId := mux.Vars(r)["id"]
+	if _, err = uuid.FromString(rawId); err != nil {
+		write400(w)
+		return
+	}
+
+	org, err := db.GetOrganizationById(rawId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get organization to update")
+		write500(w)
+		return
+	}
+	if org.OwnerId != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		write400(w)
+		return
+	}
+
+	if req.RequireMFA == nil {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Request must have a setting to change",
+				Fields: []string{"require_mfa"},
+			},
+		})
+		return
+	}
+
+	// Owners who didn't log in with a second factor would lock themselves out
+	if *req.RequireMFA {
+		if verified, err := verifiedMFA(r, *principal.UserId); err != nil {
+			log.Logger.WithField("error", err).Error("Failing to check if owner has MFA")
+			write500(w)
+			return
+		} else if !verified {
+			write409(w, &[]errorStruct{
+				{
+					Error:  "Log in with two-factor authentication before requiring it",
+					Fields: []string{"require_mfa"},
+				},
+			})
+			return
+		}
+	}
+
+	if err = db.SetOrganizationRequireMFA(org.Id, *req.RequireMFA); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to update organization")
+		write500(w)
+		return
+	}
+	userPermissions.invalidateOrganization(org.Id)
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&organizationResponse{
+		Id:         org.Id,
+		Name:       org.Name,
+		OwnerId:    org.OwnerId,
+		RequireMFA: *req.RequireMFA,
+	})
+}
+
+// IsAuthorized checks that a user may use a permission in an organization. The organization's owner may do anything,
+// other users need to be in one of its groups granting the permission. A nil error means the user is authorized,
+// ErrOrganizationNotFound, ErrNotMember, ErrPermissionDenied and ErrMFARequired say why they aren't.
+func IsAuthorized(userId, organizationId, permission string) error {
+	return authorizeUser(nil, userId, organizationId, permission)
 }
 
 func RouteOrganization(router *mux.Router) {
+	// The root path without a trailing slash is routed before the subrouter, whose strict slash would redirect it.
+	// A catch-all on the subrouter would also take the requests meant for the routes below.
+	router.Handle("/organizations", RequireAuth(http.HandlerFunc(createOrganization))).Methods("POST")
 	orgRouter := router.PathPrefix("/organizations").Subrouter().StrictSlash(true)
 
 	// Root paths
-	//orgRouter.Methods("GET").HandlerFunc(listOrganizations)
 	//orgRouter.HandleFunc("/", listOrganizations).Methods("GET")
-	orgRouter.Methods("POST").HandlerFunc(createOrganization)
-	orgRouter.HandleFunc("/", createOrganization).Methods("POST")
+	orgRouter.Handle("/", RequireAuth(http.HandlerFunc(createOrganization))).Methods("POST")
 
 	// By Id Paths
 	//orgRouter.HandleFunc("/{id}", deleteOrganization).Methods("DELETE")
 	orgRouter.HandleFunc("/{id}", showOrganization).Methods("GET")
-	//orgRouter.HandlerFunc("/{id}", partiallyUpdateOrganization).Methods("PATCH")
+	orgRouter.Handle("/{id}", RequireLogin(DenyImpersonation(http.HandlerFunc(partiallyUpdateOrganization)))).Methods("PATCH")
 	//orgRouter.HandlerFunc("/{id}", updateOrganization).Methods("PUT")
 
+	// API tokens
+	orgRouter.Handle("/{orgId}/tokens", RequireLogin(http.HandlerFunc(listAPITokens))).Methods("GET")
+	orgRouter.Handle("/{orgId}/tokens", RequireLogin(DenyImpersonation(http.HandlerFunc(createAPIToken)))).Methods("POST")
+	orgRouter.Handle("/{orgId}/tokens/{tokenId}", RequireLogin(DenyImpersonation(http.HandlerFunc(revokeAPIToken)))).Methods("DELETE")
+
+	// SAML single sign-on
+	orgRouter.Handle("/{orgId}/saml", RequireLogin(http.HandlerFunc(showSAMLProvider))).Methods("GET")
+	orgRouter.Handle("/{orgId}/saml", RequireLogin(DenyImpersonation(http.HandlerFunc(putSAMLProvider)))).Methods("PUT")
+	orgRouter.Handle("/{orgId}/saml", RequireLogin(DenyImpersonation(http.HandlerFunc(deleteSAMLProvider)))).Methods("DELETE")
+	orgRouter.HandleFunc("/{orgId}/saml/metadata", showSAMLMetadata).Methods("GET")
+	orgRouter.Handle("/{orgId}/saml/login", OptionalAuth(DenyImpersonation(http.HandlerFunc(startSAMLLogin)))).Methods("POST")
+	orgRouter.HandleFunc("/{orgId}/saml/acs", consumeSAMLResponse).Methods("POST")
+
 	// By Name Paths
 
 	// Groups subroutes
-	//orgRouter.HandleFunc("/{orgId}/groups", listOrganizationGroups).Methods("GET")
-	//orgRouter.HandleFunc("/{orgId}/groups", createOrganizationGroup).Methods("POST")
-	//orgRouter.HandleFunc("/{orgId}/groups/{groupId}", showOrganizationGroup).Methods("GET")
-	//orgRouter.HandleFunc("/{orgId}/groups/{groupId}", deleteOrganizationGroup).Methods("DELETE")
-	//orgRouter.HandleFunc("/{orgId}/groups/{groupId}", partiallyUpdateOrganizationGroup).Methods("PATCH")
-	//orgRouter.HandleFunc("/{orgId}/groups/{groupId}", updateOrganizationGroup).Methods("PUT")
+	orgRouter.HandleFunc("/{orgId}/groups", listOrganizationGroups).Methods("GET")
+	orgRouter.Handle("/{orgId}/groups", RequireAuth(DenyImpersonation(http.HandlerFunc(createOrganizationGroup)))).Methods("POST")
+	orgRouter.HandleFunc("/{orgId}/groups/{groupId}", showOrganizationGroup).Methods("GET")
+	orgRouter.Handle("/{orgId}/groups/{groupId}", RequireAuth(DenyImpersonation(http.HandlerFunc(deleteOrganizationGroup)))).Methods("DELETE")
+	orgRouter.Handle("/{orgId}/groups/{groupId}", RequireAuth(DenyImpersonation(http.HandlerFunc(partiallyUpdateOrganizationGroup)))).Methods("PATCH")
+	orgRouter.Handle("/{orgId}/groups/{groupId}", RequireAuth(DenyImpersonation(http.HandlerFunc(updateOrganizationGroup)))).Methods("PUT")
+	orgRouter.Handle("/{orgId}/groups/{groupId}/members", RequireAuth(http.HandlerFunc(listGroupMembers))).Methods("GET")
+	orgRouter.Handle("/{orgId}/groups/{groupId}/members/{userId}", RequireAuth(DenyImpersonation(http.HandlerFunc(addGroupMember)))).Methods("PUT")
+	orgRouter.Handle("/{orgId}/groups/{groupId}/members/{userId}", RequireAuth(DenyImpersonation(http.HandlerFunc(removeGroupMember)))).Methods("DELETE")
+
+	// Invitations
+	orgRouter.Handle("/{orgId}/invitations", RequireAuth(http.HandlerFunc(listOrganizationInvitations))).Methods("GET")
+	orgRouter.Handle("/{orgId}/invitations", RequireAuth(DenyImpersonation(http.HandlerFunc(createInvitation)))).Methods("POST")
+	orgRouter.Handle("/{orgId}/invitations/{invitationId}", RequireAuth(DenyImpersonation(http.HandlerFunc(revokeInvitation)))).Methods("DELETE")
 
 	router.HandleFunc("/orgsByName/{name}", showOrganizationByName).Methods("GET")
+	router.HandleFunc("/permission-types", listPermissionTypes).Methods("GET")
+	router.Handle("/invitations/accept", RequireLogin(DenyImpersonation(http.HandlerFunc(acceptInvitation)))).Methods("POST")
+	router.Handle("/invitations/decline", OptionalAuth(DenyImpersonation(http.HandlerFunc(declineInvitation)))).Methods("POST")
 }
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateOrganizationRejections(T *testing.T) {
+	userId := "00000000-0000-4000-8000-000000000001"
+	caller := &Principal{UserId: &userId, SessionId: "session"}
+
+	for _, c := range []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"malformed JSON", `{"name": `, http.StatusBadRequest},
+		{"no name", `{"owner_id": "` + userId + `"}`, http.StatusUnprocessableEntity},
+		{"empty name", `{"name": ""}`, http.StatusUnprocessableEntity},
+		{"long name", `{"name": "An organization name far longer than allowed"}`, http.StatusUnprocessableEntity},
+	} {
+		w := serveAs(caller, createOrganization, "POST", "/organizations", "/organizations", c.body)
+		if w.Code != c.wantStatus {
+			T.Errorf("%s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+		}
+	}
+}
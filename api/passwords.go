@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/mg4tv/kubrik/mail"
+	"github.com/mg4tv/kubrik/password"
+)
+
+var (
+	passwordPolicy     *password.Policy
+	passwordPolicyErr  error
+	passwordPolicyOnce sync.Once
+)
+
+// LoadPasswordPolicy reads the password policy from the configuration and returns any error in it.
+// The policy is loaded once, so this should be called at startup to fail early on a bad configuration.
+func LoadPasswordPolicy() error {
+	passwordPolicyOnce.Do(func() {
+		passwordPolicy, passwordPolicyErr = password.LoadPolicy(conf.Config)
+	})
+	return passwordPolicyErr
+}
+
+// checkPassword returns the field errors for a password the policy rejects, or nil if it is acceptable.
+// The username may be nil for users who have none.
+func checkPassword(pw string, username *string, email string) *[]errorStruct {
+	var name string
+	if username != nil {
+		name = *username
+	}
+	errs := passwordPolicy.Check(pw, name, email)
+	if len(errs) == 0 {
+		return nil
+	}
+	eStructs := make([]errorStruct, len(errs))
+	for i, err := range errs {
+		eStructs[i] = errorStruct{
+			Error:  err.Error(),
+			Fields: []string{"password"},
+		}
+	}
+	return &eStructs
+}
+
+type forgotPasswordRequest struct {
+	Email *string `json:"email,omitempty"`
+}
+
+type resetPasswordRequest struct {
+	Token                *string `json:"token,omitempty"`
+	Password             *string `json:"password,omitempty"`
+	PasswordConfirmation *string `json:"password_confirmation,omitempty"`
+}
+
+// appURL returns a link into the web app, which is where links in emails send users
+func appURL(path string, query url.Values) string {
+	return conf.Config.GetString("kubrik.app_url") + path + "?" + query.Encode()
+}
+
+// sendPasswordReset emails a password reset link to the user with the email, if there is one.
+// It runs apart from the request so that whether an account exists can't be told from the response time.
+func sendPasswordReset(email string) {
+	user, err := db.GetUserByEmail(email)
+	if err == pgx.ErrNoRows {
+		log.Logger.WithField("email", email).Debug("Password reset requested for unknown email")
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user by email for password reset")
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to generate password reset token")
+		return
+	}
+	expiresAt := time.Now().Add(conf.Config.GetDuration("kubrik.password_reset_ttl"))
+	err = db.CreatePasswordResetToken(user.Id, hashOpaqueToken(token), expiresAt,
+		conf.Config.GetInt("kubrik.password_reset_max_active"))
+	if err == db.ErrTooManyPasswordResets {
+		// Whoever keeps asking can't flood the user's inbox, and the user still has a working link
+		log.Security("password_reset_limited").WithField("user", user.Id).Warn("Not sending more password resets")
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store password reset token")
+		return
+	}
+
+	err = mail.Send(&mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. If it was you, choose a new password here:\n\n" +
+			appURL("/reset-password", url.Values{"token": {token}}) + "\n\n" +
+			"The link works once and expires in " + conf.Config.GetDuration("kubrik.password_reset_ttl").String() + ". " +
+			"If you didn't ask for this, you can ignore this email.\n",
+	})
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to send password reset email")
+	}
+}
+
+// forgotPassword is an http.HandlerFunc which emails a password reset link to the user with an email.
+// The response is the same whether or not anyone has the email.
+// It can return the following HTTP statuses:
+// 202 Accepted: A reset link will be sent if a user has the email
+// 400 Bad Request: The request was malformed
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req forgotPasswordRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode forgot password request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateForgotPasswordRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	go sendPasswordReset(*req.Email)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeInvalidResetToken(w http.ResponseWriter) {
+	write401(w, &[]errorStruct{
+		{
+			Error:  "This reset link is invalid or has expired",
+			Fields: []string{"token"},
+		},
+	})
+}
+
+// resetPassword is an http.HandlerFunc which replaces a user's password using a token from a reset email.
+// All of the user's sessions are revoked, so they have to log in again everywhere.
+// It can return the following HTTP statuses:
+// 204 No Content: The password was changed
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The token doesn't exist, has expired or was already used
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards or the password policy
+// 500 Server Error:
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req resetPasswordRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode reset password request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateResetPasswordRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	if err = LoadPasswordPolicy(); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to load password policy")
+		write500(w)
+		return
+	}
+
+	// The user is needed to hold the new password to the policy. ResetPassword checks the token again.
+	user, err := db.GetPasswordResetUser(hashOpaqueToken(*req.Token))
+	if err == db.ErrPasswordResetTokenInvalid {
+		writeInvalidResetToken(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get user of password reset token")
+		write500(w)
+		return
+	}
+	if eStructs := checkPassword(*req.Password, user.Username, user.Email); eStructs != nil {
+		write422(w, eStructs)
+		return
+	}
+
+	hash, err := passwordPolicy.Hash(*req.Password)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to hash password")
+		write500(w)
+		return
+	}
+
+	userId, err := db.ResetPassword(hashOpaqueToken(*req.Token), hash)
+	if err == db.ErrPasswordResetTokenInvalid {
+		writeInvalidResetToken(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to reset password")
+		write500(w)
+		return
+	}
+
+	if err = revokeUserSessions(userId); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to revoke sessions after password reset")
+		write500(w)
+		return
+	}
+	log.Logger.WithField("user", userId).Info("Password reset")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// Permissions groups can grant in an organization. The organization's owner has all of them.
+const (
+	permissionCreateVideo  = "CREATE_VIDEO"
+	permissionEditVideo    = "EDIT_VIDEO"
+	permissionDeleteVideo  = "DELETE_VIDEO"
+	permissionViewPrivate  = "VIEW_PRIVATE"
+	permissionManageGroups = "MANAGE_GROUPS"
+	permissionManageOrg    = "MANAGE_ORG"
+)
+
+// permissionTypes is the registry of permissions, which SyncPermissionTypes writes to the database.
+// Groups can only be given these.
+var permissionTypes = []db.PermissionTypeModel{
+	{Name: permissionCreateVideo, Description: "Upload videos to the organization"},
+	{Name: permissionEditVideo, Description: "Change the organization's videos"},
+	{Name: permissionDeleteVideo, Description: "Delete the organization's videos"},
+	{Name: permissionViewPrivate, Description: "Watch the organization's private videos"},
+	{Name: permissionManageGroups, Description: "Create and change groups, and choose who is in them"},
+	{Name: permissionManageOrg, Description: "Change the organization's settings"},
+}
+
+var validPermissions = map[string]bool{}
+
+// managementPermissions are the permissions over the organization itself. Anyone can join a public group, so
+// public groups can't grant these.
+var managementPermissions = []string{permissionManageGroups, permissionManageOrg}
+
+// grantsManagement reports whether any of the permission names is a management permission
+func grantsManagement(permissions []string) bool {
+	for _, permission := range permissions {
+		for _, management := range managementPermissions {
+			if permission == management {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func init() {
+	for _, t := range permissionTypes {
+		validPermissions[t.Name] = true
+	}
+}
+
+type permissionTypeResponse struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// SyncPermissionTypes writes the registry of permissions to the database, so that groups can be given them.
+// It should be called at startup.
+func SyncPermissionTypes() error {
+	return db.SyncPermissionTypes(permissionTypes)
+}
+
+// listPermissionTypes is an http.HandlerFunc which lists the permissions groups can grant
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the permission types
+// 500 Server Error:
+func listPermissionTypes(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	types, err := db.ListPermissionTypes()
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list permission types")
+		write500(w)
+		return
+	}
+
+	// Types dropped from the registry stay in the database, but can't be granted anymore
+	resp := []permissionTypeResponse{}
+	for _, t := range types {
+		if validPermissions[t.Name] {
+			resp = append(resp, permissionTypeResponse{
+				Id:          t.Id,
+				Name:        t.Name,
+				Description: t.Description,
+			})
+		}
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
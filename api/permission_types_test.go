@@ -0,0 +1,14 @@
+package api
+
+import "testing"
+
+func TestPermissionTypesHaveScopes(T *testing.T) {
+	for _, t := range permissionTypes {
+		if _, ok := permissionScopes[t.Name]; !ok {
+			T.Errorf("expected %s to map to a scope, or API tokens could never use it", t.Name)
+		}
+		if len(t.Name) > 31 {
+			T.Errorf("expected %s to fit in the name column", t.Name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+)
+
+// apiTokenPrefix marks API tokens, both so they can be told apart from JWTs and so secret scanners can find them
+const apiTokenPrefix = "kbk_"
+
+// Scopes API tokens can be limited to
+const (
+	scopeOrgsRead    = "orgs:read"
+	scopeOrgsWrite   = "orgs:write"
+	scopeVideosRead  = "videos:read"
+	scopeVideosWrite = "videos:write"
+	scopeUsersRead   = "users:read"
+	// scopeSCIM lets an organization token provision the organization's users and groups from its IdP
+	scopeSCIM = "scim"
+)
+
+var validScopes = map[string]bool{
+	scopeOrgsRead:    true,
+	scopeOrgsWrite:   true,
+	scopeVideosRead:  true,
+	scopeVideosWrite: true,
+	scopeUsersRead:   true,
+	scopeSCIM:        true,
+}
+
+// permissionScopes maps organization permissions to the scope an API token needs to use them.
+// Tokens can't use permissions missing from here.
+var permissionScopes = map[string]string{
+	permissionCreateVideo:  scopeVideosWrite,
+	permissionEditVideo:    scopeVideosWrite,
+	permissionDeleteVideo:  scopeVideosWrite,
+	permissionViewPrivate:  scopeVideosRead,
+	permissionManageGroups: scopeOrgsWrite,
+	permissionManageOrg:    scopeOrgsWrite,
+}
+
+// Principal is whoever a request acts for: a user logged in with an access token, or an API token belonging to a
+// user or an organization
+type Principal struct {
+	// UserId is the user the request acts as. It is nil for organization tokens.
+	UserId *string
+	// OrganizationId is the organization an organization token belongs to, and the only one it can act in
+	OrganizationId *string
+	// SessionId is the jti of the access token a logged in user called with. It is empty for API tokens.
+	SessionId string
+	// ImpersonatorId is the admin acting as the user, if the request was made with an impersonation token
+	ImpersonatorId *string
+	// TokenId is the id of the API token, if one was used
+	TokenId *string
+	// Scopes limits what an API token can do. It is nil for logged in users, who can do anything.
+	Scopes []string
+	// MFA is set when the session of the access token was started with a second factor
+	MFA bool
+}
+
+// IsAPIToken reports whether the principal authenticated with an API token rather than by logging in
+func (p *Principal) IsAPIToken() bool {
+	return p.TokenId != nil
+}
+
+// IsImpersonated reports whether an admin is acting as the user
+func (p *Principal) IsImpersonated() bool {
+	return p.ImpersonatorId != nil
+}
+
+// HasScope reports whether the principal may do what a scope covers. A write scope covers reading too.
+func (p *Principal) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope || (strings.HasSuffix(scope, ":read") && s == strings.TrimSuffix(scope, ":read")+":write") {
+			return true
+		}
+	}
+	return false
+}
+
+// principalFromHeader authenticates the bearer token in an authorization header, which is either an access token
+// or an API token
+func principalFromHeader(header string) (*Principal, error) {
+	headerParts := strings.Split(header, " ")
+	if len(headerParts) != 2 || strings.ToLower(headerParts[0]) != "bearer" {
+		return nil, errors.New("Inmroper token form. Must begin with 'bearer '.")
+	}
+
+	if !strings.HasPrefix(headerParts[1], apiTokenPrefix) {
+		claims, mfa, err := parseAccessToken(header)
+		if err != nil {
+			return nil, err
+		}
+		principal := &Principal{UserId: claims.UserId, SessionId: claims.Id, MFA: mfa}
+		if claims.Actor != nil {
+			principal.ImpersonatorId = &claims.Actor.Subject
+		}
+		return principal, nil
+	}
+
+	token, err := db.UseAPIToken(hashOpaqueToken(headerParts[1]))
+	if err == pgx.ErrNoRows {
+		return nil, errors.New("API token is unknown, revoked or expired")
+	} else if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		UserId:         token.UserId,
+		OrganizationId: token.OrganizationId,
+		TokenId:        &token.Id,
+		Scopes:         token.Scopes,
+	}, nil
+}
+
+// requireScope checks the principal has a scope. If not, a 403 is written and false is returned.
+func requireScope(w http.ResponseWriter, p *Principal, scope string) bool {
+	if p.HasScope(scope) {
+		return true
+	}
+	write403WithErrors(w, &[]errorStruct{
+		{
+			Error:  "This token needs the " + scope + " scope",
+			Fields: []string{"scope"},
+		},
+	})
+	return false
+}
+
+// authorizePrincipal checks that a principal holds a permission in an organization, like IsAuthorized. API tokens
+// also need the scope the permission maps to, and organization tokens can only act in their own organization.
+func authorizePrincipal(r *http.Request, p *Principal, organizationId, permission string) error {
+	if p.IsAPIToken() {
+		scope, ok := permissionScopes[permission]
+		if !ok || !p.HasScope(scope) {
+			return ErrPermissionDenied
+		}
+	}
+	if p.OrganizationId != nil {
+		if *p.OrganizationId != organizationId {
+			return ErrNotMember
+		}
+		return nil
+	}
+	return authorizeUser(r, *p.UserId, organizationId, permission)
+}
+
+// authorizePrincipalMember checks that a principal may see inside an organization: users must own or be a member of
+// it, and API tokens need orgs:read and, for organization tokens, to belong to it.
+func authorizePrincipalMember(r *http.Request, p *Principal, organizationId string) error {
+	if !p.HasScope(scopeOrgsRead) {
+		return ErrPermissionDenied
+	}
+	if p.OrganizationId != nil {
+		if *p.OrganizationId != organizationId {
+			return ErrNotMember
+		}
+		return nil
+	}
+	_, err := authorizeMember(r, *p.UserId, organizationId)
+	return err
+}
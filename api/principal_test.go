@@ -0,0 +1,61 @@
+package api
+
+import "testing"
+
+func TestPrincipalScopes(T *testing.T) {
+	user := &Principal{}
+	if !user.HasScope(scopeVideosWrite) {
+		T.Error("expected a logged in user to have every scope")
+	}
+
+	tokenId := "2b0ee5d4-6a8f-4a8e-9a0b-0f5f1c7c9f63"
+	token := &Principal{TokenId: &tokenId, Scopes: []string{scopeVideosWrite, scopeOrgsRead}}
+	if !token.HasScope(scopeVideosRead) {
+		T.Error("expected videos:write to cover videos:read")
+	}
+	if token.HasScope(scopeOrgsWrite) {
+		T.Error("expected orgs:read not to cover orgs:write")
+	}
+	if token.HasScope(scopeUsersRead) {
+		T.Error("expected a scope the token lacks to be refused")
+	}
+}
+
+func TestOrganizationTokenAuthorization(T *testing.T) {
+	tokenId := "2b0ee5d4-6a8f-4a8e-9a0b-0f5f1c7c9f63"
+	orgId := "8d7a3c1e-51f4-4c52-a1f0-3e9c5d2b7a10"
+	token := &Principal{TokenId: &tokenId, OrganizationId: &orgId, Scopes: []string{scopeVideosWrite}}
+
+	if err := authorizePrincipal(nil, token, orgId, "CREATE_VIDEO"); err != nil {
+		T.Error("expected the token to create videos in its organization")
+	}
+	if err := authorizePrincipal(nil, token, "0f0e0d0c-0b0a-4908-8706-050403020100", "CREATE_VIDEO"); err != ErrNotMember {
+		T.Error("expected the token to be refused in another organization")
+	}
+	if err := authorizePrincipal(nil, token, orgId, "MANAGE_GROUPS"); err != ErrPermissionDenied {
+		T.Error("expected the token to be refused a permission without a scope")
+	}
+
+	token.Scopes = []string{scopeOrgsRead}
+	if err := authorizePrincipal(nil, token, orgId, "CREATE_VIDEO"); err != ErrPermissionDenied {
+		T.Error("expected the token to be refused without videos:write")
+	}
+}
+
+func TestOrganizationTokenMembership(T *testing.T) {
+	tokenId := "2b0ee5d4-6a8f-4a8e-9a0b-0f5f1c7c9f63"
+	orgId := "8d7a3c1e-51f4-4c52-a1f0-3e9c5d2b7a10"
+	token := &Principal{TokenId: &tokenId, OrganizationId: &orgId, Scopes: []string{scopeOrgsRead}}
+
+	if err := authorizePrincipalMember(nil, token, orgId); err != nil {
+		T.Errorf("expected the token to see inside its organization, got %v", err)
+	}
+	if err := authorizePrincipalMember(nil, token, "0f0e0d0c-0b0a-4908-8706-050403020100"); err != ErrNotMember {
+		T.Errorf("expected ErrNotMember in another organization, got %v", err)
+	}
+
+	token.Scopes = []string{scopeVideosRead}
+	if err := authorizePrincipalMember(nil, token, orgId); err != ErrPermissionDenied {
+		T.Errorf("expected ErrPermissionDenied without orgs:read, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+)
+
+type roleTemplateConfig struct {
+	Name        string   `mapstructure:"name"`
+	IsPublic    bool     `mapstructure:"is_public"`
+	Permissions []string `mapstructure:"permissions"`
+	AddCreator  bool     `mapstructure:"add_creator"`
+}
+
+// defaultRoleTemplates are the groups organizations start with unless organizations.role_templates is set
+var defaultRoleTemplates = []db.GroupTemplateModel{
+	{
+		Name: "Admins",
+		Permissions: []string{
+			permissionCreateVideo, permissionEditVideo, permissionDeleteVideo, permissionViewPrivate,
+			permissionManageGroups, permissionManageOrg,
+		},
+		AddOwner: true,
+	},
+	{
+		Name:        "Editors",
+		Permissions: []string{permissionCreateVideo, permissionEditVideo, permissionDeleteVideo, permissionViewPrivate},
+	},
+	{
+		Name:        "Viewers",
+		Permissions: []string{permissionViewPrivate},
+	},
+}
+
+var roleTemplates []db.GroupTemplateModel
+var roleTemplatesErr error
+var roleTemplatesOnce sync.Once
+
+// LoadRoleTemplates reads the groups new organizations start with from organizations.role_templates and returns
+// any error in them. The templates are loaded once, so this should be called at startup to fail early.
+func LoadRoleTemplates() error {
+	roleTemplatesOnce.Do(func() {
+		roleTemplates, roleTemplatesErr = loadRoleTemplates()
+	})
+	return roleTemplatesErr
+}
+
+func loadRoleTemplates() ([]db.GroupTemplateModel, error) {
+	if !conf.Config.IsSet("organizations.role_templates") {
+		return defaultRoleTemplates, nil
+	}
+
+	var configs []roleTemplateConfig
+	if err := conf.Config.UnmarshalKey("organizations.role_templates", &configs); err != nil {
+		return nil, err
+	}
+
+	templates := []db.GroupTemplateModel{}
+	names := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" || len(c.Name) > 31 {
+			return nil, fmt.Errorf("Role template name %q must be between 1 and 31 characters", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Duplicate role template %q", c.Name)
+		}
+		names[c.Name] = true
+		for _, permission := range c.Permissions {
+			if !validPermissions[permission] {
+				return nil, fmt.Errorf("Role template %q has unknown permission %q", c.Name, permission)
+			}
+		}
+		if c.IsPublic && grantsManagement(c.Permissions) {
+			return nil, fmt.Errorf("Role template %q is public, so it can't grant MANAGE_GROUPS or MANAGE_ORG", c.Name)
+		}
+		templates = append(templates, db.GroupTemplateModel{
+			Name:        c.Name,
+			IsPublic:    c.IsPublic,
+			Permissions: c.Permissions,
+			AddOwner:    c.AddCreator,
+		})
+	}
+	return templates, nil
+}
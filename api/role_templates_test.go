@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/mg4tv/kubrik/conf"
+)
+
+func TestLoadRoleTemplates(T *testing.T) {
+	templates, err := loadRoleTemplates()
+	if err != nil {
+		T.Fatalf("expected the default templates to load, got %v", err)
+	}
+	admins := 0
+	for _, template := range templates {
+		for _, permission := range template.Permissions {
+			if !validPermissions[permission] {
+				T.Errorf("expected %s in %s to be in the registry", permission, template.Name)
+			}
+		}
+		if template.AddOwner {
+			admins++
+		}
+	}
+	if admins != 1 {
+		T.Errorf("expected the creator to be put in one group, got %d", admins)
+	}
+
+	conf.Config.Set("organizations.role_templates", []map[string]interface{}{
+		{"name": "Uploaders", "permissions": []string{permissionCreateVideo}, "add_creator": true},
+	})
+	defer conf.Config.Set("organizations.role_templates", nil)
+	templates, err = loadRoleTemplates()
+	if err != nil {
+		T.Fatalf("expected configured templates to load, got %v", err)
+	}
+	if len(templates) != 1 || templates[0].Name != "Uploaders" || !templates[0].AddOwner {
+		T.Errorf("expected the configured template, got %+v", templates)
+	}
+
+	conf.Config.Set("organizations.role_templates", []map[string]interface{}{
+		{"name": "Pilots", "permissions": []string{"LAUNCH_ROCKETS"}},
+	})
+	if _, err = loadRoleTemplates(); err == nil {
+		T.Error("expected a template with a permission missing from the registry to be refused")
+	}
+
+	conf.Config.Set("organizations.role_templates", []map[string]interface{}{
+		{"name": "Everyone", "is_public": true, "permissions": []string{permissionViewPrivate, permissionManageGroups}},
+	})
+	if _, err = loadRoleTemplates(); err == nil {
+		T.Error("expected a public template granting MANAGE_GROUPS to be refused")
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mg4tv/kubrik/db"
+)
+
+// newTestRouter routes the API the way cmd/serve.go does
+func newTestRouter() *mux.Router {
+	router := mux.NewRouter()
+	RouteAuth(router)
+	RouteAdmin(router)
+	RouteOrganization(router)
+	RouteSCIM(router)
+	RouteUser(router)
+	RouteVideos(router)
+	return router
+}
+
+// serveAs routes a request to a handler registered at template, acting for principal the way the auth middleware
+// would. A nil principal makes an anonymous request.
+func serveAs(principal *Principal, handler http.HandlerFunc, method, template, path, body string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {
+		if principal != nil {
+			ctx := context.WithValue(r.Context(), principalContextKey, principal)
+			ctx = context.WithValue(ctx, permissionsContextKey, newRequestPermissions())
+			r = r.WithContext(ctx)
+		}
+		handler(w, r)
+	}).Methods(method)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// requireDatabase skips tests which need the database from docker-compose.yaml when it can't be reached
+func requireDatabase(T *testing.T) {
+	conn, err := db.PgPool.Acquire()
+	if err != nil {
+		T.Skipf("needs the database: %v", err)
+	}
+	db.PgPool.Release(conn)
+}
+
+func TestRoutes(T *testing.T) {
+	const orgId = "00000000-0000-4000-8000-000000000001"
+	const userId = "00000000-0000-4000-8000-000000000002"
+	router := newTestRouter()
+
+	for _, c := range []struct {
+		method   string
+		path     string
+		template string
+		// wantStatus is the status without credentials, or 0 for routes which anyone may call
+		wantStatus int
+	}{
+		{"POST", "/organizations", "/organizations", http.StatusUnauthorized},
+		{"POST", "/organizations/", "/organizations/", http.StatusUnauthorized},
+		{"POST", "/organizations/" + orgId + "/tokens", "/organizations/{orgId}/tokens", http.StatusUnauthorized},
+		{"POST", "/organizations/" + orgId + "/groups", "/organizations/{orgId}/groups", http.StatusUnauthorized},
+		{"POST", "/organizations/" + orgId + "/invitations", "/organizations/{orgId}/invitations", http.StatusUnauthorized},
+		{"POST", "/organizations/" + orgId + "/saml/login", "/organizations/{orgId}/saml/login", 0},
+		{"POST", "/organizations/" + orgId + "/saml/acs", "/organizations/{orgId}/saml/acs", 0},
+		{"POST", "/invitations/accept", "/invitations/accept", http.StatusUnauthorized},
+		{"POST", "/invitations/decline", "/invitations/decline", 0},
+
+		{"POST", "/users", "/users", 0},
+		{"POST", "/users/", "/users/", 0},
+		{"POST", "/users/" + userId + "/email", "/users/{id}/email", http.StatusUnauthorized},
+		{"POST", "/users/" + userId + "/email/verification", "/users/{id}/email/verification", http.StatusUnauthorized},
+		{"POST", "/users/" + userId + "/mfa/totp", "/users/{id}/mfa/totp", http.StatusUnauthorized},
+		{"POST", "/users/" + userId + "/mfa/totp/confirm", "/users/{id}/mfa/totp/confirm", http.StatusUnauthorized},
+		{"POST", "/users/" + userId + "/tokens", "/users/{id}/tokens", http.StatusUnauthorized},
+		{"POST", "/users/" + userId + "/identities/google", "/users/{id}/identities/{provider}", http.StatusUnauthorized},
+		{"GET", "/users", "/users", 0},
+		{"GET", "/users/" + userId, "/users/{id}", 0},
+		{"GET", "/users/" + userId + "/sessions", "/users/{id}/sessions", http.StatusUnauthorized},
+		{"GET", "/users/" + userId + "/tokens", "/users/{id}/tokens", http.StatusUnauthorized},
+		{"GET", "/users/" + userId + "/organizations", "/users/{id}/organizations", http.StatusUnauthorized},
+		{"GET", "/users/" + userId + "/invitations", "/users/{id}/invitations", http.StatusUnauthorized},
+		{"GET", "/users/" + userId + "/identities", "/users/{id}/identities", http.StatusUnauthorized},
+
+		{"POST", "/videos", "/videos", http.StatusUnauthorized},
+		{"POST", "/videos/", "/videos/", http.StatusUnauthorized},
+
+		{"POST", "/auth/logout", "/auth/logout", http.StatusUnauthorized},
+		{"POST", "/auth/device/verify", "/auth/device/verify", http.StatusUnauthorized},
+		{"POST", "/admin/impersonate/" + userId, "/admin/impersonate/{userId}", http.StatusUnauthorized},
+		{"POST", "/scim/v2/Users", "/scim/v2/Users", http.StatusUnauthorized},
+		{"POST", "/scim/v2/Groups", "/scim/v2/Groups", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		var match mux.RouteMatch
+		if !router.Match(r, &match) {
+			T.Errorf("%s %s: expected a route", c.method, c.path)
+			continue
+		}
+		if template, _ := match.Route.GetPathTemplate(); template != c.template {
+			T.Errorf("%s %s: expected route %s, got %s", c.method, c.path, c.template, template)
+		}
+
+		// Anonymous requests to the routes which need credentials must be turned away before reaching a handler
+		if c.wantStatus != 0 {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != c.wantStatus {
+				T.Errorf("%s %s: expected status %d, got %d", c.method, c.path, c.wantStatus, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,685 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/mg4tv/kubrik/saml"
+	"github.com/satori/go.uuid"
+)
+
+// Errors the web app is redirected to /sso/callback with when a SAML login fails
+const (
+	samlErrInvalidRequest  = "invalid_request"
+	samlErrInvalidResponse = "invalid_response"
+	samlErrServer          = "server_error"
+)
+
+// Reasons exchanging a SAML login code finds no user to log in
+var (
+	errSAMLMissingEmail  = errors.New("The identity provider didn't send an email for the new user")
+	errSAMLAccountExists = errors.New("An account with this email already exists, log in to it to link the identity")
+	errSAMLIdentityTaken = errors.New("This identity is linked to another account")
+)
+
+type samlGroupMappingRequest struct {
+	Value   *string `json:"value,omitempty"`
+	GroupId *string `json:"group_id,omitempty"`
+}
+
+type samlProviderRequest struct {
+	Metadata        *string                    `json:"metadata,omitempty"`
+	EmailAttribute  *string                    `json:"email_attribute,omitempty"`
+	GroupsAttribute *string                    `json:"groups_attribute,omitempty"`
+	GroupMappings   *[]samlGroupMappingRequest `json:"group_mappings,omitempty"`
+}
+
+type samlGroupMappingResponse struct {
+	Value   string `json:"value"`
+	GroupId string `json:"group_id"`
+}
+
+type samlProviderResponse struct {
+	EntityId        string                     `json:"entity_id"`
+	SSOURL          string                     `json:"sso_url"`
+	EmailAttribute  string                     `json:"email_attribute"`
+	GroupsAttribute string                     `json:"groups_attribute"`
+	GroupMappings   []samlGroupMappingResponse `json:"group_mappings"`
+	SPEntityId      string                     `json:"sp_entity_id"`
+	ACSURL          string                     `json:"acs_url"`
+	CreatedAt       time.Time                  `json:"created_at"`
+	UpdatedAt       time.Time                  `json:"updated_at"`
+}
+
+type samlLoginResponse struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+}
+
+type samlTokenRequest struct {
+	Code  *string `json:"code,omitempty"`
+	State *string `json:"state,omitempty"`
+}
+
+// samlProviderName is what an organization's SAML identities are stored under in external_identities
+func samlProviderName(organizationId string) string {
+	return "saml:" + organizationId
+}
+
+// samlServiceProvider describes kubrik to an organization's IdP. idp is nil when only the URLs are needed.
+func samlServiceProvider(r *http.Request, organizationId string, idp *saml.IdentityProvider) *saml.ServiceProvider {
+	base := publicURL(r) + "/organizations/" + organizationId + "/saml"
+	return &saml.ServiceProvider{
+		EntityID:  base + "/metadata",
+		ACSURL:    base + "/acs",
+		IdP:       idp,
+		ClockSkew: conf.Config.GetDuration("saml.clock_skew"),
+	}
+}
+
+func newSAMLProviderResponse(r *http.Request, p *db.SAMLProviderModel, idp *saml.IdentityProvider) *samlProviderResponse {
+	sp := samlServiceProvider(r, p.OrganizationId, idp)
+	resp := samlProviderResponse{
+		EntityId:        idp.EntityID,
+		SSOURL:          idp.SSOURL,
+		EmailAttribute:  p.EmailAttribute,
+		GroupsAttribute: p.GroupsAttribute,
+		GroupMappings:   []samlGroupMappingResponse{},
+		SPEntityId:      sp.EntityID,
+		ACSURL:          sp.ACSURL,
+		CreatedAt:       p.CreatedAt,
+		UpdatedAt:       p.UpdatedAt,
+	}
+	for _, mapping := range p.GroupMappings {
+		resp.GroupMappings = append(resp.GroupMappings, samlGroupMappingResponse{
+			Value:   mapping.AttributeValue,
+			GroupId: mapping.GroupId,
+		})
+	}
+	return &resp
+}
+
+// samlOrganizationOwner checks that the organization in the path exists and the logged in user owns it, as only
+// owners manage how their organization logs in. If not, an error response is written and ok is false.
+func samlOrganizationOwner(w http.ResponseWriter, r *http.Request) (organizationId string, ok bool) {
+	principal := CurrentPrincipal(r)
+
+	organizationId = mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return "", false
+	}
+	org, err := db.GetOrganizationById(organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return "", false
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get organization for SAML")
+		write500(w)
+		return "", false
+	}
+	if org.OwnerId != *principal.UserId {
+		write403(w)
+		return "", false
+	}
+	return organizationId, true
+}
+
+// showSAMLProvider is an http.HandlerFunc which shows an organization's SAML identity provider, along with the
+// URLs to register kubrik at it with
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the identity provider
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user doesn't own the organization
+// 404 Not Found: No organization has the id, or it has no identity provider
+// 500 Server Error:
+func showSAMLProvider(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	organizationId, ok := samlOrganizationOwner(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := db.GetSAMLProvider(organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get SAML provider")
+		write500(w)
+		return
+	}
+	idp, err := saml.ParseMetadata([]byte(p.Metadata))
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to parse stored SAML metadata")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(newSAMLProviderResponse(r, p, idp))
+}
+
+// putSAMLProvider is an http.HandlerFunc which registers, or replaces, an organization's SAML identity provider
+// from its metadata. Users logging in through it are put in the groups their groups attribute values map to.
+// It can return the following HTTP statuses:
+// 200 OK: The identity provider was saved and the body contains it
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user doesn't own the organization, or is being impersonated
+// 404 Not Found: No organization has the id
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards, the metadata can't be used or a
+// mapping refers to a group outside the organization
+// 500 Server Error:
+func putSAMLProvider(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	encoder := json.NewEncoder(w)
+
+	var req samlProviderRequest
+	var err error
+
+	organizationId, ok := samlOrganizationOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode SAML provider request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateSAMLProviderRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	idp, err := saml.ParseMetadata([]byte(*req.Metadata))
+	if err != nil {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "The metadata can't be used: " + err.Error(),
+				Fields: []string{"metadata"},
+			},
+		})
+		return
+	}
+
+	p := db.SAMLProviderModel{
+		OrganizationId:  organizationId,
+		EntityId:        idp.EntityID,
+		Metadata:        *req.Metadata,
+		EmailAttribute:  "email",
+		GroupsAttribute: "",
+		GroupMappings:   []db.SAMLGroupMappingModel{},
+	}
+	if req.EmailAttribute != nil {
+		p.EmailAttribute = *req.EmailAttribute
+	}
+	if req.GroupsAttribute != nil {
+		p.GroupsAttribute = *req.GroupsAttribute
+	}
+	if req.GroupMappings != nil {
+		for _, mapping := range *req.GroupMappings {
+			p.GroupMappings = append(p.GroupMappings, db.SAMLGroupMappingModel{
+				AttributeValue: *mapping.Value,
+				GroupId:        *mapping.GroupId,
+			})
+		}
+	}
+
+	err = db.PutSAMLProvider(&p)
+	if err == db.ErrUnknownGroup {
+		write422(w, &[]errorStruct{
+			{
+				Error:  "Groups can only be mapped to groups of the organization",
+				Fields: []string{"group_mappings"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to save SAML provider")
+		write500(w)
+		return
+	}
+	log.Security("saml_provider_saved").WithFields(logrus.Fields{
+		"organization": organizationId,
+		"user":         *CurrentPrincipal(r).UserId,
+		"entity_id":    idp.EntityID,
+	}).Info("SAML identity provider saved")
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(newSAMLProviderResponse(r, &p, idp))
+}
+
+// deleteSAMLProvider is an http.HandlerFunc which removes an organization's SAML identity provider. Users it
+// provisioned keep their accounts and groups, but have to log in some other way.
+// It can return the following HTTP statuses:
+// 204 No Content: The identity provider was removed
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has no valid access token
+// 403 Forbidden: The logged in user doesn't own the organization, or is being impersonated
+// 404 Not Found: No organization has the id, or it has no identity provider
+// 500 Server Error:
+func deleteSAMLProvider(w http.ResponseWriter, r *http.Request) {
+	organizationId, ok := samlOrganizationOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := db.DeleteSAMLProvider(organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to delete SAML provider")
+		write500(w)
+		return
+	}
+	log.Security("saml_provider_deleted").WithFields(logrus.Fields{
+		"organization": organizationId,
+		"user":         *CurrentPrincipal(r).UserId,
+	}).Info("SAML identity provider deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// showSAMLMetadata is an http.HandlerFunc which serves kubrik's SP metadata for an organization, for its owner to
+// register kubrik at their IdP with. It is public, as IdPs fetch it themselves.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the SP metadata
+// 400 Bad Request: The organization id is malformed
+// 404 Not Found: No organization has the id
+// 500 Server Error:
+func showSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	organizationId := mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return
+	}
+	if _, err := db.GetOrganizationById(organizationId); err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get organization for SAML metadata")
+		write500(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(samlServiceProvider(r, organizationId, nil).Metadata())
+}
+
+// startSAMLLogin is an http.HandlerFunc which starts logging in with an organization's SAML identity provider.
+// The client sends the user to the url in the body, and keeps the state to exchange the code the ACS later
+// redirects back with. A logged in user starting a login links the identity to their account instead, and must be
+// logged in to exchange the code.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the url to send the user to and the state
+// 400 Bad Request: The organization id is malformed
+// 401 Unauthenticated: The request has an invalid access token
+// 403 Forbidden: The user is being impersonated
+// 404 Not Found: No organization has the id, or it has no identity provider
+// 500 Server Error:
+func startSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	organizationId := mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		write400(w)
+		return
+	}
+
+	p, err := db.GetSAMLProvider(organizationId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get SAML provider")
+		write500(w)
+		return
+	}
+	idp, err := saml.ParseMetadata([]byte(p.Metadata))
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to parse stored SAML metadata")
+		write500(w)
+		return
+	}
+
+	// Only users log in, so an organization API token starts an anonymous login
+	var linkUserId *string
+	if principal := CurrentPrincipal(r); principal != nil {
+		linkUserId = principal.UserId
+	}
+
+	requestId, err := saml.NewRequestID()
+	if err != nil {
+		write500(w)
+		return
+	}
+	state, err := newOpaqueToken()
+	if err != nil {
+		write500(w)
+		return
+	}
+	now := time.Now()
+	err = db.CreateSAMLRequest(requestId, organizationId, linkUserId, hashOpaqueToken(state),
+		now.Add(conf.Config.GetDuration("saml.request_ttl")))
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store SAML request")
+		write500(w)
+		return
+	}
+
+	location, err := samlServiceProvider(r, organizationId, idp).AuthnRequestURL(requestId, "", now)
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to build SAML request")
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&samlLoginResponse{
+		URL:   location,
+		State: state,
+	})
+}
+
+// redirectSAMLError sends the browser back to the web app with why the SAML login failed
+func redirectSAMLError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, appURL("/sso/callback", url.Values{"error": {code}}), http.StatusSeeOther)
+}
+
+// samlEmail returns the email an assertion vouches for, from the provider's email attribute or else a NameID which
+// is an email, or an empty string if there is none
+func samlEmail(assertion *saml.Assertion, emailAttribute string) string {
+	email := assertion.Attribute(emailAttribute)
+	if email == "" {
+		email = assertion.NameID
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return ""
+	}
+	return email
+}
+
+// samlUser finds the user a SAML login logs in, links it to the user who started the login, or provisions a new
+// user for it. Existing accounts are never taken over by email, since the IdP only speaks for its organization,
+// unless the organization provisioned them through SCIM.
+// errSAMLIdentityTaken, errSAMLMissingEmail and errSAMLAccountExists say why there is no user to log in.
+func samlUser(login *db.SAMLLoginModel) (string, error) {
+	provider := samlProviderName(login.OrganizationId)
+
+	user, err := db.GetUserByExternalIdentity(provider, login.Subject)
+	if err == nil {
+		if login.LinkUserId != nil && *login.LinkUserId != user.Id {
+			return "", errSAMLIdentityTaken
+		}
+		return user.Id, nil
+	} else if err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	if login.LinkUserId != nil {
+		err = db.LinkExternalIdentity(provider, login.Subject, *login.LinkUserId, login.Email, false)
+		if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+			// The user is already linked to another identity at this IdP
+			return "", errSAMLIdentityTaken
+		} else if err != nil {
+			return "", err
+		}
+		return *login.LinkUserId, nil
+	}
+
+	if login.Email == "" {
+		return "", errSAMLMissingEmail
+	}
+	existing, err := db.GetUserByEmail(login.Email)
+	if err == nil {
+		// Accounts the organization provisioned through SCIM are its to claim, anyone else's aren't
+		if _, err = db.GetSCIMUser(login.OrganizationId, existing.Id); err == pgx.ErrNoRows {
+			return "", errSAMLAccountExists
+		} else if err != nil {
+			return "", err
+		}
+		err = db.LinkExternalIdentity(provider, login.Subject, existing.Id, login.Email, false)
+		if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+			return "", errSAMLIdentityTaken
+		} else if err != nil {
+			return "", err
+		}
+		return existing.Id, nil
+	} else if err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	user, err = db.CreateUserByExternalIdentity(provider, login.Subject, login.Email, false)
+	if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		// Someone signed up with the email in the meantime
+		return "", errSAMLAccountExists
+	} else if err != nil {
+		return "", err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"organization": login.OrganizationId,
+		"user":         user.Id,
+	}).Info("Provisioned user from SAML assertion")
+	go sendEmailVerification(user.Id, user.Email, false)
+	return user.Id, nil
+}
+
+// consumeSAMLResponse is an http.HandlerFunc for the assertion consumer service, which an organization's IdP posts
+// its responses to through the user's browser. Once the response is verified, the browser is redirected to the web
+// app's /sso/callback with a code to exchange at /auth/saml/token. Failures redirect there with an error instead.
+// Nothing is done for the user yet, as the browser posting the response isn't necessarily the one which started
+// the login: only the exchange, with the state, logs in, links or provisions them and syncs their groups.
+// It can return the following HTTP statuses:
+// 303 See Other: The browser is sent back to the web app with a code or an error
+func consumeSAMLResponse(w http.ResponseWriter, r *http.Request) {
+	organizationId := mux.Vars(r)["orgId"]
+	if _, err := uuid.FromString(organizationId); err != nil {
+		redirectSAMLError(w, r, samlErrInvalidRequest)
+		return
+	}
+
+	p, err := db.GetSAMLProvider(organizationId)
+	if err == pgx.ErrNoRows {
+		redirectSAMLError(w, r, samlErrInvalidRequest)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get SAML provider")
+		redirectSAMLError(w, r, samlErrServer)
+		return
+	}
+	idp, err := saml.ParseMetadata([]byte(p.Metadata))
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to parse stored SAML metadata")
+		redirectSAMLError(w, r, samlErrServer)
+		return
+	}
+
+	now := time.Now()
+	assertion, err := samlServiceProvider(r, organizationId, idp).ParseResponse(r.PostFormValue("SAMLResponse"), now)
+	if err != nil {
+		log.Security("saml_response_rejected").WithFields(logrus.Fields{
+			"organization": organizationId,
+			"ip":           clientIP(r),
+			"error":        err,
+		}).Warn("Rejected SAML response")
+		redirectSAMLError(w, r, samlErrInvalidResponse)
+		return
+	}
+
+	// Each request is answered once, which stops responses from being replayed
+	linkUserId, stateHash, err := db.ConsumeSAMLRequest(assertion.InResponseTo, organizationId)
+	if err == db.ErrSAMLRequestInvalid {
+		log.Security("saml_response_replayed").WithFields(logrus.Fields{
+			"organization": organizationId,
+			"ip":           clientIP(r),
+			"request":      assertion.InResponseTo,
+		}).Warn("SAML response doesn't answer an outstanding request")
+		redirectSAMLError(w, r, samlErrInvalidResponse)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to consume SAML request")
+		redirectSAMLError(w, r, samlErrServer)
+		return
+	}
+
+	login := db.SAMLLoginModel{
+		OrganizationId: organizationId,
+		Subject:        assertion.NameID,
+		Email:          samlEmail(assertion, p.EmailAttribute),
+		LinkUserId:     linkUserId,
+	}
+	if p.GroupsAttribute != "" {
+		login.GroupValues = assertion.Attributes[p.GroupsAttribute]
+		if login.GroupValues == nil {
+			login.GroupValues = []string{}
+		}
+	}
+
+	code, err := newOpaqueToken()
+	if err != nil {
+		redirectSAMLError(w, r, samlErrServer)
+		return
+	}
+	err = db.CreateSAMLLoginCode(hashOpaqueToken(code), &login, stateHash,
+		now.Add(conf.Config.GetDuration("saml.login_code_ttl")))
+	if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to store SAML login code")
+		redirectSAMLError(w, r, samlErrServer)
+		return
+	}
+
+	http.Redirect(w, r, appURL("/sso/callback", url.Values{"code": {code}}), http.StatusSeeOther)
+}
+
+// loginWithSAMLCode is an http.HandlerFunc which exchanges the code from a SAML login for an access token.
+// The state from starting the login must come along, so that a code can only be used by the browser which
+// started the login. A login linking an identity must be exchanged by the user linking it, with their access token.
+// Only then is the user found, linked or provisioned and put in the groups mapped from their attributes. Users with
+// a second factor still have to provide it.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains a signed JWT and a refresh token, or an mfa_pending token if the user has a second factor
+// 400 Bad Request: The request was malformed
+// 401 Unauthenticated: The code doesn't exist, has expired, was used, the state doesn't match, or the login links an
+// identity to another user than the caller
+// 403 Forbidden: The organization deactivated the user, the IdP didn't send an email for a new user, or the user is
+// being impersonated
+// 409 Conflict: The identity is linked to another user, or an account the organization doesn't manage has the email
+// 422 Unprocessable Entity: The decoded JSON doesn't meet validation standards
+// 500 Server Error:
+func loginWithSAMLCode(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req samlTokenRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		log.Logger.Error("Failing to decode SAML token request")
+		write400(w)
+		return
+	}
+
+	if valid, eStructs := validateSAMLTokenRequest(&req); !valid {
+		write422(w, eStructs)
+		return
+	}
+
+	var callerId *string
+	if principal := CurrentPrincipal(r); principal != nil {
+		callerId = principal.UserId
+	}
+	login, err := db.UseSAMLLoginCode(hashOpaqueToken(*req.Code), hashOpaqueToken(*req.State), callerId)
+	if err == db.ErrSAMLLoginCodeInvalid {
+		write401(w, &[]errorStruct{
+			{
+				Error:  "This login code is invalid or has expired",
+				Fields: []string{"code", "state"},
+			},
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to use SAML login code")
+		write500(w)
+		return
+	}
+
+	userId, err := samlUser(login)
+	switch err {
+	case nil:
+	case errSAMLIdentityTaken, errSAMLAccountExists:
+		write409(w, &[]errorStruct{
+			{
+				Error:  err.Error(),
+				Fields: []string{"code"},
+			},
+		})
+		return
+	case errSAMLMissingEmail:
+		write403WithErrors(w, &[]errorStruct{
+			{
+				Error:  err.Error(),
+				Fields: []string{"code"},
+			},
+		})
+		return
+	default:
+		log.Logger.WithField("error", err).Error("Failing to find user of SAML login")
+		write500(w)
+		return
+	}
+
+	// Users the IdP deactivated through SCIM can't log in with it anymore
+	if member, err := db.GetSCIMUser(login.OrganizationId, userId); err == nil && !member.SCIM.Active {
+		log.Security("saml_login_deactivated").WithFields(logrus.Fields{
+			"organization": login.OrganizationId,
+			"user":         userId,
+		}).Warn("Deactivated SCIM user tried to log in with SAML")
+		write403WithErrors(w, &[]errorStruct{
+			{
+				Error:  "The organization has deactivated this account",
+				Fields: []string{"code"},
+			},
+		})
+		return
+	} else if err != nil && err != pgx.ErrNoRows {
+		log.Logger.WithField("error", err).Error("Failing to get SCIM user")
+		write500(w)
+		return
+	}
+
+	if login.GroupValues != nil {
+		if err = db.SyncSAMLGroups(login.OrganizationId, userId, login.GroupValues); err != nil {
+			log.Logger.WithField("error", err).Error("Failing to sync SAML groups")
+			write500(w)
+			return
+		}
+		userPermissions.invalidateUser(userId)
+	}
+
+	log.Security("saml_login").WithFields(logrus.Fields{
+		"organization": login.OrganizationId,
+		"user":         userId,
+		"ip":           clientIP(r),
+	}).Info("User logged in with SAML")
+	completeLogin(w, r, userId)
+}
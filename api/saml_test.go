@@ -0,0 +1,25 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/mg4tv/kubrik/saml"
+)
+
+func TestSAMLEmail(T *testing.T) {
+	for _, c := range []struct {
+		nameID     string
+		attributes map[string][]string
+		expected   string
+	}{
+		{"_a1b2c3", map[string][]string{"mail": {"jane@corp.example.com"}}, "jane@corp.example.com"},
+		{"jane@corp.example.com", nil, "jane@corp.example.com"},
+		{"_a1b2c3", nil, ""},
+		{"_a1b2c3", map[string][]string{"mail": {"Jane <jane@corp.example.com>"}}, ""},
+	} {
+		assertion := &saml.Assertion{NameID: c.nameID, Attributes: c.attributes}
+		if got := samlEmail(assertion, "mail"); got != c.expected {
+			T.Errorf("expected %q for %+v, got %q", c.expected, c, got)
+		}
+	}
+}
@@ -0,0 +1,977 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	scimContentType = "application/scim+json"
+
+	scimSchemaUser      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup     = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaList      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimDefaultCount    = 100
+	scimMaxCount        = 200
+	scimMaxNameLength   = 31
+	scimMaxStringLength = 255
+)
+
+// SCIM error types from RFC 7644 section 3.12
+const (
+	scimErrInvalidFilter = "invalidFilter"
+	scimErrInvalidSyntax = "invalidSyntax"
+	scimErrInvalidPath   = "invalidPath"
+	scimErrInvalidValue  = "invalidValue"
+	scimErrUniqueness    = "uniqueness"
+)
+
+// scimFilterRegexp matches the only filters IdPs send to find a resource: an attribute equal to a string
+var scimFilterRegexp = regexp.MustCompile(`(?i)^\s*([a-z][a-z0-9.]*)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// scimMemberPathRegexp matches the path IdPs remove a single group member with
+var scimMemberPathRegexp = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+("(?:[^"\\]|\\.)*")\s*\]$`)
+
+// scimAttributes maps the attributes resources can be filtered by, which are case insensitive, to how they're
+// spelled
+var scimAttributes = map[string]string{
+	"id":           "id",
+	"username":     "userName",
+	"externalid":   "externalId",
+	"emails":       "emails.value",
+	"emails.value": "emails.value",
+	"displayname":  "displayName",
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUserResource struct {
+	Schemas    []string    `json:"schemas"`
+	Id         string      `json:"id"`
+	ExternalId *string     `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Active     bool        `json:"active"`
+	Emails     []scimEmail `json:"emails"`
+	Meta       scimMeta    `json:"meta"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id"`
+	ExternalId  *string      `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+type scimListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+type scimErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+type scimUserRequest struct {
+	UserName   *string      `json:"userName,omitempty"`
+	ExternalId *string      `json:"externalId,omitempty"`
+	Active     *bool        `json:"active,omitempty"`
+	Emails     *[]scimEmail `json:"emails,omitempty"`
+}
+
+type scimGroupRequest struct {
+	DisplayName *string       `json:"displayName,omitempty"`
+	ExternalId  *string       `json:"externalId,omitempty"`
+	Members     *[]scimMember `json:"members,omitempty"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// scimError is a request SCIM can't carry out, reported the way RFC 7644 section 3.12 describes
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+func newSCIMBadRequest(scimType, detail string) *scimError {
+	return &scimError{status: http.StatusBadRequest, scimType: scimType, detail: detail}
+}
+
+// writeSCIMError writes an error the way SCIM clients expect rather than our own error format
+func writeSCIMError(w http.ResponseWriter, err *scimError) {
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(err.status)
+	encoder.Encode(&scimErrorResponse{
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(err.status),
+		ScimType: err.scimType,
+		Detail:   err.detail,
+	})
+}
+
+func writeSCIM(w http.ResponseWriter, status int, resource interface{}) {
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	encoder.Encode(resource)
+}
+
+// RequireSCIM wraps a handler which an organization's IdP calls to provision its users and groups. Only
+// organization API tokens with the scim scope may call it, and they act in their own organization.
+func RequireSCIM(next http.Handler) http.Handler {
+	return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal := CurrentPrincipal(r); principal.OrganizationId == nil || !principal.HasScope(scopeSCIM) {
+			writeSCIMError(w, &scimError{
+				status: http.StatusForbidden,
+				detail: "SCIM needs an organization API token with the " + scopeSCIM + " scope",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// scimOrganization returns the organization a SCIM request provisions
+func scimOrganization(r *http.Request) string {
+	return *CurrentPrincipal(r).OrganizationId
+}
+
+func newSCIMUserResource(r *http.Request, user *db.UserModel) *scimUserResource {
+	return &scimUserResource{
+		Schemas:    []string{scimSchemaUser},
+		Id:         user.Id,
+		ExternalId: user.SCIM.ExternalId,
+		UserName:   user.SCIM.UserName,
+		Active:     user.SCIM.Active,
+		Emails:     []scimEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      &user.SCIM.CreatedAt,
+			LastModified: &user.SCIM.UpdatedAt,
+			Location:     publicURL(r) + "/scim/v2/Users/" + user.Id,
+		},
+	}
+}
+
+func newSCIMGroupResource(r *http.Request, group *db.GroupModel) *scimGroupResource {
+	resource := scimGroupResource{
+		Schemas:     []string{scimSchemaGroup},
+		Id:          group.Id,
+		ExternalId:  group.ExternalId,
+		DisplayName: group.Name,
+		Members:     []scimMember{},
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Location:     publicURL(r) + "/scim/v2/Groups/" + group.Id,
+		},
+	}
+	for _, member := range group.Members {
+		display := member.Email
+		if member.SCIM != nil {
+			display = member.SCIM.UserName
+		}
+		resource.Members = append(resource.Members, scimMember{
+			Value:   member.Id,
+			Display: display,
+			Ref:     publicURL(r) + "/scim/v2/Users/" + member.Id,
+		})
+	}
+	return &resource
+}
+
+// parseSCIMFilter reads a filter comparing an attribute to a string, and returns the attribute as spelled in
+// scimAttributes. An empty filter returns an empty attribute.
+func parseSCIMFilter(filter string) (attribute, value string, err error) {
+	if strings.TrimSpace(filter) == "" {
+		return "", "", nil
+	}
+	match := scimFilterRegexp.FindStringSubmatch(filter)
+	if match == nil {
+		return "", "", newSCIMBadRequest(scimErrInvalidFilter, "Only filters of the form attribute eq \"value\" are supported")
+	}
+	attribute, ok := scimAttributes[strings.ToLower(match[1])]
+	if !ok {
+		return "", "", newSCIMBadRequest(scimErrInvalidFilter, "Resources can't be filtered by "+match[1])
+	}
+	if err = json.Unmarshal([]byte(match[2]), &value); err != nil {
+		return "", "", newSCIMBadRequest(scimErrInvalidFilter, "The filter value is not a valid string")
+	}
+	return attribute, value, nil
+}
+
+// parseSCIMPage reads the 1-based startIndex and count of a list request, clamping them to what's allowed
+func parseSCIMPage(r *http.Request) (startIndex, count int) {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err = strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil {
+		count = scimDefaultCount
+	} else if count < 0 {
+		count = 0
+	} else if count > scimMaxCount {
+		count = scimMaxCount
+	}
+	return startIndex, count
+}
+
+// parseSCIMBool reads a boolean, which some IdPs send as a "True" or "False" string
+func parseSCIMBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, newSCIMBadRequest(scimErrInvalidValue, "Expected a boolean")
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, newSCIMBadRequest(scimErrInvalidValue, "Expected a boolean")
+	}
+	return b, nil
+}
+
+func parseSCIMString(raw json.RawMessage, name string) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil || len(s) > scimMaxStringLength {
+		return "", newSCIMBadRequest(scimErrInvalidValue, name+" must be a string of at most 255 characters")
+	}
+	return s, nil
+}
+
+// applySCIMUserOperation folds a PATCH operation into the changes to a user. Attributes kubrik doesn't keep, such
+// as names, are ignored. Emails are too, since the account and its email belong to the user rather than the IdP.
+func applySCIMUserOperation(patch *db.SCIMUserPatch, op scimPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return newSCIMBadRequest(scimErrInvalidSyntax, "Unknown operation "+op.Op)
+	}
+
+	// Without a path, the value holds the attributes to set
+	if op.Path == "" {
+		if kind == "remove" {
+			return newSCIMBadRequest(scimErrInvalidPath, "Remove operations need a path")
+		}
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return newSCIMBadRequest(scimErrInvalidValue, "Expected the attributes to set")
+		}
+		for path, value := range attributes {
+			if err := applySCIMUserOperation(patch, scimPatchOperation{Op: op.Op, Path: path, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch strings.ToLower(op.Path) {
+	case "active":
+		if kind == "remove" {
+			return newSCIMBadRequest(scimErrInvalidPath, "active can't be removed")
+		}
+		active, err := parseSCIMBool(op.Value)
+		if err != nil {
+			return err
+		}
+		patch.Active = &active
+	case "username":
+		if kind == "remove" {
+			return newSCIMBadRequest(scimErrInvalidPath, "userName can't be removed")
+		}
+		userName, err := parseSCIMString(op.Value, "userName")
+		if err != nil {
+			return err
+		}
+		if userName == "" {
+			return newSCIMBadRequest(scimErrInvalidValue, "userName can't be empty")
+		}
+		patch.UserName = &userName
+	case "externalid":
+		externalId := ""
+		if kind != "remove" {
+			var err error
+			if externalId, err = parseSCIMString(op.Value, "externalId"); err != nil {
+				return err
+			}
+		}
+		patch.ExternalId = &externalId
+	}
+	return nil
+}
+
+// parseSCIMMembers reads the user ids of group members
+func parseSCIMMembers(raw json.RawMessage) ([]string, error) {
+	var members []scimMember
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, newSCIMBadRequest(scimErrInvalidValue, "Expected a list of members")
+	}
+	ids := []string{}
+	for _, member := range members {
+		if _, err := uuid.FromString(member.Value); err != nil {
+			return nil, newSCIMBadRequest(scimErrInvalidValue, "Member "+member.Value+" is not a valid id")
+		}
+		ids = append(ids, member.Value)
+	}
+	return ids, nil
+}
+
+// withoutIds returns the ids which aren't in remove
+func withoutIds(ids, remove []string) []string {
+	removed := map[string]bool{}
+	for _, id := range remove {
+		removed[id] = true
+	}
+	kept := []string{}
+	for _, id := range ids {
+		if !removed[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// applySCIMGroupOperation folds a PATCH operation into the changes to a group. Operations apply in order, so
+// removing all members and then adding one leaves the group with only that member.
+func applySCIMGroupOperation(patch *db.SCIMGroupPatch, op scimPatchOperation) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return newSCIMBadRequest(scimErrInvalidSyntax, "Unknown operation "+op.Op)
+	}
+
+	// Without a path, the value holds the attributes to set
+	if op.Path == "" {
+		if kind == "remove" {
+			return newSCIMBadRequest(scimErrInvalidPath, "Remove operations need a path")
+		}
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return newSCIMBadRequest(scimErrInvalidValue, "Expected the attributes to set")
+		}
+		for path, value := range attributes {
+			if err := applySCIMGroupOperation(patch, scimPatchOperation{Op: op.Op, Path: path, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if match := scimMemberPathRegexp.FindStringSubmatch(op.Path); match != nil {
+		var id string
+		if kind != "remove" || json.Unmarshal([]byte(match[1]), &id) != nil {
+			return newSCIMBadRequest(scimErrInvalidPath, "Members can only be removed by value")
+		}
+		if _, err := uuid.FromString(id); err != nil {
+			return newSCIMBadRequest(scimErrInvalidValue, "Member "+id+" is not a valid id")
+		}
+		op = scimPatchOperation{Op: op.Op, Path: "members", Value: json.RawMessage(`[{"value":` + match[1] + `}]`)}
+	}
+
+	switch strings.ToLower(op.Path) {
+	case "displayname":
+		if kind == "remove" {
+			return newSCIMBadRequest(scimErrInvalidPath, "displayName can't be removed")
+		}
+		name, err := parseSCIMString(op.Value, "displayName")
+		if err != nil {
+			return err
+		}
+		if name == "" || len(name) > scimMaxNameLength {
+			return newSCIMBadRequest(scimErrInvalidValue, "displayName must be between 1 and 31 characters")
+		}
+		patch.Name = &name
+	case "externalid":
+		externalId := ""
+		if kind != "remove" {
+			var err error
+			if externalId, err = parseSCIMString(op.Value, "externalId"); err != nil {
+				return err
+			}
+		}
+		patch.ExternalId = &externalId
+	case "members":
+		// Removing members without saying which removes them all
+		if kind == "remove" && len(op.Value) == 0 {
+			patch.ReplaceMembers = true
+			patch.Members = []string{}
+			patch.AddMemberIds = nil
+			patch.RemoveMemberIds = nil
+			return nil
+		}
+		ids, err := parseSCIMMembers(op.Value)
+		if err != nil {
+			return err
+		}
+		switch {
+		case kind == "replace":
+			patch.ReplaceMembers = true
+			patch.Members = ids
+			patch.AddMemberIds = nil
+			patch.RemoveMemberIds = nil
+		case kind == "add" && patch.ReplaceMembers:
+			patch.Members = append(withoutIds(patch.Members, ids), ids...)
+		case kind == "add":
+			patch.AddMemberIds = append(withoutIds(patch.AddMemberIds, ids), ids...)
+			patch.RemoveMemberIds = withoutIds(patch.RemoveMemberIds, ids)
+		case patch.ReplaceMembers:
+			patch.Members = withoutIds(patch.Members, ids)
+		default:
+			patch.RemoveMemberIds = append(withoutIds(patch.RemoveMemberIds, ids), ids...)
+			patch.AddMemberIds = withoutIds(patch.AddMemberIds, ids)
+		}
+	default:
+		return newSCIMBadRequest(scimErrInvalidPath, "Groups have no attribute "+op.Path)
+	}
+	return nil
+}
+
+// decodeSCIMPatch reads a PATCH request body. If it can't be read, an error response is written and ok is false.
+func decodeSCIMPatch(w http.ResponseWriter, r *http.Request) (req *scimPatchRequest, ok bool) {
+	decoder := json.NewDecoder(r.Body)
+
+	req = &scimPatchRequest{}
+	if err := decoder.Decode(req); err != nil {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidSyntax, "The request body is not valid JSON"))
+		return nil, false
+	}
+	if len(req.Operations) == 0 {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidSyntax, "The request has no Operations"))
+		return nil, false
+	}
+	return req, true
+}
+
+// scimResourceId reads the id in the path. Ids that aren't UUIDs can't exist, so they get a 404.
+func scimResourceId(w http.ResponseWriter, r *http.Request, name string) (id string, ok bool) {
+	id = mux.Vars(r)[name]
+	if _, err := uuid.FromString(id); err != nil {
+		writeSCIMError(w, &scimError{status: http.StatusNotFound, detail: "Resource " + id + " not found"})
+		return "", false
+	}
+	return id, true
+}
+
+func writeSCIMNotFound(w http.ResponseWriter, id string) {
+	writeSCIMError(w, &scimError{status: http.StatusNotFound, detail: "Resource " + id + " not found"})
+}
+
+func writeSCIMServerError(w http.ResponseWriter) {
+	writeSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "Server error"})
+}
+
+// listSCIMUsers is an http.HandlerFunc which lists the users the organization provisioned, optionally filtered by
+// id, userName, externalId or emails.value
+// It can return the following HTTP statuses:
+// 200 OK: The body contains a page of users
+// 400 Bad Request: The filter is not supported
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 500 Server Error:
+func listSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	attribute, value, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeSCIMError(w, err.(*scimError))
+		return
+	}
+	startIndex, count := parseSCIMPage(r)
+
+	users, total, err := db.ListSCIMUsers(scimOrganization(r), attribute, value, startIndex-1, count)
+	if err == db.ErrUnsupportedFilter {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidFilter, "Users can't be filtered by "+attribute))
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list SCIM users")
+		writeSCIMServerError(w)
+		return
+	}
+
+	resources := []*scimUserResource{}
+	for i := range users {
+		resources = append(resources, newSCIMUserResource(r, &users[i]))
+	}
+	writeSCIM(w, http.StatusOK, &scimListResponse{
+		Schemas:      []string{scimSchemaList},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// createSCIMUser is an http.HandlerFunc which provisions a user for the organization's IdP. The user gets a new
+// account with their primary email, or their userName if it is an email, and logs in through the organization's
+// SAML IdP. Existing accounts are never taken over, so an email which already has one is a conflict.
+// It can return the following HTTP statuses:
+// 201 Created: The user was provisioned and the body contains them
+// 400 Bad Request: The request was malformed or has no usable email
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 409 Conflict: An account already has the email, or the organization provisioned someone with the userName
+// 500 Server Error:
+func createSCIMUser(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req scimUserRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidSyntax, "The request body is not valid JSON"))
+		return
+	}
+	if req.UserName == nil || *req.UserName == "" || len(*req.UserName) > scimMaxStringLength {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "userName must be between 1 and 255 characters"))
+		return
+	}
+	if req.ExternalId != nil && len(*req.ExternalId) > scimMaxStringLength {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "externalId must be at most 255 characters"))
+		return
+	}
+
+	email := *req.UserName
+	if req.Emails != nil && len(*req.Emails) > 0 {
+		email = (*req.Emails)[0].Value
+		for _, e := range *req.Emails {
+			if e.Primary {
+				email = e.Value
+			}
+		}
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email || len(email) > scimMaxStringLength {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "The user needs a primary email, or a userName which is one"))
+		return
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	organizationId := scimOrganization(r)
+	user, err := db.CreateSCIMUser(organizationId, *req.UserName, email, req.ExternalId, active)
+	if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		writeSCIMError(w, &scimError{
+			status:   http.StatusConflict,
+			scimType: scimErrUniqueness,
+			detail:   "An account already has this email, or a user already has this userName",
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to create SCIM user")
+		writeSCIMServerError(w)
+		return
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"user":         user.Id,
+	}).Info("Provisioned user through SCIM")
+
+	w.Header().Set("Location", publicURL(r)+"/scim/v2/Users/"+user.Id)
+	writeSCIM(w, http.StatusCreated, newSCIMUserResource(r, user))
+}
+
+// showSCIMUser is an http.HandlerFunc which shows a user the organization provisioned
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the user
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization didn't provision a user with the id
+// 500 Server Error:
+func showSCIMUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := scimResourceId(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	user, err := db.GetSCIMUser(scimOrganization(r), userId)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, userId)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get SCIM user")
+		writeSCIMServerError(w)
+		return
+	}
+
+	writeSCIM(w, http.StatusOK, newSCIMUserResource(r, user))
+}
+
+// patchSCIMUser is an http.HandlerFunc which changes a user the organization provisioned. IdPs deactivate users by
+// replacing active with false, which takes them out of all of the organization's groups and stops them logging in
+// through its SAML IdP.
+// It can return the following HTTP statuses:
+// 200 OK: The user was changed and the body contains them
+// 400 Bad Request: The request was malformed or has an operation which can't be carried out
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization didn't provision a user with the id
+// 409 Conflict: The organization provisioned someone else with the new userName
+// 500 Server Error:
+func patchSCIMUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := scimResourceId(w, r, "userId")
+	if !ok {
+		return
+	}
+	req, ok := decodeSCIMPatch(w, r)
+	if !ok {
+		return
+	}
+
+	patch := db.SCIMUserPatch{}
+	for _, op := range req.Operations {
+		if err := applySCIMUserOperation(&patch, op); err != nil {
+			writeSCIMError(w, err.(*scimError))
+			return
+		}
+	}
+
+	organizationId := scimOrganization(r)
+	user, err := db.PatchSCIMUser(organizationId, userId, &patch)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, userId)
+		return
+	} else if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		writeSCIMError(w, &scimError{
+			status:   http.StatusConflict,
+			scimType: scimErrUniqueness,
+			detail:   "A user already has this userName",
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to patch SCIM user")
+		writeSCIMServerError(w)
+		return
+	}
+	userPermissions.invalidateUser(userId)
+	if patch.Active != nil && !*patch.Active {
+		log.Security("scim_user_deactivated").WithFields(logrus.Fields{
+			"organization": organizationId,
+			"user":         userId,
+		}).Info("User deactivated through SCIM")
+	}
+
+	writeSCIM(w, http.StatusOK, newSCIMUserResource(r, user))
+}
+
+// deleteSCIMUser is an http.HandlerFunc which deprovisions a user from the organization. They are taken out of its
+// groups but keep their account.
+// It can return the following HTTP statuses:
+// 204 No Content: The user was deprovisioned
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization didn't provision a user with the id
+// 500 Server Error:
+func deleteSCIMUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := scimResourceId(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	organizationId := scimOrganization(r)
+	err := db.DeleteSCIMUser(organizationId, userId)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, userId)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to delete SCIM user")
+		writeSCIMServerError(w)
+		return
+	}
+	userPermissions.invalidateUser(userId)
+	log.Security("scim_user_deleted").WithFields(logrus.Fields{
+		"organization": organizationId,
+		"user":         userId,
+	}).Info("User deprovisioned through SCIM")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSCIMGroups is an http.HandlerFunc which lists the organization's groups, optionally filtered by id,
+// displayName or externalId. Members are left out when excludedAttributes has members.
+// It can return the following HTTP statuses:
+// 200 OK: The body contains a page of groups
+// 400 Bad Request: The filter is not supported
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 500 Server Error:
+func listSCIMGroups(w http.ResponseWriter, r *http.Request) {
+	attribute, value, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeSCIMError(w, err.(*scimError))
+		return
+	}
+	startIndex, count := parseSCIMPage(r)
+	withMembers := !strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+
+	groups, total, err := db.ListSCIMGroups(scimOrganization(r), attribute, value, startIndex-1, count, withMembers)
+	if err == db.ErrUnsupportedFilter {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidFilter, "Groups can't be filtered by "+attribute))
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to list SCIM groups")
+		writeSCIMServerError(w)
+		return
+	}
+
+	resources := []*scimGroupResource{}
+	for i := range groups {
+		resource := newSCIMGroupResource(r, &groups[i])
+		if !withMembers {
+			resource.Members = nil
+		}
+		resources = append(resources, resource)
+	}
+	writeSCIM(w, http.StatusOK, &scimListResponse{
+		Schemas:      []string{scimSchemaList},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// createSCIMGroup is an http.HandlerFunc which creates a group in the organization for its IdP. Members must be
+// active users the organization provisioned.
+// It can return the following HTTP statuses:
+// 201 Created: The group was created and the body contains it
+// 400 Bad Request: The request was malformed, or a member isn't an active user the organization provisioned
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 409 Conflict: The organization already has a group with the displayName
+// 500 Server Error:
+func createSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req scimGroupRequest
+	var err error
+
+	if err = decoder.Decode(&req); err != nil {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidSyntax, "The request body is not valid JSON"))
+		return
+	}
+	if req.DisplayName == nil || *req.DisplayName == "" || len(*req.DisplayName) > scimMaxNameLength {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "displayName must be between 1 and 31 characters"))
+		return
+	}
+	if req.ExternalId != nil && len(*req.ExternalId) > scimMaxStringLength {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "externalId must be at most 255 characters"))
+		return
+	}
+	memberIds := []string{}
+	if req.Members != nil {
+		for _, member := range *req.Members {
+			if _, err = uuid.FromString(member.Value); err != nil {
+				writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "Member "+member.Value+" is not a valid id"))
+				return
+			}
+			memberIds = append(memberIds, member.Value)
+		}
+	}
+
+	organizationId := scimOrganization(r)
+	group, err := db.CreateSCIMGroup(organizationId, *req.DisplayName, req.ExternalId, memberIds)
+	if err == db.ErrUnknownMember {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "Members must be active users provisioned by the organization"))
+		return
+	} else if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		writeSCIMError(w, &scimError{
+			status:   http.StatusConflict,
+			scimType: scimErrUniqueness,
+			detail:   "A group already has this displayName",
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to create SCIM group")
+		writeSCIMServerError(w)
+		return
+	}
+	userPermissions.invalidateOrganization(organizationId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        group.Id,
+	}).Info("Created group through SCIM")
+
+	w.Header().Set("Location", publicURL(r)+"/scim/v2/Groups/"+group.Id)
+	writeSCIM(w, http.StatusCreated, newSCIMGroupResource(r, group))
+}
+
+// showSCIMGroup is an http.HandlerFunc which shows one of the organization's groups with its members
+// It can return the following HTTP statuses:
+// 200 OK: The body contains the group
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization has no group with the id
+// 500 Server Error:
+func showSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	groupId, ok := scimResourceId(w, r, "groupId")
+	if !ok {
+		return
+	}
+
+	group, err := db.GetSCIMGroup(scimOrganization(r), groupId)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, groupId)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to get SCIM group")
+		writeSCIMServerError(w)
+		return
+	}
+
+	writeSCIM(w, http.StatusOK, newSCIMGroupResource(r, group))
+}
+
+// patchSCIMGroup is an http.HandlerFunc which renames one of the organization's groups or changes its members.
+// Added members must be active users the organization provisioned.
+// It can return the following HTTP statuses:
+// 200 OK: The group was changed and the body contains it
+// 400 Bad Request: The request was malformed, has an operation which can't be carried out, or adds a member who
+// isn't an active user the organization provisioned
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization has no group with the id
+// 409 Conflict: The organization already has a group with the new displayName
+// 500 Server Error:
+func patchSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	groupId, ok := scimResourceId(w, r, "groupId")
+	if !ok {
+		return
+	}
+	req, ok := decodeSCIMPatch(w, r)
+	if !ok {
+		return
+	}
+
+	patch := db.SCIMGroupPatch{}
+	for _, op := range req.Operations {
+		if err := applySCIMGroupOperation(&patch, op); err != nil {
+			writeSCIMError(w, err.(*scimError))
+			return
+		}
+	}
+
+	group, err := db.PatchSCIMGroup(scimOrganization(r), groupId, &patch)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, groupId)
+		return
+	} else if err == db.ErrUnknownMember {
+		writeSCIMError(w, newSCIMBadRequest(scimErrInvalidValue, "Members must be active users provisioned by the organization"))
+		return
+	} else if pgErr, isPgErr := err.(pgx.PgError); isPgErr && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		writeSCIMError(w, &scimError{
+			status:   http.StatusConflict,
+			scimType: scimErrUniqueness,
+			detail:   "A group already has this displayName",
+		})
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to patch SCIM group")
+		writeSCIMServerError(w)
+		return
+	}
+	userPermissions.invalidateOrganization(scimOrganization(r))
+
+	writeSCIM(w, http.StatusOK, newSCIMGroupResource(r, group))
+}
+
+// deleteSCIMGroup is an http.HandlerFunc which deletes one of the organization's groups
+// It can return the following HTTP statuses:
+// 204 No Content: The group was deleted
+// 401 Unauthenticated: The request has no valid API token
+// 403 Forbidden: The token is not an organization token with the scim scope
+// 404 Not Found: The organization has no group with the id
+// 500 Server Error:
+func deleteSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	groupId, ok := scimResourceId(w, r, "groupId")
+	if !ok {
+		return
+	}
+
+	organizationId := scimOrganization(r)
+	err := db.DeleteSCIMGroup(organizationId, groupId)
+	if err == pgx.ErrNoRows {
+		writeSCIMNotFound(w, groupId)
+		return
+	} else if err != nil {
+		log.Logger.WithField("error", err).Error("Failing to delete SCIM group")
+		writeSCIMServerError(w)
+		return
+	}
+	userPermissions.invalidateOrganization(organizationId)
+	log.Logger.WithFields(logrus.Fields{
+		"organization": organizationId,
+		"group":        groupId,
+	}).Info("Deleted group through SCIM")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RouteSCIM adds the SCIM 2.0 endpoints organizations' IdPs provision users and groups with. Which organization is
+// provisioned comes from the API token.
+func RouteSCIM(router *mux.Router) {
+	scimRouter := router.PathPrefix("/scim/v2").Subrouter()
+
+	scimRouter.Handle("/Users", RequireSCIM(http.HandlerFunc(listSCIMUsers))).Methods("GET")
+	scimRouter.Handle("/Users", RequireSCIM(http.HandlerFunc(createSCIMUser))).Methods("POST")
+	scimRouter.Handle("/Users/{userId}", RequireSCIM(http.HandlerFunc(showSCIMUser))).Methods("GET")
+	scimRouter.Handle("/Users/{userId}", RequireSCIM(http.HandlerFunc(patchSCIMUser))).Methods("PATCH")
+	scimRouter.Handle("/Users/{userId}", RequireSCIM(http.HandlerFunc(deleteSCIMUser))).Methods("DELETE")
+
+	scimRouter.Handle("/Groups", RequireSCIM(http.HandlerFunc(listSCIMGroups))).Methods("GET")
+	scimRouter.Handle("/Groups", RequireSCIM(http.HandlerFunc(createSCIMGroup))).Methods("POST")
+	scimRouter.Handle("/Groups/{groupId}", RequireSCIM(http.HandlerFunc(showSCIMGroup))).Methods("GET")
+	scimRouter.Handle("/Groups/{groupId}", RequireSCIM(http.HandlerFunc(patchSCIMGroup))).Methods("PATCH")
+	scimRouter.Handle("/Groups/{groupId}", RequireSCIM(http.HandlerFunc(deleteSCIMGroup))).Methods("DELETE")
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mg4tv/kubrik/db"
+)
+
+func TestParseSCIMFilter(T *testing.T) {
+	for _, c := range []struct {
+		filter    string
+		attribute string
+		value     string
+	}{
+		{"", "", ""},
+		{`userName eq "jane@corp.example.com"`, "userName", "jane@corp.example.com"},
+		{`USERNAME EQ "Jane"`, "userName", "Jane"},
+		{`emails.value eq "jane@corp.example.com"`, "emails.value", "jane@corp.example.com"},
+		{`displayName eq "Video \"Editors\""`, "displayName", `Video "Editors"`},
+	} {
+		attribute, value, err := parseSCIMFilter(c.filter)
+		if err != nil {
+			T.Errorf("%q: %v", c.filter, err)
+			continue
+		}
+		if attribute != c.attribute || value != c.value {
+			T.Errorf("%q: expected %s %q, got %s %q", c.filter, c.attribute, c.value, attribute, value)
+		}
+	}
+
+	for _, filter := range []string{
+		`userName sw "jane"`,
+		`userName eq "jane" or userName eq "john"`,
+		`title eq "Director"`,
+		`userName eq jane`,
+	} {
+		if _, _, err := parseSCIMFilter(filter); err == nil {
+			T.Errorf("expected %q to be rejected", filter)
+		}
+	}
+}
+
+func scimOperations(T *testing.T, body string) []scimPatchOperation {
+	var req scimPatchRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		T.Fatal(err)
+	}
+	return req.Operations
+}
+
+func TestApplySCIMUserOperation(T *testing.T) {
+	for _, body := range []string{
+		`{"Operations": [{"op": "replace", "path": "active", "value": false}]}`,
+		`{"Operations": [{"op": "Replace", "value": {"active": "False"}}]}`,
+	} {
+		patch := db.SCIMUserPatch{}
+		for _, op := range scimOperations(T, body) {
+			if err := applySCIMUserOperation(&patch, op); err != nil {
+				T.Fatalf("%s: %v", body, err)
+			}
+		}
+		if patch.Active == nil || *patch.Active || patch.UserName != nil {
+			T.Errorf("%s: expected only a deactivation, got %+v", body, patch)
+		}
+	}
+
+	patch := db.SCIMUserPatch{}
+	body := `{"Operations": [
+		{"op": "replace", "path": "userName", "value": "jane.doe"},
+		{"op": "remove", "path": "externalId"},
+		{"op": "replace", "path": "name.givenName", "value": "Jane"}
+	]}`
+	for _, op := range scimOperations(T, body) {
+		if err := applySCIMUserOperation(&patch, op); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if patch.UserName == nil || *patch.UserName != "jane.doe" || patch.ExternalId == nil || *patch.ExternalId != "" {
+		T.Errorf("unexpected patch %+v", patch)
+	}
+
+	for _, body := range []string{
+		`{"Operations": [{"op": "move", "path": "active", "value": false}]}`,
+		`{"Operations": [{"op": "replace", "path": "active", "value": "maybe"}]}`,
+		`{"Operations": [{"op": "remove", "path": "userName"}]}`,
+	} {
+		patch := db.SCIMUserPatch{}
+		if err := applySCIMUserOperation(&patch, scimOperations(T, body)[0]); err == nil {
+			T.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
+
+func TestApplySCIMGroupOperation(T *testing.T) {
+	const (
+		jane = "0b0e6a4c-7b0e-4f43-9a51-2a8d0f0f6c11"
+		john = "5d9c2c1e-3f4a-4c8b-9e7d-6a1b2c3d4e5f"
+	)
+	for _, c := range []struct {
+		body     string
+		expected db.SCIMGroupPatch
+	}{
+		{
+			`{"Operations": [{"op": "add", "path": "members", "value": [{"value": "` + jane + `"}]}]}`,
+			db.SCIMGroupPatch{AddMemberIds: []string{jane}, RemoveMemberIds: []string{}},
+		},
+		{
+			`{"Operations": [
+				{"op": "add", "path": "members", "value": [{"value": "` + jane + `"}, {"value": "` + john + `"}]},
+				{"op": "remove", "path": "members[value eq \"` + jane + `\"]"}
+			]}`,
+			db.SCIMGroupPatch{AddMemberIds: []string{john}, RemoveMemberIds: []string{jane}},
+		},
+		{
+			`{"Operations": [
+				{"op": "remove", "path": "members"},
+				{"op": "add", "path": "members", "value": [{"value": "` + john + `"}]}
+			]}`,
+			db.SCIMGroupPatch{ReplaceMembers: true, Members: []string{john}},
+		},
+		{
+			`{"Operations": [{"op": "replace", "value": {"displayName": "Editors", "externalId": "ext-1"}}]}`,
+			db.SCIMGroupPatch{Name: stringPointer("Editors"), ExternalId: stringPointer("ext-1")},
+		},
+	} {
+		patch := db.SCIMGroupPatch{}
+		for _, op := range scimOperations(T, c.body) {
+			if err := applySCIMGroupOperation(&patch, op); err != nil {
+				T.Fatalf("%s: %v", c.body, err)
+			}
+		}
+		if !reflect.DeepEqual(patch, c.expected) {
+			T.Errorf("%s: expected %+v, got %+v", c.body, c.expected, patch)
+		}
+	}
+
+	for _, body := range []string{
+		`{"Operations": [{"op": "add", "path": "members", "value": [{"value": "not-an-id"}]}]}`,
+		`{"Operations": [{"op": "replace", "path": "displayName", "value": "A name much longer than groups can have"}]}`,
+		`{"Operations": [{"op": "replace", "path": "owner", "value": "x"}]}`,
+	} {
+		patch := db.SCIMGroupPatch{}
+		if err := applySCIMGroupOperation(&patch, scimOperations(T, body)[0]); err == nil {
+			T.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/mg4tv/kubrik/log"
+	"github.com/satori/go.uuid"
+)
+
+type sessionResponse struct {
+	Id         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IpAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+	// Sessions a kubrik admin started as the user
+	Impersonated bool `json:"impersonated"`
+}
+
+type logoutRequest struct {
+	All *bool `json:"all,omitempty"`
+}
+
+type sessionCacheEntry struct {
+	userId    string
+	active    bool
+	mfa       bool
+	expiresAt time.Time
+}
+
+// sessionCache remembers whether the session behind an access token jti is still active, so that validating a token
+// doesn't need a database round trip on every request. Revocations made by this process are applied immediately,
+// revocations made by other instances are picked up once the cached entry expires (kubrik.session_cache_ttl).
+type sessionCache struct {
+	sync.Mutex
+	entries map[string]sessionCacheEntry
+}
+
+var activeSessions = &sessionCache{entries: map[string]sessionCacheEntry{}}
+
+// isActive reports whether jti belongs to an active session of the user, and whether the session was started with
+// a second factor
+func (c *sessionCache) isActive(jti, userId string) (active, mfa bool, err error) {
+	now := time.Now()
+
+	c.Lock()
+	entry, ok := c.entries[jti]
+	c.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		active = entry.active && entry.userId == userId
+		return active, active && entry.mfa, nil
+	}
+
+	entry = sessionCacheEntry{expiresAt: now.Add(conf.Config.GetDuration("kubrik.session_cache_ttl"))}
+	session, err := db.TouchSessionByJti(jti)
+	if err == nil {
+		entry.active = true
+		entry.userId = session.UserId
+		entry.mfa = session.MFAAt != nil
+	} else if err != pgx.ErrNoRows {
+		return false, false, err
+	}
+
+	c.Lock()
+	// Drop stale entries every so often so that the cache doesn't grow without bound
+	if len(c.entries) > 10000 {
+		for key, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[jti] = entry
+	c.Unlock()
+
+	active = entry.active && entry.userId == userId
+	return active, active && entry.mfa, nil
+}
+
+// invalidate forgets the given jtis so that they are checked against the database on next use
+func (c *sessionCache) invalidate(jtis ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, jti := range jtis {
+		delete(c.entries, jti)
+	}
+}
+
+// startSession records a new session for the user from the request's user agent and address, and whether they
+// proved their second factor. The session's Jti is the id to use for its first access token.
+func startSession(r *http.Request, userId string, mfa bool) (*db.SessionModel, error) {
+	userAgent := r.Header.Get("User-Agent")
+	return db.CreateSession(userId, uuid.NewV4().String(), userAgent, deviceFromUserAgent(userAgent), clientIP(r), mfa)
+}
+
+// revokeUserSessions logs a user out everywhere
+func revokeUserSessions(userId string) error {
+	jtis, err := db.RevokeUserSessions(userId)
+	if err != nil {
+		return err
+	}
+	activeSessions.invalidate(jtis...)
+	return nil
+}
+
+// clientIP returns the address of the client making the request.
+// X-Forwarded-For is only honoured when kubrik.trust_proxy_headers is set, as it is otherwise trivially spoofed.
+func clientIP(r *http.Request) string {
+	if conf.Config.GetBool("kubrik.trust_proxy_headers") {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// deviceFromUserAgent makes a rough guess at the kind of device a user agent belongs to, for display purposes only
+func deviceFromUserAgent(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "Unknown"
+	case strings.Contains(ua, "smart-tv") || strings.Contains(ua, "smarttv") || strings.Contains(ua, "appletv") ||
+		strings.Contains(ua, "roku") || strings.Contains(ua, "crkey"):
+		return "TV"
+	case strings.Contains(ua, "iphone"):
+		return "iPhone"
+	case strings.Contains(ua, "ipad"):
+		return "iPad"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "mac os"):
+		return "Mac"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	}
+	return "Other"
+}
+
+// logout is an http.HandlerFunc which revokes the session of the access token used to call it.
+// If the body is {"all": true}, every session of the user is revoked instead.
+// It can return the following HTTP statuses:
+// 204 No Content: The session(s) were revoked
+// 400 Bad Request: The request was malformed and could not be parsed by JSON decoder
+// 401 Unauthenticated: The request didn't carry a valid access token
+// 403 Forbidden: An admin impersonating the user asked to revoke every session
+// 500 Server Error:
+func logout(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var req logoutRequest
+	var err error
+
+	principal := CurrentPrincipal(r)
+
+	// An empty body is a plain logout
+	if err = decoder.Decode(&req); err != nil && err != io.EOF {
+		write400(w)
+		return
+	}
+
+	if req.All != nil && *req.All {
+		// An admin may end their own impersonation, but not log the user out everywhere
+		if principal.IsImpersonated() {
+			writeImpersonationDenied(w)
+			return
+		}
+		err = revokeUserSessions(*principal.UserId)
+	} else {
+		err = db.RevokeSessionByJti(principal.SessionId)
+		activeSessions.invalidate(principal.SessionId)
+	}
+	if err != nil && err != pgx.ErrNoRows {
+		log.Logger.WithField("error", err).Error("Failing to revoke session on logout")
+		write500(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listUserSessions is an http.HandlerFunc which lists the active sessions of the logged in user
+func listUserSessions(w http.ResponseWriter, r *http.Request) {
+	encoder := json.NewEncoder(w)
+
+	principal := CurrentPrincipal(r)
+	if mux.Vars(r)["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+
+	sessions, err := db.ListSessionsByUser(*principal.UserId)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			"db_err": err,
+		}).Debug("List sessions error")
+		write500(w)
+		return
+	}
+
+	resp := []sessionResponse{}
+	for _, session := range *sessions {
+		resp = append(resp, sessionResponse{
+			Id:           session.Id,
+			Device:       session.Device,
+			UserAgent:    session.UserAgent,
+			IpAddress:    session.IpAddress,
+			CreatedAt:    session.CreatedAt,
+			LastSeenAt:   session.LastSeenAt,
+			Current:      session.Jti == principal.SessionId,
+			Impersonated: session.ImpersonatorId != nil,
+		})
+	}
+
+	addContentTypeJSONHeader(w)
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&resp)
+}
+
+// deleteUserSession is an http.HandlerFunc which revokes one of the logged in user's sessions
+func deleteUserSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	principal := CurrentPrincipal(r)
+	if vars["id"] != *principal.UserId {
+		write403(w)
+		return
+	}
+	if _, err := uuid.FromString(vars["sid"]); err != nil {
+		write400(w)
+		return
+	}
+
+	jti, err := db.RevokeSession(vars["sid"], *principal.UserId)
+	if err == pgx.ErrNoRows {
+		write404(w)
+		return
+	} else if err != nil {
+		write500(w)
+		return
+	}
+	activeSessions.invalidate(jti)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/lockout"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// Limiters for failed credential checks. Accounts are limited tightly, client addresses loosely as many users may
+// share one behind a NAT.
+var (
+	accountLimiter *lockout.Limiter
+	ipLimiter      *lockout.Limiter
+	limitersErr    error
+	limitersOnce   sync.Once
+)
+
+// LoadLimiters reads the lockout configuration and returns any error in it.
+// The limiters are loaded once, so this should be called at startup to fail early on a bad configuration.
+func LoadLimiters() error {
+	limitersOnce.Do(func() {
+		var store lockout.Store
+		if store, limitersErr = lockout.NewStore(conf.Config); limitersErr != nil {
+			return
+		}
+		accountLimiter = lockout.NewLimiter(store, lockout.LoadPolicy(conf.Config, "lockout.account", lockout.Policy{
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        30 * time.Second,
+			Threshold:       10,
+			LockoutDuration: 15 * time.Minute,
+			Window:          time.Hour,
+		}))
+		ipLimiter = lockout.NewLimiter(store, lockout.LoadPolicy(conf.Config, "lockout.ip", lockout.Policy{
+			FreeAttempts:    20,
+			BaseDelay:       time.Second,
+			MaxDelay:        30 * time.Second,
+			Threshold:       200,
+			LockoutDuration: 15 * time.Minute,
+			Window:          time.Hour,
+		}))
+	})
+	return limitersErr
+}
+
+// throttle checks whether a client may attempt to prove credentials for an account, identified by accountKey.
+// If either the account or the client's address must wait, a 429 is written and false is returned.
+// Stores that can't be reached fail open, so that an outage doesn't lock everyone out.
+func throttle(w http.ResponseWriter, r *http.Request, event, accountKey string) bool {
+	if err := LoadLimiters(); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to load lockout limiters")
+		return true
+	}
+
+	var wait time.Duration
+	for _, c := range []struct {
+		limiter *lockout.Limiter
+		key     string
+	}{
+		{accountLimiter, accountKey},
+		{ipLimiter, "ip:" + clientIP(r)},
+	} {
+		retryAfter, err := c.limiter.Check(c.key)
+		if err != nil {
+			log.Logger.WithField("error", err).Error("Failing to check lockout")
+			continue
+		}
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+
+	log.Security(event + "_throttled").WithFields(logrus.Fields{
+		"account":     accountKey,
+		"ip":          clientIP(r),
+		"retry_after": wait.String(),
+	}).Warn("Rejected attempt during lockout")
+	write429(w, wait, &[]errorStruct{
+		{
+			Error:  "Too many failed attempts. Try again later",
+			Fields: []string{},
+		},
+	})
+	return false
+}
+
+// recordFailure counts a failed credential check against an account and the client's address
+func recordFailure(r *http.Request, event, accountKey string) {
+	if LoadLimiters() != nil {
+		return
+	}
+
+	fields := logrus.Fields{
+		"account": accountKey,
+		"ip":      clientIP(r),
+	}
+	if rec, err := accountLimiter.Fail(accountKey); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to record failed attempt")
+	} else {
+		fields["failures"] = rec.Failures
+		if accountLimiter.Policy.LockedOut(rec) {
+			fields["locked_out"] = true
+		}
+	}
+	if _, err := ipLimiter.Fail("ip:" + clientIP(r)); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to record failed attempt")
+	}
+	log.Security(event + "_failed").WithFields(fields).Warn("Failed credential check")
+}
+
+// recordSuccess forgets an account's failures once it proves its credentials. The client's address keeps its
+// count, so an attacker can't clear it by logging in to an account of their own between guesses.
+func recordSuccess(accountKey string) {
+	if LoadLimiters() != nil {
+		return
+	}
+	if err := accountLimiter.Reset(accountKey); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to reset failed attempts")
+	}
+}
+
+// loginAccountKey identifies the account a login names, whether or not it exists, so that unknown accounts are
+// throttled exactly like real ones
+func loginAccountKey(req *tokenRequest) string {
+	if req.Username != nil {
+		return "login:username:" + strings.ToLower(*req.Username)
+	}
+	return "login:email:" + strings.ToLower(*req.Email)
+}
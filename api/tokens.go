@@ -0,0 +1,97 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/db"
+)
+
+// newAccessToken signs a short lived JWT for the given user, identified by jti.
+// It returns the signed token and the number of seconds until it expires.
+func newAccessToken(userId, jti string) (string, int64, error) {
+	now := time.Now()
+	ttl := conf.Config.GetDuration("kubrik.access_token_ttl")
+
+	tokenString, err := signToken(&jwtClaims{
+		UserId: &userId,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  conf.Config.GetString("kubrik.audience"),
+			ExpiresAt: now.Add(ttl).Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			Issuer:    conf.Config.GetString("kubrik.issuer"),
+		},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return tokenString, int64(ttl / time.Second), nil
+}
+
+// newOpaqueToken generates a random, URL safe token suitable for refresh tokens and other single use secrets.
+// Only the hash of the token (see hashOpaqueToken) should ever be persisted.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashOpaqueToken hashes a token generated by newOpaqueToken for storage and lookup.
+// The tokens have 256 bits of entropy, so an unsalted SHA-256 is sufficient.
+func hashOpaqueToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// writeTokens starts a new session for the user and writes an access token and refresh token for it to the response.
+// mfa is whether the user proved their second factor to log in.
+func writeTokens(w http.ResponseWriter, r *http.Request, userId string, mfa bool) {
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	session, err := startSession(r, userId, mfa)
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	expiresAt := time.Now().Add(conf.Config.GetDuration("kubrik.refresh_token_ttl"))
+	if _, err = db.CreateRefreshToken(userId, session.Id, hashOpaqueToken(refreshToken), expiresAt); err != nil {
+		write500(w)
+		return
+	}
+
+	writeTokenResponse(w, userId, session.Jti, refreshToken)
+}
+
+func writeTokenResponse(w http.ResponseWriter, userId, jti, refreshToken string) {
+	encoder := json.NewEncoder(w)
+
+	tokenString, expiresIn, err := newAccessToken(userId, jti)
+	if err != nil {
+		write500(w)
+		return
+	}
+
+	addContentTypeJSONHeader(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(&tokenResponse{
+		Token:        tokenString,
+		TokenType:    "bearer",
+		ExpiresIn:    expiresIn,
+		RefreshToken: refreshToken,
+	})
+}
@@ -2,9 +2,9 @@ package api
 
 import (
 	"net/http"
+	"strings"
 
 	"encoding/json"
-	"golang.org/x/crypto/bcrypt"
 	"github.com/mg4tv/kubrik/db"
 	"github.com/jackc/pgx"
 	"github.com/satori/go.uuid"
@@ -25,6 +25,8 @@ type userRequest struct {
 	Email                *string `json:"email,omitempty"`
 	Password             *string `json:"password,omitempty"`
 	PasswordConfirmation *string `json:"password_confirmation,omitempty"`
+	// InvitationToken accepts the invitation to an organization the user signs up from
+	InvitationToken *string `json:"invitation_token,omitempty"`
 }
 
 // validateUser ensures that a user request is valid.
@@ -100,8 +102,34 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		write422(w, vErrs)
 		return
 	}
-	// TODO: encrypt hash
-	hash, err := bcrypt.GenerateFromPassword([]byte(*req.Password), 10)
+	if err = LoadPasswordPolicy(); err != nil {
+		log.Logger.WithField("error", err).Error("Failing to load password policy")
+		write500(w)
+		return
+	}
+	if vErrs := checkPassword(*req.Password, req.Username, *req.Email); vErrs != nil {
+		write422(w, vErrs)
+		return
+	}
+	var invitation *db.InvitationModel
+	if req.InvitationToken != nil {
+		invitation, err = db.GetPendingInvitation(hashOpaqueToken(*req.InvitationToken))
+		// Invitations to an existing user can't be accepted by a new one
+		if err == db.ErrInvitationInvalid || err == nil && invitation.InviteeId != nil {
+			write422(w, &[]errorStruct{
+				{
+					Error:  "This invitation is invalid, has expired or was already answered",
+					Fields: []string{"invitation_token"},
+				},
+			})
+			return
+		} else if err != nil {
+			log.Logger.WithField("error", err).Error("Failing to get invitation for signup")
+			write500(w)
+			return
+		}
+	}
+	hash, err := passwordPolicy.Hash(*req.Password)
 	if err != nil {
 		write500(w)
 		return
@@ -109,7 +137,7 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 
 	newUser, err := db.CreateUser(req.Username, *req.Email, hash)
 	if err != nil {
-		if pgErr := err.(pgx.PgError); pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
 			write409(w, &[]errorStruct{
 				{
 					Error: pgErr.ConstraintName + "must be unique",
@@ -129,8 +157,8 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	// Check if username is taken by groups first
 	if req.Username != nil {
 		if _, err := db.GetOrganizationByName(*req.Username); err == pgx.ErrNoRows {
-			if _, err := db.CreateOrganization(*req.Username, newUser.Id, true); err != nil {
-				if pgErr := err.(pgx.PgError); pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
+			if _, err := db.CreateOrganization(*req.Username, newUser.Id, true, roleTemplates); err != nil {
+				if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" /*duplicate key violates unique constraint*/ {
 					db.DeleteUser(newUser.Id) // FIXME: handle error
 					write409(w, &[]errorStruct{
 						{
@@ -163,6 +191,24 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Accepting the invitation verifies the email it was sent to, so there's nothing more to verify then
+	verified := false
+	if invitation != nil {
+		if _, err := db.AcceptInvitation(hashOpaqueToken(*req.InvitationToken), "", newUser.Id); err != nil {
+			log.Logger.WithField("error", err).Error("Failing to accept invitation at signup")
+		} else {
+			verified = strings.EqualFold(*invitation.Email, newUser.Email)
+			log.Logger.WithFields(logrus.Fields{
+				"organization": invitation.OrganizationId,
+				"invitation":   invitation.Id,
+				"user":         newUser.Id,
+			}).Info("Accepted invitation at signup")
+		}
+	}
+	if !verified {
+		go sendEmailVerification(newUser.Id, newUser.Email, false)
+	}
+
 	addContentTypeJSONHeader(w)
 	w.WriteHeader(http.StatusOK)
 	encoder.Encode(&userResponse{
@@ -250,10 +296,11 @@ func updateUser(_ http.ResponseWriter, _ *http.Request) {
 }
 
 func RouteUser(router *mux.Router) {
+	// See RouteOrganization for why the root path is routed before the subrouter
+	router.HandleFunc("/users", listUsers).Methods("GET")
+	router.HandleFunc("/users", createUser).Methods("POST")
 	sub := router.PathPrefix("/users").Subrouter().StrictSlash(true)
-	sub.Methods("GET").HandlerFunc(listUsers)
 	sub.HandleFunc("/", listUsers).Methods("GET")
-	sub.Methods("POST").HandlerFunc(createUser)
 	sub.HandleFunc("/", createUser).Methods("POST")
 
 	sub.HandleFunc("/{id}", deleteUser).Methods("DELETE")
@@ -261,6 +308,27 @@ func RouteUser(router *mux.Router) {
 	sub.HandleFunc("/{id}", partiallyUpdateUser).Methods("PATCH")
 	sub.HandleFunc("/{id}", updateUser).Methods("PUT")
 
+	sub.Handle("/{id}/sessions", RequireLogin(http.HandlerFunc(listUserSessions))).Methods("GET")
+	sub.Handle("/{id}/sessions/{sid}", RequireLogin(DenyImpersonation(http.HandlerFunc(deleteUserSession)))).Methods("DELETE")
+
+	sub.Handle("/{id}/email", RequireLogin(DenyImpersonation(http.HandlerFunc(changeEmail)))).Methods("POST")
+	sub.Handle("/{id}/email/verification", RequireLogin(DenyImpersonation(http.HandlerFunc(resendEmailVerification)))).Methods("POST")
+
+	sub.Handle("/{id}/mfa/totp", RequireLogin(DenyImpersonation(http.HandlerFunc(enrollTOTP)))).Methods("POST")
+	sub.Handle("/{id}/mfa/totp/confirm", RequireLogin(DenyImpersonation(http.HandlerFunc(confirmTOTP)))).Methods("POST")
+	sub.Handle("/{id}/mfa/totp", RequireLogin(DenyImpersonation(http.HandlerFunc(disableTOTP)))).Methods("DELETE")
+
+	sub.Handle("/{id}/tokens", RequireLogin(http.HandlerFunc(listAPITokens))).Methods("GET")
+	sub.Handle("/{id}/tokens", RequireLogin(DenyImpersonation(http.HandlerFunc(createAPIToken)))).Methods("POST")
+	sub.Handle("/{id}/tokens/{tokenId}", RequireLogin(DenyImpersonation(http.HandlerFunc(revokeAPIToken)))).Methods("DELETE")
+
+	sub.Handle("/{id}/organizations", RequireAuth(http.HandlerFunc(listUserOrganizations))).Methods("GET")
+	sub.Handle("/{id}/invitations", RequireLogin(http.HandlerFunc(listUserInvitations))).Methods("GET")
+
+	sub.Handle("/{id}/identities", RequireLogin(http.HandlerFunc(listUserIdentities))).Methods("GET")
+	sub.Handle("/{id}/identities/{provider}", RequireLogin(DenyImpersonation(http.HandlerFunc(linkUserIdentity)))).Methods("POST")
+	sub.Handle("/{id}/identities/{provider}", RequireLogin(DenyImpersonation(http.HandlerFunc(unlinkUserIdentity)))).Methods("DELETE")
+
 	router.HandleFunc("/userByUsername/{username}", showUserByUsername).Methods("GET")
 	//router.GET("/usersByEmail/:email", showUserByEmail)
 }
@@ -1,5 +1,11 @@
 package api
 
+import (
+	"net/mail"
+
+	"github.com/satori/go.uuid"
+)
+
 func validateTokenRequest(r *tokenRequest) (bool, *[]errorStruct) {
 
 	valid := true
@@ -33,14 +39,445 @@ func validateTokenRequest(r *tokenRequest) (bool, *[]errorStruct) {
 	return true, nil
 }
 
-func validateFacebookTokenRequest(r *clientFacebookTokenRequest) bool {
-	return true
+func validateRefreshTokenRequest(r *refreshTokenRequest) (bool, *[]errorStruct) {
+	if r.RefreshToken == nil || *r.RefreshToken == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have a refresh token",
+				Fields: []string{"refresh_token"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateProviderTokenRequest(r *clientProviderTokenRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.IdToken == nil && r.Code == nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have either an id_token or a code",
+			Fields: []string{"id_token", "code"},
+		})
+	} else if r.IdToken != nil && r.Code != nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have only an id_token or a code, not both",
+			Fields: []string{"id_token", "code"},
+		})
+	} else if r.Code != nil && r.RedirectURI == nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request with a code must have the redirect_uri it was issued for",
+			Fields: []string{"redirect_uri"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateForgotPasswordRequest(r *forgotPasswordRequest) (bool, *[]errorStruct) {
+	if r.Email == nil || *r.Email == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have an email",
+				Fields: []string{"email"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateMagicLinkRequest(r *magicLinkRequest) (bool, *[]errorStruct) {
+	if r.Email == nil || *r.Email == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have an email",
+				Fields: []string{"email"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateMagicLinkTokenRequest(r *magicLinkTokenRequest) (bool, *[]errorStruct) {
+	if r.Token == nil || *r.Token == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have a login token",
+				Fields: []string{"token"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateResetPasswordRequest(r *resetPasswordRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.Token == nil || *r.Token == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a reset token",
+			Fields: []string{"token"},
+		})
+	}
+
+	if r.Password == nil || *r.Password == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a password",
+			Fields: []string{"password"},
+		})
+	} else if r.PasswordConfirmation == nil || *r.PasswordConfirmation != *r.Password {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Password and password confirmation must match",
+			Fields: []string{"password", "password_confirmation"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateVerifyEmailRequest(r *verifyEmailRequest) (bool, *[]errorStruct) {
+	if r.Token == nil || *r.Token == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have a verification token",
+				Fields: []string{"token"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateChangeEmailRequest(r *changeEmailRequest) (bool, *[]errorStruct) {
+	if r.Email == nil || *r.Email == "" {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have an email",
+				Fields: []string{"email"},
+			},
+		}
+	}
+	if addr, err := mail.ParseAddress(*r.Email); err != nil || addr.Address != *r.Email {
+		return false, &[]errorStruct{
+			{
+				Error:  "Email must be a plain email address",
+				Fields: []string{"email"},
+			},
+		}
+	}
+
+	return true, nil
+}
+
+func validateMFARequest(r *mfaRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.MfaToken == nil || *r.MfaToken == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have an mfa_token",
+			Fields: []string{"mfa_token"},
+		})
+	}
+
+	if r.Code == nil && r.RecoveryCode == nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a code or a recovery code",
+			Fields: []string{"code", "recovery_code"},
+		})
+	} else if r.Code != nil && r.RecoveryCode != nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have only a code or a recovery code, not both",
+			Fields: []string{"code", "recovery_code"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateAPITokenRequest(r *apiTokenRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.Name == nil || *r.Name == "" || len(*r.Name) > 255 {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a name of at most 255 characters",
+			Fields: []string{"name"},
+		})
+	}
+
+	if r.Scopes == nil || len(*r.Scopes) == 0 {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have at least one scope",
+			Fields: []string{"scopes"},
+		})
+	} else {
+		for _, scope := range *r.Scopes {
+			if !validScopes[scope] {
+				valid = false
+				eStructs = append(eStructs, errorStruct{
+					Error:  "Unknown scope " + scope,
+					Fields: []string{"scopes"},
+				})
+			}
+		}
+	}
+
+	if r.ExpiresIn != nil && *r.ExpiresIn <= 0 {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Expiry must be a positive number of seconds",
+			Fields: []string{"expires_in"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateSAMLProviderRequest(r *samlProviderRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.Metadata == nil || *r.Metadata == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have the identity provider's metadata",
+			Fields: []string{"metadata"},
+		})
+	}
+
+	if r.EmailAttribute != nil && (*r.EmailAttribute == "" || len(*r.EmailAttribute) > 255) {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Email attribute must be between 1 and 255 characters",
+			Fields: []string{"email_attribute"},
+		})
+	}
+
+	if r.GroupsAttribute != nil && len(*r.GroupsAttribute) > 255 {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Groups attribute must be at most 255 characters",
+			Fields: []string{"groups_attribute"},
+		})
+	}
+
+	if r.GroupMappings != nil && len(*r.GroupMappings) > 0 {
+		if r.GroupsAttribute == nil || *r.GroupsAttribute == "" {
+			valid = false
+			eStructs = append(eStructs, errorStruct{
+				Error:  "Groups can only be mapped from a groups attribute",
+				Fields: []string{"groups_attribute", "group_mappings"},
+			})
+		}
+		for _, mapping := range *r.GroupMappings {
+			if mapping.Value == nil || *mapping.Value == "" || len(*mapping.Value) > 255 {
+				valid = false
+				eStructs = append(eStructs, errorStruct{
+					Error:  "Each group mapping must have a value of at most 255 characters",
+					Fields: []string{"group_mappings"},
+				})
+			}
+			if mapping.GroupId == nil {
+				valid = false
+				eStructs = append(eStructs, errorStruct{
+					Error:  "Each group mapping must have a group_id",
+					Fields: []string{"group_mappings"},
+				})
+			} else if _, err := uuid.FromString(*mapping.GroupId); err != nil {
+				valid = false
+				eStructs = append(eStructs, errorStruct{
+					Error:  "Group id " + *mapping.GroupId + " is not a valid id",
+					Fields: []string{"group_mappings"},
+				})
+			}
+		}
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateSAMLTokenRequest(r *samlTokenRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.Code == nil || *r.Code == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a login code",
+			Fields: []string{"code"},
+		})
+	}
+
+	if r.State == nil || *r.State == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have the state the login was started with",
+			Fields: []string{"state"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+// validateGroupRequest validates a group to create or replace, or with partial set the changes to make to one
+func validateOrganizationRequest(r *organizationRequest) (bool, *[]errorStruct) {
+	if r.Name == nil || *r.Name == "" || len(*r.Name) > 31 {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have a name of at most 31 characters",
+				Fields: []string{"name"},
+			},
+		}
+	}
+
+	return true, nil
 }
 
-func validateFacebookTokenResponse(r *serverFacebookTokenResponse) bool {
-	if r.AccessToken == nil {
-		return false
+func validateGroupRequest(r *groupRequest, partial bool) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if r.Name == nil && !partial || r.Name != nil && (*r.Name == "" || len(*r.Name) > 31) {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a name of at most 31 characters",
+			Fields: []string{"name"},
+		})
+	}
+
+	if partial && r.Name == nil && r.IsPublic == nil && r.Permissions == nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have a field to change",
+			Fields: []string{"name", "is_public", "permissions"},
+		})
+	}
+
+	if r.Permissions != nil {
+		for _, permission := range *r.Permissions {
+			if !validPermissions[permission] {
+				valid = false
+				eStructs = append(eStructs, errorStruct{
+					Error:  "Unknown permission " + permission,
+					Fields: []string{"permissions"},
+				})
+			}
+		}
+		if r.IsPublic != nil && *r.IsPublic && grantsManagement(*r.Permissions) {
+			valid = false
+			eStructs = append(eStructs, publicManagementGroupError)
+		}
+	}
+
+	if !valid {
+		return false, &eStructs
 	}
 
-	return true
-}
\ No newline at end of file
+	return true, nil
+}
+
+func validateInvitationRequest(r *invitationRequest) (bool, *[]errorStruct) {
+	valid := true
+	var eStructs []errorStruct
+	if (r.Email == nil) == (r.Username == nil) {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have either an email or a username to invite",
+			Fields: []string{"email", "username"},
+		})
+	} else if r.Email != nil {
+		if addr, err := mail.ParseAddress(*r.Email); err != nil || addr.Address != *r.Email || len(*r.Email) > 255 {
+			valid = false
+			eStructs = append(eStructs, errorStruct{
+				Error:  "Email must be a plain email address",
+				Fields: []string{"email"},
+			})
+		}
+	} else if *r.Username == "" {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Username cannot be empty",
+			Fields: []string{"username"},
+		})
+	}
+
+	if r.GroupId == nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Request must have the group to invite to",
+			Fields: []string{"group_id"},
+		})
+	} else if _, err := uuid.FromString(*r.GroupId); err != nil {
+		valid = false
+		eStructs = append(eStructs, errorStruct{
+			Error:  "Group id must be a UUID",
+			Fields: []string{"group_id"},
+		})
+	}
+
+	if !valid {
+		return false, &eStructs
+	}
+
+	return true, nil
+}
+
+func validateInvitationAnswerRequest(r *invitationAnswerRequest) (bool, *[]errorStruct) {
+	hasToken := r.Token != nil && *r.Token != ""
+	hasId := r.Id != nil && *r.Id != ""
+	if hasToken == hasId {
+		return false, &[]errorStruct{
+			{
+				Error:  "Request must have either the invitation's token or its id",
+				Fields: []string{"token", "id"},
+			},
+		}
+	}
+	if hasId {
+		if _, err := uuid.FromString(*r.Id); err != nil {
+			return false, &[]errorStruct{
+				{
+					Error:  "Id must be a UUID",
+					Fields: []string{"id"},
+				},
+			}
+		}
+	}
+
+	return true, nil
+}
@@ -50,19 +50,12 @@ func createVideo(w http.ResponseWriter, r *http.Request) {
 
 	var req videoRequest
 	var err error
-	var userId *string
-
-	if userId, err = GetUserIdFromToken(r.Header.Get("authorization")); err != nil {
-		if r.Header.Get("authorization") != "" {
-			write403(w)
-		} else {
-			write401(w, &[]errorStruct{
-				{
-					Error:  "This endpoint requires a logged in user.",
-					Fields: []string{"header: authorization"},
-				},
-			})
-		}
+
+	principal := CurrentPrincipal(r)
+	if !requireScope(w, principal, scopeVideosWrite) {
+		return
+	}
+	if principal.UserId != nil && !requireVerifiedEmail(w, *principal.UserId) {
 		return
 	}
 
@@ -76,12 +69,8 @@ func createVideo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var isAuthorized bool
-	if isAuthorized, err = IsAuthorized(*userId, *req.OrganizationId, "CREATE_VIDEO"); err != nil {
-		write500(w)
-		return
-	} else if !isAuthorized {
-		write403(w)
+	if err = authorizePrincipal(r, principal, *req.OrganizationId, permissionCreateVideo); err != nil {
+		writeAuthorizationError(w, err)
 		return
 	}
 
@@ -141,11 +130,12 @@ func showVideo(w http.ResponseWriter, r *http.Request) {
 }
 
 func RouteVideos(router *mux.Router) {
+	// See RouteOrganization for why the root path is routed before the subrouter
+	router.HandleFunc("/videos", listVideos).Methods("GET")
+	router.Handle("/videos", RequireAuth(http.HandlerFunc(createVideo))).Methods("POST")
 	sub := router.PathPrefix("/videos").Subrouter().StrictSlash(true)
 	sub.HandleFunc("/", listVideos).Methods("GET")
-	sub.Methods("GET").HandlerFunc(listVideos)
-	sub.HandleFunc("/", createVideo).Methods("POST")
-	sub.Methods("POST").HandlerFunc(createVideo)
+	sub.Handle("/", RequireAuth(http.HandlerFunc(createVideo))).Methods("POST")
 
 	//router.DELETE("/videos/:id", deleteVideo)
 	router.HandleFunc("/{id}", showVideo).Methods("GET")
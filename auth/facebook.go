@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mg4tv/kubrik/log"
+)
+
+type facebookTokenResponse struct {
+	AccessToken *string `json:"access_token,omitempty"`
+	TokenType   *string `json:"token_type,omitempty"`
+	ExpiresIn   *int    `json:"expires_in,omitempty"`
+}
+
+type facebookUserAttributes struct {
+	Id    *string `json:"id,omitempty"`
+	Email *string `json:"email,omitempty"`
+}
+
+// facebookProvider logs users in with the Facebook Graph API
+type facebookProvider struct {
+	name         string
+	clientId     string
+	clientSecret string
+	graphURL     string
+}
+
+func newFacebook(config Config) (IdentityProvider, error) {
+	p := &facebookProvider{
+		name:         config.Name,
+		clientId:     config.String("client_id", ""),
+		clientSecret: config.String("client_secret", ""),
+		graphURL:     config.String("graph_url", "https://graph.facebook.com/v2.8"),
+	}
+	if p.clientId == "" {
+		return nil, errors.New("client_id is required")
+	}
+	return p, nil
+}
+
+func (p *facebookProvider) Name() string {
+	return p.name
+}
+
+func (p *facebookProvider) Exchange(code, redirectURI string) (*Token, error) {
+	req, err := http.NewRequest("GET", p.graphURL+"/oauth/access_token", nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("client_id", p.clientId)
+	q.Add("redirect_uri", redirectURI)
+	q.Add("client_secret", p.clientSecret)
+	q.Add("code", code)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Logger.
+			WithField("Body", string(body)).
+			Error("Facebook didn't like our request")
+		return nil, errors.New("Failing to exchange Facebook code")
+	}
+
+	var fbResp facebookTokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&fbResp); err != nil {
+		return nil, err
+	}
+	if fbResp.AccessToken == nil {
+		return nil, errors.New("Facebook token response has no access_token")
+	}
+	return &Token{AccessToken: *fbResp.AccessToken}, nil
+}
+
+func (p *facebookProvider) Profile(token *Token) (*Identity, error) {
+	if token.AccessToken == "" {
+		return nil, ErrUnsupportedCredentials
+	}
+
+	req, err := http.NewRequest("GET", p.graphURL+"/me", nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("fields", "id,email")
+	q.Add("access_token", token.AccessToken)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Failing to fetch Facebook user attributes: " + resp.Status)
+	}
+
+	var fbResp facebookUserAttributes
+	if err = json.NewDecoder(resp.Body).Decode(&fbResp); err != nil {
+		return nil, err
+	}
+	if fbResp.Id == nil {
+		return nil, errors.New("Facebook user attributes have no id")
+	}
+
+	identity := Identity{Subject: *fbResp.Id}
+	// Facebook only ever returns an email address once its owner has confirmed it
+	if fbResp.Email != nil {
+		identity.Email = *fbResp.Email
+		identity.EmailVerified = true
+	}
+	return &identity, nil
+}
+
+// FacebookSignedRequest is the payload of the signed_request Facebook posts to deauthorize and data deletion callbacks
+type FacebookSignedRequest struct {
+	Algorithm string `json:"algorithm"`
+	IssuedAt  int64  `json:"issued_at"`
+	UserId    string `json:"user_id"`
+}
+
+// ParseFacebookSignedRequest verifies a signed_request against the app secret and returns its payload.
+// The request is two base64url segments, a HMAC-SHA256 signature of the second and the JSON payload itself.
+func ParseFacebookSignedRequest(signedRequest, appSecret string) (*FacebookSignedRequest, error) {
+	parts := strings.Split(signedRequest, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed signed request")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return nil, errors.New("Malformed signed request signature")
+	}
+	mac := hmac.New(sha256.New, []byte(appSecret))
+	mac.Write([]byte(parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("Signed request signature does not match")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.New("Malformed signed request payload")
+	}
+	var req FacebookSignedRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if strings.ToUpper(req.Algorithm) != "HMAC-SHA256" {
+		return nil, errors.New("Unexpected signed request algorithm")
+	}
+	if req.UserId == "" {
+		return nil, errors.New("Signed request has no user id")
+	}
+	return &req, nil
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func signFacebookRequest(payload, secret string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) + "." + encoded
+}
+
+func TestParseFacebookSignedRequest(T *testing.T) {
+	signed := signFacebookRequest(`{"algorithm":"HMAC-SHA256","issued_at":1488000000,"user_id":"1234"}`, "app-secret")
+
+	req, err := ParseFacebookSignedRequest(signed, "app-secret")
+	if err != nil {
+		T.Fatal(err)
+	}
+	if req.UserId != "1234" || req.IssuedAt != 1488000000 {
+		T.Fatalf("unexpected payload %+v", req)
+	}
+
+	if _, err = ParseFacebookSignedRequest(signed, "another-secret"); err == nil {
+		T.Fatal("expected a request signed with another secret to be rejected")
+	}
+
+	unsigned := signFacebookRequest(`{"algorithm":"none","user_id":"1234"}`, "app-secret")
+	if _, err = ParseFacebookSignedRequest(unsigned, "app-secret"); err == nil {
+		T.Fatal("expected an unexpected algorithm to be rejected")
+	}
+
+	if _, err = ParseFacebookSignedRequest("garbage", "app-secret"); err == nil {
+		T.Fatal("expected a malformed request to be rejected")
+	}
+}
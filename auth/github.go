@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type gitHubTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+type gitHubUser struct {
+	Id    int64  `json:"id"`
+	Email string `json:"email"`
+}
+
+type gitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// gitHubProvider logs users in with GitHub's OAuth apps. It needs the user:email scope.
+type gitHubProvider struct {
+	name         string
+	clientId     string
+	clientSecret string
+	tokenURL     string
+	apiURL       string
+}
+
+func newGitHub(config Config) (IdentityProvider, error) {
+	p := &gitHubProvider{
+		name:         config.Name,
+		clientId:     config.String("client_id", ""),
+		clientSecret: config.String("client_secret", ""),
+		tokenURL:     config.String("token_url", "https://github.com/login/oauth/access_token"),
+		apiURL:       strings.TrimRight(config.String("api_url", "https://api.github.com"), "/"),
+	}
+	if p.clientId == "" {
+		return nil, errors.New("client_id is required")
+	}
+	return p, nil
+}
+
+func (p *gitHubProvider) Name() string {
+	return p.name
+}
+
+func (p *gitHubProvider) Exchange(code, redirectURI string) (*Token, error) {
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.clientId)
+	form.Set("client_secret", p.clientSecret)
+
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Failing to exchange GitHub code: " + resp.Status)
+	}
+
+	// GitHub reports a bad code with a 200 and an error field
+	var tokenResp gitHubTokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+	if tokenResp.Error != "" || tokenResp.AccessToken == "" {
+		return nil, errors.New("Failing to exchange GitHub code: " + tokenResp.Error)
+	}
+	return &Token{AccessToken: tokenResp.AccessToken}, nil
+}
+
+func (p *gitHubProvider) get(path, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", p.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("GitHub request for " + path + " failed: " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *gitHubProvider) Profile(token *Token) (*Identity, error) {
+	if token.AccessToken == "" {
+		return nil, ErrUnsupportedCredentials
+	}
+
+	var user gitHubUser
+	if err := p.get("/user", token.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.Id == 0 {
+		return nil, errors.New("GitHub user has no id")
+	}
+	identity := Identity{Subject: strconv.FormatInt(user.Id, 10)}
+
+	// The public profile email may be unset or unverified, so prefer the primary verified address
+	var emails []gitHubEmail
+	if err := p.get("/user/emails", token.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			identity.Email = email.Email
+			identity.EmailVerified = true
+		}
+	}
+	if identity.Email == "" {
+		identity.Email = user.Email
+	}
+	return &identity, nil
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type idTokenClaims struct {
+	Email         string    `json:"email"`
+	EmailVerified claimBool `json:"email_verified"`
+	jwt.StandardClaims
+}
+
+// claimBool is a boolean claim which providers, Google among them, may also send as the string "true" or "false".
+// Anything but true or "true" reads as false, so an email is only ever taken as verified when the provider says so.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = s == "true"
+		return nil
+	}
+	var v bool
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = claimBool(v)
+	return nil
+}
+
+// remoteKeySet fetches and caches the RSA public keys an identity provider publishes as a JWK Set
+type remoteKeySet struct {
+	sync.Mutex
+	url       string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// remoteKeySetMinRefresh limits how often an unknown kid can force the key set to be fetched again
+const remoteKeySetMinRefresh = time.Minute
+
+// remoteKeySetMaxAge is how long fetched keys are used before being fetched again
+const remoteKeySetMaxAge = time.Hour
+
+// key returns the public key with the given kid, fetching the key set if it is stale or doesn't contain the kid
+func (s *remoteKeySet) key(jwksURL, kid string) (*rsa.PublicKey, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// The URL may only be known after discovery, so forget cached keys if it has changed
+	if s.url != jwksURL {
+		s.url = jwksURL
+		s.keys = nil
+	}
+
+	age := time.Since(s.fetchedAt)
+	if key, ok := s.keys[kid]; ok && age < remoteKeySetMaxAge {
+		return key, nil
+	}
+	if s.keys == nil || age > remoteKeySetMinRefresh {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("Unknown signing key")
+}
+
+func (s *remoteKeySet) fetch() error {
+	resp, err := httpClient.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Failing to fetch JWK Set: " + resp.Status)
+	}
+
+	var set jsonWebKeySet
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	return nil
+}
+
+// verifyIdToken checks the signature of an OpenID Connect ID token against the keys at jwksURL, and that it was
+// issued by one of issuers for clientId
+func verifyIdToken(idToken string, keys *remoteKeySet, jwksURL, clientId string, issuers []string) (*idTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(idToken, &idTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, errors.New("Unexpected signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(jwksURL, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*idTokenClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("Invalid ID token")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("ID token is expired")
+	}
+	if !claims.VerifyAudience(clientId, true) {
+		return nil, errors.New("ID token was issued to another client")
+	}
+	issuerOk := false
+	for _, issuer := range issuers {
+		if claims.Issuer == issuer {
+			issuerOk = true
+		}
+	}
+	if !issuerOk {
+		return nil, errors.New("ID token has an unexpected issuer")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
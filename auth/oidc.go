@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer           string `json:"issuer"`
+	TokenEndpoint    string `json:"token_endpoint"`
+	JwksURI          string `json:"jwks_uri"`
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+}
+
+type oidcUserInfo struct {
+	Subject       string    `json:"sub"`
+	Email         string    `json:"email"`
+	EmailVerified claimBool `json:"email_verified"`
+}
+
+// oidcProvider logs users in with any OpenID Connect provider.
+// Its endpoints are either configured directly, or found through the issuer's discovery document.
+type oidcProvider struct {
+	sync.Mutex
+	name         string
+	clientId     string
+	clientSecret string
+	discoveryURL string
+	issuers      []string
+	tokenURL     string
+	jwksURL      string
+	userInfoURL  string
+	keys         *remoteKeySet
+}
+
+// newGoogle creates a provider for Google accounts. Google's endpoints can be changed so that tests can point them
+// at a local stand-in server.
+func newGoogle(config Config) (IdentityProvider, error) {
+	p := &oidcProvider{
+		name:         config.Name,
+		clientId:     config.String("client_id", ""),
+		clientSecret: config.String("client_secret", ""),
+		issuers:      config.StringSlice("issuers", []string{"accounts.google.com", "https://accounts.google.com"}),
+		tokenURL:     config.String("token_url", "https://oauth2.googleapis.com/token"),
+		jwksURL:      config.String("jwks_url", "https://www.googleapis.com/oauth2/v3/certs"),
+		userInfoURL:  config.String("userinfo_url", "https://openidconnect.googleapis.com/v1/userinfo"),
+		keys:         &remoteKeySet{},
+	}
+	if p.clientId == "" {
+		return nil, errors.New("client_id is required")
+	}
+	return p, nil
+}
+
+// newOIDC creates a provider for a generic OpenID Connect issuer.
+// Endpoints are discovered from the issuer on first use unless they are all configured.
+func newOIDC(config Config) (IdentityProvider, error) {
+	issuer := strings.TrimRight(config.String("issuer", ""), "/")
+	p := &oidcProvider{
+		name:         config.Name,
+		clientId:     config.String("client_id", ""),
+		clientSecret: config.String("client_secret", ""),
+		discoveryURL: config.String("discovery_url", issuer+"/.well-known/openid-configuration"),
+		issuers:      []string{issuer},
+		tokenURL:     config.String("token_url", ""),
+		jwksURL:      config.String("jwks_url", ""),
+		userInfoURL:  config.String("userinfo_url", ""),
+		keys:         &remoteKeySet{},
+	}
+	if issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	if p.clientId == "" {
+		return nil, errors.New("client_id is required")
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+// endpoints returns the token, JWKS and userinfo URLs, fetching the discovery document if any is unknown
+func (p *oidcProvider) endpoints() (tokenURL, jwksURL, userInfoURL string, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.tokenURL == "" || p.jwksURL == "" {
+		resp, err := httpClient.Get(p.discoveryURL)
+		if err != nil {
+			return "", "", "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", "", "", errors.New("Failing to fetch discovery document: " + resp.Status)
+		}
+
+		var doc oidcDiscoveryDocument
+		if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return "", "", "", err
+		}
+		// Per OpenID Connect Discovery the document must name the issuer it was fetched for
+		if strings.TrimRight(doc.Issuer, "/") != p.issuers[0] {
+			return "", "", "", errors.New("Discovery document is for another issuer")
+		}
+		if p.tokenURL == "" {
+			p.tokenURL = doc.TokenEndpoint
+		}
+		if p.jwksURL == "" {
+			p.jwksURL = doc.JwksURI
+		}
+		if p.userInfoURL == "" {
+			p.userInfoURL = doc.UserInfoEndpoint
+		}
+		// Issuers commonly appear with and without the trailing slash in ID tokens
+		p.issuers = append(p.issuers, doc.Issuer)
+	}
+	return p.tokenURL, p.jwksURL, p.userInfoURL, nil
+}
+
+func (p *oidcProvider) Exchange(code, redirectURI string) (*Token, error) {
+	tokenURL, _, _, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.clientId)
+	form.Set("client_secret", p.clientSecret)
+
+	resp, err := httpClient.PostForm(tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Failing to exchange authorization code: " + resp.Status)
+	}
+
+	var tokenResp oidcTokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+	if tokenResp.IdToken == "" && tokenResp.AccessToken == "" {
+		return nil, errors.New("Token response has neither an id_token nor an access_token")
+	}
+	return &Token{
+		AccessToken: tokenResp.AccessToken,
+		IdToken:     tokenResp.IdToken,
+	}, nil
+}
+
+func (p *oidcProvider) Profile(token *Token) (*Identity, error) {
+	_, jwksURL, userInfoURL, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	if token.IdToken != "" {
+		claims, err := verifyIdToken(token.IdToken, p.keys, jwksURL, p.clientId, p.issuers)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: bool(claims.EmailVerified),
+		}, nil
+	}
+
+	if token.AccessToken == "" || userInfoURL == "" {
+		return nil, ErrUnsupportedCredentials
+	}
+	req, err := http.NewRequest("GET", userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Failing to fetch userinfo: " + resp.Status)
+	}
+
+	var info oidcUserInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Subject == "" {
+		return nil, errors.New("Userinfo has no subject")
+	}
+	return &Identity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: bool(info.EmailVerified),
+	}, nil
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+// fakeIssuer stands in for an OpenID Connect provider's discovery, token and JWKS endpoints
+func fakeIssuer(t *testing.T, key *rsa.PrivateKey, idToken *string) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&oidcDiscoveryDocument{
+			Issuer:        server.URL,
+			TokenEndpoint: server.URL + "/token",
+			JwksURI:       server.URL + "/certs",
+		})
+	})
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "issuer-key",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("client_secret") != "issuer-secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&oidcTokenResponse{IdToken: *idToken})
+	})
+	return server
+}
+
+func signIdToken(t *testing.T, key *rsa.PrivateKey, issuer, audience string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &idTokenClaims{
+		Email:         "someone@example.com",
+		EmailVerified: true,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  audience,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			Issuer:    issuer,
+			Subject:   "10769150350006150715113082367",
+		},
+	})
+	token.Header["kid"] = "issuer-key"
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoadProviders(T *testing.T) {
+	v := viper.New()
+	v.Set("auth.providers", []string{"facebook", "corp"})
+	v.Set("facebook.client_id", "fb")
+	v.Set("corp.type", "oidc")
+	if err := LoadProviders(v); err == nil {
+		T.Fatal("expected an oidc provider without an issuer to be rejected")
+	}
+
+	v.Set("corp.issuer", "https://sso.example.com")
+	v.Set("corp.client_id", "corp")
+	if err := LoadProviders(v); err != nil {
+		T.Fatal(err)
+	}
+	if provider, ok := GetProvider("corp"); !ok || provider.Name() != "corp" {
+		T.Fatal("expected corp to be registered under its own name")
+	}
+	if _, ok := GetProvider("google"); ok {
+		T.Fatal("expected only listed providers to be registered")
+	}
+}
+
+func TestOIDCCodeExchange(T *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var idToken string
+	server := fakeIssuer(T, key, &idToken)
+	defer server.Close()
+	idToken = signIdToken(T, key, server.URL, "issuer-client")
+
+	v := viper.New()
+	v.Set("corp.issuer", server.URL)
+	v.Set("corp.client_id", "issuer-client")
+	v.Set("corp.client_secret", "issuer-secret")
+	provider, err := newOIDC(NewConfig(v, "corp"))
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	if _, err = provider.Exchange("bad-code", "http://localhost/cb"); err == nil {
+		T.Fatal("expected a rejected code to fail")
+	}
+
+	token, err := provider.Exchange("good-code", "http://localhost/cb")
+	if err != nil {
+		T.Fatal(err)
+	}
+	identity, err := provider.Profile(token)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if identity.Subject != "10769150350006150715113082367" || !identity.EmailVerified {
+		T.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestGoogleIdTokenRejected(T *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var idToken string
+	server := fakeIssuer(T, key, &idToken)
+	defer server.Close()
+
+	v := viper.New()
+	v.Set("google.client_id", "google-client")
+	v.Set("google.jwks_url", server.URL+"/certs")
+	provider, err := newGoogle(NewConfig(v, "google"))
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	good := signIdToken(T, key, "https://accounts.google.com", "google-client")
+	if _, err = provider.Profile(&Token{IdToken: good}); err != nil {
+		T.Fatal(err)
+	}
+
+	otherClient := signIdToken(T, key, "https://accounts.google.com", "another-client")
+	if _, err = provider.Profile(&Token{IdToken: otherClient}); err == nil {
+		T.Fatal("expected token for another client to be rejected")
+	}
+
+	otherIssuer := signIdToken(T, key, server.URL, "google-client")
+	if _, err = provider.Profile(&Token{IdToken: otherIssuer}); err == nil {
+		T.Fatal("expected token from another issuer to be rejected")
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged := signIdToken(T, otherKey, "https://accounts.google.com", "google-client")
+	if _, err = provider.Profile(&Token{IdToken: forged}); err == nil {
+		T.Fatal("expected token signed by an unknown key to be rejected")
+	}
+}
+
+func TestGoogleEmailVerified(T *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var idToken string
+	server := fakeIssuer(T, key, &idToken)
+	defer server.Close()
+
+	v := viper.New()
+	v.Set("google.client_id", "google-client")
+	v.Set("google.jwks_url", server.URL+"/certs")
+	provider, err := newGoogle(NewConfig(v, "google"))
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	// Google has sent the claim both as a boolean and as a string
+	for claim, want := range map[interface{}]bool{true: true, "true": true, false: false, "false": false, "": false} {
+		claims := jwt.MapClaims{
+			"aud":   "google-client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iss":   "https://accounts.google.com",
+			"sub":   "10769150350006150715113082367",
+			"email": "someone@example.com",
+		}
+		if claim != "" {
+			claims["email_verified"] = claim
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "issuer-key"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			T.Fatal(err)
+		}
+
+		identity, err := provider.Profile(&Token{IdToken: signed})
+		if err != nil {
+			T.Errorf("email_verified %#v: %v", claim, err)
+		} else if identity.EmailVerified != want {
+			T.Errorf("email_verified %#v: expected the email to be verified %t, got %t", claim, want, identity.EmailVerified)
+		}
+	}
+}
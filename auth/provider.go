@@ -0,0 +1,127 @@
+// Package auth holds the external identity providers users can log in with.
+//
+// Providers are enabled by listing them in auth.providers. Each provider reads its settings from the top level
+// section of the configuration named after it, and its implementation is chosen by the section's type key, which
+// defaults to the provider's name:
+//
+//	auth.providers: [facebook, google, github, okta]
+//	okta:
+//	  type: oidc
+//	  issuer: https://example.okta.com
+//	  client_id: 123
+//	  client_secret: 123
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrUnsupportedCredentials is returned by a provider which can't use the credentials it was given,
+// such as an ID token presented to a provider which doesn't issue them
+var ErrUnsupportedCredentials = errors.New("Credentials are not supported by this provider")
+
+// Identity is a user as described by an external identity provider
+type Identity struct {
+	// Subject is the provider's stable id for the user
+	Subject string
+	Email   string
+	// EmailVerified is only set when the provider vouches for the email. Unverified emails are never trusted to
+	// merge accounts or to verify a user's email.
+	EmailVerified bool
+}
+
+// Token holds the credentials a provider issued for a user
+type Token struct {
+	AccessToken string
+	IdToken     string
+}
+
+// IdentityProvider is an external service users can log in with
+type IdentityProvider interface {
+	// Name is the name the provider is configured and routed under
+	Name() string
+	// Exchange trades an authorization code, issued for redirectURI, for the user's provider tokens
+	Exchange(code, redirectURI string) (*Token, error)
+	// Profile fetches the identity of the user the token was issued for.
+	// A token with only an IdToken may be given to providers which issue ID tokens.
+	Profile(token *Token) (*Identity, error)
+}
+
+// Factory creates a provider from its configuration
+type Factory func(config Config) (IdentityProvider, error)
+
+// Config reads the settings of a single provider from its section of the configuration
+type Config struct {
+	Name string
+	v    *viper.Viper
+}
+
+// String returns the setting key, or def if it isn't set
+func (c Config) String(key, def string) string {
+	if full := c.Name + "." + key; c.v.IsSet(full) {
+		return c.v.GetString(full)
+	}
+	return def
+}
+
+// StringSlice returns the setting key, or def if it isn't set
+func (c Config) StringSlice(key string, def []string) []string {
+	if full := c.Name + "." + key; c.v.IsSet(full) {
+		return c.v.GetStringSlice(full)
+	}
+	return def
+}
+
+// NewConfig returns the settings of the provider name held by v
+func NewConfig(v *viper.Viper, name string) Config {
+	return Config{Name: name, v: v}
+}
+
+// httpClient is used for every request to an identity provider
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var factories = map[string]Factory{
+	"facebook": newFacebook,
+	"github":   newGitHub,
+	"google":   newGoogle,
+	"oidc":     newOIDC,
+}
+
+var providers = map[string]IdentityProvider{}
+
+// RegisterType makes a provider implementation available to the type key of provider configuration.
+// It is not safe to call concurrently with LoadProviders.
+func RegisterType(typ string, factory Factory) {
+	factories[typ] = factory
+}
+
+// LoadProviders creates every provider listed in auth.providers, replacing any loaded before.
+// It should be called once at startup.
+func LoadProviders(v *viper.Viper) error {
+	loaded := map[string]IdentityProvider{}
+	for _, name := range v.GetStringSlice("auth.providers") {
+		config := NewConfig(v, name)
+		factory, ok := factories[config.String("type", name)]
+		if !ok {
+			return fmt.Errorf("Provider %q has unknown type %q", name, config.String("type", name))
+		}
+		provider, err := factory(config)
+		if err != nil {
+			return fmt.Errorf("Provider %q: %s", name, err)
+		}
+		loaded[name] = provider
+	}
+	providers = loaded
+	return nil
+}
+
+// GetProvider returns the loaded provider with the given name
+func GetProvider(name string) (IdentityProvider, bool) {
+	provider, ok := providers[name]
+	return provider, ok
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPPeriod is how long each time-based one-time password is valid for
+	TOTPPeriod = 30 * time.Second
+	// totpDigits is the length of the codes, which is what authenticator apps assume
+	totpDigits = 6
+	// totpSkew is how many periods either side of the current one are accepted, to allow for clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret generates a random 160 bit secret, as recommended by RFC 4226
+func NewTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeTOTPSecret encodes a secret the way authenticator apps expect it to be typed in
+func EncodeTOTPSecret(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps read from QR codes
+func TOTPURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", EncodeTOTPSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	label := &url.URL{Path: issuer + ":" + account}
+	return "otpauth://totp/" + label.EscapedPath() + "?" + q.Encode()
+}
+
+// hotp computes an RFC 4226 one-time password for a counter
+func hotp(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// TOTPStep returns the RFC 6238 time step a moment falls in
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// TOTPCode returns the code for a secret at a moment
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(TOTPStep(t)), totpDigits)
+}
+
+// ValidateTOTP checks a code against a secret at a moment, allowing for a step of clock drift either way.
+// It returns the step the code matched, which callers record so that a code can't be used twice.
+func ValidateTOTP(secret []byte, code string, t time.Time) (step int64, ok bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := TOTPStep(t)
+	for s := now - totpSkew; s <= now+totpSkew; s++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, uint64(s), totpDigits)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
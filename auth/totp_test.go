@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 Appendix B
+func TestTOTPVectors(T *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		step := TOTPStep(time.Unix(v.unix, 0))
+		if code := hotp(secret, uint64(step), 8); code != v.code {
+			T.Errorf("at %d expected %s, got %s", v.unix, v.code, code)
+		}
+	}
+}
+
+func TestValidateTOTP(T *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+
+	step, ok := ValidateTOTP(secret, TOTPCode(secret, now), now)
+	if !ok || step != TOTPStep(now) {
+		T.Fatalf("expected the current code to validate at step %d, got %d %v", TOTPStep(now), step, ok)
+	}
+
+	if _, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(-TOTPPeriod)), now); !ok {
+		T.Error("expected the previous code to be accepted for clock drift")
+	}
+	if _, ok = ValidateTOTP(secret, TOTPCode(secret, now.Add(-3*TOTPPeriod)), now); ok {
+		T.Error("expected a code from three periods ago to be rejected")
+	}
+	if _, ok = ValidateTOTP(secret, "12345", now); ok {
+		T.Error("expected a short code to be rejected")
+	}
+}
+
+func TestTOTPURI(T *testing.T) {
+	uri := TOTPURI("kubrik", "someone@example.com", []byte("12345678901234567890"))
+	if !strings.HasPrefix(uri, "otpauth://totp/kubrik:someone@example.com?") {
+		T.Errorf("unexpected label in %s", uri)
+	}
+	if !strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") {
+		T.Errorf("unexpected secret in %s", uri)
+	}
+}
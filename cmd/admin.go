@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+	"github.com/spf13/cobra"
+)
+
+var AdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "manage platform admins",
+}
+
+var adminGrantCmd = &cobra.Command{
+	Use:   "grant EMAIL",
+	Short: "make the user with an email a platform admin",
+	Run:   func(cmd *cobra.Command, args []string) { setAdmin(cmd, args, true) },
+}
+
+var adminRevokeCmd = &cobra.Command{
+	Use:   "revoke EMAIL",
+	Short: "take platform admin away from the user with an email",
+	Run:   func(cmd *cobra.Command, args []string) { setAdmin(cmd, args, false) },
+}
+
+func init() {
+	RootCmd.AddCommand(AdminCmd)
+	AdminCmd.AddCommand(adminGrantCmd)
+	AdminCmd.AddCommand(adminRevokeCmd)
+}
+
+func setAdmin(cmd *cobra.Command, args []string, isAdmin bool) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	email := args[0]
+
+	id, err := db.SetUserAdmin(email, isAdmin)
+	if err == pgx.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "No user has the email %s\n", email)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if isAdmin {
+		fmt.Printf("%s (%s) is now an admin\n", email, id)
+	} else {
+		fmt.Printf("%s (%s) is no longer an admin\n", email, id)
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"github.com/meatballhat/negroni-logrus"
 	"github.com/mg4tv/kubrik/log"
 	"github.com/gorilla/mux"
+	"github.com/mg4tv/kubrik/auth"
+	"github.com/mg4tv/kubrik/conf"
+	"github.com/mg4tv/kubrik/mail"
 )
 
 var ServeCmd = &cobra.Command{
@@ -32,12 +35,36 @@ func init() {
 }
 
 func serve(cmd *cobra.Command, args []string) {
+	if err := api.LoadSigningKeys(); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load JWT signing keys")
+	}
+	if err := api.LoadPasswordPolicy(); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load password policy")
+	}
+	if err := api.LoadLimiters(); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load lockout configuration")
+	}
+	if err := auth.LoadProviders(conf.Config); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load identity providers")
+	}
+	if err := mail.Load(conf.Config); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load mailer")
+	}
+	if err := api.SyncPermissionTypes(); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to sync permission types")
+	}
+	if err := api.LoadRoleTemplates(); err != nil {
+		log.Logger.WithField("error", err).Fatal("Failing to load role templates")
+	}
+
 	corsMiddleware := cors.Default()
 	router := mux.NewRouter()
 
 	// Initiate subroutes
 	api.RouteAuth(router)
+	api.RouteAdmin(router)
 	api.RouteOrganization(router)
+	api.RouteSCIM(router)
 	api.RouteUser(router)
 	api.RouteVideos(router)
 
@@ -10,6 +10,38 @@ func init() {
 	Config.SetConfigName("kubrik")
 	Config.AddConfigPath("/etc/kubrik")
 	Config.AddConfigPath(".")
+
+	// Token lifetimes are parsed with time.ParseDuration
+	Config.SetDefault("kubrik.issuer", "kubrik")
+	Config.SetDefault("kubrik.audience", "mg4")
+	Config.SetDefault("kubrik.access_token_ttl", "15m")
+	Config.SetDefault("kubrik.mfa_pending_ttl", "5m")
+	Config.SetDefault("kubrik.refresh_token_ttl", "720h")
+	Config.SetDefault("kubrik.session_cache_ttl", "30s")
+	Config.SetDefault("kubrik.permission_cache_ttl", "30s")
+	Config.SetDefault("kubrik.key_grace_period", "24h")
+	Config.SetDefault("kubrik.trust_proxy_headers", false)
+	Config.SetDefault("kubrik.public_url", "")
+	Config.SetDefault("kubrik.app_url", "http://localhost:3000")
+	Config.SetDefault("kubrik.password_reset_ttl", "1h")
+	Config.SetDefault("kubrik.password_reset_max_active", 3)
+	Config.SetDefault("kubrik.magic_link_ttl", "15m")
+	Config.SetDefault("kubrik.impersonation_ttl", "15m")
+	Config.SetDefault("kubrik.magic_link_max_active", 3)
+	Config.SetDefault("kubrik.email_verification_ttl", "48h")
+	Config.SetDefault("kubrik.invitation_ttl", "168h")
+	Config.SetDefault("kubrik.invitation_max_per_hour", 50)
+	Config.SetDefault("kubrik.require_verified_email", false)
+
+	// Identity providers read their own defaults, see the auth package
+	Config.SetDefault("auth.providers", []string{"facebook"})
+	Config.SetDefault("device.client_ids", []string{})
+	Config.SetDefault("device.code_ttl", "10m")
+	Config.SetDefault("device.poll_interval", "5s")
+	Config.SetDefault("saml.request_ttl", "10m")
+	Config.SetDefault("saml.login_code_ttl", "1m")
+	Config.SetDefault("saml.clock_skew", "2m")
+
 	//TODO: check error
 	Config.ReadInConfig()
 }
\ No newline at end of file
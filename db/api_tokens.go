@@ -0,0 +1,123 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// APITokenModel is a long lived token for automation. It belongs to either a user or an organization.
+type APITokenModel struct {
+	Id             string
+	Name           string
+	Prefix         string
+	Scopes         []string
+	UserId         *string
+	OrganizationId *string
+	CreatedBy      *string
+	CreatedAt      time.Time
+	LastUsedAt     *time.Time
+	ExpiresAt      *time.Time
+}
+
+const qsAPITokenColumns = "id, name, prefix, scopes, user_id, organization_id, created_by, created_at, last_used_at, expires_at"
+
+func scanAPIToken(row interface {
+	Scan(...interface{}) error
+}) (*APITokenModel, error) {
+	var t APITokenModel
+	err := row.Scan(&t.Id, &t.Name, &t.Prefix, &t.Scopes, &t.UserId, &t.OrganizationId, &t.CreatedBy, &t.CreatedAt,
+		&t.LastUsedAt, &t.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateAPIToken stores a new API token by the hash of its secret. Exactly one of userId and organizationId must
+// be set.
+func CreateAPIToken(name, prefix string, tokenHash []byte, scopes []string, userId, organizationId *string, createdBy string, expiresAt *time.Time) (*APITokenModel, error) {
+	const qs = `INSERT INTO api_tokens(name, prefix, token_hash, scopes, user_id, organization_id, created_by, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING ` + qsAPITokenColumns
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	return scanAPIToken(conn.QueryRow(qs, name, prefix, tokenHash, scopes, userId, organizationId, createdBy, expiresAt))
+}
+
+// UseAPIToken looks up a usable API token by the hash of its secret and records that it was used.
+// pgx.ErrNoRows is returned for unknown, revoked and expired tokens alike.
+func UseAPIToken(tokenHash []byte) (*APITokenModel, error) {
+	const qs = `UPDATE api_tokens SET last_used_at=now()
+WHERE token_hash=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+RETURNING ` + qsAPITokenColumns
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	return scanAPIToken(conn.QueryRow(qs, tokenHash))
+}
+
+// ListAPITokens retrieves the unrevoked API tokens of a user, or of an organization if userId is nil
+func ListAPITokens(userId, organizationId *string) (*[]APITokenModel, error) {
+	const qs = `SELECT ` + qsAPITokenColumns + ` FROM api_tokens
+WHERE revoked_at IS NULL AND (user_id=$1 OR organization_id=$2) ORDER BY created_at`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qs, userId, organizationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APITokenModel{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// RevokeAPIToken revokes one of the API tokens of a user, or of an organization if userId is nil.
+// pgx.ErrNoRows is returned if the owner has no such unrevoked token.
+func RevokeAPIToken(id string, userId, organizationId *string) error {
+	const qs = `UPDATE api_tokens SET revoked_at=now()
+WHERE id=$1 AND revoked_at IS NULL AND (user_id=$2 OR organization_id=$3)`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, id, userId, organizationId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
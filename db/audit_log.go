@@ -0,0 +1,33 @@
+package db
+
+// Audit log actions
+const (
+	AuditImpersonationStart   = "impersonation.start"
+	AuditImpersonationRequest = "impersonation.request"
+)
+
+// AuditEntry is something done to or as a user which has to be accounted for later
+type AuditEntry struct {
+	// ActorId is who did it
+	ActorId *string
+	// SubjectId is the user it was done to or as
+	SubjectId *string
+	Action    string
+	Details   string
+	IpAddress string
+}
+
+// RecordAudit appends an entry to the audit log
+func RecordAudit(e *AuditEntry) error {
+	const qs = "INSERT INTO audit_log(actor_id, subject_id, action, details, ip_address) VALUES ($1, $2, $3, $4, $5)"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, e.ActorId, e.SubjectId, e.Action, e.Details, e.IpAddress)
+	return err
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Statuses of a device authorization
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+	DeviceCodeConsumed = "consumed"
+)
+
+// The outcomes of polling a device code that don't yield tokens, named after their RFC 8628 error codes
+var (
+	ErrDeviceAuthorizationPending = errors.New("authorization_pending")
+	ErrDeviceSlowDown             = errors.New("slow_down")
+	ErrDeviceAccessDenied         = errors.New("access_denied")
+	ErrDeviceCodeExpired          = errors.New("expired_token")
+)
+
+// deviceSlowDownIncrement is how much a device which polls too often must add to its interval, per RFC 8628
+const deviceSlowDownIncrement = 5
+
+// CreateDeviceCode stores a new device authorization. A pgx.PgError with code 23505 is returned if the user code
+// collides with an outstanding one.
+func CreateDeviceCode(deviceCodeHash []byte, userCode, clientId string, interval time.Duration, expiresAt time.Time) error {
+	const qs = `INSERT INTO device_codes(device_code_hash, user_code, client_id, status, poll_interval, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)`
+	const qsSweep = "DELETE FROM device_codes WHERE expires_at < now() - interval '1 day'"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	// Expired codes are kept a day so that devices still polling get expired_token rather than invalid_grant,
+	// and their user codes are freed after that
+	if _, err = conn.Exec(qsSweep); err != nil {
+		return err
+	}
+	_, err = conn.Exec(qs, deviceCodeHash, userCode, clientId, DeviceCodePending, int32(interval/time.Second), expiresAt)
+	return err
+}
+
+// DecideDeviceCode approves or denies the pending device authorization with a user code on behalf of a user,
+// and returns the client it was requested by. pgx.ErrNoRows is returned if no pending, unexpired code matches.
+func DecideDeviceCode(userCode, userId string, approve bool) (string, error) {
+	const qs = `UPDATE device_codes SET status=$3, user_id=$2
+WHERE user_code=$1 AND status=$4 AND expires_at > now() RETURNING client_id`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return "", err
+	}
+	defer PgPool.Release(conn)
+
+	status := DeviceCodeDenied
+	if approve {
+		status = DeviceCodeApproved
+	}
+	var clientId string
+	if err = conn.QueryRow(qs, userCode, userId, status, DeviceCodePending).Scan(&clientId); err != nil {
+		return "", err
+	}
+	return clientId, nil
+}
+
+// PollDeviceCode is called by a device waiting on its authorization. Once approved, the code is spent and the
+// approving user's id is returned. Until then one of the ErrDevice errors says why not, and pgx.ErrNoRows is
+// returned for codes that don't exist, belong to another client or were already spent.
+func PollDeviceCode(deviceCodeHash []byte, clientId string) (string, error) {
+	const qsSel = `SELECT id, user_id, status, poll_interval, expires_at, last_polled_at, now() FROM device_codes
+WHERE device_code_hash=$1 AND client_id=$2 FOR UPDATE`
+	const qsPoll = "UPDATE device_codes SET last_polled_at=$2, poll_interval=$3 WHERE id=$1"
+	const qsConsume = "UPDATE device_codes SET status=$2 WHERE id=$1"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id string
+	var userId *string
+	var status string
+	var interval int32
+	var expiresAt, now time.Time
+	var lastPolledAt *time.Time
+	err = tx.QueryRow(qsSel, deviceCodeHash, clientId).Scan(&id, &userId, &status, &interval, &expiresAt, &lastPolledAt, &now)
+	if err != nil {
+		return "", err
+	}
+	if status == DeviceCodeConsumed {
+		return "", pgx.ErrNoRows
+	}
+	if now.After(expiresAt) {
+		return "", ErrDeviceCodeExpired
+	}
+
+	var result error
+	if lastPolledAt != nil && now.Before(lastPolledAt.Add(time.Duration(interval)*time.Second)) {
+		interval += deviceSlowDownIncrement
+		result = ErrDeviceSlowDown
+	}
+	if _, err = tx.Exec(qsPoll, id, now, interval); err != nil {
+		return "", err
+	}
+
+	if result == nil {
+		switch status {
+		case DeviceCodePending:
+			result = ErrDeviceAuthorizationPending
+		case DeviceCodeDenied:
+			result = ErrDeviceAccessDenied
+		case DeviceCodeApproved:
+			if _, err = tx.Exec(qsConsume, id, DeviceCodeConsumed); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	if result != nil {
+		return "", result
+	}
+	return *userId, nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrEmailVerificationTokenInvalid is returned when an email verification token doesn't exist, has expired or was
+// used
+var ErrEmailVerificationTokenInvalid = errors.New("Email verification token is invalid")
+
+// CreateEmailVerificationToken stores the hash of a token proving a user controls an email address.
+// The address is either the user's own, or one they want to change to.
+func CreateEmailVerificationToken(userId, email string, tokenHash []byte, expiresAt time.Time) error {
+	const qs = "INSERT INTO email_verification_tokens(user_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, userId, email, tokenHash, expiresAt)
+	return err
+}
+
+// VerifyEmail spends an email verification token, making the address it was issued for the user's verified email,
+// and returns the updated user. Every other outstanding token of the user is spent with it.
+// A pgx.PgError with code 23505 is returned if another user has taken the address in the meantime.
+func VerifyEmail(tokenHash []byte) (*UserModel, error) {
+	const qsSel = "SELECT user_id, email, expires_at, used_at FROM email_verification_tokens WHERE token_hash=$1 FOR UPDATE"
+	const qsUpdUser = `UPDATE users SET email=$2, email_verified_at=now() WHERE id=$1
+RETURNING username, email_verified_at`
+	const qsUseTokens = "UPDATE email_verification_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var user UserModel
+	var expiresAt time.Time
+	var usedAt *time.Time
+	err = tx.QueryRow(qsSel, tokenHash).Scan(&user.Id, &user.Email, &expiresAt, &usedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrEmailVerificationTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if usedAt != nil || time.Now().After(expiresAt) {
+		return nil, ErrEmailVerificationTokenInvalid
+	}
+
+	if err = tx.QueryRow(qsUpdUser, user.Id, user.Email).Scan(&user.Username, &user.EmailVerifiedAt); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(qsUseTokens, user.Id); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrLastLoginMethod is returned when unlinking an identity would leave a user with no way to log in
+var ErrLastLoginMethod = errors.New("Identity is the user's only login method")
+
+type ExternalIdentityModel struct {
+	Provider  string
+	Subject   string
+	UserId    string
+	Email     *string
+	CreatedAt time.Time
+}
+
+// CreateUserByExternalIdentity takes an identity provider's name, its id for a user and an email, and creates a new
+// user with that email, then links the external_identities table to that new user.
+// The email is marked verified if the provider vouched for it.
+func CreateUserByExternalIdentity(provider, subject, email string, emailVerified bool) (*UserModel, error) {
+	const qsInsUser = `INSERT INTO users(email, email_verified_at)
+VALUES($1, CASE WHEN $2::BOOLEAN THEN now() END) RETURNING id, username, email_verified_at`
+	const qsInsIdentity = "INSERT INTO external_identities(provider, subject, user_id, email) VALUES ($1, $2, $3, $4)"
+
+	// Both rows are written in a transaction so that a failed link doesn't leave an orphaned user behind
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Attempt to insert the new user
+	row := tx.QueryRow(qsInsUser, email, emailVerified)
+	var id string
+	var username *string
+	var emailVerifiedAt *time.Time
+	if err = row.Scan(&id, &username, &emailVerifiedAt); err != nil {
+		return nil, err
+	}
+
+	// Attempt to write the link to external_identities
+	if _, err = tx.Exec(qsInsIdentity, provider, subject, id, email); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &UserModel{
+		Id:              id,
+		Username:        username,
+		Email:           email,
+		EmailVerifiedAt: emailVerifiedAt,
+	}, nil
+}
+
+// GetUserByExternalIdentity takes an identity provider's name and its id for a user and uses them to look for
+// linked users. If a link exists, it retrieves the user by the id linked.
+func GetUserByExternalIdentity(provider, subject string) (*UserModel, error) {
+	const qs = `SELECT id, username, email FROM users
+WHERE id=(SELECT user_id FROM external_identities WHERE provider=$1 AND subject=$2)`
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var id string
+	var username *string
+	var email string
+	row := conn.QueryRow(qs, provider, subject)
+	err = row.Scan(&id, &username, &email)
+	if err != nil {
+		return nil, err
+	}
+	return &UserModel{
+		Id:       id,
+		Username: username,
+		Email:    email,
+	}, nil
+}
+
+// UnlinkExternalIdentity removes the link between an identity provider's user and ours, returning the id of the
+// user it was linked to. pgx.ErrNoRows is returned if there was no link.
+func UnlinkExternalIdentity(provider, subject string) (string, error) {
+	const qs = "DELETE FROM external_identities WHERE provider=$1 AND subject=$2 RETURNING user_id"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return "", err
+	}
+	defer PgPool.Release(conn)
+
+	var userId string
+	if err = conn.QueryRow(qs, provider, subject).Scan(&userId); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// ForgetExternalIdentity removes the link between an identity provider's user and ours. If that leaves the user
+// with no way to log in, no password and no other identity, the user and everything they own is deleted too.
+// It reports whether the user was deleted. pgx.ErrNoRows is returned if there was no link.
+func ForgetExternalIdentity(provider, subject string) (bool, error) {
+	const qsDelIdentity = "DELETE FROM external_identities WHERE provider=$1 AND subject=$2 RETURNING user_id"
+	const qsDelUser = `DELETE FROM users WHERE id=$1 AND encrypted_password IS NULL
+AND NOT EXISTS (SELECT 1 FROM external_identities WHERE user_id=$1)`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var userId string
+	if err = tx.QueryRow(qsDelIdentity, provider, subject).Scan(&userId); err != nil {
+		return false, err
+	}
+
+	var tag pgx.CommandTag
+	if tag, err = tx.Exec(qsDelUser, userId); err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListExternalIdentitiesByUser retrieves the identities linked to a user
+func ListExternalIdentitiesByUser(userId string) (*[]ExternalIdentityModel, error) {
+	const qs = `SELECT provider, subject, user_id, email, created_at FROM external_identities
+WHERE user_id=$1 ORDER BY created_at`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qs, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []ExternalIdentityModel{}
+	for rows.Next() {
+		var identity ExternalIdentityModel
+		if err = rows.Scan(&identity.Provider, &identity.Subject, &identity.UserId, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &identities, nil
+}
+
+// LinkExternalIdentity links an identity provider's user to an existing user. If the provider vouched for an email
+// matching the user's own, the user's email is marked verified too.
+// A pgx.PgError with code 23505 is returned if the identity is linked to anyone already, or the user already has an
+// identity with the provider.
+func LinkExternalIdentity(provider, subject, userId, email string, emailVerified bool) error {
+	const qsInsIdentity = "INSERT INTO external_identities(provider, subject, user_id, email) VALUES ($1, $2, $3, $4)"
+	const qsVerifyEmail = `UPDATE users SET email_verified_at=now()
+WHERE id=$1 AND lower(email)=lower($2) AND email_verified_at IS NULL`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(qsInsIdentity, provider, subject, userId, email); err != nil {
+		return err
+	}
+	if emailVerified {
+		if _, err = tx.Exec(qsVerifyEmail, userId, email); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UnlinkUserIdentity removes a user's identity with a provider.
+// pgx.ErrNoRows is returned if the user has no identity with the provider, and ErrLastLoginMethod if the user has
+// no password and no other identity to log in with.
+func UnlinkUserIdentity(userId, provider string) error {
+	const qsLockUser = "SELECT encrypted_password FROM users WHERE id=$1 FOR UPDATE"
+	const qsCount = "SELECT count(*), count(*) FILTER (WHERE provider=$2) FROM external_identities WHERE user_id=$1"
+	const qsDel = "DELETE FROM external_identities WHERE user_id=$1 AND provider=$2"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the user keeps two concurrent unlinks from each leaving the other as the last login method
+	var encryptedPassword []byte
+	if err = tx.QueryRow(qsLockUser, userId).Scan(&encryptedPassword); err != nil {
+		return err
+	}
+
+	var total, matching int64
+	if err = tx.QueryRow(qsCount, userId, provider).Scan(&total, &matching); err != nil {
+		return err
+	}
+	if matching == 0 {
+		return pgx.ErrNoRows
+	}
+	if encryptedPassword == nil && total == matching {
+		return ErrLastLoginMethod
+	}
+
+	if _, err = tx.Exec(qsDel, userId, provider); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
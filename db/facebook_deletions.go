@@ -0,0 +1,70 @@
+package db
+
+import "time"
+
+const (
+	// FacebookDeletionPending is the status of a deletion request that hasn't been carried out yet
+	FacebookDeletionPending = "pending"
+	// FacebookDeletionCompleted is the status of a deletion request whose data has been removed
+	FacebookDeletionCompleted = "completed"
+)
+
+// FacebookDeletionRequestModel is a data deletion request made by a user through Facebook.
+// It deliberately keeps no reference to the user, whose account may no longer exist.
+type FacebookDeletionRequestModel struct {
+	ConfirmationCode string
+	FacebookUserId   string
+	Status           string
+	RequestedAt      time.Time
+	CompletedAt      *time.Time
+}
+
+// CreateFacebookDeletionRequest records a pending data deletion request for a Facebook user
+func CreateFacebookDeletionRequest(confirmationCode, facebookUserId string) error {
+	const qs = "INSERT INTO facebook_deletion_requests(confirmation_code, facebook_user_id, status) VALUES ($1, $2, $3)"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, confirmationCode, facebookUserId, FacebookDeletionPending)
+	return err
+}
+
+// CompleteFacebookDeletionRequest marks a data deletion request as carried out
+func CompleteFacebookDeletionRequest(confirmationCode string) error {
+	const qs = "UPDATE facebook_deletion_requests SET status=$2, completed_at=now() WHERE confirmation_code=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, confirmationCode, FacebookDeletionCompleted)
+	return err
+}
+
+// GetFacebookDeletionRequest retrieves a data deletion request by its confirmation code
+func GetFacebookDeletionRequest(confirmationCode string) (*FacebookDeletionRequestModel, error) {
+	const qs = `SELECT confirmation_code, facebook_user_id, status, requested_at, completed_at
+FROM facebook_deletion_requests WHERE confirmation_code=$1`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var req FacebookDeletionRequestModel
+	row := conn.QueryRow(qs, confirmationCode)
+	if err = row.Scan(&req.ConfirmationCode, &req.FacebookUserId, &req.Status, &req.RequestedAt, &req.CompletedAt); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
@@ -0,0 +1,481 @@
+package db
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrUnknownPermission is returned when a group is given a permission type which doesn't exist
+var ErrUnknownPermission = errors.New("Permission type does not exist")
+
+// ErrPublicGroupPermission is returned when an update would leave a public group granting a permission that only
+// private groups may grant
+var ErrPublicGroupPermission = errors.New("Public groups can't grant this permission")
+
+// GroupUpdate holds the changes to make to a group. Nil fields are left as they are.
+type GroupUpdate struct {
+	Name     *string
+	IsPublic *bool
+	// Permissions replaces the group's permissions with the permission types of these names
+	Permissions *[]string
+	// PrivatePermissions are the names of the permissions which the group, once updated, may only grant if private
+	PrivatePermissions []string
+}
+
+// readGroupPermissions fills in the permissions of groups, keyed by id
+func readGroupPermissions(q queryer, groups map[string]*GroupModel, ids []string) error {
+	const qs = `SELECT p.group_id, p.id, p.permission_type_id, t.name
+FROM organization_group_permissions p
+	JOIN organization_group_permission_types t
+		ON p.permission_type_id = t.id
+WHERE p.group_id::text=ANY($1)
+ORDER BY t.name`
+
+	rows, err := q.Query(qs, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupId string
+		var permission PermissionModel
+		if err = rows.Scan(&groupId, &permission.Id, &permission.PermissionTypeId, &permission.PermissionTypeName); err != nil {
+			return err
+		}
+		groups[groupId].Permissions = append(groups[groupId].Permissions, permission)
+	}
+	return rows.Err()
+}
+
+func getGroup(q queryer, organizationId, groupId string) (*GroupModel, error) {
+	const qs = "SELECT id, name, is_public, external_id FROM organization_groups WHERE organization_id=$1 AND id=$2"
+
+	group := GroupModel{Permissions: []PermissionModel{}}
+	err := q.QueryRow(qs, organizationId, groupId).Scan(&group.Id, &group.Name, &group.IsPublic, &group.ExternalId)
+	if err != nil {
+		return nil, err
+	}
+	if err = readGroupPermissions(q, map[string]*GroupModel{group.Id: &group}, []string{group.Id}); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// setGroupPermissions replaces a group's permissions with the permission types of the names.
+// ErrUnknownPermission is returned if any of the names isn't a permission type.
+func setGroupPermissions(tx *pgx.Tx, groupId string, names []string) error {
+	const qsCount = "SELECT count(*) FROM organization_group_permission_types WHERE name=ANY($1)"
+	const qsDel = "DELETE FROM organization_group_permissions WHERE group_id=$1"
+	const qsIns = `INSERT INTO organization_group_permissions(group_id, permission_type_id)
+SELECT $1::UUID, id FROM organization_group_permission_types WHERE name=ANY($2)`
+
+	unique := map[string]bool{}
+	for _, name := range names {
+		unique[name] = true
+	}
+	var found int64
+	if err := tx.QueryRow(qsCount, names).Scan(&found); err != nil {
+		return err
+	}
+	if int(found) != len(unique) {
+		return ErrUnknownPermission
+	}
+
+	if _, err := tx.Exec(qsDel, groupId); err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		if _, err := tx.Exec(qsIns, groupId, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListGroups retrieves an organization's groups along with their permissions.
+// pgx.ErrNoRows is returned if there is no organization with the id.
+func ListGroups(organizationId string) ([]GroupModel, error) {
+	const qsOrg = "SELECT 1 FROM organizations WHERE id=$1"
+	const qs = `SELECT id, name, is_public, external_id FROM organization_groups WHERE organization_id=$1
+ORDER BY name`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var exists int
+	if err = conn.QueryRow(qsOrg, organizationId).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(qs, organizationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []GroupModel{}
+	for rows.Next() {
+		group := GroupModel{Permissions: []PermissionModel{}}
+		if err = rows.Scan(&group.Id, &group.Name, &group.IsPublic, &group.ExternalId); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(groups) > 0 {
+		byId := map[string]*GroupModel{}
+		ids := []string{}
+		for i := range groups {
+			byId[groups[i].Id] = &groups[i]
+			ids = append(ids, groups[i].Id)
+		}
+		if err = readGroupPermissions(conn, byId, ids); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// GetGroup retrieves one of an organization's groups along with its permissions.
+// pgx.ErrNoRows is returned if the organization has no such group.
+func GetGroup(organizationId, groupId string) (*GroupModel, error) {
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	return getGroup(conn, organizationId, groupId)
+}
+
+// CreateGroup creates a group in an organization with the permission types of the names.
+// ErrUnknownPermission is returned if any of the names isn't a permission type, and a pgx.PgError with code 23505
+// if the organization already has a group with the name.
+func CreateGroup(organizationId, name string, isPublic bool, permissions []string) (*GroupModel, error) {
+	const qsIns = "INSERT INTO organization_groups(name, is_public, organization_id) VALUES ($1, $2, $3) RETURNING id"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	if err = tx.QueryRow(qsIns, name, isPublic, organizationId).Scan(&id); err != nil {
+		return nil, err
+	}
+	if err = setGroupPermissions(tx, id, permissions); err != nil {
+		return nil, err
+	}
+
+	group, err := getGroup(tx, organizationId, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// UpdateGroup changes one of an organization's groups.
+// pgx.ErrNoRows is returned if the organization has no such group, ErrUnknownPermission if any of the permission
+// names isn't a permission type, ErrPublicGroupPermission if the group would be public and grant any of the private
+// permissions, and a pgx.PgError with code 23505 if the new name is taken.
+func UpdateGroup(organizationId, groupId string, update *GroupUpdate) (*GroupModel, error) {
+	const qsUpd = `UPDATE organization_groups SET name=COALESCE($3, name), is_public=COALESCE($4, is_public)
+WHERE organization_id=$1 AND id=$2`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(qsUpd, organizationId, groupId, update.Name, update.IsPublic)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	if update.Permissions != nil {
+		if err = setGroupPermissions(tx, groupId, *update.Permissions); err != nil {
+			return nil, err
+		}
+	}
+
+	// The update locked the group, so this sees any concurrent change to it
+	group, err := getGroup(tx, organizationId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if group.IsPublic {
+		for _, permission := range group.Permissions {
+			for _, private := range update.PrivatePermissions {
+				if permission.PermissionTypeName == private {
+					return nil, ErrPublicGroupPermission
+				}
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// DeleteGroup deletes one of an organization's groups, and with it its memberships and permissions.
+// pgx.ErrNoRows is returned if the organization has no such group.
+func DeleteGroup(organizationId, groupId string) error {
+	const qs = "DELETE FROM organization_groups WHERE organization_id=$1 AND id=$2"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, organizationId, groupId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// UserOrganizationModel is an organization a user owns or belongs to, along with the groups they are in there
+type UserOrganizationModel struct {
+	Organization OrganizationModel
+	IsOwner      bool
+	Groups       []GroupModel
+	// Permissions are the names of the permissions the user has in the organization. Owners have every permission.
+	Permissions []string
+}
+
+// ListGroupMembers retrieves the users in one of an organization's groups.
+// pgx.ErrNoRows is returned if the organization has no such group.
+func ListGroupMembers(organizationId, groupId string) ([]UserModel, error) {
+	const qsGroup = "SELECT 1 FROM organization_groups WHERE organization_id=$1 AND id=$2"
+	const qs = `SELECT u.id, u.username FROM organization_group_users gu
+	JOIN users u
+		ON gu.user_id = u.id
+WHERE gu.organization_group_id=$1
+ORDER BY u.username, u.id`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var exists int
+	if err = conn.QueryRow(qsGroup, organizationId, groupId).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(qs, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []UserModel{}
+	for rows.Next() {
+		var user UserModel
+		if err = rows.Scan(&user.Id, &user.Username); err != nil {
+			return nil, err
+		}
+		members = append(members, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// AddGroupMember puts a user in a group. Adding someone who is already a member does nothing.
+func AddGroupMember(groupId, userId string) error {
+	const qs = `INSERT INTO organization_group_users(user_id, organization_group_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, userId, groupId)
+	return err
+}
+
+// RemoveGroupMember takes a user out of a group.
+// pgx.ErrNoRows is returned if the user isn't a member of it.
+func RemoveGroupMember(groupId, userId string) error {
+	const qs = "DELETE FROM organization_group_users WHERE organization_group_id=$1 AND user_id=$2"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, groupId, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListUserOrganizations retrieves the organizations a user owns or is in a group of, with the groups they are in
+// and the permissions those give them
+func ListUserOrganizations(userId string) ([]UserOrganizationModel, error) {
+	const qsOrgs = `SELECT o.id, o.name, o.is_user_org, o.owner_id, o.require_mfa FROM organizations o
+WHERE o.owner_id=$1 OR EXISTS (
+	SELECT 1 FROM organization_group_users gu
+		JOIN organization_groups g
+			ON gu.organization_group_id = g.id
+	WHERE gu.user_id = $1 AND g.organization_id = o.id
+)
+ORDER BY o.name`
+	const qsGroups = `SELECT g.organization_id, g.id, g.name, g.is_public, g.external_id
+FROM organization_group_users gu
+	JOIN organization_groups g
+		ON gu.organization_group_id = g.id
+WHERE gu.user_id=$1
+ORDER BY g.name`
+	const qsAllPermissions = "SELECT name FROM organization_group_permission_types ORDER BY name"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qsOrgs, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []UserOrganizationModel{}
+	byId := map[string]int{}
+	for rows.Next() {
+		org := UserOrganizationModel{Groups: []GroupModel{}, Permissions: []string{}}
+		err = rows.Scan(&org.Organization.Id, &org.Organization.Name, &org.Organization.IsUserOrg,
+			&org.Organization.OwnerId, &org.Organization.RequireMFA)
+		if err != nil {
+			return nil, err
+		}
+		org.IsOwner = org.Organization.OwnerId == userId
+		byId[org.Organization.Id] = len(organizations)
+		organizations = append(organizations, org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = conn.Query(qsGroups, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []GroupModel{}
+	groupOrganizations := []string{}
+	for rows.Next() {
+		var organizationId string
+		group := GroupModel{Permissions: []PermissionModel{}}
+		if err = rows.Scan(&organizationId, &group.Id, &group.Name, &group.IsPublic, &group.ExternalId); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+		groupOrganizations = append(groupOrganizations, organizationId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(groups) > 0 {
+		groupsById := map[string]*GroupModel{}
+		ids := []string{}
+		for i := range groups {
+			groupsById[groups[i].Id] = &groups[i]
+			ids = append(ids, groups[i].Id)
+		}
+		if err = readGroupPermissions(conn, groupsById, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	ownsAny := false
+	for _, org := range organizations {
+		ownsAny = ownsAny || org.IsOwner
+	}
+	var allPermissions []string
+	if ownsAny {
+		rows, err = conn.Query(qsAllPermissions)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			allPermissions = append(allPermissions, name)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, group := range groups {
+		org := &organizations[byId[groupOrganizations[i]]]
+		org.Groups = append(org.Groups, group)
+	}
+	for i := range organizations {
+		org := &organizations[i]
+		if org.IsOwner {
+			org.Permissions = append(org.Permissions, allPermissions...)
+			continue
+		}
+		seen := map[string]bool{}
+		for _, group := range org.Groups {
+			for _, permission := range group.Permissions {
+				if !seen[permission.PermissionTypeName] {
+					seen[permission.PermissionTypeName] = true
+					org.Permissions = append(org.Permissions, permission.PermissionTypeName)
+				}
+			}
+		}
+		sort.Strings(org.Permissions)
+	}
+	return organizations, nil
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrInvitationInvalid is returned when an invitation doesn't exist, isn't for the user, has expired, or was
+// already accepted, declined or revoked
+var ErrInvitationInvalid = errors.New("Invitation is invalid")
+
+// ErrTooManyInvitations is returned when an organization has sent as many invitations in the last hour as it may
+var ErrTooManyInvitations = errors.New("Too many invitations sent recently")
+
+// InvitationModel is an invitation to join one of an organization's groups
+type InvitationModel struct {
+	Id               string
+	OrganizationId   string
+	OrganizationName string
+	GroupId          string
+	GroupName        string
+	// Email is set for invitations sent to an email rather than to a user
+	Email *string
+	// InviteeId is the invited user. Invitations by email only have one once they are accepted.
+	InviteeId       *string
+	InviteeUsername *string
+	// InviterId is nil for invitations made with an organization token, or by a user since deleted
+	InviterId *string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+const qsSelectInvitations = `SELECT i.id, i.organization_id, o.name, i.organization_group_id, g.name, i.email,
+	i.invitee_id, u.username, i.inviter_id, i.created_at, i.expires_at
+FROM organization_invitations i
+	JOIN organizations o
+		ON i.organization_id = o.id
+	JOIN organization_groups g
+		ON i.organization_group_id = g.id
+	LEFT JOIN users u
+		ON i.invitee_id = u.id
+`
+
+// qsInvitationPending is the condition for invitations which can still be accepted
+const qsInvitationPending = `i.accepted_at IS NULL AND i.declined_at IS NULL AND i.revoked_at IS NULL
+	AND i.expires_at > now()`
+
+// qsInvitationForUser is the condition for invitations to the user with the id in $1: those to them, and those to
+// their email once they have verified it
+const qsInvitationForUser = `(i.invitee_id=$1 OR i.invitee_id IS NULL AND lower(i.email)=(
+	SELECT lower(email) FROM users WHERE id=$1 AND email_verified_at IS NOT NULL))`
+
+func scanInvitation(row interface {
+	Scan(dest ...interface{}) error
+}) (*InvitationModel, error) {
+	var inv InvitationModel
+	err := row.Scan(&inv.Id, &inv.OrganizationId, &inv.OrganizationName, &inv.GroupId, &inv.GroupName, &inv.Email,
+		&inv.InviteeId, &inv.InviteeUsername, &inv.InviterId, &inv.CreatedAt, &inv.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func listInvitations(condition string, args ...interface{}) ([]InvitationModel, error) {
+	qs := qsSelectInvitations + "WHERE " + condition + " AND " + qsInvitationPending + " ORDER BY i.created_at"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []InvitationModel{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *inv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// CreateInvitation stores an invitation to one of an organization's groups along with the hash of its token, and
+// fills in the rest of the model. Organizations may send at most maxPerHour invitations an hour, so that nobody's
+// inbox can be flooded with them.
+// ErrUnknownGroup is returned if the group isn't the organization's, and ErrTooManyInvitations if the organization
+// is over its limit.
+func CreateInvitation(inv *InvitationModel, tokenHash []byte, maxPerHour int) error {
+	const qsGroupExists = "SELECT 1 FROM organization_groups WHERE id=$1 AND organization_id=$2"
+	const qsLock = "SELECT id FROM organizations WHERE id=$1 FOR UPDATE"
+	const qsCount = `SELECT count(*) FROM organization_invitations
+WHERE organization_id=$1 AND created_at > now() - interval '1 hour'`
+	const qsIns = `INSERT INTO organization_invitations(organization_id, organization_group_id, email, invitee_id,
+	inviter_id, token_hash, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(qsGroupExists, inv.GroupId, inv.OrganizationId).Scan(&exists)
+	if err == pgx.ErrNoRows {
+		return ErrUnknownGroup
+	} else if err != nil {
+		return err
+	}
+
+	// Lock the organization so that concurrent requests can't both slip under the limit
+	var organizationId string
+	if err = tx.QueryRow(qsLock, inv.OrganizationId).Scan(&organizationId); err != nil {
+		return err
+	}
+	var recent int64
+	if err = tx.QueryRow(qsCount, inv.OrganizationId).Scan(&recent); err != nil {
+		return err
+	}
+	if recent >= int64(maxPerHour) {
+		return ErrTooManyInvitations
+	}
+
+	var id string
+	err = tx.QueryRow(qsIns, inv.OrganizationId, inv.GroupId, inv.Email, inv.InviteeId, inv.InviterId, tokenHash,
+		inv.ExpiresAt).Scan(&id)
+	if err != nil {
+		return err
+	}
+	created, err := scanInvitation(tx.QueryRow(qsSelectInvitations+"WHERE i.id=$1", id))
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	*inv = *created
+	return nil
+}
+
+// GetPendingInvitation retrieves the invitation with a token, if it can still be accepted.
+// ErrInvitationInvalid is returned otherwise.
+func GetPendingInvitation(tokenHash []byte) (*InvitationModel, error) {
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	inv, err := scanInvitation(conn.QueryRow(qsSelectInvitations+"WHERE i.token_hash=$1 AND "+qsInvitationPending,
+		tokenHash))
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvitationInvalid
+	}
+	return inv, err
+}
+
+// ListOrganizationInvitations retrieves the invitations to an organization which can still be accepted
+func ListOrganizationInvitations(organizationId string) ([]InvitationModel, error) {
+	return listInvitations("i.organization_id=$1", organizationId)
+}
+
+// ListUserInvitations retrieves the invitations for a user which they can still accept. Invitations to their email
+// are among them once they have verified it.
+func ListUserInvitations(userId string) ([]InvitationModel, error) {
+	return listInvitations(qsInvitationForUser, userId)
+}
+
+// RevokeInvitation withdraws an invitation to an organization.
+// pgx.ErrNoRows is returned if the organization has no such invitation which can still be accepted.
+func RevokeInvitation(organizationId, invitationId string) error {
+	const qs = `UPDATE organization_invitations i SET revoked_at=now()
+WHERE i.organization_id=$1 AND i.id=$2 AND ` + qsInvitationPending
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, organizationId, invitationId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// findInvitation locks the pending invitation with a token or, when tokenHash is nil, the pending invitation with
+// the id for the user
+func findInvitation(tx *pgx.Tx, tokenHash []byte, invitationId, userId string) (*InvitationModel, error) {
+	qsByToken := qsSelectInvitations + "WHERE i.token_hash=$1 AND " + qsInvitationPending + " FOR UPDATE OF i"
+	qsById := qsSelectInvitations + "WHERE " + qsInvitationForUser + " AND i.id::text=$2 AND " + qsInvitationPending +
+		" FOR UPDATE OF i"
+
+	var row *pgx.Row
+	if tokenHash != nil {
+		row = tx.QueryRow(qsByToken, tokenHash)
+	} else {
+		row = tx.QueryRow(qsById, userId, invitationId)
+	}
+	inv, err := scanInvitation(row)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvitationInvalid
+	}
+	return inv, err
+}
+
+// AcceptInvitation puts a user in the group of an invitation, which is found by its token or, when tokenHash is
+// nil, by its id among the user's invitations. Anyone with the token of an invitation by email may accept it, as
+// it was sent to them, while invitations to a user are only theirs to accept. Accepting with the token proves the
+// user reads the invited email, so it is marked verified if it is theirs.
+// ErrInvitationInvalid is returned if there is no such invitation the user can accept.
+func AcceptInvitation(tokenHash []byte, invitationId, userId string) (*InvitationModel, error) {
+	const qsAccept = "UPDATE organization_invitations SET accepted_at=now(), invitee_id=$2 WHERE id=$1"
+	const qsInsMember = `INSERT INTO organization_group_users(user_id, organization_group_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING`
+	const qsVerify = `UPDATE users SET email_verified_at=now()
+WHERE id=$1 AND lower(email)=lower($2) AND email_verified_at IS NULL`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	inv, err := findInvitation(tx, tokenHash, invitationId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if inv.InviteeId != nil && *inv.InviteeId != userId {
+		return nil, ErrInvitationInvalid
+	}
+
+	if _, err = tx.Exec(qsAccept, inv.Id, userId); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(qsInsMember, userId, inv.GroupId); err != nil {
+		return nil, err
+	}
+	if tokenHash != nil && inv.Email != nil {
+		if _, err = tx.Exec(qsVerify, userId, *inv.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	inv.InviteeId = &userId
+	return inv, nil
+}
+
+// DeclineInvitation turns down an invitation, which is found by its token or, when tokenHash is nil, by its id
+// among the user's invitations.
+// ErrInvitationInvalid is returned if there is no such invitation which can still be accepted.
+func DeclineInvitation(tokenHash []byte, invitationId, userId string) error {
+	const qsDecline = "UPDATE organization_invitations SET declined_at=now() WHERE id=$1"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inv, err := findInvitation(tx, tokenHash, invitationId, userId)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(qsDecline, inv.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
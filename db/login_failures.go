@@ -0,0 +1,68 @@
+package db
+
+import "time"
+
+// GetLoginFailures retrieves the failed attempts recorded against a key, such as an account or a client address
+func GetLoginFailures(key string) (int, time.Time, error) {
+	const qs = "SELECT failures, last_failure_at FROM login_failures WHERE key=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer PgPool.Release(conn)
+
+	var failures int32
+	var lastFailureAt time.Time
+	if err = conn.QueryRow(qs, key).Scan(&failures, &lastFailureAt); err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(failures), lastFailureAt, nil
+}
+
+// RecordLoginFailure counts a failed attempt against a key and returns the updated count. Failures older than the
+// window are forgotten first. Other keys past their own window are swept too, so that the table doesn't grow without
+// bound.
+func RecordLoginFailure(key string, now time.Time, window time.Duration) (int, time.Time, error) {
+	const qsUpsert = `INSERT INTO login_failures(key, failures, last_failure_at, forget_at) VALUES ($1, 1, $2, $4)
+ON CONFLICT (key) DO UPDATE SET
+	failures=CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+	last_failure_at=EXCLUDED.last_failure_at,
+	forget_at=EXCLUDED.forget_at
+RETURNING failures, last_failure_at`
+	const qsSweep = "DELETE FROM login_failures WHERE forget_at < $1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer PgPool.Release(conn)
+
+	var failures int32
+	var lastFailureAt time.Time
+	err = conn.QueryRow(qsUpsert, key, now, now.Add(-window), now.Add(window)).Scan(&failures, &lastFailureAt)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if _, err = conn.Exec(qsSweep, now); err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(failures), lastFailureAt, nil
+}
+
+// ResetLoginFailures forgets the failed attempts recorded against a key
+func ResetLoginFailures(key string) error {
+	const qs = "DELETE FROM login_failures WHERE key=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	_, err = conn.Exec(qs, key)
+	return err
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrMagicLinkTokenInvalid is returned when a magic link token doesn't exist, has expired or was used
+var ErrMagicLinkTokenInvalid = errors.New("Magic link token is invalid")
+
+// ErrTooManyMagicLinks is returned when a user already has as many unused magic links as they may have at once
+var ErrTooManyMagicLinks = errors.New("Too many outstanding magic links")
+
+// CreateMagicLinkToken stores the hash of a magic link token for a user, unless the user already has maxActive
+// links which are neither used nor expired
+func CreateMagicLinkToken(userId string, tokenHash []byte, expiresAt time.Time, maxActive int) error {
+	const qsLock = "SELECT id FROM users WHERE id=$1 FOR UPDATE"
+	const qsCount = "SELECT count(*) FROM magic_link_tokens WHERE user_id=$1 AND used_at IS NULL AND expires_at > now()"
+	const qsIns = "INSERT INTO magic_link_tokens(user_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user so that concurrent requests can't both slip under the limit
+	var id string
+	if err = tx.QueryRow(qsLock, userId).Scan(&id); err != nil {
+		return err
+	}
+	var active int64
+	if err = tx.QueryRow(qsCount, userId).Scan(&active); err != nil {
+		return err
+	}
+	if active >= int64(maxActive) {
+		return ErrTooManyMagicLinks
+	}
+	if _, err = tx.Exec(qsIns, userId, tokenHash, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseMagicLinkToken spends a magic link token and returns the id of its user.
+// Following the link proves the user reads the email, so an unverified email is marked verified.
+func UseMagicLinkToken(tokenHash []byte) (string, error) {
+	const qsSel = "SELECT user_id, expires_at, used_at FROM magic_link_tokens WHERE token_hash=$1 FOR UPDATE"
+	const qsUse = "UPDATE magic_link_tokens SET used_at=now() WHERE token_hash=$1"
+	const qsVerify = "UPDATE users SET email_verified_at=now() WHERE id=$1 AND email_verified_at IS NULL"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userId string
+	var expiresAt time.Time
+	var usedAt *time.Time
+	err = tx.QueryRow(qsSel, tokenHash).Scan(&userId, &expiresAt, &usedAt)
+	if err == pgx.ErrNoRows {
+		return "", ErrMagicLinkTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+	if usedAt != nil || time.Now().After(expiresAt) {
+		return "", ErrMagicLinkTokenInvalid
+	}
+
+	if _, err = tx.Exec(qsUse, tokenHash); err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(qsVerify, userId); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
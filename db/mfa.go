@@ -0,0 +1,200 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrTOTPAlreadyEnabled is returned when enrolling a user who has already confirmed an authenticator
+var ErrTOTPAlreadyEnabled = errors.New("TOTP is already enabled")
+
+// ErrTOTPCodeReused is returned when a code from a time step that was already used, or an earlier one, is presented
+var ErrTOTPCodeReused = errors.New("TOTP code has already been used")
+
+type TOTPModel struct {
+	UserId       string
+	Secret       []byte
+	LastUsedStep int64
+	ConfirmedAt  *time.Time
+}
+
+// CreatePendingTOTP stores a new secret for a user to enroll an authenticator with. It replaces any enrollment that
+// was never confirmed, and returns ErrTOTPAlreadyEnabled if one was.
+func CreatePendingTOTP(userId string, secret []byte) error {
+	const qs = `INSERT INTO user_totp(user_id, secret) VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, created_at=now(), last_used_step=0
+WHERE user_totp.confirmed_at IS NULL`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, userId, secret)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+// GetTOTP retrieves a user's authenticator, confirmed or not
+func GetTOTP(userId string) (*TOTPModel, error) {
+	const qs = "SELECT secret, last_used_step, confirmed_at FROM user_totp WHERE user_id=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	totp := TOTPModel{UserId: userId}
+	if err = conn.QueryRow(qs, userId).Scan(&totp.Secret, &totp.LastUsedStep, &totp.ConfirmedAt); err != nil {
+		return nil, err
+	}
+	return &totp, nil
+}
+
+// ConfirmTOTP enables a user's pending authenticator, recording the step of the code that confirmed it, and
+// replaces the user's recovery codes with new ones
+func ConfirmTOTP(userId string, step int64, recoveryCodeHashes [][]byte) error {
+	const qsConfirm = `UPDATE user_totp SET confirmed_at=now(), last_used_step=$2
+WHERE user_id=$1 AND confirmed_at IS NULL AND last_used_step < $2`
+	const qsDelCodes = "DELETE FROM recovery_codes WHERE user_id=$1"
+	const qsInsCode = "INSERT INTO recovery_codes(user_id, code_hash) VALUES ($1, $2)"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(qsConfirm, userId, step)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if _, err = tx.Exec(qsDelCodes, userId); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.Exec(qsInsCode, userId, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a user's code for a time step was used. ErrTOTPCodeReused is returned if that step, or
+// a later one, was used already, so that an intercepted code can't be replayed.
+func UseTOTPStep(userId string, step int64) error {
+	const qs = `UPDATE user_totp SET last_used_step=$2
+WHERE user_id=$1 AND confirmed_at IS NOT NULL AND last_used_step < $2`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, userId, step)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+// UseRecoveryCode spends one of a user's recovery codes. pgx.ErrNoRows is returned if the user has no unused code
+// with the hash.
+func UseRecoveryCode(userId string, codeHash []byte) error {
+	const qs = "UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, userId, codeHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTOTP turns off a user's second factor, removing the authenticator and the recovery codes
+func DeleteTOTP(userId string) error {
+	const qsDelTOTP = "DELETE FROM user_totp WHERE user_id=$1"
+	const qsDelCodes = "DELETE FROM recovery_codes WHERE user_id=$1"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(qsDelTOTP, userId); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(qsDelCodes, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UserHasMFA reports whether a user has a confirmed second factor
+func UserHasMFA(userId string) (bool, error) {
+	const qs = "SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id=$1 AND confirmed_at IS NOT NULL)"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return false, err
+	}
+	defer PgPool.Release(conn)
+
+	var enabled bool
+	if err = conn.QueryRow(qs, userId).Scan(&enabled); err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// SetOrganizationRequireMFA sets whether an organization requires its members to have a second factor
+func SetOrganizationRequireMFA(organizationId string, required bool) error {
+	const qs = "UPDATE organizations SET require_mfa=$2 WHERE id=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, organizationId, required)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
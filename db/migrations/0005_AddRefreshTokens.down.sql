@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS refresh_tokens_family_ids;
+DROP TABLE IF EXISTS refresh_tokens;
\ No newline at end of file
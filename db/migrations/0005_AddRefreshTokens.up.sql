@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id    UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  family_id  UUID                                         NOT NULL,
+  token_hash BYTEA UNIQUE                                 NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  expires_at TIMESTAMPTZ                                  NOT NULL,
+  used_at    TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+
+CREATE INDEX refresh_tokens_family_ids
+  ON refresh_tokens (family_id);
@@ -0,0 +1,3 @@
+ALTER TABLE refresh_tokens DROP CONSTRAINT IF EXISTS refresh_tokens_family_id_fkey;
+DROP INDEX IF EXISTS sessions_user_ids;
+DROP TABLE IF EXISTS sessions;
\ No newline at end of file
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS sessions (
+  id           UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  jti          UUID UNIQUE                                  NOT NULL,
+  user_id      UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  user_agent   TEXT DEFAULT ''                              NOT NULL,
+  device       VARCHAR(31) DEFAULT ''                       NOT NULL,
+  ip_address   VARCHAR(45) DEFAULT ''                       NOT NULL,
+  created_at   TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  last_seen_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  revoked_at   TIMESTAMPTZ
+);
+
+
+CREATE INDEX sessions_user_ids
+  ON sessions (user_id);
+
+
+-- Every refresh token family belongs to exactly one session, which shares its id
+INSERT INTO sessions (id, jti, user_id, revoked_at)
+  SELECT family_id, uuid_generate_v4(), user_id, CASE WHEN bool_and(revoked_at IS NOT NULL) THEN now() END
+  FROM refresh_tokens
+  GROUP BY family_id, user_id;
+
+ALTER TABLE refresh_tokens
+  ADD CONSTRAINT refresh_tokens_family_id_fkey FOREIGN KEY (family_id) REFERENCES sessions (id) ON DELETE CASCADE;
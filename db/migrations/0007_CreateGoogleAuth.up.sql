@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS google_users (
+  google_user_id VARCHAR(255) PRIMARY KEY,
+  user_id        UUID REFERENCES users (id) ON DELETE CASCADE UNIQUE NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS facebook_users (
+  facebook_user_id VARCHAR(32) PRIMARY KEY,
+  user_id          UUID REFERENCES users (id) ON DELETE CASCADE UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS google_users (
+  google_user_id VARCHAR(255) PRIMARY KEY,
+  user_id        UUID REFERENCES users (id) ON DELETE CASCADE UNIQUE NOT NULL
+);
+
+
+INSERT INTO facebook_users (facebook_user_id, user_id)
+  SELECT subject, user_id
+  FROM external_identities
+  WHERE provider = 'facebook';
+
+INSERT INTO google_users (google_user_id, user_id)
+  SELECT subject, user_id
+  FROM external_identities
+  WHERE provider = 'google';
+
+
+DROP INDEX IF EXISTS external_identities_user_ids;
+DROP TABLE IF EXISTS external_identities;
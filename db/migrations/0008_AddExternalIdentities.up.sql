@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS external_identities (
+  provider   VARCHAR(31)                                  NOT NULL,
+  subject    VARCHAR(255)                                 NOT NULL,
+  user_id    UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  email      VARCHAR(255),
+  created_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  PRIMARY KEY (provider, subject),
+  UNIQUE (provider, user_id)
+);
+
+
+CREATE INDEX external_identities_user_ids
+  ON external_identities (user_id);
+
+
+INSERT INTO external_identities (provider, subject, user_id)
+  SELECT 'facebook', facebook_user_id, user_id
+  FROM facebook_users;
+
+INSERT INTO external_identities (provider, subject, user_id)
+  SELECT 'google', google_user_id, user_id
+  FROM google_users;
+
+
+DROP TABLE IF EXISTS google_users;
+DROP TABLE IF EXISTS facebook_users;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS facebook_deletion_requests;
\ No newline at end of file
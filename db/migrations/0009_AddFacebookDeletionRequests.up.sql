@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS facebook_deletion_requests (
+  confirmation_code VARCHAR(32) PRIMARY KEY,
+  facebook_user_id  VARCHAR(255)              NOT NULL,
+  status            VARCHAR(31)               NOT NULL,
+  requested_at      TIMESTAMPTZ DEFAULT now() NOT NULL,
+  completed_at      TIMESTAMPTZ
+);
\ No newline at end of file
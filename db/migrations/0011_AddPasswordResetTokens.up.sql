@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id    UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  token_hash BYTEA UNIQUE                                 NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  expires_at TIMESTAMPTZ                                  NOT NULL,
+  used_at    TIMESTAMPTZ
+);
+
+
+CREATE INDEX password_reset_tokens_user_ids
+  ON password_reset_tokens (user_id);
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id    UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  email      VARCHAR(255)                                 NOT NULL,
+  token_hash BYTEA UNIQUE                                 NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  expires_at TIMESTAMPTZ                                  NOT NULL,
+  used_at    TIMESTAMPTZ
+);
+
+
+CREATE INDEX email_verification_tokens_user_ids
+  ON email_verification_tokens (user_id);
\ No newline at end of file
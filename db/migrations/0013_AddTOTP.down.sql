@@ -0,0 +1,8 @@
+ALTER TABLE sessions
+  DROP COLUMN IF EXISTS mfa_at;
+
+ALTER TABLE organizations
+  DROP COLUMN IF EXISTS require_mfa;
+
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
\ No newline at end of file
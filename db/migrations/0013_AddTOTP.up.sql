@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id        UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+  secret         BYTEA                     NOT NULL,
+  last_used_step BIGINT DEFAULT 0          NOT NULL,
+  created_at     TIMESTAMPTZ DEFAULT now() NOT NULL,
+  confirmed_at   TIMESTAMPTZ
+);
+
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id    UUID REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+  code_hash  BYTEA                                        NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  used_at    TIMESTAMPTZ,
+  UNIQUE (user_id, code_hash)
+);
+
+
+ALTER TABLE organizations
+  ADD COLUMN require_mfa BOOLEAN DEFAULT FALSE NOT NULL;
+
+
+-- When the session's user proved their second factor, NULL for sessions started without one
+ALTER TABLE sessions
+  ADD COLUMN mfa_at TIMESTAMPTZ;
\ No newline at end of file
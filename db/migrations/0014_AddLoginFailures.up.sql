@@ -0,0 +1,11 @@
+-- Keys are counted under different policies, so each row remembers when its own policy's window lets it be forgotten
+CREATE TABLE IF NOT EXISTS login_failures (
+  key             VARCHAR(320) PRIMARY KEY,
+  failures        INTEGER     NOT NULL,
+  last_failure_at TIMESTAMPTZ NOT NULL,
+  forget_at       TIMESTAMPTZ NOT NULL
+);
+
+
+CREATE INDEX login_failures_forget_ats
+  ON login_failures (forget_at);
\ No newline at end of file
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id              UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  name            VARCHAR(255)                                         NOT NULL,
+  prefix          VARCHAR(15)                                          NOT NULL,
+  token_hash      BYTEA UNIQUE                                         NOT NULL,
+  scopes          TEXT []                                              NOT NULL,
+  user_id         UUID REFERENCES users (id) ON DELETE CASCADE,
+  organization_id UUID REFERENCES organizations (id) ON DELETE CASCADE,
+  created_by      UUID REFERENCES users (id) ON DELETE SET NULL,
+  created_at      TIMESTAMPTZ DEFAULT now()                            NOT NULL,
+  last_used_at    TIMESTAMPTZ,
+  expires_at      TIMESTAMPTZ,
+  revoked_at      TIMESTAMPTZ,
+  CHECK ((user_id IS NULL) <> (organization_id IS NULL))
+);
+
+
+CREATE INDEX api_tokens_user_ids
+  ON api_tokens (user_id);
+
+
+CREATE INDEX api_tokens_organization_ids
+  ON api_tokens (organization_id);
\ No newline at end of file
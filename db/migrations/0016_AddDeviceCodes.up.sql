@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS device_codes (
+  id               UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  device_code_hash BYTEA UNIQUE                                 NOT NULL,
+  user_code        VARCHAR(8) UNIQUE                            NOT NULL,
+  client_id        VARCHAR(255)                                 NOT NULL,
+  user_id          UUID REFERENCES users (id) ON DELETE CASCADE,
+  status           VARCHAR(15)                                  NOT NULL,
+  poll_interval    INTEGER                                      NOT NULL,
+  created_at       TIMESTAMPTZ DEFAULT now()                    NOT NULL,
+  expires_at       TIMESTAMPTZ                                  NOT NULL,
+  last_polled_at   TIMESTAMPTZ
+);
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS audit_log;
+
+ALTER TABLE sessions
+  DROP COLUMN IF EXISTS impersonator_id;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS is_admin;
\ No newline at end of file
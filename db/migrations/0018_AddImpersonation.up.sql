@@ -0,0 +1,25 @@
+ALTER TABLE users
+  ADD COLUMN is_admin BOOLEAN DEFAULT FALSE NOT NULL;
+
+
+-- Sessions an admin started as another user
+ALTER TABLE sessions
+  ADD COLUMN impersonator_id UUID REFERENCES users (id) ON DELETE CASCADE;
+
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  actor_id   UUID REFERENCES users (id) ON DELETE SET NULL,
+  subject_id UUID REFERENCES users (id) ON DELETE SET NULL,
+  action     VARCHAR(63)                               NOT NULL,
+  details    TEXT DEFAULT ''                           NOT NULL,
+  ip_address VARCHAR(45) DEFAULT ''                    NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()                 NOT NULL
+);
+
+
+CREATE INDEX audit_log_actor_ids
+  ON audit_log (actor_id);
+
+CREATE INDEX audit_log_subject_ids
+  ON audit_log (subject_id);
\ No newline at end of file
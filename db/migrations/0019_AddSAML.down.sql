@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS saml_login_codes;
+DROP TABLE IF EXISTS saml_requests;
+DROP TABLE IF EXISTS saml_group_mappings;
+DROP TABLE IF EXISTS saml_providers;
+
+DELETE FROM external_identities
+WHERE provider LIKE 'saml:%';
+
+ALTER TABLE external_identities
+  ALTER COLUMN provider TYPE VARCHAR(31);
\ No newline at end of file
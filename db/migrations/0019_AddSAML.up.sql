@@ -0,0 +1,51 @@
+-- SAML identities are stored as saml:<organization id>, which doesn't fit in 31 characters
+ALTER TABLE external_identities
+  ALTER COLUMN provider TYPE VARCHAR(63);
+
+
+CREATE TABLE IF NOT EXISTS saml_providers (
+  organization_id  UUID PRIMARY KEY REFERENCES organizations (id) ON DELETE CASCADE,
+  entity_id        VARCHAR(1023)                NOT NULL,
+  metadata         TEXT                         NOT NULL,
+  email_attribute  VARCHAR(255) DEFAULT 'email' NOT NULL,
+  groups_attribute VARCHAR(255) DEFAULT ''      NOT NULL,
+  created_at       TIMESTAMPTZ DEFAULT now()    NOT NULL,
+  updated_at       TIMESTAMPTZ DEFAULT now()    NOT NULL
+);
+
+
+-- Users whose groups attribute has the value are put in the group
+CREATE TABLE IF NOT EXISTS saml_group_mappings (
+  organization_id       UUID REFERENCES saml_providers (organization_id) ON DELETE CASCADE NOT NULL,
+  attribute_value       VARCHAR(255)                                                    NOT NULL,
+  organization_group_id UUID REFERENCES organization_groups (id) ON DELETE CASCADE      NOT NULL,
+  PRIMARY KEY (organization_id, attribute_value, organization_group_id)
+);
+
+
+-- Outstanding authentication requests. A response is only accepted in reply to one, and only once
+CREATE TABLE IF NOT EXISTS saml_requests (
+  id              VARCHAR(63) PRIMARY KEY,
+  organization_id UUID REFERENCES organizations (id) ON DELETE CASCADE NOT NULL,
+  link_user_id    UUID REFERENCES users (id) ON DELETE CASCADE,
+  state_hash      BYTEA                                                NOT NULL,
+  created_at      TIMESTAMPTZ DEFAULT now()                            NOT NULL,
+  expires_at      TIMESTAMPTZ                                          NOT NULL
+);
+
+
+-- Verified assertions waiting for the browser which started the login to exchange their code. Users are only
+-- logged in, linked, provisioned or put in groups once it does
+CREATE TABLE IF NOT EXISTS saml_login_codes (
+  code_hash       BYTEA PRIMARY KEY,
+  organization_id UUID REFERENCES organizations (id) ON DELETE CASCADE NOT NULL,
+  subject         VARCHAR(255)                                         NOT NULL,
+  email           VARCHAR(255) DEFAULT ''                              NOT NULL,
+  -- NULL when the organization doesn't map groups
+  group_values    TEXT [],
+  link_user_id    UUID REFERENCES users (id) ON DELETE CASCADE,
+  state_hash      BYTEA                                                NOT NULL,
+  created_at      TIMESTAMPTZ DEFAULT now()                            NOT NULL,
+  expires_at      TIMESTAMPTZ                                          NOT NULL,
+  used_at         TIMESTAMPTZ
+);
\ No newline at end of file
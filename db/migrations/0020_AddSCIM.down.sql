@@ -0,0 +1,4 @@
+ALTER TABLE organization_groups
+  DROP COLUMN IF EXISTS external_id;
+
+DROP TABLE IF EXISTS scim_users;
\ No newline at end of file
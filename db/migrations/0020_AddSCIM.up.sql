@@ -0,0 +1,22 @@
+-- Users an organization's IdP provisioned through SCIM, with what the IdP calls them
+CREATE TABLE IF NOT EXISTS scim_users (
+  organization_id UUID REFERENCES organizations (id) ON DELETE CASCADE NOT NULL,
+  user_id         UUID REFERENCES users (id) ON DELETE CASCADE         NOT NULL,
+  user_name       VARCHAR(255)                                         NOT NULL,
+  external_id     VARCHAR(255),
+  active          BOOLEAN DEFAULT TRUE                                 NOT NULL,
+  created_at      TIMESTAMPTZ DEFAULT now()                            NOT NULL,
+  updated_at      TIMESTAMPTZ DEFAULT now()                            NOT NULL,
+  PRIMARY KEY (organization_id, user_id)
+);
+
+
+CREATE UNIQUE INDEX scim_users_user_names
+  ON scim_users (organization_id, lower(user_name));
+
+CREATE INDEX scim_users_user_ids
+  ON scim_users (user_id);
+
+
+ALTER TABLE organization_groups
+  ADD COLUMN external_id VARCHAR(255);
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE organization_group_permission_types
+  DROP COLUMN IF EXISTS description,
+  DROP CONSTRAINT IF EXISTS organization_group_permission_types_name_key,
+  ALTER COLUMN name DROP NOT NULL;
\ No newline at end of file
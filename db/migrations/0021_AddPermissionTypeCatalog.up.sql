@@ -0,0 +1,22 @@
+-- Permission types are synced from kubrik's registry by name, which identifies them
+DELETE FROM organization_group_permission_types WHERE name IS NULL;
+
+-- Groups keep the permissions they had through a duplicate by getting them through the type which is kept instead
+INSERT INTO organization_group_permissions (group_id, permission_type_id)
+SELECT DISTINCT p.group_id, kept.id
+FROM organization_group_permissions p
+  JOIN organization_group_permission_types t ON p.permission_type_id = t.id
+  JOIN organization_group_permission_types kept ON t.name = kept.name AND t.id > kept.id
+WHERE NOT EXISTS(SELECT 1
+                 FROM organization_group_permission_types earlier
+                 WHERE earlier.name = kept.name AND earlier.id < kept.id)
+ON CONFLICT DO NOTHING;
+
+DELETE FROM organization_group_permission_types t
+USING organization_group_permission_types other
+WHERE t.name = other.name AND t.id > other.id;
+
+ALTER TABLE organization_group_permission_types
+  ALTER COLUMN name SET NOT NULL,
+  ADD CONSTRAINT organization_group_permission_types_name_key UNIQUE (name),
+  ADD COLUMN description TEXT DEFAULT '' NOT NULL;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS organization_invitations;
\ No newline at end of file
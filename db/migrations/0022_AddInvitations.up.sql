@@ -0,0 +1,23 @@
+-- Invitations to join an organization's group, sent to an email or to an existing user
+CREATE TABLE IF NOT EXISTS organization_invitations (
+  id                    UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  organization_id       UUID REFERENCES organizations (id) ON DELETE CASCADE        NOT NULL,
+  organization_group_id UUID REFERENCES organization_groups (id) ON DELETE CASCADE  NOT NULL,
+  email                 VARCHAR(255),
+  invitee_id            UUID REFERENCES users (id) ON DELETE CASCADE,
+  inviter_id            UUID REFERENCES users (id) ON DELETE SET NULL,
+  token_hash            BYTEA UNIQUE                                                NOT NULL,
+  created_at            TIMESTAMPTZ DEFAULT now()                                   NOT NULL,
+  expires_at            TIMESTAMPTZ                                                 NOT NULL,
+  accepted_at           TIMESTAMPTZ,
+  declined_at           TIMESTAMPTZ,
+  revoked_at            TIMESTAMPTZ,
+  CHECK (email IS NOT NULL OR invitee_id IS NOT NULL)
+);
+
+
+CREATE INDEX organization_invitations_organization_ids
+  ON organization_invitations (organization_id);
+
+CREATE INDEX organization_invitations_invitee_ids
+  ON organization_invitations (invitee_id);
\ No newline at end of file
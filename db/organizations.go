@@ -1,5 +1,7 @@
 package db
 
+import "github.com/jackc/pgx"
+
 type PermissionModel struct {
 	Id                 string
 	PermissionTypeId   string
@@ -11,49 +13,95 @@ type GroupModel struct {
 	Name        string
 	IsPublic    bool
 	Permissions []PermissionModel
+	// ExternalId is the IdP's id for a group provisioned through SCIM
+	ExternalId *string
+	// Members is only read through SCIM
+	Members []UserModel
 }
 
 type OrganizationModel struct {
-	Id        string
-	Name      string
-	IsUserOrg bool
-	OwnerId   string
-	Groups    []GroupModel
+	Id         string
+	Name       string
+	IsUserOrg  bool
+	OwnerId    string
+	RequireMFA bool
+	Groups     []GroupModel
 }
 
 type OrganizationGroupModel struct {
 }
 
-func CreateOrganization(name, ownerId string, isUserOrg bool) (*OrganizationModel, error) {
+// GroupTemplateModel is a group every new organization starts with
+type GroupTemplateModel struct {
+	Name        string
+	IsPublic    bool
+	Permissions []string
+	// AddOwner puts the organization's owner in the group
+	AddOwner bool
+}
+
+// CreateOrganization creates an organization along with a group for each template, all or nothing.
+// ErrUnknownPermission is returned if a template has a permission type which doesn't exist.
+func CreateOrganization(name, ownerId string, isUserOrg bool, templates []GroupTemplateModel) (*OrganizationModel, error) {
 	const qsIns = "INSERT INTO organizations(name, owner_id, is_user_org) VALUES($1, $2, $3) RETURNING id"
+	const qsInsGroup = "INSERT INTO organization_groups(name, is_public, organization_id) VALUES ($1, $2, $3) RETURNING id"
+	const qsInsOwner = "INSERT INTO organization_group_users(user_id, organization_group_id) VALUES ($1, $2)"
 	var err error
 
-	// Get a connection from the pool and set it up to release
-	conn, err := PgPool.Acquire()
+	tx, err := PgPool.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer PgPool.Release(conn)
+	defer tx.Rollback()
 
-	// Attempt to insert the new user
-	row := conn.QueryRow(qsIns, name, ownerId, isUserOrg)
+	// Attempt to insert the new organization
+	row := tx.QueryRow(qsIns, name, ownerId, isUserOrg)
 	var id string
 	if err = row.Scan(&id); err != nil {
 		return nil, err
 	}
-	return &OrganizationModel{
+
+	org := OrganizationModel{
 		Id:        id,
 		Name:      name,
 		IsUserOrg: isUserOrg,
 		OwnerId:   ownerId,
-	}, nil
+		Groups:    []GroupModel{},
+	}
+	for _, template := range templates {
+		var groupId string
+		if err = tx.QueryRow(qsInsGroup, template.Name, template.IsPublic, id).Scan(&groupId); err != nil {
+			return nil, err
+		}
+		if err = setGroupPermissions(tx, groupId, template.Permissions); err != nil {
+			return nil, err
+		}
+		if template.AddOwner {
+			if _, err = tx.Exec(qsInsOwner, ownerId, groupId); err != nil {
+				return nil, err
+			}
+		}
+
+		group, err := getGroup(tx, id, groupId)
+		if err != nil {
+			return nil, err
+		}
+		org.Groups = append(org.Groups, *group)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &org, nil
 }
 
 func GetOrganizationById(id string) (*OrganizationModel, error) {
-	const qs = `SELECT o.name, o.is_user_org, o.owner_id,
-	g.id as group_id, g.name as group_name, g.is_public as group_is_public,
-	p.id as permission_id, p.permission_type_id,
-	t.name as permission_type_name
+	// Organizations without groups, and groups without permissions, come back with NULLs from the outer joins
+	const qs = `SELECT o.name, o.is_user_org, o.owner_id, o.require_mfa,
+	COALESCE(g.id::text, '') as group_id, COALESCE(g.name, '') as group_name,
+	COALESCE(g.is_public, false) as group_is_public,
+	COALESCE(p.id::text, '') as permission_id, COALESCE(p.permission_type_id::text, '') as permission_type_id,
+	COALESCE(t.name, '') as permission_type_name
 FROM organizations o
 	LEFT JOIN organization_groups g
 		ON o.id = g.organization_id
@@ -80,6 +128,7 @@ WHERE o.id = $1`
 		var name string
 		var isUserOrg bool
 		var ownerId string
+		var requireMFA bool
 		var groupId string
 		var groupName string
 		var groupIsPublic bool
@@ -88,7 +137,7 @@ WHERE o.id = $1`
 		var permissionTypeName string
 
 		err = rows.Scan(
-			&name, &isUserOrg, &ownerId,
+			&name, &isUserOrg, &ownerId, &requireMFA,
 			&groupId, &groupName, &groupIsPublic,
 			&permissionId, &permissionTypeId, &permissionTypeName)
 		if err != nil {
@@ -100,6 +149,7 @@ WHERE o.id = $1`
 		response.Name = name
 		response.IsUserOrg = isUserOrg
 		response.OwnerId = ownerId
+		response.RequireMFA = requireMFA
 
 		// Find group if it exists
 		groupExists := false
@@ -132,6 +182,12 @@ WHERE o.id = $1`
 			})
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if response.Id == "" {
+		return nil, pgx.ErrNoRows
+	}
 	return &response, nil
 }
 
@@ -156,3 +212,52 @@ func GetOrganizationByName(name string) (*OrganizationModel, error) {
 		OwnerId: ownerId,
 	}, nil
 }
+
+// UserPermissionsModel is what a user may do in an organization, as granted by the groups they are in
+type UserPermissionsModel struct {
+	IsOwner bool
+	// IsMember is set if the user is in any of the organization's groups
+	IsMember    bool
+	RequireMFA  bool
+	Permissions []string
+}
+
+// GetUserPermissions collects the names of the permissions a user has in an organization through its groups.
+// pgx.ErrNoRows is returned if there is no organization with the id.
+func GetUserPermissions(userId, organizationId string) (*UserPermissionsModel, error) {
+	const qs = `SELECT o.owner_id = $2, o.require_mfa,
+	EXISTS (
+		SELECT 1 FROM organization_group_users gu
+			JOIN organization_groups g
+				ON gu.organization_group_id = g.id
+		WHERE gu.user_id = $2 AND g.organization_id = o.id
+	),
+	ARRAY(
+		SELECT DISTINCT t.name FROM organization_group_users gu
+			JOIN organization_groups g
+				ON gu.organization_group_id = g.id
+			JOIN organization_group_permissions p
+				ON g.id = p.group_id
+			JOIN organization_group_permission_types t
+				ON p.permission_type_id = t.id
+		WHERE gu.user_id = $2 AND g.organization_id = o.id
+		ORDER BY t.name
+	)
+FROM organizations o
+WHERE o.id = $1`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var permissions UserPermissionsModel
+	err = conn.QueryRow(qs, organizationId, userId).
+		Scan(&permissions.IsOwner, &permissions.RequireMFA, &permissions.IsMember, &permissions.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	return &permissions, nil
+}
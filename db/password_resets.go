@@ -0,0 +1,106 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrPasswordResetTokenInvalid is returned when a password reset token doesn't exist, has expired or was used
+var ErrPasswordResetTokenInvalid = errors.New("Password reset token is invalid")
+
+// ErrTooManyPasswordResets is returned when a user already has as many unused password reset tokens as they may
+// have at once
+var ErrTooManyPasswordResets = errors.New("Too many outstanding password resets")
+
+// CreatePasswordResetToken stores the hash of a password reset token for a user, unless the user already has
+// maxActive tokens which are neither used nor expired
+func CreatePasswordResetToken(userId string, tokenHash []byte, expiresAt time.Time, maxActive int) error {
+	const qsLock = "SELECT id FROM users WHERE id=$1 FOR UPDATE"
+	const qsCount = "SELECT count(*) FROM password_reset_tokens WHERE user_id=$1 AND used_at IS NULL AND expires_at > now()"
+	const qsIns = "INSERT INTO password_reset_tokens(user_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user so that concurrent requests can't both slip under the limit
+	var id string
+	if err = tx.QueryRow(qsLock, userId).Scan(&id); err != nil {
+		return err
+	}
+	var active int64
+	if err = tx.QueryRow(qsCount, userId).Scan(&active); err != nil {
+		return err
+	}
+	if active >= int64(maxActive) {
+		return ErrTooManyPasswordResets
+	}
+	if _, err = tx.Exec(qsIns, userId, tokenHash, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordResetUser returns the user a password reset token belongs to, as long as the token can still be used
+func GetPasswordResetUser(tokenHash []byte) (*UserModel, error) {
+	const qs = "SELECT user_id FROM password_reset_tokens WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var userId string
+	err = conn.QueryRow(qs, tokenHash).Scan(&userId)
+	if err == pgx.ErrNoRows {
+		return nil, ErrPasswordResetTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	return GetUserById(userId)
+}
+
+// ResetPassword spends a password reset token to replace its user's password and returns the user's id.
+// Every other outstanding token of the user is spent with it, so an older email can't undo the reset.
+func ResetPassword(tokenHash []byte, encryptedPassword []byte) (string, error) {
+	const qsSel = "SELECT user_id, expires_at, used_at FROM password_reset_tokens WHERE token_hash=$1 FOR UPDATE"
+	const qsUpdUser = "UPDATE users SET encrypted_password=$2 WHERE id=$1"
+	const qsUseTokens = "UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userId string
+	var expiresAt time.Time
+	var usedAt *time.Time
+	err = tx.QueryRow(qsSel, tokenHash).Scan(&userId, &expiresAt, &usedAt)
+	if err == pgx.ErrNoRows {
+		return "", ErrPasswordResetTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+	if usedAt != nil || time.Now().After(expiresAt) {
+		return "", ErrPasswordResetTokenInvalid
+	}
+
+	if _, err = tx.Exec(qsUpdUser, userId, encryptedPassword); err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(qsUseTokens, userId); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
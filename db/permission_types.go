@@ -0,0 +1,59 @@
+package db
+
+// PermissionTypeModel is a permission groups can grant in an organization
+type PermissionTypeModel struct {
+	Id          string
+	Name        string
+	Description string
+}
+
+// SyncPermissionTypes makes sure every permission type exists with its description.
+// Types missing from types are left alone, so that groups keep them across a rollback to a version which had them.
+func SyncPermissionTypes(types []PermissionTypeModel) error {
+	const qs = `INSERT INTO organization_group_permission_types(name, description) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET description=$2`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range types {
+		if _, err = tx.Exec(qs, t.Name, t.Description); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListPermissionTypes retrieves every permission type
+func ListPermissionTypes() ([]PermissionTypeModel, error) {
+	const qs = "SELECT id, name, description FROM organization_group_permission_types ORDER BY name"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := []PermissionTypeModel{}
+	for rows.Next() {
+		var t PermissionTypeModel
+		if err = rows.Scan(&t.Id, &t.Name, &t.Description); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return types, nil
+}
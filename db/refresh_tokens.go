@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token which has already been rotated is presented again.
+// When this happens every token in the family is revoked, as either the client or an attacker holds a stolen token.
+var ErrRefreshTokenReused = errors.New("Refresh token has already been used")
+
+// ErrRefreshTokenRevoked is returned when a refresh token has been explicitly revoked
+var ErrRefreshTokenRevoked = errors.New("Refresh token has been revoked")
+
+// ErrRefreshTokenExpired is returned when a refresh token is past its expiry
+var ErrRefreshTokenExpired = errors.New("Refresh token has expired")
+
+type RefreshTokenModel struct {
+	Id        string
+	UserId    string
+	FamilyId  string
+	TokenHash []byte
+	ExpiresAt time.Time
+}
+
+// CreateRefreshToken writes a new refresh token hash for a user.
+// The family of a refresh token is the session it was issued for, see CreateSession.
+func CreateRefreshToken(userId, familyId string, tokenHash []byte, expiresAt time.Time) (*RefreshTokenModel, error) {
+	const qsIns = `INSERT INTO refresh_tokens(user_id, family_id, token_hash, expires_at)
+VALUES($1, $2, $3, $4) RETURNING id`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var id string
+	row := conn.QueryRow(qsIns, userId, familyId, tokenHash, expiresAt)
+	if err = row.Scan(&id); err != nil {
+		return nil, err
+	}
+	return &RefreshTokenModel{
+		Id:        id,
+		UserId:    userId,
+		FamilyId:  familyId,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// RotateRefreshToken marks the token matching tokenHash as used and replaces it with newTokenHash in the same family.
+// The session the family belongs to is moved on to newJti, the id of the access token issued alongside.
+// If the token was already used, the whole family and its session are revoked and ErrRefreshTokenReused is returned,
+// along with the jti the session had if it was still active.
+// If no token matches, pgx.ErrNoRows is returned.
+func RotateRefreshToken(tokenHash, newTokenHash []byte, newJti string, expiresAt time.Time) (*RefreshTokenModel, string, error) {
+	const qsSel = `SELECT id, user_id, family_id, expires_at, used_at, revoked_at
+FROM refresh_tokens WHERE token_hash=$1 FOR UPDATE`
+	const qsUse = "UPDATE refresh_tokens SET used_at=now() WHERE id=$1"
+	const qsSession = "UPDATE sessions SET jti=$2, last_seen_at=now() WHERE id=$1 AND revoked_at IS NULL"
+	const qsIns = `INSERT INTO refresh_tokens(user_id, family_id, token_hash, expires_at)
+VALUES($1, $2, $3, $4) RETURNING id`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var id string
+	var userId string
+	var familyId string
+	var oldExpiresAt time.Time
+	var usedAt *time.Time
+	var revokedAt *time.Time
+	row := tx.QueryRow(qsSel, tokenHash)
+	if err = row.Scan(&id, &userId, &familyId, &oldExpiresAt, &usedAt, &revokedAt); err != nil {
+		return nil, "", err
+	}
+
+	if revokedAt != nil {
+		return nil, "", ErrRefreshTokenRevoked
+	}
+
+	if usedAt != nil {
+		if _, err = tx.Exec(qsRevokeFamily, familyId); err != nil {
+			return nil, "", err
+		}
+		// The session may have been revoked already, leaving no jti to return
+		var revokedJti string
+		if err = tx.QueryRow(qsRevokeSession, familyId).Scan(&revokedJti); err != nil && err != pgx.ErrNoRows {
+			return nil, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return nil, revokedJti, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(oldExpiresAt) {
+		return nil, "", ErrRefreshTokenExpired
+	}
+
+	if _, err = tx.Exec(qsUse, id); err != nil {
+		return nil, "", err
+	}
+
+	tag, err := tx.Exec(qsSession, familyId, newJti)
+	if err != nil {
+		return nil, "", err
+	}
+	if tag.RowsAffected() != 1 {
+		return nil, "", ErrRefreshTokenRevoked
+	}
+
+	var newId string
+	row = tx.QueryRow(qsIns, userId, familyId, newTokenHash, expiresAt)
+	if err = row.Scan(&newId); err != nil {
+		return nil, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return &RefreshTokenModel{
+		Id:        newId,
+		UserId:    userId,
+		FamilyId:  familyId,
+		TokenHash: newTokenHash,
+		ExpiresAt: expiresAt,
+	}, "", nil
+}
+
+const qsRevokeFamily = "UPDATE refresh_tokens SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL"
+
+// RevokeRefreshTokenFamily revokes every outstanding refresh token in a family
+func RevokeRefreshTokenFamily(familyId string) error {
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	if _, err = conn.Exec(qsRevokeFamily, familyId); err != nil {
+		return err
+	}
+	return nil
+}
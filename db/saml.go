@@ -0,0 +1,288 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrSAMLRequestInvalid is returned when a SAML response doesn't answer an outstanding request of the organization
+var ErrSAMLRequestInvalid = errors.New("SAML request is invalid")
+
+// ErrSAMLLoginCodeInvalid is returned when a SAML login code doesn't exist, has expired, was used or was issued to
+// another browser or user
+var ErrSAMLLoginCodeInvalid = errors.New("SAML login code is invalid")
+
+// ErrUnknownGroup is returned when a group mapping refers to a group that isn't the organization's
+var ErrUnknownGroup = errors.New("Group is not in the organization")
+
+type SAMLGroupMappingModel struct {
+	AttributeValue string
+	GroupId        string
+}
+
+// SAMLLoginModel is a verified assertion waiting for its login code to be exchanged
+type SAMLLoginModel struct {
+	OrganizationId string
+	// Subject is the assertion's NameID, which its identity is stored under
+	Subject string
+	// Email is empty if the assertion didn't vouch for one
+	Email string
+	// GroupValues are the values of the groups attribute, or nil if the organization doesn't map groups
+	GroupValues []string
+	// LinkUserId is the user to link the identity to, or nil to log in with it
+	LinkUserId *string
+}
+
+type SAMLProviderModel struct {
+	OrganizationId  string
+	EntityId        string
+	Metadata        string
+	EmailAttribute  string
+	GroupsAttribute string
+	GroupMappings   []SAMLGroupMappingModel
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// PutSAMLProvider creates or replaces an organization's SAML identity provider along with its group mappings.
+// ErrUnknownGroup is returned if a mapping refers to a group outside the organization.
+func PutSAMLProvider(p *SAMLProviderModel) error {
+	const qsUpsert = `INSERT INTO saml_providers(organization_id, entity_id, metadata, email_attribute, groups_attribute)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (organization_id) DO UPDATE SET entity_id=$2, metadata=$3, email_attribute=$4, groups_attribute=$5,
+	updated_at=now()
+RETURNING created_at, updated_at`
+	const qsDelMappings = "DELETE FROM saml_group_mappings WHERE organization_id=$1"
+	const qsInsMapping = `INSERT INTO saml_group_mappings(organization_id, attribute_value, organization_group_id)
+SELECT $1, $2, id FROM organization_groups WHERE id=$3 AND organization_id=$1
+ON CONFLICT DO NOTHING`
+	const qsGroupExists = "SELECT 1 FROM organization_groups WHERE id=$1 AND organization_id=$2"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(qsUpsert, p.OrganizationId, p.EntityId, p.Metadata, p.EmailAttribute, p.GroupsAttribute).
+		Scan(&p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(qsDelMappings, p.OrganizationId); err != nil {
+		return err
+	}
+	for _, mapping := range p.GroupMappings {
+		var exists int
+		err = tx.QueryRow(qsGroupExists, mapping.GroupId, p.OrganizationId).Scan(&exists)
+		if err == pgx.ErrNoRows {
+			return ErrUnknownGroup
+		} else if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(qsInsMapping, p.OrganizationId, mapping.AttributeValue, mapping.GroupId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSAMLProvider retrieves an organization's SAML identity provider and its group mappings.
+// pgx.ErrNoRows is returned if the organization has none.
+func GetSAMLProvider(organizationId string) (*SAMLProviderModel, error) {
+	const qs = `SELECT entity_id, metadata, email_attribute, groups_attribute, created_at, updated_at
+FROM saml_providers WHERE organization_id=$1`
+	const qsMappings = `SELECT attribute_value, organization_group_id FROM saml_group_mappings
+WHERE organization_id=$1 ORDER BY attribute_value, organization_group_id`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	p := SAMLProviderModel{OrganizationId: organizationId, GroupMappings: []SAMLGroupMappingModel{}}
+	err = conn.QueryRow(qs, organizationId).
+		Scan(&p.EntityId, &p.Metadata, &p.EmailAttribute, &p.GroupsAttribute, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(qsMappings, organizationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mapping SAMLGroupMappingModel
+		if err = rows.Scan(&mapping.AttributeValue, &mapping.GroupId); err != nil {
+			return nil, err
+		}
+		p.GroupMappings = append(p.GroupMappings, mapping)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DeleteSAMLProvider removes an organization's SAML identity provider. Users it provisioned keep their accounts but
+// can no longer log in with it. pgx.ErrNoRows is returned if the organization has none.
+func DeleteSAMLProvider(organizationId string) error {
+	const qs = "DELETE FROM saml_providers WHERE organization_id=$1"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, organizationId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CreateSAMLRequest records an authentication request sent to an organization's identity provider. linkUserId is
+// the user to link the identity to once it comes back, or nil to log in with it. Expired requests are swept too.
+func CreateSAMLRequest(id, organizationId string, linkUserId *string, stateHash []byte, expiresAt time.Time) error {
+	const qsSweep = "DELETE FROM saml_requests WHERE expires_at < now()"
+	const qsIns = `INSERT INTO saml_requests(id, organization_id, link_user_id, state_hash, expires_at)
+VALUES ($1, $2, $3, $4, $5)`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	if _, err = conn.Exec(qsSweep); err != nil {
+		return err
+	}
+	_, err = conn.Exec(qsIns, id, organizationId, linkUserId, stateHash, expiresAt)
+	return err
+}
+
+// ConsumeSAMLRequest spends an organization's outstanding authentication request, so that a response to it is only
+// ever accepted once. It returns the user to link to, if any, and the hash of the state handed to the browser.
+// ErrSAMLRequestInvalid is returned if the request doesn't exist, is another organization's or has expired.
+func ConsumeSAMLRequest(id, organizationId string) (linkUserId *string, stateHash []byte, err error) {
+	const qs = `DELETE FROM saml_requests WHERE id=$1 AND organization_id=$2
+RETURNING link_user_id, state_hash, expires_at`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var expiresAt time.Time
+	err = conn.QueryRow(qs, id, organizationId).Scan(&linkUserId, &stateHash, &expiresAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrSAMLRequestInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(expiresAt) {
+		return nil, nil, ErrSAMLRequestInvalid
+	}
+	return linkUserId, stateHash, nil
+}
+
+// SyncSAMLGroups puts a user in the organization's groups mapped from their groups attribute values, and takes
+// them out of the mapped groups the values no longer map to. Membership of unmapped groups is left alone.
+func SyncSAMLGroups(organizationId, userId string, values []string) error {
+	const qsDel = `DELETE FROM organization_group_users
+WHERE user_id=$2 AND organization_group_id IN (
+	SELECT organization_group_id FROM saml_group_mappings WHERE organization_id=$1
+	EXCEPT
+	SELECT organization_group_id FROM saml_group_mappings WHERE organization_id=$1 AND attribute_value=ANY($3)
+)`
+	const qsIns = `INSERT INTO organization_group_users(user_id, organization_group_id)
+SELECT DISTINCT $2::UUID, organization_group_id FROM saml_group_mappings
+WHERE organization_id=$1 AND attribute_value=ANY($3)
+ON CONFLICT DO NOTHING`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(qsDel, organizationId, userId, values); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(qsIns, organizationId, userId, values); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateSAMLLoginCode stores the hash of a code the web app exchanges for a user's tokens after a SAML login, along
+// with the verified assertion. Only a browser holding the state the login was started with can exchange it.
+func CreateSAMLLoginCode(codeHash []byte, login *SAMLLoginModel, stateHash []byte, expiresAt time.Time) error {
+	const qsSweep = "DELETE FROM saml_login_codes WHERE expires_at < now()"
+	const qsIns = `INSERT INTO saml_login_codes(code_hash, organization_id, subject, email, group_values, link_user_id,
+	state_hash, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	// pgx sends a nil []string as an empty array rather than NULL
+	var groupValues interface{}
+	if login.GroupValues != nil {
+		groupValues = login.GroupValues
+	}
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	if _, err = conn.Exec(qsSweep); err != nil {
+		return err
+	}
+	_, err = conn.Exec(qsIns, codeHash, login.OrganizationId, login.Subject, login.Email, groupValues,
+		login.LinkUserId, stateHash, expiresAt)
+	return err
+}
+
+// UseSAMLLoginCode spends a SAML login code and returns the assertion it was issued for. callerId is the logged in
+// user exchanging it, if any. Codes of logins linking an identity can only be spent by the user linking it.
+// ErrSAMLLoginCodeInvalid is returned if the code doesn't exist, has expired, was used, the state doesn't match or
+// the caller isn't the user linking it.
+func UseSAMLLoginCode(codeHash, stateHash []byte, callerId *string) (*SAMLLoginModel, error) {
+	const qs = `UPDATE saml_login_codes SET used_at=now()
+WHERE code_hash=$1 AND state_hash=$2 AND used_at IS NULL AND expires_at > now()
+	AND (link_user_id IS NULL OR link_user_id::text=$3)
+RETURNING organization_id, subject, email, group_values, link_user_id`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var login SAMLLoginModel
+	err = conn.QueryRow(qs, codeHash, stateHash, callerId).
+		Scan(&login.OrganizationId, &login.Subject, &login.Email, &login.GroupValues, &login.LinkUserId)
+	if err == pgx.ErrNoRows {
+		return nil, ErrSAMLLoginCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
@@ -0,0 +1,514 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrUnknownMember is returned when a group member isn't an active user the organization provisioned
+var ErrUnknownMember = errors.New("User is not provisioned in the organization")
+
+// ErrUnsupportedFilter is returned when listing SCIM resources by an attribute they can't be filtered by
+var ErrUnsupportedFilter = errors.New("Unsupported SCIM filter attribute")
+
+// SCIMMembershipModel is a user as an organization's IdP provisioned them
+type SCIMMembershipModel struct {
+	OrganizationId string
+	UserName       string
+	ExternalId     *string
+	Active         bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// SCIMUserPatch holds the changes to a provisioned user. Nil fields are left alone, and an empty ExternalId
+// removes it.
+type SCIMUserPatch struct {
+	UserName   *string
+	ExternalId *string
+	Active     *bool
+}
+
+// SCIMGroupPatch holds the changes to a provisioned group. Nil fields are left alone, and an empty ExternalId
+// removes it. When ReplaceMembers is set the group's members become Members, otherwise AddMemberIds are added and
+// RemoveMemberIds removed.
+type SCIMGroupPatch struct {
+	Name            *string
+	ExternalId      *string
+	ReplaceMembers  bool
+	Members         []string
+	AddMemberIds    []string
+	RemoveMemberIds []string
+}
+
+// The conditions each SCIM attribute is filtered with, comparing it to $2
+var scimUserFilters = map[string]string{
+	"id":           "u.id::text=$2",
+	"userName":     "lower(s.user_name)=lower($2)",
+	"externalId":   "s.external_id=$2",
+	"emails.value": "lower(u.email)=lower($2)",
+}
+
+var scimGroupFilters = map[string]string{
+	"id":          "g.id::text=$2",
+	"displayName": "lower(g.name)=lower($2)",
+	"externalId":  "g.external_id=$2",
+}
+
+const qsSCIMUser = `SELECT u.id, u.username, u.email, s.user_name, s.external_id, s.active, s.created_at, s.updated_at
+FROM scim_users s
+	JOIN users u
+		ON s.user_id = u.id
+WHERE s.organization_id=$1`
+
+func scanSCIMUser(row interface {
+	Scan(...interface{}) error
+}, organizationId string) (*UserModel, error) {
+	user := UserModel{SCIM: &SCIMMembershipModel{OrganizationId: organizationId}}
+	err := row.Scan(&user.Id, &user.Username, &user.Email, &user.SCIM.UserName, &user.SCIM.ExternalId,
+		&user.SCIM.Active, &user.SCIM.CreatedAt, &user.SCIM.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateSCIMUser creates a user provisioned by an organization's IdP, with an unverified email and no password.
+// They log in through the organization's SAML IdP, which may claim the account.
+// A pgx.PgError with code 23505 is returned if a user already has the email, or the organization already
+// provisioned someone with the user name.
+func CreateSCIMUser(organizationId, userName, email string, externalId *string, active bool) (*UserModel, error) {
+	const qsInsUser = "INSERT INTO users(email) VALUES ($1) RETURNING id, username"
+	const qsInsMembership = `INSERT INTO scim_users(organization_id, user_id, user_name, external_id, active)
+VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at`
+
+	// Both rows are written in a transaction so that a taken user name doesn't leave an orphaned user behind
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user := UserModel{
+		Email: email,
+		SCIM: &SCIMMembershipModel{
+			OrganizationId: organizationId,
+			UserName:       userName,
+			ExternalId:     externalId,
+			Active:         active,
+		},
+	}
+	if err = tx.QueryRow(qsInsUser, email).Scan(&user.Id, &user.Username); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(qsInsMembership, organizationId, user.Id, userName, externalId, active).
+		Scan(&user.SCIM.CreatedAt, &user.SCIM.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetSCIMUser retrieves a user an organization provisioned. pgx.ErrNoRows is returned if it didn't provision them.
+func GetSCIMUser(organizationId, userId string) (*UserModel, error) {
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	return scanSCIMUser(conn.QueryRow(qsSCIMUser+" AND s.user_id=$2", organizationId, userId), organizationId)
+}
+
+// ListSCIMUsers retrieves a page of the users an organization provisioned, along with how many there are in all.
+// When attribute isn't empty, only users whose SCIM attribute equals value are listed.
+// ErrUnsupportedFilter is returned if users can't be filtered by the attribute.
+func ListSCIMUsers(organizationId, attribute, value string, offset, limit int) ([]UserModel, int, error) {
+	condition := "$2::text IS NULL"
+	args := []interface{}{organizationId, nil}
+	if attribute != "" {
+		var ok bool
+		if condition, ok = scimUserFilters[attribute]; !ok {
+			return nil, 0, ErrUnsupportedFilter
+		}
+		args[1] = value
+	}
+	qsCount := `SELECT count(*) FROM scim_users s JOIN users u ON s.user_id = u.id
+WHERE s.organization_id=$1 AND ` + condition
+	qs := qsSCIMUser + " AND " + condition + " ORDER BY s.created_at, u.id OFFSET $3 LIMIT $4"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer PgPool.Release(conn)
+
+	var total int64
+	if err = conn.QueryRow(qsCount, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := conn.Query(qs, append(args, offset, limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []UserModel{}
+	for rows.Next() {
+		user, err := scanSCIMUser(rows, organizationId)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, int(total), nil
+}
+
+// PatchSCIMUser changes a user an organization provisioned. Deactivating them takes them out of all of the
+// organization's groups. pgx.ErrNoRows is returned if the organization didn't provision them, and a pgx.PgError
+// with code 23505 if it provisioned someone else with the new user name.
+func PatchSCIMUser(organizationId, userId string, patch *SCIMUserPatch) (*UserModel, error) {
+	const qsUpd = `UPDATE scim_users SET user_name=COALESCE($3, user_name),
+	external_id=CASE WHEN $4::text IS NULL THEN external_id ELSE NULLIF($4, '') END,
+	active=COALESCE($5, active), updated_at=now()
+WHERE organization_id=$1 AND user_id=$2`
+	const qsDelGroups = `DELETE FROM organization_group_users
+WHERE user_id=$2 AND organization_group_id IN (SELECT id FROM organization_groups WHERE organization_id=$1)`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(qsUpd, organizationId, userId, patch.UserName, patch.ExternalId, patch.Active)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	if patch.Active != nil && !*patch.Active {
+		if _, err = tx.Exec(qsDelGroups, organizationId, userId); err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := scanSCIMUser(tx.QueryRow(qsSCIMUser+" AND s.user_id=$2", organizationId, userId), organizationId)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeleteSCIMUser deprovisions a user from an organization, taking them out of all of its groups. Their account is
+// kept, as it is theirs rather than the organization's. pgx.ErrNoRows is returned if the organization didn't
+// provision them.
+func DeleteSCIMUser(organizationId, userId string) error {
+	const qsDel = "DELETE FROM scim_users WHERE organization_id=$1 AND user_id=$2"
+	const qsDelGroups = `DELETE FROM organization_group_users
+WHERE user_id=$2 AND organization_group_id IN (SELECT id FROM organization_groups WHERE organization_id=$1)`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(qsDel, organizationId, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	if _, err = tx.Exec(qsDelGroups, organizationId, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is what reading groups needs from either a connection or a transaction
+type queryer interface {
+	QueryRow(sql string, args ...interface{}) *pgx.Row
+	Query(sql string, args ...interface{}) (*pgx.Rows, error)
+}
+
+// readSCIMGroupMembers fills in the members of groups, keyed by id
+func readSCIMGroupMembers(q queryer, organizationId string, groups map[string]*GroupModel, ids []string) error {
+	const qs = `SELECT gu.organization_group_id, u.id, u.username, u.email, s.user_name
+FROM organization_group_users gu
+	JOIN users u
+		ON gu.user_id = u.id
+	LEFT JOIN scim_users s
+		ON s.user_id = u.id AND s.organization_id = $1
+WHERE gu.organization_group_id::text=ANY($2)
+ORDER BY u.email`
+
+	rows, err := q.Query(qs, organizationId, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupId string
+		var user UserModel
+		var userName *string
+		if err = rows.Scan(&groupId, &user.Id, &user.Username, &user.Email, &userName); err != nil {
+			return err
+		}
+		if userName != nil {
+			user.SCIM = &SCIMMembershipModel{OrganizationId: organizationId, UserName: *userName}
+		}
+		groups[groupId].Members = append(groups[groupId].Members, user)
+	}
+	return rows.Err()
+}
+
+func getSCIMGroup(q queryer, organizationId, groupId string) (*GroupModel, error) {
+	const qs = "SELECT id, name, is_public, external_id FROM organization_groups WHERE organization_id=$1 AND id=$2"
+
+	group := GroupModel{Members: []UserModel{}}
+	err := q.QueryRow(qs, organizationId, groupId).Scan(&group.Id, &group.Name, &group.IsPublic, &group.ExternalId)
+	if err != nil {
+		return nil, err
+	}
+	err = readSCIMGroupMembers(q, organizationId, map[string]*GroupModel{group.Id: &group}, []string{group.Id})
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetSCIMGroup retrieves one of an organization's groups along with its members.
+// pgx.ErrNoRows is returned if the organization has no such group.
+func GetSCIMGroup(organizationId, groupId string) (*GroupModel, error) {
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	return getSCIMGroup(conn, organizationId, groupId)
+}
+
+// ListSCIMGroups retrieves a page of an organization's groups, along with how many there are in all. When
+// attribute isn't empty, only groups whose SCIM attribute equals value are listed. Members are only read if asked
+// for, as IdPs usually list groups to find one by name.
+// ErrUnsupportedFilter is returned if groups can't be filtered by the attribute.
+func ListSCIMGroups(organizationId, attribute, value string, offset, limit int, withMembers bool) ([]GroupModel, int, error) {
+	condition := "$2::text IS NULL"
+	args := []interface{}{organizationId, nil}
+	if attribute != "" {
+		var ok bool
+		if condition, ok = scimGroupFilters[attribute]; !ok {
+			return nil, 0, ErrUnsupportedFilter
+		}
+		args[1] = value
+	}
+	qsCount := "SELECT count(*) FROM organization_groups g WHERE g.organization_id=$1 AND " + condition
+	qs := `SELECT g.id, g.name, g.is_public, g.external_id FROM organization_groups g
+WHERE g.organization_id=$1 AND ` + condition + " ORDER BY g.name, g.id OFFSET $3 LIMIT $4"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer PgPool.Release(conn)
+
+	var total int64
+	if err = conn.QueryRow(qsCount, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := conn.Query(qs, append(args, offset, limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []GroupModel{}
+	for rows.Next() {
+		group := GroupModel{Members: []UserModel{}}
+		if err = rows.Scan(&group.Id, &group.Name, &group.IsPublic, &group.ExternalId); err != nil {
+			return nil, 0, err
+		}
+		groups = append(groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	if withMembers && len(groups) > 0 {
+		byId := map[string]*GroupModel{}
+		ids := []string{}
+		for i := range groups {
+			byId[groups[i].Id] = &groups[i]
+			ids = append(ids, groups[i].Id)
+		}
+		if err = readSCIMGroupMembers(conn, organizationId, byId, ids); err != nil {
+			return nil, 0, err
+		}
+	}
+	return groups, int(total), nil
+}
+
+// checkSCIMMembers makes sure all of the users are active users the organization provisioned. Only they can be put
+// in groups through SCIM, so that an IdP can't pull in accounts it doesn't manage.
+func checkSCIMMembers(tx *pgx.Tx, organizationId string, userIds []string) error {
+	const qs = `SELECT count(*) FROM scim_users
+WHERE organization_id=$1 AND active AND user_id::text=ANY($2)`
+
+	if len(userIds) == 0 {
+		return nil
+	}
+	distinct := map[string]bool{}
+	for _, id := range userIds {
+		distinct[id] = true
+	}
+	var count int64
+	if err := tx.QueryRow(qs, organizationId, userIds).Scan(&count); err != nil {
+		return err
+	}
+	if int(count) != len(distinct) {
+		return ErrUnknownMember
+	}
+	return nil
+}
+
+// CreateSCIMGroup creates a group in an organization for its IdP, with the members given.
+// ErrUnknownMember is returned if a member isn't an active user the organization provisioned, and a pgx.PgError
+// with code 23505 if the organization already has a group with the name.
+func CreateSCIMGroup(organizationId, name string, externalId *string, memberIds []string) (*GroupModel, error) {
+	const qsIns = `INSERT INTO organization_groups(name, is_public, organization_id, external_id)
+VALUES ($1, FALSE, $2, $3) RETURNING id`
+	const qsInsMembers = `INSERT INTO organization_group_users(user_id, organization_group_id)
+SELECT DISTINCT unnest($2::text[])::UUID, $1::UUID
+ON CONFLICT DO NOTHING`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id string
+	if err = tx.QueryRow(qsIns, name, organizationId, externalId).Scan(&id); err != nil {
+		return nil, err
+	}
+	if err = checkSCIMMembers(tx, organizationId, memberIds); err != nil {
+		return nil, err
+	}
+	if len(memberIds) > 0 {
+		if _, err = tx.Exec(qsInsMembers, id, memberIds); err != nil {
+			return nil, err
+		}
+	}
+
+	group, err := getSCIMGroup(tx, organizationId, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// PatchSCIMGroup changes one of an organization's groups and its members.
+// pgx.ErrNoRows is returned if the organization has no such group, ErrUnknownMember if an added member isn't an
+// active user the organization provisioned, and a pgx.PgError with code 23505 if the new name is taken.
+func PatchSCIMGroup(organizationId, groupId string, patch *SCIMGroupPatch) (*GroupModel, error) {
+	const qsUpd = `UPDATE organization_groups SET name=COALESCE($3, name),
+	external_id=CASE WHEN $4::text IS NULL THEN external_id ELSE NULLIF($4, '') END
+WHERE organization_id=$1 AND id=$2`
+	const qsDelAll = "DELETE FROM organization_group_users WHERE organization_group_id=$1"
+	const qsDelMembers = "DELETE FROM organization_group_users WHERE organization_group_id=$1 AND user_id::text=ANY($2)"
+	const qsInsMembers = `INSERT INTO organization_group_users(user_id, organization_group_id)
+SELECT DISTINCT unnest($2::text[])::UUID, $1::UUID
+ON CONFLICT DO NOTHING`
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(qsUpd, organizationId, groupId, patch.Name, patch.ExternalId)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	add := patch.AddMemberIds
+	if patch.ReplaceMembers {
+		if _, err = tx.Exec(qsDelAll, groupId); err != nil {
+			return nil, err
+		}
+		add = patch.Members
+	} else if len(patch.RemoveMemberIds) > 0 {
+		if _, err = tx.Exec(qsDelMembers, groupId, patch.RemoveMemberIds); err != nil {
+			return nil, err
+		}
+	}
+	if err = checkSCIMMembers(tx, organizationId, add); err != nil {
+		return nil, err
+	}
+	if len(add) > 0 {
+		if _, err = tx.Exec(qsInsMembers, groupId, add); err != nil {
+			return nil, err
+		}
+	}
+
+	group, err := getSCIMGroup(tx, organizationId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// DeleteSCIMGroup deletes one of an organization's groups, and with it everyone's membership of it.
+// pgx.ErrNoRows is returned if the organization has no such group.
+func DeleteSCIMGroup(organizationId, groupId string) error {
+	const qs = "DELETE FROM organization_groups WHERE organization_id=$1 AND id=$2"
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer PgPool.Release(conn)
+
+	tag, err := conn.Exec(qs, organizationId, groupId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
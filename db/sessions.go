@@ -0,0 +1,222 @@
+package db
+
+import "time"
+
+type SessionModel struct {
+	Id         string
+	Jti        string
+	UserId     string
+	UserAgent  string
+	Device     string
+	IpAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ImpersonatorId is the admin who started the session as the user, if it wasn't the user
+	ImpersonatorId *string
+	// MFAAt is when the session was started with a second factor, or nil if it wasn't
+	MFAAt *time.Time
+}
+
+const qsRevokeSession = "UPDATE sessions SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL RETURNING jti"
+
+// CreateSession records a new login for a user. jti is the id of the first access token issued for the session,
+// and is replaced each time the session's refresh token is rotated. mfa is whether the user proved their second
+// factor to log in.
+func CreateSession(userId, jti, userAgent, device, ipAddress string, mfa bool) (*SessionModel, error) {
+	const qsIns = `INSERT INTO sessions(jti, user_id, user_agent, device, ip_address, mfa_at)
+VALUES($1, $2, $3, $4, $5, CASE WHEN $6 THEN now() END) RETURNING id, created_at, last_seen_at, mfa_at`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	var id string
+	var createdAt time.Time
+	var lastSeenAt time.Time
+	var mfaAt *time.Time
+	row := conn.QueryRow(qsIns, jti, userId, userAgent, device, ipAddress, mfa)
+	if err = row.Scan(&id, &createdAt, &lastSeenAt, &mfaAt); err != nil {
+		return nil, err
+	}
+	return &SessionModel{
+		Id:         id,
+		Jti:        jti,
+		UserId:     userId,
+		UserAgent:  userAgent,
+		Device:     device,
+		IpAddress:  ipAddress,
+		CreatedAt:  createdAt,
+		LastSeenAt: lastSeenAt,
+		MFAAt:      mfaAt,
+	}, nil
+}
+
+// CreateImpersonationSession records an admin acting as a user. jti is the id of the only access token the session
+// will have, as impersonation sessions are never refreshed. mfa is whether the admin's own session was started with
+// a second factor.
+func CreateImpersonationSession(userId, impersonatorId, jti, userAgent, device, ipAddress string, mfa bool) (*SessionModel, error) {
+	const qsIns = `INSERT INTO sessions(jti, user_id, user_agent, device, ip_address, impersonator_id, mfa_at)
+VALUES($1, $2, $3, $4, $5, $6, CASE WHEN $7 THEN now() END) RETURNING id, created_at, last_seen_at, mfa_at`
+
+	// Get a connection from the pool and set it up to release
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	s := SessionModel{
+		Jti:            jti,
+		UserId:         userId,
+		UserAgent:      userAgent,
+		Device:         device,
+		IpAddress:      ipAddress,
+		ImpersonatorId: &impersonatorId,
+	}
+	row := conn.QueryRow(qsIns, jti, userId, userAgent, device, ipAddress, impersonatorId, mfa)
+	if err = row.Scan(&s.Id, &s.CreatedAt, &s.LastSeenAt, &s.MFAAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// TouchSessionByJti marks the active session holding the access token jti as seen now and returns it.
+// If the session has been revoked or the jti is no longer current, pgx.ErrNoRows is returned.
+func TouchSessionByJti(jti string) (*SessionModel, error) {
+	const qs = `UPDATE sessions SET last_seen_at=now() WHERE jti=$1 AND revoked_at IS NULL
+RETURNING id, user_id, user_agent, device, ip_address, created_at, last_seen_at, mfa_at`
+
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	s := SessionModel{Jti: jti}
+	row := conn.QueryRow(qs, jti)
+	err = row.Scan(&s.Id, &s.UserId, &s.UserAgent, &s.Device, &s.IpAddress, &s.CreatedAt, &s.LastSeenAt, &s.MFAAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSessionsByUser returns every session of a user which has not been revoked, most recently seen first
+func ListSessionsByUser(userId string) (*[]SessionModel, error) {
+	const qs = `SELECT id, jti, user_agent, device, ip_address, created_at, last_seen_at, impersonator_id
+FROM sessions WHERE user_id=$1 AND revoked_at IS NULL ORDER BY last_seen_at DESC`
+
+	conn, err := PgPool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer PgPool.Release(conn)
+
+	rows, err := conn.Query(qs, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := []SessionModel{}
+	for rows.Next() {
+		s := SessionModel{UserId: userId}
+		err = rows.Scan(&s.Id, &s.Jti, &s.UserAgent, &s.Device, &s.IpAddress, &s.CreatedAt, &s.LastSeenAt, &s.ImpersonatorId)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// RevokeSession revokes a user's session along with its refresh tokens.
+// It returns the jti of the session's current access token.
+// If the session doesn't exist, belongs to another user, or is already revoked, pgx.ErrNoRows is returned.
+func RevokeSession(id, userId string) (string, error) {
+	const qs = "UPDATE sessions SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL RETURNING jti"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var jti string
+	if err = tx.QueryRow(qs, id, userId).Scan(&jti); err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(qsRevokeFamily, id); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return jti, nil
+}
+
+// RevokeSessionByJti revokes the session whose current access token is jti, along with its refresh tokens.
+// If no active session holds jti, pgx.ErrNoRows is returned.
+func RevokeSessionByJti(jti string) error {
+	const qs = "UPDATE sessions SET revoked_at=now() WHERE jti=$1 AND revoked_at IS NULL RETURNING id"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id string
+	if err = tx.QueryRow(qs, jti).Scan(&id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(qsRevokeFamily, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeUserSessions revokes every session of a user along with their refresh tokens.
+// It returns the jtis of the access tokens which were current for the revoked sessions.
+func RevokeUserSessions(userId string) ([]string, error) {
+	const qs = "UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL RETURNING jti"
+	const qsTokens = "UPDATE refresh_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL"
+
+	tx, err := PgPool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(qs, userId)
+	if err != nil {
+		return nil, err
+	}
+	jtis := []string{}
+	for rows.Next() {
+		var jti string
+		if err = rows.Scan(&jti); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jtis = append(jtis, jti)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(qsTokens, userId); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return jtis, nil
+}
@@ -1,10 +1,17 @@
 package db
 
+import "time"
+
 type UserModel struct {
 	Id                string
 	Username          *string
 	Email             string
 	EncryptedPassword []byte
+	EmailVerifiedAt   *time.Time
+	// IsAdmin marks platform admins, who run kubrik rather than any organization in it
+	IsAdmin bool
+	// SCIM is how an organization's IdP provisioned the user. It is only set when the user is read through SCIM.
+	SCIM *SCIMMembershipModel
 }
 
 
@@ -65,7 +72,7 @@ func ListUsers(ids []string) (*[]UserModel, error) {
 }
 
 func GetUserById(id string) (*UserModel, error) {
-	const qs = "SELECT username, email, encrypted_password FROM users WHERE id=$1"
+	const qs = "SELECT username, email, encrypted_password, email_verified_at, is_admin FROM users WHERE id=$1"
 	conn, err := PgPool.Acquire()
 	if err != nil {
 		return nil, err
@@ -75,8 +82,10 @@ func GetUserById(id string) (*UserModel, error) {
 	var username *string
 	var email string
 	var encrypted_password []byte
+	var email_verified_at *time.Time
+	var is_admin bool
 	row := conn.QueryRow(qs, id)
-	err = row.Scan(&username, &email, &encrypted_password)
+	err = row.Scan(&username, &email, &encrypted_password, &email_verified_at, &is_admin)
 	if err != nil {
 		return nil, err
 	}
@@ -85,11 +94,13 @@ func GetUserById(id string) (*UserModel, error) {
 		Username:          username,
 		Email:             email,
 		EncryptedPassword: encrypted_password,
+		EmailVerifiedAt:   email_verified_at,
+		IsAdmin:           is_admin,
 	}, nil
 }
 
 func GetUserByEmail(email string) (*UserModel, error) {
-	const qs = "SELECT id, username, encrypted_password FROM users WHERE email=$1"
+	const qs = "SELECT id, username, encrypted_password, email_verified_at FROM users WHERE email=$1"
 	conn, err := PgPool.Acquire()
 	if err != nil {
 		return nil, err
@@ -99,8 +110,9 @@ func GetUserByEmail(email string) (*UserModel, error) {
 	var id string
 	var username *string
 	var encrypted_password []byte
+	var email_verified_at *time.Time
 	row := conn.QueryRow(qs, email)
-	err = row.Scan(&id, &username, &encrypted_password)
+	err = row.Scan(&id, &username, &encrypted_password, &email_verified_at)
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +121,7 @@ func GetUserByEmail(email string) (*UserModel, error) {
 		Username:          username,
 		Email:             email,
 		EncryptedPassword: encrypted_password,
+		EmailVerifiedAt:   email_verified_at,
 	}, nil
 }
 
@@ -141,66 +154,35 @@ func UpdateUser(u UserModel) error {
 	return nil
 }
 
-// CreateUserByFacebook takes a facebookId and an email and creates a new user with that email, then links the
-// facebook_users table to that new user
-func CreateUserByFacebook(facebookId string, email string) (*UserModel, error) {
-	const qsInsUser = "INSERT INTO users(email) VALUES($1)"
-	const qsSel = "SELECT id, username FROM users where email=$1"
-	const qsInsFBUser = "INSERT INTO facebook_users(facebook_user_id, user_id) VALUES ($1, $2)"
+// UpgradePasswordHash replaces a user's password hash with one of the same password made at a higher cost.
+// Nothing changes if the password was changed since oldHash was read, so an upgrade can't undo a reset.
+func UpgradePasswordHash(id string, oldHash []byte, newHash []byte) error {
+	const qs = "UPDATE users SET encrypted_password=$3 WHERE id=$1 AND encrypted_password=$2"
 
 	// Get a connection from the pool and set it up to release
 	conn, err := PgPool.Acquire()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer PgPool.Release(conn)
 
-	// Attempt to insert the new user
-	if _, err = conn.Exec(qsInsUser, email); err != nil {
-		return nil, err
-	}
-
-	// Attempt to find the new user's id by username and email
-	row := conn.QueryRow(qsSel, email)
-	var id string
-	var username *string
-	if err = row.Scan(&id, &username); err != nil {
-		return nil, err
-	}
-
-	// Attempt to write the facebook id link to facebook_users
-	if _, err = conn.Exec(qsInsFBUser, facebookId, id); err != nil {
-		return nil, err
-	}
-
-	return &UserModel{
-		Id:       id,
-		Username: username,
-		Email:    email,
-	}, nil
+	_, err = conn.Exec(qs, id, oldHash, newHash)
+	return err
 }
 
-// GetUserByFacebook takes a facebook user id (provided by facebook per app) and uses it to look for linked users
-// If a link exists, it retrieves the user by the id linked.
-func GetUserByFacebook(facebookId string) (*UserModel, error) {
-	const qs = "SELECT id, username, email FROM users WHERE id=(SELECT user_id FROM facebook_users WHERE facebook_user_id=$1)"
+// SetUserAdmin grants or revokes platform admin to the user with an email and returns the user's id.
+// If no user has the email, pgx.ErrNoRows is returned.
+func SetUserAdmin(email string, isAdmin bool) (string, error) {
+	const qs = "UPDATE users SET is_admin=$2 WHERE email=$1 RETURNING id"
+
+	// Get a connection from the pool and set it up to release
 	conn, err := PgPool.Acquire()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer PgPool.Release(conn)
 
 	var id string
-	var username *string
-	var email string
-	row := conn.QueryRow(qs, facebookId)
-	err = row.Scan(&id, &username, &email)
-	if err != nil {
-		return nil, err
-	}
-	return &UserModel{
-		Id:       id,
-		Username: username,
-		Email:    email,
-	}, nil
+	err = conn.QueryRow(qs, email, isAdmin).Scan(&id)
+	return id, err
 }
@@ -0,0 +1,48 @@
+package lockout
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// NewStore creates the store named by lockout.store, either memory or postgres
+func NewStore(v *viper.Viper) (Store, error) {
+	v.SetDefault("lockout.store", "memory")
+	switch store := v.GetString("lockout.store"); store {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return PostgresStore{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown lockout store %q", store)
+	}
+}
+
+// LoadPolicy reads a policy from a section of the configuration, such as lockout.account:
+//
+//	lockout.account:
+//	  free_attempts: 3
+//	  base_delay: 1s
+//	  max_delay: 30s
+//	  threshold: 10
+//	  lockout_duration: 15m
+//	  window: 1h
+//
+// Unset keys fall back to the defaults given.
+func LoadPolicy(v *viper.Viper, section string, defaults Policy) Policy {
+	v.SetDefault(section+".free_attempts", defaults.FreeAttempts)
+	v.SetDefault(section+".base_delay", defaults.BaseDelay)
+	v.SetDefault(section+".max_delay", defaults.MaxDelay)
+	v.SetDefault(section+".threshold", defaults.Threshold)
+	v.SetDefault(section+".lockout_duration", defaults.LockoutDuration)
+	v.SetDefault(section+".window", defaults.Window)
+	return Policy{
+		FreeAttempts:    v.GetInt(section + ".free_attempts"),
+		BaseDelay:       v.GetDuration(section + ".base_delay"),
+		MaxDelay:        v.GetDuration(section + ".max_delay"),
+		Threshold:       v.GetInt(section + ".threshold"),
+		LockoutDuration: v.GetDuration(section + ".lockout_duration"),
+		Window:          v.GetDuration(section + ".window"),
+	}
+}
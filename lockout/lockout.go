@@ -0,0 +1,106 @@
+// Package lockout slows down and eventually stops repeated failed attempts at guessing credentials.
+//
+// Failures are counted per key, such as an account or a client address, in a Store. Once a key has failed more
+// than a policy's free attempts, every further attempt must wait for a delay that doubles with each failure, and
+// once it reaches the policy's threshold the key is locked out for a while. Counts are forgotten once a key has
+// gone without failures for the policy's window, or when it succeeds.
+package lockout
+
+import (
+	"time"
+)
+
+// Record is what a store knows about a key's recent failures
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// Store keeps failure records. Stores must be safe for concurrent use.
+type Store interface {
+	// Get returns the record of a key. Keys without failures have a zero record.
+	Get(key string) (Record, error)
+	// Fail records a failure for a key at a moment, first forgetting earlier failures older than window,
+	// and returns the updated record
+	Fail(key string, now time.Time, window time.Duration) (Record, error)
+	// Reset forgets a key's failures
+	Reset(key string) error
+}
+
+// Policy decides how long a key must wait after its failures
+type Policy struct {
+	// FreeAttempts is how many failures are allowed before any delay applies
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past the free attempts. Each further failure doubles it.
+	BaseDelay time.Duration
+	// MaxDelay caps the progressive delay
+	MaxDelay time.Duration
+	// Threshold is how many failures lock a key out. Zero means keys are never locked out.
+	Threshold int
+	// LockoutDuration is how long a locked out key must wait after its last failure
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered for
+	Window time.Duration
+}
+
+// RetryAfter returns how long a key with a record must still wait at a moment before its next attempt
+func (p *Policy) RetryAfter(rec Record, now time.Time) time.Duration {
+	if rec.Failures == 0 || now.Sub(rec.LastFailure) > p.Window {
+		return 0
+	}
+
+	var wait time.Duration
+	if p.Threshold > 0 && rec.Failures >= p.Threshold {
+		wait = p.LockoutDuration
+	} else if rec.Failures > p.FreeAttempts {
+		wait = p.BaseDelay
+		for i := p.FreeAttempts + 1; i < rec.Failures && wait < p.MaxDelay; i++ {
+			wait *= 2
+		}
+		if wait > p.MaxDelay {
+			wait = p.MaxDelay
+		}
+	}
+
+	if remaining := rec.LastFailure.Add(wait).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// LockedOut reports whether a record has reached the lockout threshold, rather than just a progressive delay
+func (p *Policy) LockedOut(rec Record) bool {
+	return p.Threshold > 0 && rec.Failures >= p.Threshold
+}
+
+// Limiter applies a policy to the keys in a store
+type Limiter struct {
+	Store  Store
+	Policy Policy
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewLimiter creates a limiter applying a policy to the keys in a store
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{Store: store, Policy: policy, now: time.Now}
+}
+
+// Check returns how long a key must wait before its next attempt, zero if it may try now
+func (l *Limiter) Check(key string) (time.Duration, error) {
+	rec, err := l.Store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return l.Policy.RetryAfter(rec, l.now()), nil
+}
+
+// Fail records a failed attempt for a key and returns its updated record
+func (l *Limiter) Fail(key string) (Record, error) {
+	return l.Store.Fail(key, l.now(), l.Policy.Window)
+}
+
+// Reset forgets a key's failures, after it succeeded
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Reset(key)
+}
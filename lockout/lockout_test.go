@@ -0,0 +1,94 @@
+package lockout
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        8 * time.Second,
+	Threshold:       10,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+func TestProgressiveDelay(T *testing.T) {
+	now := time.Unix(1488000000, 0)
+	expected := map[int]time.Duration{
+		1:  0,
+		3:  0,
+		4:  time.Second,
+		5:  2 * time.Second,
+		6:  4 * time.Second,
+		7:  8 * time.Second,
+		9:  8 * time.Second,
+		10: 15 * time.Minute,
+	}
+	for failures, wait := range expected {
+		if got := testPolicy.RetryAfter(Record{Failures: failures, LastFailure: now}, now); got != wait {
+			T.Errorf("after %d failures expected to wait %s, got %s", failures, wait, got)
+		}
+	}
+
+	rec := Record{Failures: 10, LastFailure: now}
+	if got := testPolicy.RetryAfter(rec, now.Add(10*time.Minute)); got != 5*time.Minute {
+		T.Errorf("expected 5m left of the lockout, got %s", got)
+	}
+	if got := testPolicy.RetryAfter(rec, now.Add(2*time.Hour)); got != 0 {
+		T.Errorf("expected failures outside the window to be forgotten, got %s", got)
+	}
+}
+
+func TestLimiterWithMemoryStore(T *testing.T) {
+	now := time.Unix(1488000000, 0)
+	l := NewLimiter(NewMemoryStore(), testPolicy)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if _, err := l.Fail("login:someone"); err != nil {
+			T.Fatal(err)
+		}
+	}
+	if wait, _ := l.Check("login:someone"); wait != time.Second {
+		T.Errorf("expected a one second delay, got %s", wait)
+	}
+	if wait, _ := l.Check("login:someone-else"); wait != 0 {
+		T.Errorf("expected other keys to be unaffected, got %s", wait)
+	}
+
+	// A failure after the window starts counting afresh
+	now = now.Add(2 * time.Hour)
+	if rec, _ := l.Fail("login:someone"); rec.Failures != 1 {
+		T.Errorf("expected the count to restart after the window, got %d", rec.Failures)
+	}
+
+	l.Reset("login:someone")
+	if rec, _ := l.Store.Get("login:someone"); rec.Failures != 0 {
+		T.Errorf("expected reset to forget failures, got %d", rec.Failures)
+	}
+}
+
+func TestMemoryStoreSweepKeepsLongerWindows(T *testing.T) {
+	now := time.Unix(1488000000, 0)
+	s := NewMemoryStore()
+	if _, err := s.Fail("account:someone", now, 24*time.Hour); err != nil {
+		T.Fatal(err)
+	}
+	for i := len(s.records); i < memorySweepSize; i++ {
+		s.records[fmt.Sprintf("ip:%d", i)] = memoryRecord{Record{1, now}, now.Add(time.Minute)}
+	}
+
+	// A failure under a shorter window sweeps the keys past their own window only
+	if _, err := s.Fail("ip:elsewhere", now.Add(2*time.Hour), time.Hour); err != nil {
+		T.Fatal(err)
+	}
+	if rec, _ := s.Get("account:someone"); rec.Failures != 1 {
+		T.Errorf("expected a key within its own window to be kept, got %d failures", rec.Failures)
+	}
+	if len(s.records) != 2 {
+		T.Errorf("expected the keys past their window to be swept, %d are left", len(s.records))
+	}
+}
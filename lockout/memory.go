@@ -0,0 +1,64 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// memorySweepSize is how many keys the memory store holds before it forgets the ones past their window
+const memorySweepSize = 10000
+
+// MemoryStore keeps failure records in process. It suits single instance deployments, as each instance would
+// otherwise count separately.
+type MemoryStore struct {
+	sync.Mutex
+	records map[string]memoryRecord
+}
+
+// memoryRecord is a record along with when its key's policy lets it be forgotten, as keys are counted under
+// different policies
+type memoryRecord struct {
+	Record
+	forgetAt time.Time
+}
+
+// NewMemoryStore creates an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]memoryRecord{}}
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.records[key].Record, nil
+}
+
+func (s *MemoryStore) Fail(key string, now time.Time, window time.Duration) (Record, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.records) >= memorySweepSize {
+		for k, rec := range s.records {
+			if now.After(rec.forgetAt) {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	rec := s.records[key]
+	if now.Sub(rec.LastFailure) > window {
+		rec.Failures = 0
+	}
+	rec.Failures++
+	rec.LastFailure = now
+	rec.forgetAt = now.Add(window)
+	s.records[key] = rec
+	return rec.Record, nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.records, key)
+	return nil
+}
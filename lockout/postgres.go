@@ -0,0 +1,33 @@
+package lockout
+
+import (
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/mg4tv/kubrik/db"
+)
+
+// PostgresStore keeps failure records in the login_failures table, so that every instance sees the same counts
+type PostgresStore struct{}
+
+func (PostgresStore) Get(key string) (Record, error) {
+	failures, lastFailure, err := db.GetLoginFailures(key)
+	if err == pgx.ErrNoRows {
+		return Record{}, nil
+	} else if err != nil {
+		return Record{}, err
+	}
+	return Record{Failures: failures, LastFailure: lastFailure}, nil
+}
+
+func (PostgresStore) Fail(key string, now time.Time, window time.Duration) (Record, error) {
+	failures, lastFailure, err := db.RecordLoginFailure(key, now, window)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Failures: failures, LastFailure: lastFailure}, nil
+}
+
+func (PostgresStore) Reset(key string) error {
+	return db.ResetLoginFailures(key)
+}
@@ -0,0 +1,9 @@
+package log
+
+import "github.com/Sirupsen/logrus"
+
+// Security returns an entry for a security relevant event, such as a failed login, so that they can be filtered
+// and alerted on by the security_event field
+func Security(event string) *logrus.Entry {
+	return Logger.WithField("security_event", event)
+}
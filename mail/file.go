@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mg4tv/kubrik/log"
+)
+
+// fileMailer writes each message to its own .eml file in a directory instead of delivering it
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func (m *fileMailer) Send(msg *Message) error {
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := filepath.Join(m.dir, fmt.Sprintf("%d.eml", now.UnixNano()))
+	return ioutil.WriteFile(name, format(m.from, msg, now), 0600)
+}
+
+// logMailer logs that messages were sent instead of delivering them. Bodies carry login links and tokens, so only
+// their length is logged.
+type logMailer struct {
+	from string
+}
+
+func (m *logMailer) Send(msg *Message) error {
+	log.Logger.WithFields(logrus.Fields{
+		"from":       m.from,
+		"to":         msg.To,
+		"subject":    msg.Subject,
+		"body_bytes": len(msg.Body),
+	}).Info("Mail not delivered, mail.driver is log")
+	return nil
+}
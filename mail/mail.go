@@ -0,0 +1,112 @@
+// Package mail sends the emails kubrik needs to reach its users, such as password resets.
+//
+// The mailer is chosen by mail.driver:
+//
+//	mail.driver: smtp # one of smtp, file or log
+//	mail.from: kubrik <no-reply@mg4.tv>
+//	mail.smtp.host: smtp.example.com
+//	mail.smtp.port: 587
+//	mail.smtp.username: kubrik
+//	mail.smtp.password: 123
+//	mail.file.dir: /tmp/kubrik-mail # the default
+//
+// The file and log mailers never deliver anything and are meant for development. The log mailer leaves out message
+// bodies, which carry login links and tokens, so use the file mailer to follow them. Tests can capture messages with
+// an Outbox.
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Message is a plain text email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var (
+	mailerMu sync.RWMutex
+	mailer   Mailer = &logMailer{from: "kubrik <no-reply@localhost>"}
+)
+
+// Load creates the mailer configured in mail.driver and makes it the one Send uses
+func Load(v *viper.Viper) error {
+	v.SetDefault("mail.driver", "log")
+	v.SetDefault("mail.from", "kubrik <no-reply@localhost>")
+	v.SetDefault("mail.smtp.port", 587)
+	v.SetDefault("mail.file.dir", filepath.Join(os.TempDir(), "kubrik-mail"))
+
+	from := v.GetString("mail.from")
+	if _, err := mail.ParseAddress(from); err != nil {
+		return fmt.Errorf("mail.from: %v", err)
+	}
+
+	var m Mailer
+	switch driver := v.GetString("mail.driver"); driver {
+	case "smtp":
+		if v.GetString("mail.smtp.host") == "" {
+			return errors.New("mail.smtp.host is required")
+		}
+		m = &smtpMailer{
+			from:     from,
+			host:     v.GetString("mail.smtp.host"),
+			port:     v.GetInt("mail.smtp.port"),
+			username: v.GetString("mail.smtp.username"),
+			password: v.GetString("mail.smtp.password"),
+		}
+	case "file":
+		m = &fileMailer{from: from, dir: v.GetString("mail.file.dir")}
+	case "log":
+		m = &logMailer{from: from}
+	default:
+		return fmt.Errorf("Unknown mail driver %q", driver)
+	}
+	SetMailer(m)
+	return nil
+}
+
+// SetMailer replaces the mailer Send uses, which lets tests capture messages
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	mailer = m
+}
+
+// Send delivers a message with the configured mailer
+func Send(msg *Message) error {
+	mailerMu.RLock()
+	m := mailer
+	mailerMu.RUnlock()
+	return m.Send(msg)
+}
+
+// format renders a message as an RFC 5322 email
+func format(from string, msg *Message, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.Bytes()
+}
@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mg4tv/kubrik/log"
+	"github.com/spf13/viper"
+)
+
+func TestFileMailer(T *testing.T) {
+	dir, err := ioutil.TempDir("", "kubrik-mail")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.Set("mail.driver", "file")
+	v.Set("mail.from", "kubrik <no-reply@mg4.tv>")
+	v.Set("mail.file.dir", dir)
+	if err = Load(v); err != nil {
+		T.Fatal(err)
+	}
+	defer SetMailer(&logMailer{from: "kubrik <no-reply@localhost>"})
+
+	if err = Send(&Message{To: "someone@example.com", Subject: "Reset your password", Body: "Hello"}); err != nil {
+		T.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		T.Fatalf("expected one message, found %d", len(files))
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	for _, want := range []string{"From: kubrik <no-reply@mg4.tv>\r\n", "To: someone@example.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\nHello"} {
+		if !strings.Contains(string(b), want) {
+			T.Errorf("message is missing %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownDriver(T *testing.T) {
+	v := viper.New()
+	v.Set("mail.driver", "pigeon")
+	if err := Load(v); err == nil {
+		T.Fatal("expected an unknown driver to be rejected")
+	}
+}
+
+func TestOutbox(T *testing.T) {
+	outbox := NewOutbox()
+	SetMailer(outbox)
+	defer SetMailer(&logMailer{from: "kubrik <no-reply@localhost>"})
+
+	Send(&Message{To: "a@example.com", Subject: "First"})
+	Send(&Message{To: "b@example.com", Subject: "Second"})
+	Send(&Message{To: "a@example.com", Subject: "Third"})
+
+	if n := len(outbox.Messages()); n != 3 {
+		T.Fatalf("expected 3 messages, found %d", n)
+	}
+	msgs := outbox.To("a@example.com")
+	if len(msgs) != 2 || msgs[0].Subject != "First" || msgs[1].Subject != "Third" {
+		T.Errorf("unexpected messages to a@example.com: %+v", msgs)
+	}
+}
+
+func TestLogMailerLeavesOutBodies(T *testing.T) {
+	var buf bytes.Buffer
+	out := log.Logger.Out
+	log.Logger.Out = &buf
+	defer func() { log.Logger.Out = out }()
+
+	m := &logMailer{from: "kubrik <no-reply@localhost>"}
+	if err := m.Send(&Message{To: "someone@example.com", Subject: "Reset your password", Body: "token=secret"}); err != nil {
+		T.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Reset your password") || strings.Contains(buf.String(), "secret") {
+		T.Errorf("expected the subject to be logged without the body, got %s", buf.String())
+	}
+}
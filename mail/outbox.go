@@ -0,0 +1,40 @@
+package mail
+
+import "sync"
+
+// Outbox is a Mailer which keeps messages in memory instead of delivering them. Tests install one with SetMailer
+// to read the links kubrik emails.
+type Outbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewOutbox returns an empty Outbox
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+func (o *Outbox) Send(msg *Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, *msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
+
+// To returns the messages sent so far to an address, oldest first
+func (o *Outbox) To(address string) []Message {
+	var msgs []Message
+	for _, msg := range o.Messages() {
+		if msg.To == address {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
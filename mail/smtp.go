@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// smtpMailer delivers messages through an SMTP relay, upgrading to TLS when the server offers it
+type smtpMailer struct {
+	from     string
+	host     string
+	port     int
+	username string
+	password string
+}
+
+func (m *smtpMailer) Send(msg *Message) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	return smtp.SendMail(addr, auth, from.Address, []string{to.Address}, format(m.from, msg, time.Now()))
+}
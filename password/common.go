@@ -0,0 +1,231 @@
+package password
+
+import "strings"
+
+// common lists passwords that show up over and over in breach dumps. It is deliberately short enough to ship in the
+// binary; deployments that want the full dumps can point password.blocklist_file at them.
+const common = `
+123456
+123456789
+12345678
+12345
+1234567
+1234567890
+123123
+1234
+111111
+000000
+0000000000
+1111111111
+1234512345
+1234554321
+1q2w3e4r
+1q2w3e4r5t
+1q2w3e4r5t6y
+1qaz2wsx
+1qaz2wsx3edc
+qazwsx
+qazwsxedc
+zaq12wsx
+zaq1zaq1
+qwerty
+qwerty123
+qwerty1234
+qwertyuiop
+qwertyuiop123
+asdfgh
+asdfghjkl
+asdfasdf
+zxcvbnm
+zxcvbnm123
+q1w2e3r4
+q1w2e3r4t5
+abc123
+abcd1234
+abcdef
+abcdefg
+abcdefgh
+abcdefghij
+a1b2c3d4
+aa123456
+123qwe
+123qweasd
+123abc
+654321
+987654321
+9876543210
+0987654321
+112233
+121212
+123321
+159753
+147258369
+7777777
+88888888
+666666
+555555
+password
+password1
+password12
+password123
+password1234
+password!
+passw0rd
+p@ssw0rd
+p@ssword
+pass1234
+passwort
+motdepasse
+contraseña
+senha123
+letmein
+letmein123
+welcome
+welcome1
+welcome123
+iloveyou
+iloveyou1
+iloveyou123
+admin
+admin123
+administrator
+root
+toor
+changeme
+changeme123
+default
+guest
+test
+test123
+test1234
+testtest
+secret
+secret123
+login
+master
+master123
+access
+trustno1
+monkey
+dragon
+football
+baseball
+basketball
+soccer
+hockey
+superman
+batman
+spiderman
+starwars
+pokemon
+princess
+sunshine
+shadow
+michael
+jennifer
+jordan23
+charlie
+freedom
+whatever
+computer
+internet
+mustang
+ferrari
+harley
+hunter2
+killer
+pepper
+ginger
+cheese
+chocolate
+cookie
+butterfly
+flower
+summer
+winter
+spring
+autumn
+summer2024
+winter2024
+summer2025
+winter2025
+blink182
+linkinpark
+metallica
+liverpool
+chelsea
+arsenal
+manchester
+barcelona
+realmadrid
+juventus
+tinkerbell
+babygirl
+lovely
+loveme
+iloveu
+fuckyou
+asshole
+1234qwer
+qwer1234
+asdf1234
+zxcv1234
+qwe123
+qweasd
+qweasdzxc
+qweqwe
+asdasd
+zxczxc
+aaaaaa
+aaaaaaaa
+abcabc
+abc12345
+1234abcd
+11111111
+12341234
+12344321
+00000000
+99999999
+12121212
+11223344
+123654
+123456a
+123456q
+a123456
+a123456789
+q123456
+1234567a
+password01
+letmein1
+qwerty1
+qwerty12
+iloveyou2
+myspace1
+myspace
+facebook
+google
+youtube
+instagram
+twitter
+linkedin
+netflix
+mg4tv
+mg4.tv
+kubrik
+kubrik123
+video
+videos
+streaming
+livestream
+`
+
+// commonPasswords returns a fresh set of the bundled common passwords, lower cased
+func commonPasswords() map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, p := range strings.Split(common, "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			set[strings.ToLower(p)] = struct{}{}
+		}
+	}
+	return set
+}
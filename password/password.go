@@ -0,0 +1,132 @@
+// Package password decides which passwords kubrik accepts and hashes them.
+//
+// The policy is read from the configuration:
+//
+//	password.min_length: 10
+//	password.bcrypt_cost: 12
+//	password.blocklist_file: /etc/kubrik/breached.txt # optional, one password per line
+//
+// Passwords on the bundled list of common passwords, or in the blocklist file, are always rejected.
+package password
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxLength is the most bcrypt looks at. Anything past it would be silently ignored.
+const maxLength = 72
+
+// Reasons a password is rejected, worded for the user who chose it
+var (
+	ErrTooLong        = fmt.Errorf("Password must be at most %d bytes long", maxLength)
+	ErrCommon         = errors.New("Password is too common, choose one that is harder to guess")
+	ErrSameAsUsername = errors.New("Password must not be your username")
+	ErrSameAsEmail    = errors.New("Password must not be your email")
+)
+
+// Policy is what a password must satisfy and how it is hashed
+type Policy struct {
+	MinLength int
+	Cost      int
+	blocklist map[string]struct{}
+
+	dummyOnce sync.Once
+	dummy     []byte
+}
+
+// LoadPolicy reads the policy from the password section of the configuration
+func LoadPolicy(v *viper.Viper) (*Policy, error) {
+	v.SetDefault("password.min_length", 10)
+	v.SetDefault("password.bcrypt_cost", 12)
+
+	p := &Policy{
+		MinLength: v.GetInt("password.min_length"),
+		Cost:      v.GetInt("password.bcrypt_cost"),
+		blocklist: commonPasswords(),
+	}
+	if p.Cost < bcrypt.MinCost || p.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("password.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if p.MinLength < 1 || p.MinLength > maxLength {
+		return nil, fmt.Errorf("password.min_length must be between 1 and %d", maxLength)
+	}
+	if file := v.GetString("password.blocklist_file"); file != "" {
+		if err := p.loadBlocklist(file); err != nil {
+			return nil, fmt.Errorf("password.blocklist_file: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// loadBlocklist adds every line of a file to the passwords the policy rejects
+func (p *Policy) loadBlocklist(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.blocklist[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// Check returns every reason the policy rejects a password chosen by the user with a username and email.
+// The username may be empty for users who have none.
+func (p *Policy) Check(password, username, email string) []error {
+	var errs []error
+	if len([]rune(password)) < p.MinLength {
+		errs = append(errs, fmt.Errorf("Password must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxLength {
+		errs = append(errs, ErrTooLong)
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := p.blocklist[lower]; ok {
+		errs = append(errs, ErrCommon)
+	}
+	if username != "" && lower == strings.ToLower(username) {
+		errs = append(errs, ErrSameAsUsername)
+	}
+	if email != "" {
+		email = strings.ToLower(email)
+		if lower == email || (strings.Contains(email, "@") && lower == email[:strings.LastIndex(email, "@")]) {
+			errs = append(errs, ErrSameAsEmail)
+		}
+	}
+	return errs
+}
+
+// Hash hashes a password at the policy's cost
+func (p *Policy) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), p.Cost)
+}
+
+// NeedsUpgrade reports whether a hash was made at a lower cost than the policy's, so that it should be replaced the
+// next time the password is known
+func (p *Policy) NeedsUpgrade(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost < p.Cost
+}
+
+// CompareDummy takes as long as checking a password against a real hash, for when there is no user to check
+// against and the response must not reveal that
+func (p *Policy) CompareDummy(password string) {
+	p.dummyOnce.Do(func() {
+		p.dummy, _ = bcrypt.GenerateFromPassword([]byte("kubrik dummy password"), p.Cost)
+	})
+	bcrypt.CompareHashAndPassword(p.dummy, []byte(password))
+}
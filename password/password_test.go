@@ -0,0 +1,118 @@
+package password
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testPolicy(T *testing.T, v *viper.Viper) *Policy {
+	v.SetDefault("password.bcrypt_cost", bcrypt.MinCost)
+	p, err := LoadPolicy(v)
+	if err != nil {
+		T.Fatal(err)
+	}
+	return p
+}
+
+func TestCheck(T *testing.T) {
+	p := testPolicy(T, viper.New())
+
+	for _, c := range []struct {
+		password string
+		want     error
+	}{
+		{"correct horse battery", nil},
+		{"short", nil}, // checked below, the message carries the length
+		{"Password123", ErrCommon},
+		{"QWERTYUIOP", ErrCommon},
+		{"Jane.Doe.1984", ErrSameAsUsername},
+		{"jane@example.com", ErrSameAsEmail},
+		{"janedoe@example", nil},
+		{string(make([]byte, 73)), ErrTooLong},
+	} {
+		errs := p.Check(c.password, "jane.doe.1984", "JANE@example.com")
+		if c.password == "short" {
+			if len(errs) != 1 || errs[0].Error() != "Password must be at least 10 characters long" {
+				T.Errorf("expected a short password to be rejected for its length, got %v", errs)
+			}
+			continue
+		}
+		if c.want == nil {
+			if len(errs) != 0 {
+				T.Errorf("expected %q to be accepted, got %v", c.password, errs)
+			}
+			continue
+		}
+		found := false
+		for _, err := range errs {
+			found = found || err == c.want
+		}
+		if !found {
+			T.Errorf("expected %q to be rejected with %q, got %v", c.password, c.want, errs)
+		}
+	}
+
+	if errs := p.Check("jane.doe.1984", "", ""); len(errs) != 0 {
+		T.Errorf("expected no identity checks without a username or email, got %v", errs)
+	}
+	if errs := p.Check("jane@example.com", "", "jane@example.com"); len(errs) != 1 || errs[0] != ErrSameAsEmail {
+		T.Errorf("expected only the email to be rejected, got %v", errs)
+	}
+}
+
+func TestBlocklistFile(T *testing.T) {
+	f, err := ioutil.TempFile("", "kubrik-blocklist")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Tr0ub4dor&3\n\n  another leaked one  \n")
+	f.Close()
+
+	v := viper.New()
+	v.Set("password.blocklist_file", f.Name())
+	p := testPolicy(T, v)
+	for _, password := range []string{"tr0ub4dor&3", "another leaked one", "password123"} {
+		if errs := p.Check(password, "", ""); len(errs) != 1 || errs[0] != ErrCommon {
+			T.Errorf("expected %q to be blocked, got %v", password, errs)
+		}
+	}
+
+	v.Set("password.blocklist_file", f.Name()+".missing")
+	if _, err := LoadPolicy(v); err == nil {
+		T.Error("expected a missing blocklist file to be an error")
+	}
+}
+
+func TestNeedsUpgrade(T *testing.T) {
+	v := viper.New()
+	v.Set("password.bcrypt_cost", bcrypt.MinCost+1)
+	p := testPolicy(T, v)
+
+	old, _ := bcrypt.GenerateFromPassword([]byte("correct horse battery"), bcrypt.MinCost)
+	if !p.NeedsUpgrade(old) {
+		T.Error("expected a hash below the policy's cost to need an upgrade")
+	}
+	current, err := p.Hash("correct horse battery")
+	if err != nil {
+		T.Fatal(err)
+	}
+	if p.NeedsUpgrade(current) {
+		T.Error("expected a hash at the policy's cost not to need an upgrade")
+	}
+	if p.NeedsUpgrade([]byte("not a hash")) {
+		T.Error("expected an invalid hash not to need an upgrade")
+	}
+}
+
+func TestLoadPolicyRejectsBadCost(T *testing.T) {
+	v := viper.New()
+	v.Set("password.bcrypt_cost", 50)
+	if _, err := LoadPolicy(v); err == nil {
+		T.Fatal("expected a cost above bcrypt's maximum to be rejected")
+	}
+}
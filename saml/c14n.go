@@ -0,0 +1,151 @@
+package saml
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// canonicalize serializes an element with Exclusive XML Canonicalization 1.0, without comments
+// (http://www.w3.org/2001/10/xml-exc-c14n#). If exclude is set, that element is left out along with everything in
+// it, which is what the enveloped signature transform does to the signature itself. inclusivePrefixes is the
+// InclusiveNamespaces PrefixList of the transform, where "#default" stands for the default namespace.
+func canonicalize(e *element, exclude *element, inclusivePrefixes []string) []byte {
+	inclusive := map[string]bool{}
+	for _, p := range inclusivePrefixes {
+		if p == "#default" {
+			p = ""
+		}
+		inclusive[p] = true
+	}
+	var b bytes.Buffer
+	writeCanonical(&b, e, exclude, inclusive, map[string]string{})
+	return b.Bytes()
+}
+
+// writeCanonical writes an element given the namespace declarations its output ancestors already rendered
+func writeCanonical(b *bytes.Buffer, e *element, exclude *element, inclusive map[string]bool, rendered map[string]string) {
+	// Exclusive canonicalization only declares the namespaces the element and its attributes use, and those on the
+	// inclusive list
+	used := map[string]bool{e.prefix: true}
+	for _, a := range e.attrs {
+		if a.prefix != "" {
+			used[a.prefix] = true
+		}
+	}
+	for p := range inclusive {
+		used[p] = true
+	}
+
+	var decls []attr
+	for p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri, ok := e.lookupNS(p)
+		if !ok {
+			continue
+		}
+		if prev, ok := rendered[p]; ok && prev == uri {
+			continue
+		}
+		// An empty default namespace only needs saying if an ancestor declared another one
+		if p == "" && uri == "" && rendered[""] == "" {
+			continue
+		}
+		decls = append(decls, attr{local: p, value: uri})
+	}
+	sort.Sort(byPrefix(decls))
+
+	attrs := make(byNamespace, len(e.attrs))
+	for i, a := range e.attrs {
+		attrs[i].attr = a
+		if a.prefix != "" {
+			attrs[i].space, _ = e.lookupNS(a.prefix)
+		}
+	}
+	sort.Sort(attrs)
+
+	childRendered := rendered
+	if len(decls) > 0 {
+		childRendered = make(map[string]string, len(rendered)+len(decls))
+		for p, uri := range rendered {
+			childRendered[p] = uri
+		}
+	}
+
+	name := qualifiedName(e.prefix, e.local)
+	b.WriteByte('<')
+	b.WriteString(name)
+	for _, d := range decls {
+		if d.local == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + d.local + `="`)
+		}
+		b.WriteString(escapeAttr(d.value))
+		b.WriteByte('"')
+		childRendered[d.local] = d.value
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + qualifiedName(a.prefix, a.local) + `="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, c := range e.children {
+		switch child := c.(type) {
+		case *element:
+			if child != exclude {
+				writeCanonical(b, child, exclude, inclusive, childRendered)
+			}
+		case charData:
+			b.WriteString(escapeText(string(child)))
+		}
+	}
+
+	b.WriteString("</" + name + ">")
+}
+
+// byPrefix sorts namespace declarations the way canonical XML orders them, the default namespace first
+type byPrefix []attr
+
+func (s byPrefix) Len() int           { return len(s) }
+func (s byPrefix) Less(i, j int) bool { return s[i].local < s[j].local }
+func (s byPrefix) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// byNamespace sorts attributes the way canonical XML orders them, by namespace and then by local name
+type byNamespace []struct {
+	attr
+	space string
+}
+
+func (s byNamespace) Len() int { return len(s) }
+func (s byNamespace) Less(i, j int) bool {
+	if s[i].space != s[j].space {
+		return s[i].space < s[j].space
+	}
+	return s[i].local < s[j].local
+}
+func (s byNamespace) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func qualifiedName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
@@ -0,0 +1,65 @@
+package saml
+
+import "testing"
+
+func TestCanonicalize(T *testing.T) {
+	const doc = `<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns="urn:d">` +
+		`<a:child b:attr="1" z="2" a:y="3"><!-- dropped -->x &amp; &lt; &gt; "q"</a:child>` +
+		`<c/><e xmlns=""><f tab="&#9;" newline="&#10;"/></e></a:root>`
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		T.Fatal(err)
+	}
+	child := root.children[0].(*element)
+	e := root.children[2].(*element)
+
+	for _, c := range []struct {
+		name     string
+		e        *element
+		prefixes []string
+		want     string
+	}{
+		{
+			"whole document", root, nil,
+			`<a:root xmlns:a="urn:a"><a:child xmlns:b="urn:b" z="2" a:y="3" b:attr="1">x &amp; &lt; &gt; "q"</a:child>` +
+				`<c xmlns="urn:d"></c><e><f newline="&#xA;" tab="&#x9;"></f></e></a:root>`,
+		},
+		{
+			"subtree", child, nil,
+			`<a:child xmlns:a="urn:a" xmlns:b="urn:b" z="2" a:y="3" b:attr="1">x &amp; &lt; &gt; "q"</a:child>`,
+		},
+		{
+			"subtree with an inclusive default namespace", child, []string{"#default"},
+			`<a:child xmlns="urn:d" xmlns:a="urn:a" xmlns:b="urn:b" z="2" a:y="3" b:attr="1">x &amp; &lt; &gt; "q"</a:child>`,
+		},
+		{
+			"subtree undeclaring the default namespace", e, nil,
+			`<e><f newline="&#xA;" tab="&#x9;"></f></e>`,
+		},
+	} {
+		if got := string(canonicalize(c.e, nil, c.prefixes)); got != c.want {
+			T.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+
+	// An element under one with a default namespace, which says it has none, must say so
+	nested, err := parseXML([]byte(`<r xmlns="urn:d"><s xmlns=""><t/></s></r>`))
+	if err != nil {
+		T.Fatal(err)
+	}
+	if got, want := string(canonicalize(nested, nil, nil)), `<r xmlns="urn:d"><s xmlns=""><t></t></s></r>`; got != want {
+		T.Errorf("got %s, want %s", got, want)
+	}
+
+	if got, want := string(canonicalize(root, child, nil)), `<a:root xmlns:a="urn:a"><c xmlns="urn:d"></c>`+
+		`<e><f newline="&#xA;" tab="&#x9;"></f></e></a:root>`; got != want {
+		T.Errorf("expected the excluded element to be left out, got %s", got)
+	}
+}
+
+func TestParseXMLRejectsDTDs(T *testing.T) {
+	const doc = `<!DOCTYPE r [<!ENTITY e "boom">]><r>&e;</r>`
+	if _, err := parseXML([]byte(doc)); err == nil {
+		T.Fatal("expected a document with a DTD to be rejected")
+	}
+}
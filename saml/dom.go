@@ -0,0 +1,175 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+// element is a node of the small DOM signatures are checked on. Unlike encoding/xml's unmarshalling, it keeps
+// namespace prefixes and declarations exactly as they were written, which canonicalization needs.
+type element struct {
+	parent   *element
+	prefix   string
+	local    string
+	nsDecls  []attr // xmlns and xmlns:p declarations, with prefix "" for the default namespace
+	attrs    []attr
+	children []interface{} // *element or charData
+}
+
+type attr struct {
+	prefix string
+	local  string
+	value  string
+}
+
+type charData string
+
+// parseXML reads a document into a DOM. Documents with a DTD are rejected: SAML has no use for one and they only
+// open the door to entity expansion attacks.
+func parseXML(data []byte) (*element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+
+	var root, current *element
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, errors.New("XML has more than one root element")
+			}
+			e := &element{parent: current, prefix: t.Name.Space, local: t.Name.Local}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.nsDecls = append(e.nsDecls, attr{local: "", value: a.Value})
+				case a.Name.Space == "xmlns":
+					e.nsDecls = append(e.nsDecls, attr{local: a.Name.Local, value: a.Value})
+				default:
+					e.attrs = append(e.attrs, attr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+				}
+			}
+			if current == nil {
+				root = e
+			} else {
+				current.children = append(current.children, e)
+			}
+			current = e
+			if _, ok := current.lookupNS(current.prefix); !ok {
+				return nil, fmt.Errorf("XML uses undeclared namespace prefix %q", current.prefix)
+			}
+			for _, a := range current.attrs {
+				if _, ok := current.lookupNS(a.prefix); a.prefix != "" && !ok {
+					return nil, fmt.Errorf("XML uses undeclared namespace prefix %q", a.prefix)
+				}
+			}
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, errors.New("XML has mismatched end element " + t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, charData(t))
+			} else if len(bytes.TrimSpace(t)) != 0 {
+				return nil, errors.New("XML has text outside the root element")
+			}
+		case xml.Directive:
+			return nil, errors.New("XML with a DTD is not accepted")
+		}
+		// Comments are dropped, as canonicalization without comments would drop them, and processing
+		// instructions only ever appear as the XML declaration
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("XML document is incomplete")
+	}
+	return root, nil
+}
+
+// lookupNS returns the namespace a prefix is bound to where the element is
+func (e *element) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for n := e; n != nil; n = n.parent {
+		for _, d := range n.nsDecls {
+			if d.local == prefix {
+				return d.value, true
+			}
+		}
+	}
+	// The default namespace is empty unless declared
+	return "", prefix == ""
+}
+
+// space returns the namespace of the element
+func (e *element) space() string {
+	space, _ := e.lookupNS(e.prefix)
+	return space
+}
+
+func (e *element) is(space, local string) bool {
+	return e.local == local && e.space() == space
+}
+
+// elements returns the child elements with a name
+func (e *element) elements(space, local string) []*element {
+	var found []*element
+	for _, c := range e.children {
+		if child, ok := c.(*element); ok && child.is(space, local) {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// element returns the only child element with a name, or nil if there isn't exactly one
+func (e *element) element(space, local string) *element {
+	if found := e.elements(space, local); len(found) == 1 {
+		return found[0]
+	}
+	return nil
+}
+
+// attr returns the value of an attribute without a namespace
+func (e *element) attr(local string) string {
+	for _, a := range e.attrs {
+		if a.prefix == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// text returns the text directly inside the element. Text split up by comments is joined back together, the same
+// way canonicalization sees it, so comments can't be used to make it read differently from what was signed.
+func (e *element) text() string {
+	var b bytes.Buffer
+	for _, c := range e.children {
+		if t, ok := c.(charData); ok {
+			b.WriteString(string(t))
+		}
+	}
+	return string(b.Bytes())
+}
+
+// walk calls fn for the element and every element below it, in document order
+func (e *element) walk(fn func(*element)) {
+	fn(e)
+	for _, c := range e.children {
+		if child, ok := c.(*element); ok {
+			child.walk(fn)
+		}
+	}
+}
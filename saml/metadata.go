@@ -0,0 +1,87 @@
+package saml
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// SAML namespaces and the values used in them
+const (
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+// IdentityProvider is what a service provider needs to know about an IdP, as read from its metadata
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL is where users are sent to log in, with the HTTP-Redirect binding
+	SSOURL string
+	// Certificates are the ones the IdP may sign with. There is usually one, or two during a key rollover.
+	Certificates []*x509.Certificate
+}
+
+// ParseMetadata reads an IdP's metadata, an EntityDescriptor with an IDPSSODescriptor. The metadata isn't
+// required to be signed: it is trusted because the organization's owner uploaded it.
+func ParseMetadata(data []byte) (*IdentityProvider, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	entity := root
+	if root.is(nsMetadata, "EntitiesDescriptor") {
+		entity = root.element(nsMetadata, "EntityDescriptor")
+	}
+	if entity == nil || !entity.is(nsMetadata, "EntityDescriptor") {
+		return nil, errors.New("Metadata must describe exactly one entity")
+	}
+
+	idp := &IdentityProvider{EntityID: entity.attr("entityID")}
+	if idp.EntityID == "" {
+		return nil, errors.New("Metadata has no entityID")
+	}
+	descriptor := entity.element(nsMetadata, "IDPSSODescriptor")
+	if descriptor == nil {
+		return nil, errors.New("Metadata has no IDPSSODescriptor")
+	}
+
+	for _, sso := range descriptor.elements(nsMetadata, "SingleSignOnService") {
+		if sso.attr("Binding") == bindingRedirect {
+			idp.SSOURL = sso.attr("Location")
+			break
+		}
+	}
+	if idp.SSOURL == "" {
+		return nil, errors.New("Metadata has no SingleSignOnService with the HTTP-Redirect binding")
+	}
+
+	for _, key := range descriptor.elements(nsMetadata, "KeyDescriptor") {
+		if use := key.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		info := key.element(nsDSig, "KeyInfo")
+		if info == nil {
+			continue
+		}
+		for _, data := range info.elements(nsDSig, "X509Data") {
+			for _, c := range data.elements(nsDSig, "X509Certificate") {
+				der, err := decodeBase64(c.text())
+				if err != nil {
+					return nil, err
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, err
+				}
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+	}
+	if len(idp.Certificates) == 0 {
+		return nil, errors.New("Metadata has no signing certificate")
+	}
+	return idp, nil
+}
@@ -0,0 +1,294 @@
+// Package saml lets organizations log their users in to kubrik with their own SAML 2.0 identity provider.
+//
+// kubrik acts as a service provider which starts logins itself (SP-initiated) with the HTTP-Redirect binding and
+// receives responses with the HTTP-POST binding. Responses must be signed, either as a whole or their assertion,
+// with RSA-SHA256 or RSA-SHA512 and exclusive canonicalization, which is what IdPs use today. Encrypted assertions
+// are not supported.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	statusSuccess       = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationBearer  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	nameIDFormatEmail   = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	nameIDFormatPersist = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	defaultClockSkew    = 2 * time.Minute
+	samlTimeFormat      = "2006-01-02T15:04:05Z"
+)
+
+// ServiceProvider is kubrik as one organization's IdP sees it
+type ServiceProvider struct {
+	// EntityID names kubrik to the IdP. It is conventionally the URL of the SP metadata.
+	EntityID string
+	// ACSURL is the assertion consumer service the IdP posts responses to
+	ACSURL string
+	IdP    *IdentityProvider
+	// ClockSkew is how far the IdP's clock may be off from ours. It defaults to two minutes.
+	ClockSkew time.Duration
+}
+
+// Assertion is what the IdP vouches for about a user who logged in
+type Assertion struct {
+	// InResponseTo is the id of the AuthnRequest the response answers
+	InResponseTo string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	Attributes   map[string][]string
+}
+
+// Attribute returns the first value of an attribute, or an empty string
+func (a *Assertion) Attribute(name string) string {
+	if values := a.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// NewRequestID generates an id for an AuthnRequest. IDs must not start with a digit, as they are XML ids.
+func NewRequestID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "id-" + hex.EncodeToString(b), nil
+}
+
+// AuthnRequestURL returns the URL to send a user to so that they log in at the IdP, with the HTTP-Redirect
+// binding. The IdP will answer with a response whose InResponseTo is requestID.
+func (sp *ServiceProvider) AuthnRequestURL(requestID, relayState string, now time.Time) (string, error) {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, `<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s"`,
+		nsProtocol, nsAssertion, escapeAttr(requestID), now.UTC().Format(samlTimeFormat))
+	fmt.Fprintf(&req, ` Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`,
+		escapeAttr(sp.IdP.SSOURL), escapeAttr(sp.ACSURL), bindingPOST)
+	fmt.Fprintf(&req, `<saml:Issuer>%s</saml:Issuer>`, escapeText(sp.EntityID))
+	req.WriteString(`<samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`)
+
+	var deflated bytes.Buffer
+	w, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	w.Write(req.Bytes())
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	query := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())}}
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	separator := "?"
+	if strings.Contains(sp.IdP.SSOURL, "?") {
+		separator = "&"
+	}
+	return sp.IdP.SSOURL + separator + query.Encode(), nil
+}
+
+// Metadata describes kubrik to the IdP, for the organization's owner to register kubrik there
+func (sp *ServiceProvider) Metadata() []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<md:EntityDescriptor xmlns:md="%s" entityID="%s">`, nsMetadata, escapeAttr(sp.EntityID))
+	fmt.Fprintf(&b, `<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`, nsProtocol)
+	fmt.Fprintf(&b, `<md:NameIDFormat>%s</md:NameIDFormat>`, nameIDFormatPersist)
+	fmt.Fprintf(&b, `<md:NameIDFormat>%s</md:NameIDFormat>`, nameIDFormatEmail)
+	fmt.Fprintf(&b, `<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>`,
+		bindingPOST, escapeAttr(sp.ACSURL))
+	b.WriteString(`</md:SPSSODescriptor></md:EntityDescriptor>`)
+	return b.Bytes()
+}
+
+// ParseResponse validates a base64 encoded response posted to the ACS and returns its assertion. It checks that:
+//
+//	the response or its assertion is signed by the IdP, and whatever was signed is what's read
+//	the response succeeded and answers a request, and was meant for the ACS
+//	the assertion was issued by the IdP for kubrik, and is within its validity period
+//	the subject has a bearer confirmation for the ACS which hasn't expired
+//	when only the assertion is signed, its confirmation answers the same request as the response
+//
+// Callers must still check InResponseTo is a request they made and haven't seen answered before.
+func (sp *ServiceProvider) ParseResponse(encoded string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, errors.New("SAML response is not base64")
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.is(nsProtocol, "Response") {
+		return nil, errors.New("SAML response is not a Response")
+	}
+	skew := sp.ClockSkew
+	if skew == 0 {
+		skew = defaultClockSkew
+	}
+
+	if len(root.elements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("Encrypted SAML assertions are not supported")
+	}
+	assertion := root.element(nsAssertion, "Assertion")
+	if assertion == nil {
+		return nil, errors.New("SAML response must have exactly one assertion")
+	}
+
+	// Either signature will do, as long as every one present is valid
+	responseSigned := signatureOf(root) != nil
+	if responseSigned {
+		if err = verifySignature(root, root, sp.IdP.Certificates); err != nil {
+			return nil, err
+		}
+	}
+	if signatureOf(assertion) != nil {
+		if err = verifySignature(root, assertion, sp.IdP.Certificates); err != nil {
+			return nil, err
+		}
+	} else if !responseSigned {
+		return nil, ErrNotSigned
+	}
+
+	if dest := root.attr("Destination"); dest != "" && dest != sp.ACSURL {
+		return nil, errors.New("SAML response was sent to another destination")
+	}
+	if issuer := root.element(nsAssertion, "Issuer"); issuer != nil && issuer.text() != sp.IdP.EntityID {
+		return nil, errors.New("SAML response was issued by another IdP")
+	}
+	status := root.element(nsProtocol, "Status")
+	if status == nil {
+		return nil, errors.New("SAML response has no status")
+	}
+	if code := status.element(nsProtocol, "StatusCode"); code == nil || code.attr("Value") != statusSuccess {
+		return nil, errors.New("SAML login did not succeed at the IdP")
+	}
+	result := &Assertion{InResponseTo: root.attr("InResponseTo"), Attributes: map[string][]string{}}
+	if result.InResponseTo == "" {
+		return nil, errors.New("SAML response doesn't answer a request, IdP-initiated login is not supported")
+	}
+
+	if issuer := assertion.element(nsAssertion, "Issuer"); issuer == nil || issuer.text() != sp.IdP.EntityID {
+		return nil, errors.New("SAML assertion was issued by another IdP")
+	}
+	if err = sp.checkConditions(assertion, now, skew); err != nil {
+		return nil, err
+	}
+	// Without a signature over the response its InResponseTo could be anyone's, wrapped around an assertion taken
+	// from another login. The assertion has to name the request itself.
+	if err = sp.checkSubject(assertion, result, !responseSigned, now, skew); err != nil {
+		return nil, err
+	}
+
+	if statement := assertion.element(nsAssertion, "AuthnStatement"); statement != nil {
+		result.SessionIndex = statement.attr("SessionIndex")
+	}
+	for _, statement := range assertion.elements(nsAssertion, "AttributeStatement") {
+		for _, a := range statement.elements(nsAssertion, "Attribute") {
+			name := a.attr("Name")
+			for _, v := range a.elements(nsAssertion, "AttributeValue") {
+				result.Attributes[name] = append(result.Attributes[name], strings.TrimSpace(v.text()))
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkConditions checks the assertion is within its validity period and meant for kubrik
+func (sp *ServiceProvider) checkConditions(assertion *element, now time.Time, skew time.Duration) error {
+	conditions := assertion.element(nsAssertion, "Conditions")
+	if conditions == nil {
+		return errors.New("SAML assertion has no conditions")
+	}
+	notBefore, hasNotBefore, err := timeAttr(conditions, "NotBefore")
+	if err != nil {
+		return err
+	} else if hasNotBefore && now.Add(skew).Before(notBefore) {
+		return errors.New("SAML assertion is not valid yet")
+	}
+	notOnOrAfter, hasNotOnOrAfter, err := timeAttr(conditions, "NotOnOrAfter")
+	if err != nil {
+		return err
+	} else if hasNotOnOrAfter && !now.Add(-skew).Before(notOnOrAfter) {
+		return errors.New("SAML assertion has expired")
+	}
+
+	restrictions := conditions.elements(nsAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return errors.New("SAML assertion has no audience")
+	}
+	// Every restriction must be met, each by any of its audiences
+	for _, restriction := range restrictions {
+		met := false
+		for _, audience := range restriction.elements(nsAssertion, "Audience") {
+			met = met || strings.TrimSpace(audience.text()) == sp.EntityID
+		}
+		if !met {
+			return errors.New("SAML assertion is meant for another service provider")
+		}
+	}
+	return nil
+}
+
+// checkSubject reads the subject of the assertion and checks it may log in to kubrik. With requireInResponseTo, the
+// confirmation must answer the response's request rather than leave it out.
+func (sp *ServiceProvider) checkSubject(assertion *element, result *Assertion, requireInResponseTo bool, now time.Time, skew time.Duration) error {
+	subject := assertion.element(nsAssertion, "Subject")
+	if subject == nil {
+		return errors.New("SAML assertion has no subject")
+	}
+	nameID := subject.element(nsAssertion, "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.text()) == "" {
+		return errors.New("SAML assertion has no NameID")
+	}
+	result.NameID = strings.TrimSpace(nameID.text())
+	result.NameIDFormat = nameID.attr("Format")
+
+	for _, confirmation := range subject.elements(nsAssertion, "SubjectConfirmation") {
+		if confirmation.attr("Method") != confirmationBearer {
+			continue
+		}
+		data := confirmation.element(nsAssertion, "SubjectConfirmationData")
+		if data == nil || data.attr("Recipient") != sp.ACSURL {
+			continue
+		}
+		if irt := data.attr("InResponseTo"); irt != "" && irt != result.InResponseTo || irt == "" && requireInResponseTo {
+			continue
+		}
+		notBefore, hasNotBefore, err := timeAttr(data, "NotBefore")
+		if err != nil || (hasNotBefore && now.Add(skew).Before(notBefore)) {
+			continue
+		}
+		// Bearer confirmations must expire
+		notOnOrAfter, hasNotOnOrAfter, err := timeAttr(data, "NotOnOrAfter")
+		if err != nil || !hasNotOnOrAfter || !now.Add(-skew).Before(notOnOrAfter) {
+			continue
+		}
+		return nil
+	}
+	return errors.New("SAML assertion has no valid bearer confirmation for kubrik")
+}
+
+// timeAttr reads an optional xs:dateTime attribute, which IdPs write with or without fractional seconds
+func timeAttr(e *element, name string) (t time.Time, present bool, err error) {
+	s := e.attr(name)
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+		return time.Time{}, true, fmt.Errorf("SAML %s has an invalid %s", e.local, name)
+	}
+	return t, true, nil
+}
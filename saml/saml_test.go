@@ -0,0 +1,359 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "sign the fixture responses in testdata again with testdata/idp.key")
+
+const (
+	testSPEntityID = "https://kubrik.example.com/organizations/3f2b1c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d/saml/metadata"
+	testACSURL     = "https://kubrik.example.com/organizations/3f2b1c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d/saml/acs"
+	testRequestID  = "id-4f1c0d7e2b9a8c6d5e4f3a2b1c0d9e8f7a6b5c4d"
+)
+
+// testNow is within the validity of the fixture responses
+var testNow = time.Date(2026, time.January, 1, 12, 1, 0, 0, time.UTC)
+
+// responseTemplate is the response the fixtures are signed from. The signature replaces the <!--signature-->
+// comment of the element with the given id, which comes right after its issuer, as the schema requires.
+const responseTemplate = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response1" Version="2.0" IssueInstant="2026-01-01T12:00:00Z" Destination="` + testACSURL + `" InResponseTo="` + testRequestID + `">
+  <saml:Issuer>https://idp.example.com/metadata</saml:Issuer>{{response}}
+  <samlp:Status>
+    <samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/>
+  </samlp:Status>
+  <saml:Assertion xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ID="_assertion1" Version="2.0" IssueInstant="2026-01-01T12:00:00Z">
+    <saml:Issuer>https://idp.example.com/metadata</saml:Issuer>{{assertion}}
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">jane.doe@corp.example.com</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData NotOnOrAfter="2026-01-01T12:05:00Z" Recipient="` + testACSURL + `" InResponseTo="` + testRequestID + `"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="2026-01-01T11:59:30Z" NotOnOrAfter="2026-01-01T12:05:00Z">
+      <saml:AudienceRestriction>
+        <saml:Audience>` + testSPEntityID + `</saml:Audience>
+      </saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="2026-01-01T12:00:00Z" SessionIndex="_session1">
+      <saml:AuthnContext>
+        <saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef>
+      </saml:AuthnContext>
+    </saml:AuthnStatement>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="email">
+        <saml:AttributeValue xsi:type="xs:string">jane.doe@corp.example.com</saml:AttributeValue>
+      </saml:Attribute>
+      <saml:Attribute Name="groups">
+        <saml:AttributeValue xsi:type="xs:string">Engineering</saml:AttributeValue>
+        <saml:AttributeValue xsi:type="xs:string">Video Editors</saml:AttributeValue>
+      </saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+var fixtures = map[string]string{
+	"response_signed_assertion.xml": "assertion",
+	"response_signed_response.xml":  "response",
+}
+
+// signFixture signs the element of the template marked by placeholder, the way an IdP would
+func signFixture(T *testing.T, placeholder string, key *rsa.PrivateKey, cert *x509.Certificate) string {
+	return signResponse(T, responseTemplate, placeholder, key, cert)
+}
+
+// signResponse signs the element of a response marked by placeholder, as signFixture does the template
+func signResponse(T *testing.T, doc, placeholder string, key *rsa.PrivateKey, cert *x509.Certificate) string {
+	for _, p := range []string{"response", "assertion"} {
+		if p != placeholder {
+			doc = strings.Replace(doc, "{{"+p+"}}", "", 1)
+		}
+	}
+	unsigned, err := parseXML([]byte(strings.Replace(doc, "{{"+placeholder+"}}", "", 1)))
+	if err != nil {
+		T.Fatal(err)
+	}
+	id := "_" + placeholder + "1"
+	var signed *element
+	unsigned.walk(func(e *element) {
+		if e.attr("ID") == id {
+			signed = e
+		}
+	})
+	digest := sha256.Sum256(canonicalize(signed, nil, nil))
+
+	signature := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"><ec:InclusiveNamespaces xmlns:ec="http://www.w3.org/2001/10/xml-exc-c14n#" PrefixList="xs"/></ds:Transform>` +
+		`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+		`<ds:DigestValue>{{digest}}</ds:DigestValue></ds:Reference></ds:SignedInfo>` +
+		`<ds:SignatureValue>{{signature}}</ds:SignatureValue><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` +
+		base64.StdEncoding.EncodeToString(cert.Raw) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature>`
+	doc = strings.Replace(doc, "{{"+placeholder+"}}", signature, 1)
+
+	// The digest covers the element as canonicalized with the xs prefix included, which the transform asks for
+	signed = nil
+	withSignature, err := parseXML([]byte(strings.Replace(doc, "{{digest}}", "", 1)))
+	if err != nil {
+		T.Fatal(err)
+	}
+	withSignature.walk(func(e *element) {
+		if e.attr("ID") == id {
+			signed = e
+		}
+	})
+	digest = sha256.Sum256(canonicalize(signed, signatureOf(signed), []string{"xs"}))
+	doc = strings.Replace(doc, "{{digest}}", base64.StdEncoding.EncodeToString(digest[:]), 1)
+
+	withDigest, err := parseXML([]byte(doc))
+	if err != nil {
+		T.Fatal(err)
+	}
+	withDigest.walk(func(e *element) {
+		if e.attr("ID") == id {
+			signed = e
+		}
+	})
+	signedInfo := signatureOf(signed).element(nsDSig, "SignedInfo")
+	hashed := sha256.Sum256(canonicalize(signedInfo, nil, nil))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		T.Fatal(err)
+	}
+	return strings.Replace(doc, "{{signature}}", base64.StdEncoding.EncodeToString(sig), 1)
+}
+
+func readTestIdP(T *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	keyPEM, err := ioutil.ReadFile(filepath.Join("testdata", "idp.key"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		T.Fatal(err)
+	}
+	certPEM, err := ioutil.ReadFile(filepath.Join("testdata", "idp.crt"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	block, _ = pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		T.Fatal(err)
+	}
+	return key.(*rsa.PrivateKey), cert
+}
+
+func testSP(T *testing.T) *ServiceProvider {
+	metadata, err := ioutil.ReadFile(filepath.Join("testdata", "idp_metadata.xml"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	idp, err := ParseMetadata(metadata)
+	if err != nil {
+		T.Fatal(err)
+	}
+	return &ServiceProvider{EntityID: testSPEntityID, ACSURL: testACSURL, IdP: idp}
+}
+
+func readFixture(T *testing.T, name string) string {
+	if *update {
+		key, cert := readTestIdP(T)
+		doc := signFixture(T, fixtures[name], key, cert)
+		if err := ioutil.WriteFile(filepath.Join("testdata", name), []byte(doc), 0644); err != nil {
+			T.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		T.Fatal(err)
+	}
+	return string(b)
+}
+
+func encode(doc string) string {
+	return base64.StdEncoding.EncodeToString([]byte(doc))
+}
+
+func TestParseMetadata(T *testing.T) {
+	sp := testSP(T)
+	if sp.IdP.EntityID != "https://idp.example.com/metadata" {
+		T.Errorf("unexpected entity id %q", sp.IdP.EntityID)
+	}
+	if sp.IdP.SSOURL != "https://idp.example.com/sso/redirect" {
+		T.Errorf("expected the HTTP-Redirect endpoint, got %q", sp.IdP.SSOURL)
+	}
+	if len(sp.IdP.Certificates) != 1 || sp.IdP.Certificates[0].Subject.CommonName != "kubrik test IdP" {
+		T.Errorf("unexpected certificates %v", sp.IdP.Certificates)
+	}
+
+	if _, err := ParseMetadata([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`)); err == nil {
+		T.Error("expected metadata without an IDPSSODescriptor to be rejected")
+	}
+}
+
+func TestParseResponse(T *testing.T) {
+	sp := testSP(T)
+
+	for name := range fixtures {
+		assertion, err := sp.ParseResponse(encode(readFixture(T, name)), testNow)
+		if err != nil {
+			T.Errorf("%s: %v", name, err)
+			continue
+		}
+		if assertion.NameID != "jane.doe@corp.example.com" || assertion.InResponseTo != testRequestID {
+			T.Errorf("%s: unexpected assertion %+v", name, assertion)
+		}
+		if assertion.Attribute("email") != "jane.doe@corp.example.com" || assertion.SessionIndex != "_session1" {
+			T.Errorf("%s: unexpected assertion %+v", name, assertion)
+		}
+		if groups := assertion.Attributes["groups"]; len(groups) != 2 || groups[1] != "Video Editors" {
+			T.Errorf("%s: unexpected groups %v", name, groups)
+		}
+	}
+}
+
+func TestParseResponseRejects(T *testing.T) {
+	sp := testSP(T)
+	signedAssertion := readFixture(T, "response_signed_assertion.xml")
+	signedResponse := readFixture(T, "response_signed_response.xml")
+
+	other := *sp
+	other.EntityID = "https://someone-else.example.com/metadata"
+	otherACS := *sp
+	otherACS.ACSURL = "https://someone-else.example.com/acs"
+
+	// A certificate the IdP never published
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "attacker"},
+		NotBefore: testNow.Add(-time.Hour), NotAfter: testNow.Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	attackerCert, _ := x509.ParseCertificate(der)
+	forged := signFixture(T, "assertion", key, attackerCert)
+
+	unsigned := signedAssertion[:strings.Index(signedAssertion, "<ds:Signature")] +
+		signedAssertion[strings.Index(signedAssertion, "</ds:Signature>")+len("</ds:Signature>"):]
+
+	// The signed assertion is hidden where it is never read, and an unsigned one takes its place
+	start, end := strings.Index(signedAssertion, "<saml:Assertion"), strings.Index(signedAssertion, "</saml:Assertion>")+len("</saml:Assertion>")
+	original := signedAssertion[start:end]
+	evil := strings.Replace(original, "jane.doe@corp.example.com", "admin@corp.example.com", -1)
+	wrapped := strings.Replace(signedAssertion, original,
+		`<samlp:Extensions>`+original+`</samlp:Extensions>`+evil, 1)
+
+	// An assertion whose confirmation names no request could be wrapped in a response answering anyone's request,
+	// as nothing signed ties the two together
+	idpKey, idpCert := readTestIdP(T)
+	unbound := signResponse(T, strings.Replace(responseTemplate, `" InResponseTo="`+testRequestID+`"/>`, `"/>`, 1),
+		"assertion", idpKey, idpCert)
+
+	for _, c := range []struct {
+		name string
+		sp   *ServiceProvider
+		doc  string
+		now  time.Time
+	}{
+		{"expired", sp, signedAssertion, testNow.Add(10 * time.Minute)},
+		{"not yet valid", sp, signedAssertion, testNow.Add(-10 * time.Minute)},
+		{"for another service provider", &other, signedAssertion, testNow},
+		{"for another ACS", &otherACS, signedResponse, testNow},
+		{"tampered assertion", sp, strings.Replace(signedAssertion, "Video Editors", "Administrators", 1), testNow},
+		{"tampered response", sp, strings.Replace(signedResponse, "jane.doe@corp", "admin@corp", 1), testNow},
+		{"signed by someone else", sp, forged, testNow},
+		{"unsigned", sp, unsigned, testNow},
+		{"wrapped", sp, wrapped, testNow},
+		{"duplicate assertion", sp, strings.Replace(signedAssertion, original, original+evil, 1), testNow},
+		{"unanswered", sp, strings.Replace(signedResponse, ` InResponseTo="`+testRequestID+`"`, "", 1), testNow},
+		{"answering another request", sp, strings.Replace(signedAssertion, `InResponseTo="`+testRequestID+`">`,
+			`InResponseTo="id-attacker">`, 1), testNow},
+		{"assertion not bound to a request", sp, unbound, testNow},
+	} {
+		if _, err := c.sp.ParseResponse(encode(c.doc), c.now); err == nil {
+			T.Errorf("%s: expected the response to be rejected", c.name)
+		}
+	}
+}
+
+func TestParseResponseSignedOverRequest(T *testing.T) {
+	// A signed response vouches for the request it answers, so the confirmation needn't repeat it
+	key, cert := readTestIdP(T)
+	doc := signResponse(T, strings.Replace(responseTemplate, `" InResponseTo="`+testRequestID+`"/>`, `"/>`, 1),
+		"response", key, cert)
+	assertion, err := testSP(T).ParseResponse(encode(doc), testNow)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if assertion.InResponseTo != testRequestID {
+		T.Errorf("unexpected InResponseTo %q", assertion.InResponseTo)
+	}
+}
+
+func TestParseResponseIgnoresComments(T *testing.T) {
+	// Comments are outside what is signed, so one inside the NameID must neither break the signature nor cut the
+	// NameID short
+	doc := strings.Replace(readFixture(T, "response_signed_assertion.xml"),
+		"jane.doe@corp.example.com</saml:NameID>", "jane.doe@corp<!-- -->.example.com</saml:NameID>", 1)
+	assertion, err := testSP(T).ParseResponse(encode(doc), testNow)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if assertion.NameID != "jane.doe@corp.example.com" {
+		T.Errorf("unexpected NameID %q", assertion.NameID)
+	}
+}
+
+func TestAuthnRequestURL(T *testing.T) {
+	sp := testSP(T)
+	location, err := sp.AuthnRequestURL(testRequestID, "state", testNow)
+	if err != nil {
+		T.Fatal(err)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if u.Host != "idp.example.com" || u.Query().Get("RelayState") != "state" {
+		T.Errorf("unexpected URL %s", location)
+	}
+
+	deflated, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		T.Fatal(err)
+	}
+	req, err := parseXML(inflated)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !req.is(nsProtocol, "AuthnRequest") || req.attr("ID") != testRequestID ||
+		req.attr("AssertionConsumerServiceURL") != testACSURL {
+		T.Errorf("unexpected request %s", inflated)
+	}
+	if issuer := req.element(nsAssertion, "Issuer"); issuer == nil || issuer.text() != testSPEntityID {
+		T.Errorf("unexpected issuer in %s", inflated)
+	}
+}
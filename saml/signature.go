@@ -0,0 +1,172 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes signatures may use
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// XML signature namespaces and the algorithms accepted in them. SHA-1 is deliberately not among them.
+const (
+	nsDSig       = "http://www.w3.org/2000/09/xmldsig#"
+	nsExcC14N    = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algExcC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	algSHA256    = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algSHA512    = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var (
+	// ErrNotSigned is returned for a response in which neither the response nor the assertion is signed
+	ErrNotSigned = errors.New("SAML response is not signed")
+	// ErrInvalidSignature is returned for a signature which doesn't check out against the identity provider's
+	// certificates, or which doesn't cover what it should
+	ErrInvalidSignature = errors.New("SAML signature is invalid")
+)
+
+var signatureHashes = map[string]crypto.Hash{
+	algRSASHA256: crypto.SHA256,
+	algRSASHA512: crypto.SHA512,
+}
+
+var digestHashes = map[string]crypto.Hash{
+	algSHA256: crypto.SHA256,
+	algSHA512: crypto.SHA512,
+}
+
+// signatureOf returns the enveloped signature of an element, or nil if it has none
+func signatureOf(e *element) *element {
+	if sigs := e.elements(nsDSig, "Signature"); len(sigs) > 0 {
+		return sigs[0]
+	}
+	return nil
+}
+
+// verifySignature checks the enveloped signature of an element was made by one of certs and covers the whole
+// element. Everything read from a signed element afterwards must be read from that same element, never looked up
+// again in the document, or a forged copy could be read instead.
+func verifySignature(root, e *element, certs []*x509.Certificate) error {
+	sigs := e.elements(nsDSig, "Signature")
+	if len(sigs) == 0 {
+		return ErrNotSigned
+	} else if len(sigs) > 1 {
+		return ErrInvalidSignature
+	}
+	sig := sigs[0]
+
+	// The reference must point at the element itself, and nothing else in the document may share its id
+	id := e.attr("ID")
+	if id == "" {
+		return ErrInvalidSignature
+	}
+	count := 0
+	root.walk(func(n *element) {
+		if n.attr("ID") == id {
+			count++
+		}
+	})
+	if count != 1 {
+		return ErrInvalidSignature
+	}
+
+	signedInfo := sig.element(nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return ErrInvalidSignature
+	}
+	c14nMethod := signedInfo.element(nsDSig, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != algExcC14N {
+		return ErrInvalidSignature
+	}
+	sigMethod := signedInfo.element(nsDSig, "SignatureMethod")
+	if sigMethod == nil {
+		return ErrInvalidSignature
+	}
+	sigHash, ok := signatureHashes[sigMethod.attr("Algorithm")]
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	ref := signedInfo.element(nsDSig, "Reference")
+	if ref == nil || ref.attr("URI") != "#"+id {
+		return ErrInvalidSignature
+	}
+	transforms := ref.element(nsDSig, "Transforms")
+	if transforms == nil {
+		return ErrInvalidSignature
+	}
+	var refPrefixes []string
+	enveloped, canonical := false, false
+	for _, t := range transforms.elements(nsDSig, "Transform") {
+		switch t.attr("Algorithm") {
+		case algEnveloped:
+			enveloped = true
+		case algExcC14N:
+			canonical = true
+			refPrefixes = inclusivePrefixes(t)
+		default:
+			return ErrInvalidSignature
+		}
+	}
+	if !enveloped || !canonical {
+		return ErrInvalidSignature
+	}
+
+	digestMethod := ref.element(nsDSig, "DigestMethod")
+	digestValue := ref.element(nsDSig, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return ErrInvalidSignature
+	}
+	digestHash, ok := digestHashes[digestMethod.attr("Algorithm")]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	expected, err := decodeBase64(digestValue.text())
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	h := digestHash.New()
+	h.Write(canonicalize(e, sig, refPrefixes))
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return ErrInvalidSignature
+	}
+
+	sigValue := sig.element(nsDSig, "SignatureValue")
+	if sigValue == nil {
+		return ErrInvalidSignature
+	}
+	signature, err := decodeBase64(sigValue.text())
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	h = sigHash.New()
+	h.Write(canonicalize(signedInfo, nil, inclusivePrefixes(c14nMethod)))
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, sigHash, hashed, signature) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// inclusivePrefixes reads the InclusiveNamespaces PrefixList of a canonicalization method or transform
+func inclusivePrefixes(method *element) []string {
+	if inclusive := method.element(nsExcC14N, "InclusiveNamespaces"); inclusive != nil {
+		return strings.Fields(inclusive.attr("PrefixList"))
+	}
+	return nil
+}
+
+// decodeBase64 decodes base64 which may be broken over several lines, as it usually is in XML
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}